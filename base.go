@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/creachadair/jrpc2/channel"
 	"github.com/creachadair/jrpc2/code"
@@ -25,9 +31,16 @@ type Assigner interface {
 // A Handler handles a single request.
 type Handler interface {
 	// Handle invokes the method with the specified request. The response value
-	// must be JSON-marshalable or nil. In case of error, the handler can
-	// return a value of type *jrpc2.Error to control the response code sent
-	// back to the caller; otherwise the server will wrap the resulting value.
+	// must be JSON-marshalable or nil. A nil value, including a nil pointer,
+	// is reported to the caller as a null result. In case of error, the
+	// handler can return a value of type *jrpc2.Error, or an error that wraps
+	// one, to control the response sent back to the caller. An error that
+	// implements code.Coder is reported with the code it returns; otherwise
+	// the server will wrap the resulting value. An error that wraps
+	// context.Canceled or context.DeadlineExceeded, such as ctx.Err(), is
+	// reported with code code.Cancelled or code.DeadlineExceeded respectively.
+	// If the handler panics, the server recovers and reports
+	// code.InternalError (see also ServerOptions.PanicStack).
 	//
 	// The context passed to the handler by a *jrpc2.Server includes two extra
 	// values that the handler may extract.
@@ -43,14 +56,70 @@ type Handler interface {
 	// The inbound request is the same value passed to the Handle method -- the
 	// latter is primarily useful in handlers generated by handler.New, which do
 	// not receive this value directly.
+	//
+	// Handlers for requests in the same batch may share values by calling:
+	//
+	//    v := jrpc2.BatchValue(ctx, key, init)
+	//
+	// See BatchValue for details.
 	Handle(context.Context, *Request) (interface{}, error)
 }
 
+// An Interceptor wraps the handling of a request by a server, for example to
+// check authorization, record logs, or translate errors for every method. It
+// is called with the context and request that would be passed to the handler,
+// and a function next that continues handling them. An interceptor may pass a
+// different context or request to next, for example one constructed by the
+// WithParams method of req, and may report a different result or error than
+// next reports. It may also report a result or error without calling next, in
+// which case the handler is not invoked. See ServerOptions.Interceptors.
+type Interceptor func(ctx context.Context, req *Request, next func(context.Context, *Request) (interface{}, error)) (interface{}, error)
+
+// A DeprecatedHandler is a Handler for a method that is deprecated.  The
+// server counts calls to deprecated methods in its metrics. Unless the server
+// is constructed with the RejectDeprecated option, calls to deprecated methods
+// are otherwise handled normally. Use handler.Deprecated to mark an existing
+// handler.
+type DeprecatedHandler interface {
+	Handler
+
+	// Deprecated returns a human-readable note about the deprecation, for
+	// example to describe what callers should use instead.
+	Deprecated() string
+}
+
+// A DeprecationNamer is an Assigner that can report which of its methods are
+// deprecated without assigning their handlers. If the Assigner of a server
+// implements this interface, the server reports its deprecated methods in its
+// ServerInfo. The assigners in the handler package implement it.
+type DeprecationNamer interface {
+	Assigner
+
+	// Deprecations returns a map from the names of the deprecated methods of
+	// the assigner to their deprecation notes (see DeprecatedHandler). It is
+	// called for each ServerInfo, so it should be cheap and have no side
+	// effects.
+	Deprecations() map[string]string
+}
+
+// RawResult is a pre-encoded JSON value that a Handler may return as its
+// result. The server copies a result of type RawResult into the response
+// without re-encoding it; see ServerOptions.TrustRawResults. Unlike ordinary
+// results, including those of type json.RawMessage, the characters <, >, and &
+// in strings of a RawResult are not escaped.
+type RawResult []byte
+
 // A Request is a request message from a client to a server.
 type Request struct {
 	id     json.RawMessage // the request ID, nil for notifications
 	method string          // the name of the method being requested
 	params json.RawMessage // method parameters
+	raw    json.RawMessage // the original encoding, if retained
+	meta   interface{}     // transport metadata, if any
+	useNum bool            // decode numbers in params as json.Number
+	codec  JSONCodec       // decodes params (nil means StdJSON)
+	recvd  time.Time       // when the server received the request
+	cid    string          // correlation ID assigned by the server
 }
 
 // IsNotification reports whether the request is a notification, and thus does
@@ -76,6 +145,10 @@ func (r *Request) HasParams() bool { return len(r.params) != 0 }
 // method. The jrpc2.StrictFields helper function adapts existing values to
 // this interface.
 //
+// Numbers decoded into interface values have type float64, unless the server
+// (or for server notifications and callbacks, the client) was created with the
+// UseNumber option, in which case they have type json.Number.
+//
 // If v has type *json.RawMessage, decoding cannot fail.
 func (r *Request) UnmarshalParams(v interface{}) error {
 	if len(r.params) == 0 {
@@ -86,20 +159,51 @@ func (r *Request) UnmarshalParams(v interface{}) error {
 		*t = json.RawMessage(string(r.params)) // copy
 		return nil
 	case strictFielder:
-		dec := json.NewDecoder(bytes.NewReader(r.params))
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(v); err != nil {
+		if err := decodeJSON(r.codec, r.params, v, r.useNum); err != nil {
 			return Errorf(code.InvalidParams, "invalid parameters: %v", err.Error())
 		}
 		return nil
 	}
-	return json.Unmarshal(r.params, v)
+	return decodeJSON(r.codec, r.params, v, r.useNum)
+}
+
+// WithParams returns a copy of r whose parameters are the JSON encoding of
+// params, which must be nil or encodable as a JSON object or array. If params
+// is nil, the copy has no parameters. The original request is not modified.
+func (r *Request) WithParams(params interface{}) (*Request, error) {
+	var bits json.RawMessage
+	if params != nil {
+		var err error
+		bits, err = orStdJSON(r.codec).Marshal(params)
+		if err != nil {
+			return nil, err
+		} else if len(bits) == 0 || (bits[0] != '[' && bits[0] != '{' && !isNull(bits)) {
+			return nil, Errorf(code.InvalidRequest, "invalid parameters: array or object required")
+		} else if isNull(bits) {
+			bits = nil
+		}
+	}
+	cp := *r
+	cp.params = bits
+	return &cp, nil
 }
 
 // ParamString returns the encoded request parameters of r as a string.
 // If r has no parameters, it returns "".
 func (r *Request) ParamString() string { return string(r.params) }
 
+// ReceivedAt reports when the server received r from its channel, before the
+// request was queued for dispatch. It returns the zero time for a request that
+// did not originate from a server's channel, such as one constructed by
+// ParseRequests. For requests in a batch, the time is that of the batch.
+func (r *Request) ReceivedAt() time.Time { return r.recvd }
+
+// CorrelationID returns the correlation ID the server assigned to r when it
+// was received, or "" if r did not originate from a server's channel. The ID
+// is unique among the requests handled by the server, and appears in the
+// server's debug logs for r.
+func (r *Request) CorrelationID() string { return r.cid }
+
 // ErrInvalidVersion is returned by ParseRequests if one or more of the
 // requests in the input has a missing or invalid version marker.
 var ErrInvalidVersion = Errorf(code.InvalidRequest, "incorrect version marker")
@@ -135,6 +239,8 @@ type Response struct {
 	id     string
 	err    *Error
 	result json.RawMessage
+	useNum bool      // decode numbers in the result as json.Number
+	codec  JSONCodec // decodes the result (nil means StdJSON)
 
 	// Waiters synchronize on reading from ch. The first successful reader from
 	// ch completes the request and is responsible for updating rsp and then
@@ -162,20 +268,32 @@ func (r *Response) Error() *Error { return r.err }
 // implementation of json.Unmarshaler, or implementing a DisallowUnknownFields
 // method. The jrpc2.StrictFields helper function adapts existing values to
 // this interface.
+//
+// If the client was created with the UseNumber option, numbers decoded into
+// interface values have type json.Number rather than float64.
 func (r *Response) UnmarshalResult(v interface{}) error {
 	if r.err != nil {
 		return r.err
 	}
-	switch t := v.(type) {
-	case *json.RawMessage:
+	if t, ok := v.(*json.RawMessage); ok {
 		*t = json.RawMessage(string(r.result)) // copy
 		return nil
-	case strictFielder:
-		dec := json.NewDecoder(bytes.NewReader(r.result))
-		dec.DisallowUnknownFields()
-		return dec.Decode(v)
 	}
-	return json.Unmarshal(r.result, v)
+	return decodeJSON(r.codec, r.result, v, r.useNum)
+}
+
+// decodeJSON decodes data into v using c, or StdJSON if c == nil. Unknown
+// fields are rejected if v has a DisallowUnknownFields method, and numbers
+// are decoded as json.Number if useNumber is true. A value wrapped by
+// StrictFields is unwrapped, so that c decodes into the original value.
+func decodeJSON(c JSONCodec, data []byte, v interface{}, useNumber bool) error {
+	opts := DecodeOptions{UseNumber: useNumber}
+	if s, ok := v.(*strict); ok {
+		v, opts.DisallowUnknownFields = s.v, true
+	} else if _, ok := v.(strictFielder); ok {
+		opts.DisallowUnknownFields = true
+	}
+	return orStdJSON(c).Unmarshal(data, v, opts)
 }
 
 // ResultString returns the encoded result message of r as a string.
@@ -184,12 +302,12 @@ func (r *Response) ResultString() string { return string(r.result) }
 
 // MarshalJSON converts the response to equivalent JSON.
 func (r *Response) MarshalJSON() ([]byte, error) {
-	return json.Marshal(&jmessage{
+	return jmessages{{
 		V:  Version,
 		ID: json.RawMessage(r.id),
 		R:  r.result,
 		E:  r.err,
-	})
+	}}.toJSON()
 }
 
 // wait blocks until r is complete. It is safe to call this multiple times and
@@ -221,45 +339,206 @@ func (r *Response) wait() {
 // messages.  This handles the decoding of batch requests in JSON-RPC 2.0.
 type jmessages []*jmessage
 
+// toJSON encodes j as a single object if it has exactly one element that did
+// not arrive in a batch, and otherwise as an array. This ensures the reply to
+// a single request is a single object, while the reply to a batch is an array
+// even if only one of its elements produced a response.
 func (j jmessages) toJSON() ([]byte, error) {
+	var buf bytes.Buffer
 	if len(j) == 1 && !j[0].batch {
-		return json.Marshal(j[0])
+		if err := j[0].appendJSON(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
 	}
-	return json.Marshal([]*jmessage(j))
+	buf.WriteByte('[')
+	for i, msg := range j {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := msg.appendJSON(&buf); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// appendJSON appends the JSON encoding of j to buf.  Responses are encoded
+// directly, so that the result is copied into the output without being
+// re-encoded; the result must therefore already be valid, compact JSON.
+// A response has exactly one of "error" or "result": if j.E != nil the result
+// is omitted, and otherwise an empty result is encoded as null.
+// A response with no version is encoded in the JSON-RPC 1.0 format (see
+// appendV1). Other messages use the standard encoding.
+func (j *jmessage) appendJSON(buf *bytes.Buffer) error {
+	if j.M != "" || j.P != nil {
+		bits, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		buf.Write(bits)
+		return nil
+	} else if j.V == "" {
+		return j.appendV1(buf)
+	}
+	v, err := json.Marshal(j.V)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(`{"jsonrpc":`)
+	buf.Write(v)
+	if len(j.ID) != 0 {
+		id, err := json.Marshal(j.ID)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`,"id":`)
+		buf.Write(id)
+	}
+	if j.E != nil {
+		e, err := json.Marshal(j.E)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`,"error":`)
+		buf.Write(e)
+	} else if len(j.R) == 0 {
+		buf.WriteString(`,"result":null`)
+	} else {
+		buf.WriteString(`,"result":`)
+		buf.Write(j.R)
+	}
+	if j.C != "" {
+		c, err := json.Marshal(j.C)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`,"encoding":`)
+		buf.Write(c)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// appendV1 appends the JSON-RPC 1.0 encoding of the response j to buf. Unlike
+// a 2.0 response, it has no version marker, and it has both a result and an
+// error, one of which is null.
+func (j *jmessage) appendV1(buf *bytes.Buffer) error {
+	buf.WriteString(`{"id":`)
+	if len(j.ID) == 0 {
+		buf.WriteString("null")
+	} else {
+		id, err := json.Marshal(j.ID)
+		if err != nil {
+			return err
+		}
+		buf.Write(id)
+	}
+	buf.WriteString(`,"result":`)
+	if len(j.R) == 0 || j.E != nil {
+		buf.WriteString("null")
+	} else {
+		buf.Write(j.R)
+	}
+	buf.WriteString(`,"error":`)
+	if j.E == nil {
+		buf.WriteString("null")
+	} else {
+		e, err := json.Marshal(j.E)
+		if err != nil {
+			return err
+		}
+		buf.Write(e)
+	}
+	if j.C != "" {
+		c, err := json.Marshal(j.C)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`,"encoding":`)
+		buf.Write(c)
+	}
+	buf.WriteByte('}')
+	return nil
 }
 
 // N.B. Not UnmarshalJSON, because json.Unmarshal checks for validity early and
 // here we want to control the error that is returned.
+//
+// The top-level value of data must be an object or an array, as determined by
+// its first non-space byte. An object is a single request, and is decoded as
+// a one-element list whose element is not marked as part of a batch, so that
+// its reply is likewise a single object. If it is an array, its elements are
+// decoded incrementally. If the array contains a
+// syntax error, the elements preceding the error are retained, each marked
+// with an error so that it will not be processed, and a parse error is
+// returned for the batch. Otherwise, validity of the individual messages is
+// checked at usage.
 func (j *jmessages) parseJSON(data []byte) error {
 	*j = (*j)[:0] // reset state
 
-	// When parsing requests, validation checks are deferred: The only immediate
-	// mode of failure for unmarshaling is if the request is not a valid object
-	// or array.
-	var msgs []json.RawMessage
-	var batch bool
+	data = bytes.TrimLeft(data, " \t\r\n")
 	if len(data) == 0 || data[0] != '[' {
-		msgs = append(msgs, nil)
-		if err := json.Unmarshal(data, &msgs[0]); err != nil {
+		var msg json.RawMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
 			return Errorf(code.ParseError, "invalid request message")
+		} else if msg[0] != '{' {
+			return Errorf(code.InvalidRequest, "request must be an object or array")
 		}
-	} else if err := json.Unmarshal(data, &msgs); err != nil {
-		return Errorf(code.ParseError, "invalid request batch")
-	} else {
-		batch = true
+		*j = append(*j, parseMessage(msg, false))
+		return nil
 	}
 
-	// Now parse the individual request messages, but do not fail on errors.  We
-	// know that the messages are intact, but validity is checked at usage.
-	for _, raw := range msgs {
-		req := new(jmessage)
-		req.parseJSON(raw)
-		req.batch = batch
-		*j = append(*j, req)
+	// Decode the elements of the batch one at a time, so that a syntax error
+	// does not discard the elements that precede it.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.Token() // consume the opening bracket
+	var err error
+	for dec.More() {
+		var msg json.RawMessage
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+		*j = append(*j, parseMessage(msg, true))
+	}
+	if err == nil {
+		err = checkBatchEnd(dec)
+	}
+	if err != nil {
+		skip := Errorf(code.ParseError, "request not processed: invalid request batch")
+		for _, req := range *j {
+			req.err = skip // do not process a partial batch
+		}
+		return DataErrorf(code.ParseError, err.Error(), "invalid request batch")
 	}
 	return nil
 }
 
+// checkBatchEnd reports whether the remaining input of dec consists of the
+// closing bracket of a batch, with nothing following it.
+func checkBatchEnd(dec *json.Decoder) error {
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim(']') {
+		return fmt.Errorf("unexpected %v at end of batch", tok)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("extra data after batch")
+	}
+	return nil
+}
+
+// parseMessage parses a single message. Errors in the message are recorded
+// in the result, to be reported at usage.
+func parseMessage(raw json.RawMessage, batch bool) *jmessage {
+	req := new(jmessage)
+	req.parseJSON(raw)
+	req.batch = batch
+	req.raw = raw // N.B. each element has its own copy
+	return req
+}
+
 // jmessage is the transmission format of a protocol message.
 type jmessage struct {
 	V  string          `json:"jsonrpc"`      // must be Version
@@ -273,44 +552,73 @@ type jmessage struct {
 	E *Error          `json:"error,omitempty"`  // set on error
 	R json.RawMessage `json:"result,omitempty"` // set on success
 
+	// A non-standard extension: If set, R is compressed with this encoding
+	// (see Codec).
+	C string `json:"encoding,omitempty"`
+
 	// N.B.: In a valid protocol message, M and P are mutually exclusive with E
 	// and R. Specifically, if M != "" then E and R must both be unset. This is
 	// checked during parsing.
 
-	batch bool  // this message was part of a batch
-	err   error // if not nil, this message is invalid and err is why
+	batch bool            // this message was part of a batch
+	raw   json.RawMessage // the original encoding of the message
+	meta  interface{}     // transport metadata from the channel, if any
+	recv  time.Time       // when the message was received by the server
+	extra []string        // names of unrecognized fields, if any
+	err   error           // if not nil, this message is invalid and err is why
 }
 
+// fail records an error for j, unless an error was already recorded, and
+// returns the recorded error.
 func (j *jmessage) fail(code code.Code, msg string) error {
-	j.err = Errorf(code, msg)
+	if j.err == nil {
+		j.err = Errorf(code, msg)
+	}
 	return j.err
 }
 
 func (j *jmessage) parseJSON(data []byte) error {
-	// Unmarshal into a map so we can check for extra keys.  The json.Decoder
+	// Unmarshal into a map so we can record extra keys.  The json.Decoder
 	// has DisallowUnknownFields, but fails decoding eagerly for fields that do
 	// not map to known tags. We want to fully parse the object so we can
 	// propagate the "id" in error responses, if it is set. So we have to decode
-	// and check the fields ourselves.
+	// and check the fields ourselves. Whether extra keys are an error is up to
+	// the receiver (see ServerOptions.StrictSpec).
 
 	var obj map[string]json.RawMessage
 	if err := json.Unmarshal(data, &obj); err != nil {
-		return j.fail(code.ParseError, "request is not a JSON object")
+		return j.fail(code.InvalidRequest, "request is not a JSON object")
+	}
+
+	// Visit the keys in a fixed order, so that if the message has multiple
+	// problems, the error reported does not vary.
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
 	*j = jmessage{}    // reset content
 	var extra []string // extra field names
-	for key, val := range obj {
+	for _, key := range keys {
+		val := obj[key]
 		switch key {
 		case "jsonrpc":
 			if json.Unmarshal(val, &j.V) != nil {
-				j.fail(code.ParseError, "invalid version key")
+				j.fail(code.InvalidRequest, "invalid version key")
 			}
 		case "id":
-			j.ID = val
+			// Keep the ID even if other fields are invalid, so that an error
+			// response can echo it. Per spec, an ID must be a string, number,
+			// or null; otherwise the error is reported with a null ID.
+			if isValidID(val) {
+				j.ID = val
+			} else {
+				j.fail(code.InvalidRequest, "invalid request ID")
+			}
 		case "method":
 			if json.Unmarshal(val, &j.M) != nil {
-				j.fail(code.ParseError, "invalid method name")
+				j.fail(code.InvalidRequest, "invalid method name")
 			}
 		case "params":
 			// As a special case, reduce "null" to nil in the parameters.
@@ -327,20 +635,28 @@ func (j *jmessage) parseJSON(data []byte) error {
 			}
 		case "result":
 			j.R = val
+		case "encoding":
+			if json.Unmarshal(val, &j.C) != nil {
+				j.fail(code.InvalidRequest, "invalid result encoding")
+			}
 		default:
 			extra = append(extra, key)
 		}
 	}
 
 	// Report an error if request/response fields overlap.
-	if j.M != "" && (j.E != nil || j.R != nil) {
+	if j.M != "" && (j.E != nil || j.R != nil || j.C != "") {
 		j.fail(code.InvalidRequest, "mixed request and reply fields")
 	}
 
-	// Report an error for extraneous fields.
-	if j.err == nil && len(extra) != 0 {
-		j.err = DataErrorf(code.InvalidRequest, extra, "extra fields in request")
+	// Per spec, a version 2 request with a null ID is not a notification,
+	// which has no ID at all, so it is reported as invalid. Version 1 used a
+	// null ID for notifications, so those are accepted (see fixID).
+	if j.M != "" && j.V == Version && j.ID != nil && isNull(j.ID) {
+		j.fail(code.InvalidRequest, "request ID must not be null")
 	}
+
+	j.extra = extra
 	return nil
 }
 
@@ -366,6 +682,71 @@ func fixID(id json.RawMessage) json.RawMessage {
 	return nil
 }
 
+// idKey returns a key for the valid request ID id, under which the server
+// tracks the requests in flight. IDs have the same key if they have the same
+// value: Strings and numbers have different keys even if their text is the
+// same, and numbers are compared by their exact decimal value however they
+// are written, so large or fractional IDs do not collide. If id is unset or
+// null, idKey returns "".
+func idKey(id json.RawMessage) string {
+	if len(id) == 0 || fixID(id) == nil {
+		return ""
+	} else if id[0] == '"' {
+		var s string
+		if err := json.Unmarshal(id, &s); err == nil {
+			return "s" + s
+		}
+	} else if key, ok := numberKey(string(id)); ok {
+		return key
+	}
+	return "?" + string(id) // not valid; should not occur
+}
+
+// numberKey returns a canonical form of the JSON number num, consisting of its
+// significant digits and a decimal exponent. It reports false if num is not a
+// valid number, or its exponent is out of range.
+func numberKey(num string) (string, bool) {
+	sign := ""
+	if strings.HasPrefix(num, "-") {
+		sign, num = "-", num[1:]
+	}
+	var exp int
+	if i := strings.IndexAny(num, "eE"); i >= 0 {
+		v, err := strconv.Atoi(strings.TrimPrefix(num[i+1:], "+"))
+		if err != nil {
+			return "", false
+		}
+		exp, num = v, num[:i]
+	}
+	if i := strings.IndexByte(num, '.'); i >= 0 {
+		exp -= len(num) - i - 1
+		num = num[:i] + num[i+1:]
+	}
+	if num == "" || strings.Trim(num, "0123456789") != "" {
+		return "", false
+	}
+	digits := strings.TrimLeft(num, "0")
+	if digits == "" {
+		return "n0", true // N.B. -0 == 0
+	}
+	trimmed := strings.TrimRight(digits, "0")
+	exp += len(digits) - len(trimmed)
+	return "n" + sign + trimmed + "e" + strconv.Itoa(exp), true
+}
+
+// isValidID reports whether id is a valid JSON-RPC request ID, namely a
+// string, a number, or null.
+func isValidID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return false
+	}
+	switch c := id[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	}
+	return isNull(id)
+}
+
 // encode marshals rsps as JSON and forwards it to the channel.
 func encode(ch channel.Sender, rsps jmessages) (int, error) {
 	bits, err := rsps.toJSON()
@@ -383,7 +764,8 @@ func encode(ch channel.Sender, rsps jmessages) (int, error) {
 // other than ASCII letters, digits, and "-", or if host contains a "/".
 //
 // Otherwise, the network is assigned as "tcp". Note that this function does
-// not verify whether the address is lexically valid.
+// not verify whether the address is lexically valid. To support addresses
+// with an explicit network scheme, use ParseAddress.
 func Network(s string) string {
 	i := strings.LastIndex(s, ":")
 	if i < 0 {
@@ -412,6 +794,66 @@ func isServiceName(s string) bool {
 	return true
 }
 
+// ParseAddress parses a network address and returns the network type and
+// address suitable for use with net.Dial or net.Listen.
+//
+// An address may have an explicit scheme prefix:
+//
+//    tcp://host:port   -- TCP, host may be an IPv6 literal in brackets
+//    tcp4://host:port  -- TCP over IPv4 only
+//    tcp6://host:port  -- TCP over IPv6 only
+//    unix:///abs/path  -- Unix-domain socket with absolute path /abs/path
+//    unix://rel/path   -- Unix-domain socket with relative path rel/path
+//
+// Other schemes are reported as errors. An address without a scheme is
+// classified by Network. Note that this means an address such as
+// "sock:80" is treated as TCP; use an explicit unix:// scheme for a socket
+// path that would otherwise be mistaken for a host and port.
+func ParseAddress(addr string) (network, address string, _ error) {
+	i := strings.Index(addr, "://")
+	if i < 0 || !isScheme(addr[:i]) {
+		if addr == "" {
+			return "", "", errors.New("empty address")
+		}
+		return Network(addr), addr, nil
+	}
+	scheme, rest := addr[:i], addr[i+3:]
+	switch scheme {
+	case "tcp", "tcp4", "tcp6":
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s address: %w", scheme, err)
+		} else if port == "" {
+			return "", "", fmt.Errorf("invalid %s address: missing port", scheme)
+		}
+		return scheme, net.JoinHostPort(host, port), nil
+	case "unix":
+		if rest == "" {
+			return "", "", errors.New("invalid unix address: empty path")
+		}
+		return scheme, rest, nil
+	default:
+		return "", "", fmt.Errorf("unsupported address scheme %q", scheme)
+	}
+}
+
+// isScheme reports whether s is a syntactically valid URL scheme.
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := range s {
+		b := s[i]
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' {
+			continue
+		} else if i > 0 && (b >= '0' && b <= '9' || b == '+' || b == '-' || b == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
 // isNull reports whether msg is exactly the JSON "null" value.
 func isNull(msg json.RawMessage) bool {
 	return len(msg) == 4 && msg[0] == 'n' && msg[1] == 'u' && msg[2] == 'l' && msg[3] == 'l'
@@ -420,6 +862,9 @@ func isNull(msg json.RawMessage) bool {
 // filterError filters an *Error value to distinguish context errors from other
 // error types. If err is not a context error, it is returned unchanged.
 func filterError(e *Error) error {
+	if e.err != nil {
+		return e.err
+	}
 	switch e.code {
 	case code.Cancelled:
 		return context.Canceled
@@ -2,6 +2,8 @@ package jrpc2_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/creachadair/jrpc2"
@@ -103,3 +105,47 @@ func BenchmarkParseRequests(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkLargeResult(b *testing.B) {
+	// Benchmark delivery of a large result that the handler has already
+	// encoded, compared to a result that must be marshaled.
+	value := make([]string, 256*1024/64)
+	for i := range value {
+		value[i] = fmt.Sprintf("%062d", i)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		b.Fatalf("Marshal: %v", err)
+	}
+	mux := handler.Map{
+		"Value": handler.New(func(context.Context) []string { return value }),
+		"Raw": handler.New(func(context.Context) jrpc2.RawResult {
+			return jrpc2.RawResult(encoded)
+		}),
+	}
+	tests := []struct {
+		desc, method string
+		trust        bool
+	}{
+		{"Marshal", "Value", false},
+		{"RawChecked", "Raw", false},
+		{"RawTrusted", "Raw", true},
+	}
+	for _, test := range tests {
+		b.Run(test.desc, func(b *testing.B) {
+			loc := server.NewLocal(mux, &server.LocalOptions{
+				Server: &jrpc2.ServerOptions{TrustRawResults: test.trust},
+			})
+			defer loc.Close()
+			ctx := context.Background()
+
+			b.SetBytes(int64(len(encoded)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := loc.Client.Call(ctx, test.method, nil); err != nil {
+					b.Fatalf("Call %s failed: %v", test.method, err)
+				}
+			}
+		})
+	}
+}
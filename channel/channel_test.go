@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // newPipe creates a pair of connected in-memory channels using the specified
@@ -244,3 +245,81 @@ func TestWithTrigger(t *testing.T) {
 		})
 	}
 }
+
+func TestThrottle(t *testing.T) {
+	const (
+		rate    = 20000 // bytes per second
+		burst   = 1000  // bytes
+		msgSize = 1000
+		numMsgs = 11
+	)
+	lhs, rhs := Direct()
+	ch := Throttle(lhs, rate, burst)
+	defer rhs.Close()
+
+	var total int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := rhs.Recv()
+			if err != nil {
+				return
+			}
+			total += len(msg)
+		}
+	}()
+
+	// The first message fits in the burst; the remainder must wait for the
+	// bucket to refill at the given rate.
+	msg := []byte(strings.Repeat("x", msgSize))
+	start := time.Now()
+	for i := 0; i < numMsgs; i++ {
+		if err := ch.Send(msg); err != nil {
+			t.Fatalf("Send %d failed: %v", i+1, err)
+		}
+	}
+	elapsed := time.Since(start)
+	ch.Close()
+	<-done
+
+	want := time.Duration((numMsgs*msgSize - burst) * int(time.Second) / rate)
+	if elapsed < want*9/10 {
+		t.Errorf("Sending %d bytes took %v, want at least %v", numMsgs*msgSize, elapsed, want)
+	}
+	if total != numMsgs*msgSize {
+		t.Errorf("Received %d bytes, want %d", total, numMsgs*msgSize)
+	}
+	t.Logf("Sent %d bytes in %v", total, elapsed)
+}
+
+func TestThrottleUnlimited(t *testing.T) {
+	lhs, rhs := Direct()
+	defer lhs.Close()
+	defer rhs.Close()
+	if ch := Throttle(lhs, 0, 100); ch != lhs {
+		t.Errorf("Throttle(ch, 0, 100): got %v, want the original channel", ch)
+	}
+}
+
+func TestThrottleClose(t *testing.T) {
+	lhs, rhs := Direct()
+	ch := Throttle(lhs, 10, 1)
+	defer rhs.Close()
+
+	// A large message would take minutes to admit at this rate, but closing
+	// the channel ends the wait.
+	errc := make(chan error, 1)
+	go func() { errc <- ch.Send(make([]byte, 1000)) }()
+	time.Sleep(50 * time.Millisecond)
+	ch.Close()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Send on closed channel did not fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send did not return after Close")
+	}
+}
@@ -63,6 +63,20 @@ type Channel interface {
 	Close() error
 }
 
+// Metadata is an optional interface that a Channel may implement to expose
+// information about its transport to the server, such as the HTTP request
+// that carried a message. After each successful call to Recv, the server
+// calls Metadata and attaches the result to the requests in the message it
+// received. Handlers can retrieve this value with jrpc2.ChannelMetadata.
+//
+// The value may be the same for every message, as for the peer address of a
+// network connection, or may change with each message received.
+type Metadata interface {
+	// Metadata returns transport metadata for the record most recently
+	// returned by Recv, or nil if there is none.
+	Metadata() interface{}
+}
+
 // IsErrClosing reports whether err is the internal error returned by a read
 // from a pipe or socket that is closed. This is false for err == nil.
 func IsErrClosing(err error) bool {
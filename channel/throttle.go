@@ -0,0 +1,130 @@
+package channel
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Throttle returns a Channel that delegates I/O operations to ch, but limits
+// the rate at which message bytes are sent and received to bytesPerSec in each
+// direction. Each direction has a token bucket that holds up to burst bytes,
+// so that short bursts of up to that size are not delayed. If burst <= 0, it
+// defaults to bytesPerSec. If bytesPerSec <= 0, Throttle returns ch unchanged.
+//
+// A Send that exceeds the rate is delayed before it is passed to ch. A Recv
+// that exceeds the rate is delayed after its message is received from ch.
+// Messages larger than burst are permitted, but incur a delay proportionate
+// to their size. Closing the channel ends any pending delays: A pending Send
+// reports an error without sending its message, while a pending Recv returns
+// its message immediately.
+func Throttle(ch Channel, bytesPerSec, burst int) Channel {
+	if bytesPerSec <= 0 {
+		return ch
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	done := make(chan struct{})
+	return &throttled{
+		ch:   ch,
+		send: newBucket(bytesPerSec, burst, done),
+		recv: newBucket(bytesPerSec, burst, done),
+		done: done,
+	}
+}
+
+type throttled struct {
+	ch         Channel
+	send, recv *bucket
+
+	close sync.Once
+	done  chan struct{} // closed when the channel is closed
+}
+
+// Send implements part of the channel.Channel interface. It waits until the
+// send rate permits msg to be sent, then delegates to the wrapped channel.
+func (t *throttled) Send(msg []byte) error {
+	if !t.send.wait(len(msg)) {
+		return errors.New("send on closed channel")
+	}
+	return t.ch.Send(msg)
+}
+
+// Recv implements part of the channel.Channel interface. It delegates to the
+// wrapped channel, then waits until the receive rate permits the message to
+// be delivered.
+func (t *throttled) Recv() ([]byte, error) {
+	msg, err := t.ch.Recv()
+	if err == nil {
+		t.recv.wait(len(msg))
+	}
+	return msg, err
+}
+
+// Close implements part of the channel.Channel interface. It ends any pending
+// delays and closes the wrapped channel.
+func (t *throttled) Close() error {
+	t.close.Do(func() { close(t.done) })
+	return t.ch.Close()
+}
+
+// Metadata implements the channel.Metadata interface. It delegates to the
+// wrapped channel if it implements Metadata, and otherwise returns nil.
+func (t *throttled) Metadata() interface{} {
+	if md, ok := t.ch.(Metadata); ok {
+		return md.Metadata()
+	}
+	return nil
+}
+
+// A bucket is a token bucket that admits bytes at a fixed rate.
+type bucket struct {
+	rate  float64       // bytes per second
+	burst float64       // maximum capacity of the bucket
+	done  chan struct{} // when closed, stop waiting
+
+	mu     sync.Mutex
+	tokens float64   // currently available; negative if in debt
+	last   time.Time // when tokens was last updated
+}
+
+func newBucket(rate, burst int, done chan struct{}) *bucket {
+	return &bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		done:   done,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes are admitted by the bucket, or until b.done is
+// closed. It reports whether the bytes were admitted before b.done closed.
+// Concurrent callers are admitted in turn.
+func (b *bucket) wait(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return true
+	}
+
+	// Wait until the debt is repaid. Holding the lock while waiting ensures
+	// that later callers queue behind this one.
+	t := time.NewTimer(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-b.done:
+		return false
+	}
+}
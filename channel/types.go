@@ -3,6 +3,7 @@ package channel
 import (
 	"errors"
 	"io"
+	"sync"
 )
 
 // A Framing converts a reader and a writer into a Channel with a particular
@@ -33,40 +34,70 @@ func (c triggered) Recv() ([]byte, error) {
 func (c triggered) Send(msg []byte) error { return c.ch.Send(msg) }
 func (c triggered) Close() error          { return c.ch.Close() }
 
+// Metadata implements the channel.Metadata interface. It delegates to the
+// wrapped channel if it implements Metadata, and otherwise returns nil.
+func (c triggered) Metadata() interface{} {
+	if md, ok := c.ch.(Metadata); ok {
+		return md.Metadata()
+	}
+	return nil
+}
+
 type direct struct {
-	send chan<- []byte
-	recv <-chan []byte
+	out, in *directPipe
 }
 
-func (d direct) Send(msg []byte) (err error) {
+// A directPipe carries messages in one direction between the ends of a Direct
+// channel. Closing done, rather than data, allows the sender to close its
+// end while a Send is blocked.
+type directPipe struct {
+	data chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newDirectPipe() *directPipe {
+	return &directPipe{data: make(chan []byte), done: make(chan struct{})}
+}
+
+func (d direct) Send(msg []byte) error {
+	select {
+	case <-d.out.done:
+		return errors.New("send on closed channel")
+	default:
+	}
 	cp := make([]byte, len(msg))
 	copy(cp, msg)
-	defer func() {
-		if p := recover(); p != nil {
-			err = errors.New("send on closed channel")
-		}
-	}()
-	d.send <- cp
-	return nil
+	select {
+	case d.out.data <- cp:
+		return nil
+	case <-d.out.done:
+		return errors.New("send on closed channel")
+	}
 }
 
 func (d direct) Recv() ([]byte, error) {
-	msg, ok := <-d.recv
-	if ok {
+	select {
+	case msg := <-d.in.data:
 		return msg, nil
+	case <-d.in.done:
+		return nil, io.EOF
 	}
-	return nil, io.EOF
 }
 
-func (d direct) Close() error { close(d.send); return nil }
+func (d direct) Close() error {
+	d.out.once.Do(func() { close(d.out.done) })
+	return nil
+}
 
 // Direct returns a pair of synchronous connected channels that pass message
 // buffers directly in memory without framing or encoding. Sends to client will
-// be received by server, and vice versa.
+// be received by server, and vice versa. Closing one end of the pair causes
+// the other end to receive io.EOF; it is safe to close an end while a Send on
+// that end is blocked.
 func Direct() (client, server Channel) {
-	c2s := make(chan []byte)
-	s2c := make(chan []byte)
-	client = direct{send: c2s, recv: s2c}
-	server = direct{send: s2c, recv: c2s}
+	c2s, s2c := newDirectPipe(), newDirectPipe()
+	client = direct{out: c2s, in: s2c}
+	server = direct{out: s2c, in: c2s}
 	return
 }
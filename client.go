@@ -7,44 +7,103 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/creachadair/jrpc2/channel"
 	"github.com/creachadair/jrpc2/code"
+	"golang.org/x/sync/semaphore"
 )
 
 // A Client is a JSON-RPC 2.0 client. The client sends requests and receives
 // responses on a channel.Channel provided by the caller.
 type Client struct {
 	done chan struct{} // closed when the reader is done at shutdown time
+	last chan struct{} // closed when the last batch received is delivered
 
 	log   func(string, ...interface{}) // write debug logs here
 	enctx encoder
 	snote func(*jmessage)
-	scall func(*jmessage) ([]byte, error)
+	scall func(*jmessage) func() ([]byte, error)
+	rcall func(*jmessage) ([]byte, error)
+	hpool *handlerPool // runs NotifyHandlers and CallbackHandlers
 	chook func(*Client, *Response)
-
-	allow1 bool // tolerate v1 replies with no version marker
-	allowC bool // send rpc.cancel when a request context ends
+	shook func(*ShutdownInfo)
+	tapTx func([]byte) // observes each message sent
+	tapRx func([]byte) // observes each message received
+
+	allow1 bool      // tolerate v1 replies with no version marker
+	allowC bool      // send rpc.cancel when a request context ends
+	useNum bool      // decode numbers in results as json.Number
+	jcodec JSONCodec // encodes params and decodes results
+
+	prefix string  // prefix for outbound method names
+	codecs []Codec // codecs for compressed results
+
+	clock   Clock         // measures the call timeout
+	timeout time.Duration // default timeout for calls (0 = none)
+	cmet    ClientMetrics // receives reports of calls and notifications
+
+	pmax  int64               // maximum pending calls (0 = no limit)
+	pfast bool                // fail calls beyond pmax rather than waiting
+	psem  *semaphore.Weighted // counts pending calls, if pmax > 0
+
+	redial dialer             // opens a new channel after a failure (nil = none)
+	rdelay time.Duration      // initial delay between redial attempts
+	rmax   time.Duration      // maximum delay between redial attempts
+	rlimit int                // maximum consecutive redial failures (0 = none)
+	rctx   context.Context    // governs redial attempts; ends at Close
+	rstop  context.CancelFunc // cancels rctx
+	oncon  func()
+	ondis  func(error)
 
 	mu      sync.Mutex           // protects the fields below
 	ch      channel.Channel      // channel to the server
+	wait    chan struct{}        // closed when a redial is settled (nil = none)
+	lost    error                // why the channel failed, while redialing
+	sent    time.Time            // when a message was last sent to the server
 	err     error                // error from a previous operation
 	pending map[string]*Response // requests pending completion, by ID
 	nextID  int64                // next unused request ID
+	shut    bool                 // the server announced a shutdown
+	grace   time.Duration        // the grace period of the announced shutdown
 }
 
 // NewClient returns a new client that communicates with the server via ch.
 func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
+	pool := &handlerPool{sem: opts.handlerLimit()}
+	redial, rdelay, rmax, rlimit := opts.redial()
 	c := &Client{
 		done:   make(chan struct{}),
+		last:   make(chan struct{}),
 		log:    opts.logger(),
 		allow1: opts.allowV1(),
 		allowC: opts.allowCancel(),
+		useNum: opts.useNumber(),
+		jcodec: opts.jsonCodec(),
+		prefix: opts.methodPrefix(),
+		codecs: opts.codecs(),
+		clock:  opts.clock(),
 		enctx:  opts.encodeContext(),
-		snote:  opts.handleNotification(),
+		snote:  opts.handleNotification(pool),
 		scall:  opts.handleCallback(),
+		hpool:  pool,
+		rcall:  opts.replyCallback(),
 		chook:  opts.handleCancel(),
+		shook:  opts.handleShutdown(),
+		tapTx:  opts.onSend(),
+		tapRx:  opts.onReceive(),
+
+		timeout: opts.callTimeout(),
+		cmet:    opts.metrics(),
+
+		redial: redial,
+		rdelay: rdelay,
+		rmax:   rmax,
+		rlimit: rlimit,
+		oncon:  opts.onConnect(),
+		ondis:  opts.onDisconnect(),
 
 		// Lock-protected fields
 		ch:      ch,
@@ -54,14 +113,30 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 		// Note that we start the ID counter at 1 here to avoid issues with a
 		// server implementation that treats 0 as equivalent to null.
 	}
+	close(c.last) // nothing has been received yet
+	if max, fast := opts.maxPending(); max > 0 {
+		c.pmax, c.pfast = int64(max), fast
+		c.psem = semaphore.NewWeighted(c.pmax)
+	}
+	if interval, method := opts.keepAlive(); interval > 0 {
+		c.sent = c.clock.Now()
+		go c.keepAlive(interval, method)
+	}
+	if redial != nil {
+		c.rctx, c.rstop = context.WithCancel(context.Background())
+	}
 
 	// The main client loop reads responses from the server and delivers them
 	// back to pending requests by their ID. Outbound requests do not queue;
-	// they are sent synchronously in the Send method.
+	// they are sent synchronously in the Send method. If the channel fails
+	// and the client can redial, the loop continues on the new channel.
 
 	go func() {
 		defer close(c.done)
-		for c.accept(ch) == nil {
+		for ch != nil {
+			for c.accept(ch) == nil {
+			}
+			ch = c.reconnect()
 		}
 	}()
 	return c
@@ -74,20 +149,59 @@ func (c *Client) accept(ch channel.Receiver) error {
 	var in jmessages
 	bits, err := ch.Recv()
 	if err == nil {
+		c.tapRx(bits)
 		err = in.parseJSON(bits)
 	}
 	if err != nil {
-		if !isUninteresting(err) {
+		// Deliver the responses already received before failing the requests
+		// still pending, since a server may close the connection as soon as
+		// it has sent its last response.
+		<-c.last
+		c.mu.Lock()
+		if c.shut {
+			// The server said it would close the connection, so whatever error
+			// that caused is expected.
+			c.log("Connection closed after server shutdown: %v", err)
+			err = errServerShutdown
+		} else if !isUninteresting(err) {
 			c.log("Decoding error: %v", err)
 		}
-		c.mu.Lock()
-		c.stop(err)
+		if c.ch == nil {
+			// The channel was already closed, by Close or by a failed check
+			// of the connection (see keepAlive).
+		} else if c.redial != nil {
+			c.disconnect(err)
+		} else {
+			c.stop(err)
+		}
 		c.mu.Unlock()
 		return err
 	}
 
+	// Note a shutdown announcement before the responses are delivered, so that
+	// it is in effect when the server closes the connection.
+	for _, msg := range in {
+		if !msg.isNotification() {
+			continue
+		}
+		c.cmet.NotificationReceived(strings.TrimPrefix(msg.M, c.prefix))
+		if msg.M == rpcShutdown {
+			var info ShutdownInfo
+			json.Unmarshal(msg.P, &info) // N.B. errors are logged by handleShutdown
+			c.mu.Lock()
+			c.shut, c.grace = true, time.Duration(info.Grace*float64(time.Second))
+			c.mu.Unlock()
+		}
+	}
+
 	c.log("Received %d responses", len(in))
+	// Deliver each batch after the one before it, so that the client sees
+	// responses and notifications in the order the server sent them.
+	prev, next := c.last, make(chan struct{})
+	c.last = next
 	go func() {
+		defer close(next)
+		<-prev
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		for _, rsp := range in {
@@ -101,21 +215,59 @@ func (c *Client) accept(ch channel.Receiver) error {
 // caller must hold c.mu, and this blocks until the handler completes.
 // Precondition: msg is a request or notification, not a response or error.
 func (c *Client) handleRequest(msg *jmessage) {
-	if msg.isNotification() {
+	if msg.M == rpcShutdown && msg.isNotification() {
+		c.handleShutdown(msg)
+	} else if msg.isNotification() {
 		if c.snote == nil {
 			c.log("Discarding notification: %v", msg)
 		} else {
 			c.snote(msg)
 		}
-	} else if c.scall == nil {
-		c.log("Discarding callback request: %v", msg)
-	} else if bits, err := c.scall(msg); err != nil {
+	} else if run := c.scall(msg); run != nil {
+		c.hpool.start(func() {
+			bits, err := run()
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.sendReply(msg, bits, err)
+		})
+	} else {
+		bits, err := c.rcall(msg)
+		c.sendReply(msg, bits, err)
+	}
+}
+
+// sendReply sends the encoded reply bits to the callback request msg from the
+// server, unless err != nil. The caller must hold c.mu.
+func (c *Client) sendReply(msg *jmessage, bits []byte, err error) {
+	if err != nil {
 		c.log("Callback for %v failed: %v", msg, err)
-	} else if err := c.ch.Send(bits); err != nil {
+	} else if c.ch == nil {
+		c.log("Discarding reply for callback %v: client is closed", msg)
+	} else if err := c.write(bits); err != nil {
 		c.log("Sending reply for callback %v failed: %v", msg, err)
 	}
 }
 
+// write sends bits to the server, after passing them to the OnSend hook. The
+// caller must hold c.mu, and c.ch must not be nil.
+func (c *Client) write(bits []byte) error {
+	c.tapTx(bits)
+	return c.ch.Send(bits)
+}
+
+// handleShutdown handles an rpc.shutdown notification from the server. The
+// caller must hold c.mu.
+func (c *Client) handleShutdown(msg *jmessage) {
+	var info ShutdownInfo
+	if err := json.Unmarshal(msg.P, &info); err != nil {
+		c.log("Invalid shutdown notification: %v", err)
+	}
+	c.log("Server announced shutdown [%gs grace]: %s", info.Grace, info.Reason)
+	if c.shook != nil {
+		c.shook(&info)
+	}
+}
+
 // For each response, find the request pending on its ID and deliver it.  The
 // caller must hold c.mu.  Unknown response IDs are logged and discarded.  As
 // we are under the lock, we do not wait for the pending receiver to pick up
@@ -140,6 +292,10 @@ func (c *Client) deliver(rsp *jmessage) {
 			},
 		}
 		c.log("Invalid response for ID %q", id)
+	} else if err := c.decompress(rsp); err != nil {
+		delete(c.pending, id)
+		p.ch <- &jmessage{ID: rsp.ID, E: err}
+		c.log("Invalid compressed response for ID %q: %v", id, err)
 	} else {
 		// Remove the pending request from the set and deliver its response.
 		// Determining whether it's an error is the caller's responsibility.
@@ -152,6 +308,10 @@ func (c *Client) deliver(rsp *jmessage) {
 // req constructs a fresh request for the specified method and parameters.
 // This does not transmit the request to the server; use c.send to do so.
 func (c *Client) req(ctx context.Context, method string, params interface{}) (*jmessage, error) {
+	if err := checkHello(ctx, method); err != nil {
+		return nil, err
+	}
+	method = c.wireMethod(method)
 	bits, err := c.marshalParams(ctx, method, params)
 	if err != nil {
 		return nil, err
@@ -171,6 +331,10 @@ func (c *Client) req(ctx context.Context, method string, params interface{}) (*j
 
 // note constructs a notification request for the specified method and parameters.
 func (c *Client) note(ctx context.Context, method string, params interface{}) (*jmessage, error) {
+	if err := checkHello(ctx, method); err != nil {
+		return nil, err
+	}
+	method = c.wireMethod(method)
 	bits, err := c.marshalParams(ctx, method, params)
 	if err != nil {
 		return nil, err
@@ -178,6 +342,16 @@ func (c *Client) note(ctx context.Context, method string, params interface{}) (*
 	return &jmessage{V: Version, M: method, P: bits}, nil
 }
 
+// wireMethod returns the name of method as sent to the server, with the
+// method prefix applied. Reserved method names beginning with "rpc." are not
+// prefixed.
+func (c *Client) wireMethod(method string) string {
+	if c.prefix == "" || strings.HasPrefix(method, "rpc.") {
+		return method
+	}
+	return c.prefix + method
+}
+
 // send transmits the specified requests to the server and returns a slice of
 // pending responses awaiting a reply from the server.
 //
@@ -185,8 +359,15 @@ func (c *Client) note(ctx context.Context, method string, params interface{}) (*
 // expects a response (that is, all those that are not notifications). If all
 // the requests are notifications, the slice will be empty.
 //
-// This method blocks until the entire batch of requests has been transmitted.
+// This method blocks until the entire batch of requests has been transmitted,
+// after waiting for room among the pending calls if the client limits them.
 func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error) {
+	return c.sendLimit(ctx, reqs, true)
+}
+
+// sendLimit implements send. If limit is false, the requests are not counted
+// against the client's limit on pending calls.
+func (c *Client) sendLimit(ctx context.Context, reqs jmessages, limit bool) ([]*Response, error) {
 	if len(reqs) == 0 {
 		return nil, errors.New("empty request batch")
 	}
@@ -199,23 +380,45 @@ func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error)
 		return nil, Errorf(code.InternalError, "marshaling request failed: %v", err)
 	}
 
+	if limit {
+		if err := c.acquirePending(ctx, reqs); err != nil {
+			return nil, err
+		}
+	}
 	var pends []*Response
 	var pctxs []context.Context
 	for _, req := range reqs {
 		if id := string(req.ID); id != "" {
-			pctx, p := newPending(ctx, id)
+			pctx, p := newPending(ctx, id, c.clock, c.timeout)
+			p.useNum = c.useNum
+			p.codec = c.jcodec
+			if limit && c.psem != nil {
+				cancel, once := p.cancel, new(sync.Once)
+				p.cancel = func() { cancel(); once.Do(func() { c.psem.Release(1) }) }
+			}
 			pends = append(pends, p)
 			pctxs = append(pctxs, pctx)
 		}
 	}
 
-	c.mu.Lock()
+	if err := c.lockReady(ctx); err != nil {
+		for _, p := range pends {
+			p.cancel()
+		}
+		return nil, err
+	}
 	defer c.mu.Unlock()
-	if c.err != nil {
-		return nil, c.err
+	if c.err == nil {
+		c.log("Outgoing batch: %s", string(b))
+		err = c.write(b)
+		c.sent = c.clock.Now()
+	} else {
+		err = connTerminated(c.err)
 	}
-	c.log("Outgoing batch: %s", string(b))
-	if err := c.ch.Send(b); err != nil {
+	if err != nil {
+		for _, p := range pends {
+			p.cancel() // release the contexts of the requests not sent
+		}
 		return nil, err
 	}
 
@@ -229,6 +432,32 @@ func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error)
 	return pends, nil
 }
 
+// acquirePending reserves a slot for each call among reqs, if the client has
+// a limit on pending calls. Each slot is released when the response to its
+// call has settled, or when the call is not sent.
+func (c *Client) acquirePending(ctx context.Context, reqs jmessages) error {
+	if c.psem == nil {
+		return nil
+	}
+	var n int64
+	for _, req := range reqs {
+		if len(req.ID) != 0 {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	} else if n > c.pmax {
+		return ErrTooManyPending
+	} else if c.pfast {
+		if !c.psem.TryAcquire(n) {
+			return ErrTooManyPending
+		}
+		return nil
+	}
+	return c.psem.Acquire(ctx, n)
+}
+
 // waitComplete waits for completion of the context governing p. When the
 // context ends, check whether the request is still in the pending set for the
 // client: If so, a reply has not yet been delivered.  Otherwise, the
@@ -250,16 +479,9 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 	c.log("Context ended for id %q, err=%v", id, err)
 	delete(c.pending, id)
 
-	var jerr *Error
-	if c.err != nil && !isUninteresting(c.err) {
-		jerr = &Error{code: code.InternalError, message: c.err.Error()}
-	} else if err != nil {
-		jerr = &Error{code: code.FromError(err), message: err.Error()}
-	}
-
 	p.ch <- &jmessage{
 		ID: json.RawMessage(id),
-		E:  jerr,
+		E:  &Error{code: code.FromError(err), message: err.Error()},
 	}
 
 	// Inform the server, best effort only. N.B. Use a background context here,
@@ -280,7 +502,8 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 
 // Call initiates a single request and blocks until the response returns.
 // A successful call reports a nil error and a non-nil response. Errors from
-// the server have concrete type *jrpc2.Error.
+// the server have concrete type *jrpc2.Error. If the connection to the server
+// ends before the response arrives, the error wraps ErrConnTerminated.
 //
 //    rsp, err := c.Call(ctx, method, params)
 //    if e, ok := err.(*jrpc2.Error); ok {
@@ -291,6 +514,14 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 //    handleValidResponse(rsp)
 //
 func (c *Client) Call(ctx context.Context, method string, params interface{}) (*Response, error) {
+	start := c.clock.Now()
+	rsp, err := c.call(ctx, method, params)
+	c.cmet.CallDone(method, c.clock.Now().Sub(start), code.FromError(err))
+	return rsp, err
+}
+
+// call implements Call, without reporting metrics.
+func (c *Client) call(ctx context.Context, method string, params interface{}) (*Response, error) {
 	req, err := c.req(ctx, method, params)
 	if err != nil {
 		return nil, err
@@ -308,10 +539,13 @@ func (c *Client) Call(ctx context.Context, method string, params interface{}) (*
 
 // CallResult invokes Call with the given method and params. If it succeeds,
 // the result is decoded into result. This is a convenient shorthand for Call
-// followed by UnmarshalResult. It will panic if result == nil.
+// followed by UnmarshalResult. If result == nil, the result is discarded, and
+// CallResult reports only whether the call succeeded. An error from the
+// server is reported as Call reports it, and a result that cannot be decoded
+// into result is reported as a decoding error.
 func (c *Client) CallResult(ctx context.Context, method string, params, result interface{}) error {
 	rsp, err := c.Call(ctx, method, params)
-	if err != nil {
+	if err != nil || result == nil {
 		return err
 	}
 	return rsp.UnmarshalResult(result)
@@ -322,8 +556,37 @@ func (c *Client) CallResult(ctx context.Context, method string, params, result i
 // original specs, omitting notifications.
 //
 // Any error returned is from sending the batch; the caller must check each
-// response for errors from the server.
+// response for errors from the server. The failure of one call does not
+// affect the responses to the others.
 func (c *Client) Batch(ctx context.Context, specs []Spec) ([]*Response, error) {
+	start := c.clock.Now()
+	rsps, err := c.batch(ctx, specs)
+	elapsed := c.clock.Now().Sub(start)
+
+	// Report the calls, and the notifications if the batch was sent. The
+	// responses are in the same order as the calls among the specs.
+	next := 0
+	for _, spec := range specs {
+		if spec.Notify {
+			if err == nil {
+				c.cmet.NotificationSent(spec.Method)
+			}
+			continue
+		}
+		ec := code.FromError(err)
+		if err == nil {
+			if e := rsps[next].Error(); e != nil {
+				ec = e.Code()
+			}
+			next++
+		}
+		c.cmet.CallDone(spec.Method, elapsed, ec)
+	}
+	return rsps, err
+}
+
+// batch implements Batch, without reporting metrics.
+func (c *Client) batch(ctx context.Context, specs []Spec) ([]*Response, error) {
 	reqs := make(jmessages, len(specs))
 	for i, spec := range specs {
 		if spec.Notify {
@@ -363,11 +626,16 @@ func (c *Client) Notify(ctx context.Context, method string, params interface{})
 	if err != nil {
 		return err
 	}
-	_, err = c.send(ctx, jmessages{req})
-	return err
+	if _, err := c.send(ctx, jmessages{req}); err != nil {
+		return err
+	}
+	c.cmet.NotificationSent(method)
+	return nil
 }
 
-// Close shuts down the client, abandoning any pending in-flight requests.
+// Close shuts down the client, failing any pending in-flight requests with
+// ErrConnTerminated. It blocks until the responses already received from the
+// server have been delivered.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	c.stop(errClientStopped)
@@ -381,26 +649,221 @@ func (c *Client) Close() error {
 }
 
 func isUninteresting(err error) bool {
-	return err == io.EOF || channel.IsErrClosing(err) || err == errClientStopped
+	return err == io.EOF || channel.IsErrClosing(err) || err == errClientStopped ||
+		err == errServerShutdown
 }
 
 // stop closes down the reader for c and records err as its final state.  The
 // caller must hold c.mu. If multiple callers invoke stop, only the first will
 // successfully record its error status.
 func (c *Client) stop(err error) {
+	if c.rstop != nil {
+		c.rstop() // abandon redialing, if any
+	}
+	if c.wait != nil {
+		// The client is reconnecting, so there is no channel to close, and
+		// the requests that were pending have already failed.
+		close(c.wait)
+		c.wait = nil
+		c.err = err
+		return
+	}
 	if c.ch == nil {
 		return // nothing is running
 	}
 	c.ch.Close()
-
-	// Unblock and fail any pending requests.
-	for _, p := range c.pending {
-		p.cancel()
-	}
+	c.failPending(err)
 	c.err = err
 	c.ch = nil
 }
 
+// failPending fails the pending requests because the connection to the server
+// ended with err. The caller must hold c.mu.
+func (c *Client) failPending(err error) {
+	cerr := connTerminated(err)
+	for id, p := range c.pending {
+		delete(c.pending, id)
+		p.ch <- &jmessage{
+			ID: json.RawMessage(id),
+			E:  &Error{code: code.SystemError, message: cerr.Error(), err: cerr},
+		}
+		p.cancel() // release the context observer
+	}
+}
+
+// connTerminated returns an error wrapping ErrConnTerminated, for the reason
+// err that the connection to the server ended.
+func connTerminated(err error) error {
+	return fmt.Errorf("%w: %v", ErrConnTerminated, err)
+}
+
+// disconnect closes the failed channel to the server and fails the pending
+// requests, so that the client can redial (see reconnect). Calls sent in the
+// meantime wait until the redial is settled. The caller must hold c.mu.
+func (c *Client) disconnect(err error) {
+	c.ch.Close()
+	c.failPending(err)
+	c.ch, c.lost = nil, err
+	c.wait = make(chan struct{})
+}
+
+// reconnect redials the server after its channel failed, retrying with
+// backoff until it succeeds, the attempt limit is reached, or the client is
+// closed. It returns the new channel, or nil if the client has stopped.
+// The caller must not hold c.mu.
+func (c *Client) reconnect() channel.Channel {
+	c.mu.Lock()
+	wait, err, shut, grace := c.wait, c.lost, c.shut, c.grace
+	c.mu.Unlock()
+	if wait == nil {
+		return nil // the client has stopped
+	}
+	c.log("Connection lost, redialing: %v", err)
+	if c.ondis != nil {
+		c.ondis(err)
+	}
+
+	// If the server announced its shutdown, give it time to go away before
+	// the first attempt, rather than redialing a server that is still
+	// draining or not yet restarted.
+	if shut {
+		if grace < c.rdelay {
+			grace = c.rdelay
+		}
+		c.log("Server shut down; waiting %v before redialing", grace)
+		select {
+		case <-c.clock.After(grace):
+		case <-c.rctx.Done():
+			return nil
+		}
+	}
+
+	delay := c.rdelay
+	for try := 1; ; try++ {
+		ch, err := c.redial(c.rctx)
+		c.mu.Lock()
+		if c.wait != wait {
+			c.mu.Unlock()
+			if err == nil {
+				ch.Close() // the client was closed while we were dialing
+			}
+			return nil
+		} else if err == nil {
+			c.ch, c.wait, c.lost, c.shut, c.grace = ch, nil, nil, false, 0
+			c.sent = c.clock.Now()
+			close(wait)
+			c.mu.Unlock()
+
+			c.log("Reconnected after %d attempt(s)", try)
+			if c.oncon != nil {
+				c.oncon()
+			}
+			return ch
+		}
+		c.log("Redial attempt %d failed: %v", try, err)
+		if c.rlimit > 0 && try >= c.rlimit {
+			c.stop(err)
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.clock.After(delay):
+		case <-c.rctx.Done():
+			return nil
+		}
+		if delay *= 2; delay > c.rmax {
+			delay = c.rmax
+		}
+	}
+}
+
+// keepAlive checks the connection to the server by calling method whenever
+// the client has sent nothing for interval, until the client stops. If a check
+// fails, the connection is closed as if it had failed.
+func (c *Client) keepAlive(interval time.Duration, method string) {
+	for {
+		c.mu.Lock()
+		stopped, wait, idle := c.err != nil, c.wait, c.clock.Now().Sub(c.sent)
+		c.mu.Unlock()
+
+		if stopped {
+			return
+		} else if wait != nil {
+			// The client is redialing; check again when that settles.
+			select {
+			case <-wait:
+			case <-c.done:
+				return
+			}
+			continue
+		} else if idle < interval {
+			select {
+			case <-c.clock.After(interval - idle):
+			case <-c.done:
+				return
+			}
+			continue
+		}
+
+		err := c.ping(interval, method)
+		if err == nil || errors.Is(err, ErrConnTerminated) {
+			continue // alive, or already closed for another reason
+		}
+		c.mu.Lock()
+		if c.ch != nil {
+			err = fmt.Errorf("keepalive check failed: %w", err)
+			c.log("Closing connection: %v", err)
+			if c.redial != nil {
+				c.disconnect(err)
+			} else {
+				c.stop(err)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// ping calls method to check the connection to the server, and reports
+// whether it succeeded within timeout. The call does not count against the
+// client's limit on pending calls.
+func (c *Client) ping(timeout time.Duration, method string) error {
+	ctx, cancel := withTimeout(context.Background(), c.clock, timeout)
+	defer cancel()
+	req, err := c.req(ctx, method, nil)
+	if err != nil {
+		return err
+	}
+	rsps, err := c.sendLimit(ctx, jmessages{req}, false)
+	if err != nil {
+		return err
+	}
+	rsps[0].wait()
+	if err := rsps[0].Error(); err != nil {
+		return filterError(err)
+	}
+	return nil
+}
+
+// lockReady acquires c.mu once the client is not waiting to redial the
+// server. If ctx ends first, lockReady reports its error without holding the
+// lock.
+func (c *Client) lockReady(ctx context.Context) error {
+	c.mu.Lock()
+	for c.wait != nil {
+		wait := c.wait
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	return nil
+}
+
 func (c *Client) versionOK(v string) bool {
 	if v == "" {
 		return c.allow1
@@ -414,7 +877,7 @@ func (c *Client) marshalParams(ctx context.Context, method string, params interf
 	if params == nil {
 		return c.enctx(ctx, method, nil) // no parameters, that is OK
 	}
-	pbits, err := json.Marshal(params)
+	pbits, err := c.jcodec.Marshal(params)
 	if err != nil {
 		return nil, err
 	}
@@ -430,13 +893,62 @@ func (c *Client) marshalParams(ctx context.Context, method string, params interf
 	return bits, err
 }
 
-func newPending(ctx context.Context, id string) (context.Context, *Response) {
+// newPending constructs a pending response for the request with the given ID,
+// and a context governing it derived from ctx. If timeout > 0 and ctx has no
+// deadline, the context ends once timeout has elapsed according to clock.
+func newPending(ctx context.Context, id string, clock Clock, timeout time.Duration) (context.Context, *Response) {
+	stop := func() {}
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		ctx, stop = withTimeout(ctx, clock, timeout)
+	}
+
 	// Buffer the channel so the response reader does not need to rendezvous
 	// with the recipient.
 	pctx, cancel := context.WithCancel(ctx)
 	return pctx, &Response{
 		ch:     make(chan *jmessage, 1),
 		id:     id,
-		cancel: cancel,
+		cancel: func() { cancel(); stop() },
+	}
+}
+
+// A handlerPool runs handler functions on at most as many goroutines as its
+// semaphore permits. A function started while the pool is full is queued, and
+// run in order of arrival by the next goroutine that becomes free, so that the
+// caller never blocks waiting for a handler to finish.
+type handlerPool struct {
+	sem *semaphore.Weighted
+
+	mu    sync.Mutex
+	queue []func()
+}
+
+// start runs f on a new goroutine if the pool has room, or else queues f.
+func (p *handlerPool) start(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) != 0 || !p.sem.TryAcquire(1) {
+		p.queue = append(p.queue, f)
+		return
+	}
+	go p.run(f)
+}
+
+// run calls f, then the functions queued while it ran, until the queue is
+// empty, and then releases its slot in the pool.
+func (p *handlerPool) run(f func()) {
+	for f != nil {
+		f()
+
+		p.mu.Lock()
+		f = nil
+		if len(p.queue) != 0 {
+			f = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+		} else {
+			p.sem.Release(1) // N.B. under the lock, so start sees it
+		}
+		p.mu.Unlock()
 	}
 }
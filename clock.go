@@ -0,0 +1,86 @@
+package jrpc2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Clock reports the current time and measures the passage of time for a
+// server or a client. By default both use the system clock from the time
+// package. Tests may provide a fake Clock via ServerOptions or ClientOptions to
+// control time without waiting in real time.
+type Clock interface {
+	// Now reports the current time.
+	Now() time.Time
+
+	// After returns a channel that delivers the current time once at least
+	// duration d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock implements the Clock interface using the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// withTimeout returns a copy of ctx that ends with context.DeadlineExceeded
+// once d has elapsed according to clock.
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(systemClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	tc := &timeoutContext{
+		Context:  ctx,
+		deadline: clock.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	timer := clock.After(d)
+	go func() {
+		var err error
+		select {
+		case <-timer:
+			err = context.DeadlineExceeded
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-stop:
+			err = context.Canceled
+		}
+		tc.mu.Lock()
+		tc.err = err
+		tc.mu.Unlock()
+		close(tc.done)
+	}()
+	var once sync.Once
+	return tc, func() { once.Do(func() { close(stop) }) }
+}
+
+// A timeoutContext is a context whose deadline is measured by a Clock other
+// than the system clock, which the context package does not support. It has
+// its own done channel, so that contexts derived from it report its error
+// rather than that of its parent.
+type timeoutContext struct {
+	context.Context // the parent
+	deadline        time.Time
+	done            chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	if d, ok := c.Context.Deadline(); ok && d.Before(c.deadline) {
+		return d, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Done() <-chan struct{} { return c.done }
+
+func (c *timeoutContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -60,7 +60,11 @@ func main() {
 		log.Fatal("You must provide -server address to connect to")
 	}
 
-	conn, err := net.Dial(jrpc2.Network(*serverAddr), *serverAddr)
+	ntype, addr, err := jrpc2.ParseAddress(*serverAddr)
+	if err != nil {
+		log.Fatalf("Invalid address: %v", err)
+	}
+	conn, err := net.Dial(ntype, addr)
 	if err != nil {
 		log.Fatalf("Dial %q: %v", *serverAddr, err)
 	}
@@ -92,7 +92,11 @@ func main() {
 		"Post": handler.Map{"Alert": handler.New(Alert)},
 	}
 
-	lst, err := net.Listen(jrpc2.Network(*address), *address)
+	ntype, addr, err := jrpc2.ParseAddress(*address)
+	if err != nil {
+		log.Fatalf("Invalid address: %v", err)
+	}
+	lst, err := net.Listen(ntype, addr)
 	if err != nil {
 		log.Fatalln("Listen:", err)
 	}
@@ -38,17 +38,33 @@ var (
 	doTiming    = flag.Bool("T", false, "Print call timing stats")
 	withLogging = flag.Bool("v", false, "Enable verbose logging")
 	withMeta    = flag.String("meta", "", "Attach this JSON value as request metadata (implies -c)")
+	waitReady   = flag.Duration("wait-ready", 0, "Retry dialing the server until this timeout elapses (0 for one attempt)")
+	checkReady  = flag.Bool("ping", false, "Check that the server is responding before issuing calls")
+	doList      = flag.Bool("list", false, "List the methods exported by the server instead of issuing calls")
+)
+
+// Exit codes for failures before any calls are issued.
+const (
+	exitNoConnect = 2 // unable to connect to the server
+	exitNotReady  = 3 // connected, but the server did not respond
 )
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: %[1]s [options] <address> {<method> <params>}...
        %[1]s [options] -m <address> <method> <params>...
+       %[1]s [options] -list <address>
 
 Connect to the specified address and transmit the specified JSON-RPC method
 calls in sequence (or as a batch, if -batch is set).  The resulting response
 values are printed to stdout.
 
+The address may have an explicit scheme, "tcp://host:port" or
+"unix:///path/to/socket"; see jrpc2.ParseAddress. Without a scheme, an
+address of the form "host:port" uses TCP and any other address is treated as
+the path of a Unix-domain socket. An "http://" or "https://" address is an
+HTTP endpoint URL.
+
 Without -m, each pair of arguments names a method and its parameters to call.
 With -m, the first argument names a method to be repeatedly called with each of
 the remaining arguments as its parameter.
@@ -67,8 +83,21 @@ See also: https://godoc.org/github.com/creachadair/jrpc2/channel.
 The default framing is read from the JCALL_FRAMING environment variable, if set.
 The -f flag overrides the environment.
 
+The -dial flag bounds each attempt to connect to the server. If -wait-ready is
+set, failed attempts are retried with backoff until that timeout elapses, which
+is useful when the server is still starting up. If -ping is set, jcall calls
+rpc.serverInfo after connecting and before issuing the requested calls, to
+check that the server is responding; any reply, even an error, suffices.
+
+With -list, jcall prints the names of the methods exported by the server, one
+per line, as reported by rpc.serverInfo, and issues no other calls.
+
+If jcall cannot connect to the server, it exits with status %[2]d. If it connects
+but the -ping check fails, it exits with status %[3]d. Otherwise, if any call
+fails, it exits with status 1.
+
 Options:
-`, filepath.Base(os.Args[0]))
+`, filepath.Base(os.Args[0]), exitNoConnect, exitNotReady)
 		flag.PrintDefaults()
 	}
 }
@@ -78,7 +107,11 @@ func main() {
 
 	// There must be at least one request, and more are permitted.  Each method
 	// must have an argument, though it may be empty.
-	if *doMulti {
+	if *doList {
+		if flag.NArg() != 1 {
+			log.Fatal("Arguments are <address>")
+		}
+	} else if *doMulti {
 		if flag.NArg() < 3 {
 			log.Fatal("Arguments are <address> <method> <params>...")
 		}
@@ -116,17 +149,35 @@ func main() {
 	} else if nc := chanutil.Framing(*chanFraming); nc == nil {
 		log.Fatalf("Unknown channel framing %q", *chanFraming)
 	} else {
-		ntype := jrpc2.Network(flag.Arg(0))
-		conn, err := net.DialTimeout(ntype, flag.Arg(0), *dialTimeout)
+		ntype, addr, err := jrpc2.ParseAddress(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Invalid address: %v", err)
+		}
+		conn, err := dial(ntype, addr)
 		if err != nil {
-			log.Fatalf("Dial %q: %v", flag.Arg(0), err)
+			log.Printf("Dial %q: %v", flag.Arg(0), err)
+			os.Exit(exitNoConnect)
 		}
 		defer conn.Close()
 		cc = nc(conn, conn)
 	}
-	tdial := time.Now()
 
 	cli := newClient(cc)
+	if *checkReady {
+		if err := ping(cli); err != nil {
+			log.Printf("Server at %q is not responding: %v", flag.Arg(0), err)
+			os.Exit(exitNotReady)
+		}
+	}
+	tdial := time.Now()
+
+	if *doList {
+		if err := listMethods(ctx, cli); err != nil {
+			log.Fatalf("Listing methods: %v", err)
+		}
+		return
+	}
+
 	pdur, err := issueCalls(ctx, cli, flag.Args()[1:])
 	// defer failure on error till after we print aggregate timing stats
 	tcall := time.Now()
@@ -144,6 +195,57 @@ func main() {
 	}
 }
 
+// dial connects to addr on the specified network. Each attempt is bounded by
+// the -dial timeout. If -wait-ready is set, failed attempts are retried with
+// backoff until the -wait-ready timeout has elapsed.
+func dial(ntype, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(*waitReady)
+	wait := 50 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout(ntype, addr, *dialTimeout)
+		if err == nil || time.Now().Add(wait).After(deadline) {
+			return conn, err
+		}
+		if *withLogging {
+			log.Printf("Dial %q: %v (retrying in %v)", addr, err, wait)
+		}
+		time.Sleep(wait)
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+}
+
+// ping checks that the server is responding by calling rpc.serverInfo. Any
+// reply counts as success, including an error reported by the server, for
+// example if it does not enable the built-in methods.
+func ping(cli *jrpc2.Client) error {
+	ctx := context.Background()
+	if *dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *dialTimeout)
+		defer cancel()
+	}
+	_, err := cli.Call(ctx, "rpc.serverInfo", nil)
+	if _, ok := err.(*jrpc2.Error); ok {
+		return nil
+	}
+	return err
+}
+
+// listMethods prints the names of the methods exported by the server, as
+// reported by rpc.serverInfo.
+func listMethods(ctx context.Context, cli *jrpc2.Client) error {
+	info, err := jrpc2.RPCServerInfo(ctx, cli)
+	if err != nil {
+		return err
+	}
+	for _, name := range info.Methods {
+		fmt.Println(name)
+	}
+	return nil
+}
+
 func newClient(conn channel.Channel) *jrpc2.Client {
 	opts := &jrpc2.ClientOptions{
 		OnNotify: func(req *jrpc2.Request) {
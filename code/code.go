@@ -68,11 +68,23 @@ const (
 
 // The JSON-RPC 2.0 specification reserves the range -32000 to -32099 for
 // implementation-defined server errors. These are used by the jrpc2 package.
+// Code -32095 is skipped: Programs written before the codes following it were
+// defined may register -32095 for their own use, and Register would panic if
+// it were defined here.
 const (
 	NoError          Code = -32099 // Denotes a nil error (used by FromError)
 	SystemError      Code = -32098 // Errors from the operating environment
 	Cancelled        Code = -32097 // Request cancelled (context.Canceled)
 	DeadlineExceeded Code = -32096 // Request deadline exceeded (context.DeadlineExceeded)
+	Deprecated       Code = -32094 // Method is deprecated and calls are rejected
+	ResultTooLarge   Code = -32093 // Encoded result exceeds the server limit
+	Unavailable      Code = -32092 // Method is temporarily disabled by the server
+	Unauthorized     Code = -32091 // Request authorization is missing or invalid
+	Replayed         Code = -32090 // Request authorization was already used
+	ShuttingDown     Code = -32089 // Server is shutting down and refuses new calls
+	LimitExceeded    Code = -32088 // Request exceeds a size limit of the server
+	RateLimited      Code = -32087 // Request exceeds the rate limit of the server
+	Overloaded       Code = -32086 // Server has too much work queued to accept the request
 )
 
 var stdError = map[Code]string{
@@ -86,6 +98,15 @@ var stdError = map[Code]string{
 	SystemError:      "system error",
 	Cancelled:        "request cancelled",
 	DeadlineExceeded: "deadline exceeded",
+	Deprecated:       "method deprecated",
+	ResultTooLarge:   "result too large",
+	Unavailable:      "method unavailable",
+	Unauthorized:     "unauthorized",
+	Replayed:         "request replayed",
+	ShuttingDown:     "server shutting down",
+	LimitExceeded:    "limit exceeded",
+	RateLimited:      "rate limited",
+	Overloaded:       "server overloaded",
 }
 
 // Register adds a new Code value with the specified message string.  This
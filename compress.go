@@ -0,0 +1,119 @@
+package jrpc2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// A Codec compresses and decompresses the results of calls. A server and a
+// client that share a Codec may agree to compress large results with it (see
+// RPCHello). A Codec must be safe for concurrent use by multiple goroutines.
+type Codec interface {
+	// Name reports the name of the encoding implemented by the codec, for
+	// example "gzip". Names are compared exactly.
+	Name() string
+
+	// Compress returns a compressed encoding of data.
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress returns the original data from a compressed encoding.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec for the "gzip" encoding, using the compress/gzip
+// package at the default compression level.
+var GzipCodec Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// findCodec returns the codec in cs with the given name, or nil.
+func findCodec(cs []Codec, name string) Codec {
+	for _, c := range cs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// defaultCompressMin is the smallest result compressed by default.
+const defaultCompressMin = 1024
+
+// compress compresses the results of rsps whose size is at least the
+// threshold, using the codec negotiated with the client. A compressed result
+// is encoded as a JSON string holding the base64 encoding of the compressed
+// data, and the name of the codec is recorded in the "encoding" member of the
+// response. Results that do not get smaller are sent as they are. The caller
+// must hold s.mu.
+func (s *Server) compress(rsps jmessages) {
+	if s.enc == nil {
+		return
+	}
+	for _, rsp := range rsps {
+		if len(rsp.R) < s.zmin || rsp.E != nil {
+			continue
+		}
+		z, err := s.enc.Compress(rsp.R)
+		if err != nil {
+			s.log("Compressing result for ID %s: %v", string(rsp.ID), err)
+			continue
+		}
+		bits, err := json.Marshal(z)
+		if err != nil || len(bits) >= len(rsp.R) {
+			continue
+		}
+		s.metrics.Count("rpc.compressedResults", 1)
+		s.metrics.Count("rpc.compressedBytesSaved", int64(len(rsp.R)-len(bits)))
+		rsp.R = bits
+		rsp.C = s.enc.Name()
+	}
+}
+
+// decompress replaces the compressed result of rsp, if any, with the
+// original, using the codec named by its encoding.
+func (c *Client) decompress(rsp *jmessage) *Error {
+	if rsp.C == "" || rsp.E != nil {
+		return nil
+	}
+	codec := findCodec(c.codecs, rsp.C)
+	if codec == nil {
+		return &Error{code: code.InternalError, message: fmt.Sprintf("unknown result encoding %q", rsp.C)}
+	}
+	var z []byte
+	if err := json.Unmarshal(rsp.R, &z); err != nil {
+		return &Error{code: code.InternalError, message: fmt.Sprintf("invalid %s result: %v", rsp.C, err)}
+	}
+	bits, err := codec.Decompress(z)
+	if err != nil {
+		return &Error{code: code.InternalError, message: fmt.Sprintf("decompressing %s result: %v", rsp.C, err)}
+	}
+	rsp.R, rsp.C = bits, ""
+	return nil
+}
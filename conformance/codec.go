@@ -0,0 +1,189 @@
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// codecChecks are the checks applied by CheckCodec.
+var codecChecks = []struct {
+	name  string
+	check func(jrpc2.JSONCodec) error
+}{
+	{"RoundTrip", checkRoundTrip},
+	{"MarshalRaw", checkMarshalRaw},
+	{"UnmarshalRaw", checkUnmarshalRaw},
+	{"Marshaler", checkMarshaler},
+	{"Unmarshaler", checkUnmarshaler},
+	{"UseNumber", checkUseNumber},
+	{"UnknownFields", checkUnknownFields},
+	{"InvalidJSON", checkInvalidJSON},
+}
+
+type codecValue struct {
+	S string            `json:"s"`
+	N int64             `json:"n,omitempty"`
+	F float64           `json:"f"`
+	B []bool            `json:"b"`
+	M map[string]string `json:"m,omitempty"`
+	P *codecValue       `json:"p,omitempty"`
+	X string            `json:"-"`
+}
+
+// Values of struct type, including nested values, are encoded and decoded
+// according to their field tags.
+func checkRoundTrip(c jrpc2.JSONCodec) error {
+	in := codecValue{
+		S: "<a & b>", N: 1 << 60, F: 0.5, B: []bool{true, false},
+		M: map[string]string{"k": "v"}, P: &codecValue{S: "inner"}, X: "ignored",
+	}
+	bits, err := c.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("marshal: %v", err)
+	}
+	var out codecValue
+	if err := c.Unmarshal(bits, &out, jrpc2.DecodeOptions{}); err != nil {
+		return fmt.Errorf("unmarshal %#q: %v", bits, err)
+	}
+	in.X = ""
+	if !reflect.DeepEqual(out, in) {
+		return fmt.Errorf("got %+v, want %+v", out, in)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(bits, &obj); err != nil {
+		return fmt.Errorf("invalid encoding %#q: %v", bits, err)
+	} else if _, ok := obj["X"]; ok {
+		return fmt.Errorf("encoding %#q includes an ignored field", bits)
+	}
+	return nil
+}
+
+// A json.RawMessage is encoded verbatim, apart from whitespace.
+func checkMarshalRaw(c jrpc2.JSONCodec) error {
+	const raw = `{"z":1,"a":[12345678901234567890,1e400]}`
+	for _, v := range []interface{}{
+		json.RawMessage(raw),
+		struct {
+			R json.RawMessage `json:"r"`
+		}{json.RawMessage(raw)},
+	} {
+		bits, err := c.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("marshal %T: %v", v, err)
+		} else if want := mustStd(v); string(bits) != want {
+			return fmt.Errorf("marshal %T: got %#q, want %#q", v, bits, want)
+		}
+	}
+	return nil
+}
+
+// A json.RawMessage is decoded verbatim.
+func checkUnmarshalRaw(c jrpc2.JSONCodec) error {
+	const raw = `{"z":1,"a":[12345678901234567890,1e400]}`
+	var v struct {
+		R json.RawMessage `json:"r"`
+	}
+	if err := c.Unmarshal([]byte(`{"r":`+raw+`}`), &v, jrpc2.DecodeOptions{}); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	} else if string(v.R) != raw {
+		return fmt.Errorf("got %#q, want %#q", v.R, raw)
+	}
+	return nil
+}
+
+type codecMarshaler struct{ v int }
+
+func (m codecMarshaler) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf(`"m%d"`, m.v)), nil }
+
+func (m *codecMarshaler) UnmarshalJSON(data []byte) error {
+	_, err := fmt.Sscanf(string(data), `"m%d"`, &m.v)
+	return err
+}
+
+// Values that implement json.Marshaler are encoded by their methods.
+func checkMarshaler(c jrpc2.JSONCodec) error {
+	v := []interface{}{codecMarshaler{1}, &codecMarshaler{2}}
+	bits, err := c.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %v", err)
+	} else if want := `["m1","m2"]`; string(bits) != want {
+		return fmt.Errorf("got %#q, want %#q", bits, want)
+	}
+	return nil
+}
+
+// Values that implement json.Unmarshaler are decoded by their methods.
+func checkUnmarshaler(c jrpc2.JSONCodec) error {
+	var v []codecMarshaler
+	if err := c.Unmarshal([]byte(`["m3","m4"]`), &v, jrpc2.DecodeOptions{}); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	} else if want := []codecMarshaler{{3}, {4}}; !reflect.DeepEqual(v, want) {
+		return fmt.Errorf("got %+v, want %+v", v, want)
+	}
+	return nil
+}
+
+// Numbers decoded into interface values are float64, or json.Number if the
+// UseNumber option is set.
+func checkUseNumber(c jrpc2.JSONCodec) error {
+	const input = `{"n":12345678901234567890}`
+	var v map[string]interface{}
+	if err := c.Unmarshal([]byte(input), &v, jrpc2.DecodeOptions{}); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	} else if _, ok := v["n"].(float64); !ok {
+		return fmt.Errorf("without UseNumber: got %T, want float64", v["n"])
+	}
+	v = nil
+	if err := c.Unmarshal([]byte(input), &v, jrpc2.DecodeOptions{UseNumber: true}); err != nil {
+		return fmt.Errorf("unmarshal with UseNumber: %v", err)
+	} else if n, ok := v["n"].(json.Number); !ok || n != "12345678901234567890" {
+		return fmt.Errorf("with UseNumber: got %T %v, want json.Number", v["n"], v["n"])
+	}
+	return nil
+}
+
+// Unknown fields are ignored, unless the DisallowUnknownFields option is set.
+func checkUnknownFields(c jrpc2.JSONCodec) error {
+	const input = `{"s":"ok","extra":true}`
+	var v codecValue
+	if err := c.Unmarshal([]byte(input), &v, jrpc2.DecodeOptions{}); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	} else if v.S != "ok" {
+		return fmt.Errorf("got %+v, want s=ok", v)
+	}
+	opts := jrpc2.DecodeOptions{DisallowUnknownFields: true}
+	if err := c.Unmarshal([]byte(input), &v, opts); err == nil {
+		return errors.New("with DisallowUnknownFields: unknown field was accepted")
+	}
+	if err := c.Unmarshal([]byte(`{"s":"ok"}`), &v, opts); err != nil {
+		return fmt.Errorf("with DisallowUnknownFields: %v", err)
+	}
+	return nil
+}
+
+// Invalid input and values of the wrong type are reported as errors.
+func checkInvalidJSON(c jrpc2.JSONCodec) error {
+	var v codecValue
+	for _, input := range []string{`{"s":`, `{"s":1}`, `[]`, `{"s":"a"} x`} {
+		if err := c.Unmarshal([]byte(input), &v, jrpc2.DecodeOptions{}); err == nil {
+			return fmt.Errorf("unmarshal %#q: got %+v, want error", input, v)
+		}
+	}
+	if bits, err := c.Marshal(make(chan int)); err == nil {
+		return fmt.Errorf("marshal chan: got %#q, want error", bits)
+	}
+	return nil
+}
+
+// mustStd returns the encoding of v by encoding/json, which must succeed.
+func mustStd(v interface{}) string {
+	bits, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(bits)
+}
@@ -0,0 +1,276 @@
+// Package conformance checks the wire behaviour of a JSON-RPC 2.0 server
+// against the examples given in the JSON-RPC 2.0 specification.
+//
+// The examples are listed in Spec. To check a server, start it with the
+// handlers returned by Methods, and call Check with a channel connected to it:
+//
+//    cli, srv := channel.Direct()
+//    s := jrpc2.NewServer(conformance.Methods(), nil).Start(srv)
+//    for _, err := range conformance.Check(cli) {
+//       log.Print(err)
+//    }
+//
+// Requests are sent as raw bytes, and responses are compared as raw bytes,
+// after normalization by Normalize.
+//
+// The CheckCodec function checks that a jrpc2.JSONCodec behaves as the jrpc2
+// package requires.
+//
+// See also: https://www.jsonrpc.org/specification#examples
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/handler"
+)
+
+// An Exchange is an example request and its expected response.
+type Exchange struct {
+	Name     string // a brief description of the example
+	Request  string // the request as sent
+	Response string // the expected response; "" if there is none
+}
+
+// Spec lists the example exchanges from the JSON-RPC 2.0 specification. The
+// requests and responses are copied verbatim from the specification.
+var Spec = []Exchange{
+	{"PositionalParams",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 1}`},
+	{"PositionalParamsReversed",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [23, 42], "id": 2}`,
+		`{"jsonrpc": "2.0", "result": -19, "id": 2}`},
+	{"NamedParams",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 3}`},
+	{"NamedParamsReordered",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": {"minuend": 42, "subtrahend": 23}, "id": 4}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 4}`},
+	{"Notification",
+		`{"jsonrpc": "2.0", "method": "update", "params": [1,2,3,4,5]}`, ""},
+	{"NotificationUnknownMethod",
+		`{"jsonrpc": "2.0", "method": "foobar"}`, ""},
+	{"NonexistentMethod",
+		`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "1"}`},
+	{"InvalidJSON",
+		`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+	{"InvalidRequest",
+		`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+	{"BatchInvalidJSON",
+		`[
+  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+  {"jsonrpc": "2.0", "method"
+]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+	{"EmptyBatch",
+		`[]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+	{"InvalidBatchOfOne",
+		`[1]`,
+		`[
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}
+]`},
+	{"InvalidBatch",
+		`[1,2,3]`,
+		`[
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}
+]`},
+	{"MixedBatch",
+		`[
+  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},
+  {"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},
+  {"foo": "boo"},
+  {"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"},
+  {"jsonrpc": "2.0", "method": "get_data", "id": "9"}
+]`,
+		`[
+  {"jsonrpc": "2.0", "result": 7, "id": "1"},
+  {"jsonrpc": "2.0", "result": 19, "id": "2"},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "5"},
+  {"jsonrpc": "2.0", "result": ["hello", 5], "id": "9"}
+]`},
+	{"NotificationBatch",
+		`[
+  {"jsonrpc": "2.0", "method": "notify_sum", "params": [1,2,4]},
+  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}
+]`, ""},
+}
+
+// Methods returns handlers for the methods used by the examples in Spec.
+func Methods() handler.Map {
+	return handler.Map{
+		"subtract": handler.Func(func(_ context.Context, req *jrpc2.Request) (interface{}, error) {
+			var named struct {
+				Minuend    int `json:"minuend"`
+				Subtrahend int `json:"subtrahend"`
+			}
+			var pos []int
+			if err := req.UnmarshalParams(&pos); err == nil && len(pos) == 2 {
+				return pos[0] - pos[1], nil
+			} else if err := req.UnmarshalParams(&named); err != nil {
+				return nil, err
+			}
+			return named.Minuend - named.Subtrahend, nil
+		}),
+		"sum": handler.New(func(_ context.Context, vs []int) int {
+			var sum int
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+		"get_data": handler.New(func(context.Context) []interface{} {
+			return []interface{}{"hello", 5}
+		}),
+		"update":       handler.New(func(context.Context, []int) error { return nil }),
+		"notify_hello": handler.New(func(context.Context, []int) error { return nil }),
+		"notify_sum":   handler.New(func(context.Context, []int) error { return nil }),
+	}
+}
+
+// probe is a call sent after each exchange whose expected response is empty,
+// so that the reply to the probe shows that the server sent nothing else.
+const (
+	probe      = `{"jsonrpc":"2.0","method":"subtract","params":[1,1],"id":"probe"}`
+	probeReply = `{"jsonrpc":"2.0","result":0,"id":"probe"}`
+)
+
+// Check sends the request of each exchange in Spec to the server at the other
+// end of ch, and compares the responses to those expected. It returns an
+// error for each exchange whose response differs, or nil if all match. If ch
+// fails, Check stops and reports the error.
+func Check(ch channel.Channel) []*Error {
+	var errs []*Error
+	for _, ex := range Spec {
+		if err := checkExchange(ch, ex); err != nil {
+			errs = append(errs, &Error{Name: ex.Name, Err: err})
+			if err == ErrChannel {
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// CheckCodec checks that c encodes and decodes values as the jrpc2 package
+// requires of a JSONCodec. It returns an error for each check that fails, or
+// nil if all pass.
+func CheckCodec(c jrpc2.JSONCodec) []*Error {
+	var errs []*Error
+	for _, cc := range codecChecks {
+		if err := cc.check(c); err != nil {
+			errs = append(errs, &Error{Name: cc.name, Err: err})
+		}
+	}
+	return errs
+}
+
+// ErrChannel is reported by Check if the channel fails.
+var ErrChannel = errors.New("channel failed")
+
+// An Error reports an exchange whose response did not match, from Check, or
+// a codec check that failed, from CheckCodec.
+type Error struct {
+	Name string // the name of the exchange or check that failed
+	Err  error  // the reason it failed
+}
+
+func (e *Error) Error() string { return e.Name + ": " + e.Err.Error() }
+
+// Unwrap supports error wrapping.
+func (e *Error) Unwrap() error { return e.Err }
+
+func checkExchange(ch channel.Channel, ex Exchange) error {
+	if err := ch.Send([]byte(ex.Request)); err != nil {
+		return ErrChannel
+	}
+	want := ex.Response
+	if want == "" {
+		// There should be no response. Send a probe, whose reply should be the
+		// next (and only) message received.
+		if err := ch.Send([]byte(probe)); err != nil {
+			return ErrChannel
+		}
+		want = probeReply
+	}
+	got, err := ch.Recv()
+	if err != nil {
+		return ErrChannel
+	}
+	ngot, err := Normalize(got)
+	if err != nil {
+		return fmt.Errorf("invalid response %#q: %v", got, err)
+	}
+	nwant, err := Normalize([]byte(want))
+	if err != nil {
+		return fmt.Errorf("invalid expected response %#q: %v", want, err)
+	}
+	if !bytes.Equal(ngot, nwant) {
+		return fmt.Errorf("got response %s, want %s", ngot, nwant)
+	}
+	return nil
+}
+
+// Normalize returns a normalized form of the JSON-RPC response message in
+// data, so that responses that differ only in ways permitted by the
+// specification have the same normal form. Specifically, insignificant
+// whitespace and the order of object keys are normalized, as is the order of
+// the responses in a batch, and the "message" and "data" fields of errors are
+// removed, since the specification leaves their contents to the server. The
+// framing of the response, as a single object or an array, is preserved.
+func Normalize(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	batch, ok := v.([]interface{})
+	if !ok {
+		return json.Marshal(normalizeResponse(v))
+	}
+	elts := make([]string, len(batch))
+	for i, rsp := range batch {
+		bits, err := json.Marshal(normalizeResponse(rsp))
+		if err != nil {
+			return nil, err
+		}
+		elts[i] = string(bits)
+	}
+	sort.Strings(elts)
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, elt := range elts {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(elt)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// normalizeResponse removes the message and data from an error response
+// object. The encoding/json package sorts the keys when v is re-encoded.
+func normalizeResponse(v interface{}) interface{} {
+	if obj, ok := v.(map[string]interface{}); ok {
+		if e, ok := obj["error"].(map[string]interface{}); ok {
+			delete(e, "message")
+			delete(e, "data")
+		}
+	}
+	return v
+}
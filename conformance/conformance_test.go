@@ -0,0 +1,86 @@
+package conformance
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// knownDeviations lists the examples for which the server intentionally
+// differs from the specification, and why.
+var knownDeviations = map[string]string{
+	"BatchInvalidJSON": "the server reports an error for each element decoded " +
+		"before a syntax error in a batch, followed by the parse error",
+}
+
+// Verify that the server conforms to the examples in the specification.
+func TestServer(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(Methods(), nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	for _, err := range Check(cli) {
+		if why, ok := knownDeviations[err.Name]; ok {
+			t.Logf("Known deviation: %v (%s)", err, why)
+		} else {
+			t.Error(err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`{"jsonrpc": "2.0", "result": 19, "id": 1}`, `{"id":1,"jsonrpc":"2.0","result":19}`},
+		{`{"id": null, "jsonrpc": "2.0", "error": {"message": "x", "code": -32600, "data": 1}}`,
+			`{"error":{"code":-32600},"id":null,"jsonrpc":"2.0"}`},
+		{`[{"id": 2, "result": 1}, {"id": 1, "result": 2}]`,
+			`[{"id":1,"result":2},{"id":2,"result":1}]`},
+		{`[{"id": 1, "result": 1}]`, `[{"id":1,"result":1}]`},
+	}
+	for _, test := range tests {
+		got, err := Normalize([]byte(test.input))
+		if err != nil {
+			t.Errorf("Normalize(%#q): unexpected error: %v", test.input, err)
+		} else if string(got) != test.want {
+			t.Errorf("Normalize(%#q): got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// lossyCodec is a JSONCodec that ignores its decoding options.
+type lossyCodec struct{}
+
+func (lossyCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (lossyCodec) Unmarshal(data []byte, v interface{}, _ jrpc2.DecodeOptions) error {
+	return json.Unmarshal(data, v)
+}
+
+// Verify that the standard codec passes the codec checks, and that a codec
+// that departs from the required behaviour does not.
+func TestCheckCodec(t *testing.T) {
+	for _, err := range CheckCodec(jrpc2.StdJSON) {
+		t.Errorf("StdJSON: %v", err)
+	}
+
+	var failed []string
+	for _, err := range CheckCodec(lossyCodec{}) {
+		t.Logf("lossyCodec: %v", err)
+		failed = append(failed, err.Name)
+	}
+	sort.Strings(failed)
+	if got, want := strings.Join(failed, ","), "UnknownFields,UseNumber"; got != want {
+		t.Errorf("lossyCodec: got failures %q, want %q", got, want)
+	}
+}
@@ -4,15 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sync"
+	"sync/atomic"
 
 	"github.com/creachadair/jrpc2/metrics"
 )
 
 // ServerMetrics returns the server metrics collector associated with the given
 // context, or nil if ctx does not have a collector attached.  The context
-// passed to a handler by *jrpc2.Server will include this value.
+// passed to a handler by *jrpc2.Server will include this value. Handlers may
+// use it to record their own metrics, which are reported along with those of
+// the server by its Metrics and ServerInfo methods.
 func ServerMetrics(ctx context.Context) *metrics.M {
-	return ctx.Value(serverKey{}).(*Server).metrics
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s.metrics
+	}
+	return nil
 }
 
 // InboundRequest returns the inbound request associated with the given
@@ -32,6 +39,46 @@ func InboundRequest(ctx context.Context) *Request {
 
 type inboundRequestKey struct{}
 
+// RawRequest returns a copy of the original encoding of the inbound request
+// associated with the given context, or nil if ctx does not have an inbound
+// request or the server did not retain it. For a request that was part of a
+// batch, the result is the encoding of that request alone.
+//
+// The server retains the original encoding of requests only if it was
+// constructed with the RetainRawRequest option set true.
+func RawRequest(ctx context.Context) []byte {
+	req := InboundRequest(ctx)
+	if req == nil || req.raw == nil {
+		return nil
+	}
+	return append([]byte(nil), req.raw...)
+}
+
+// ChannelMetadata returns the transport metadata reported by the channel for
+// the inbound request associated with the given context, or nil if ctx does
+// not have an inbound request or the channel did not report any metadata.
+// See channel.Metadata. Metadata attached to ctx by WithChannelMetadata take
+// precedence over those reported by the channel.
+func ChannelMetadata(ctx context.Context) interface{} {
+	if v := ctx.Value(channelMetadataKey{}); v != nil {
+		return v
+	}
+	if req := InboundRequest(ctx); req != nil {
+		return req.meta
+	}
+	return nil
+}
+
+type channelMetadataKey struct{}
+
+// WithChannelMetadata returns a copy of ctx in which meta replaces the
+// transport metadata reported by ChannelMetadata. This allows a DecodeContext
+// hook to recover the metadata of a transport whose requests were relayed to
+// the server by another client, as jhttp.DecodeContext does for a Bridge.
+func WithChannelMetadata(ctx context.Context, meta interface{}) context.Context {
+	return context.WithValue(ctx, channelMetadataKey{}, meta)
+}
+
 // PushNotify posts a server notification to the client. If ctx does not
 // contain a server notifier, this reports ErrPushUnsupported. The context
 // passed to the handler by *jrpc2.Server will support notifications if the
@@ -59,6 +106,38 @@ func PushCall(ctx context.Context, method string, params interface{}) (*Response
 	return s.Callback(ctx, method, params)
 }
 
+// PushProgress posts an "rpc.progress" notification to the client, reporting
+// the progress of the call whose context is ctx. The parameter of the
+// notification is a ProgressInfo carrying the ID of the call and the encoding
+// of value. Unless the server queues its pushes (see PushQueueSize in
+// ServerOptions), progress notifications are sent before the response to the
+// call.
+//
+// PushProgress reports ErrPushUnsupported if ctx does not support server
+// pushes (see PushNotify), ErrRequestDone if the call has completed or been
+// cancelled, and ErrConnClosed if the client connection is closed. It is an
+// error to report progress for a notification, since it has no ID.
+func PushProgress(ctx context.Context, value interface{}) error {
+	s, ok := ctx.Value(serverKey{}).(*Server)
+	if !ok || !s.allowP {
+		return ErrPushUnsupported
+	}
+	req := InboundRequest(ctx)
+	if req == nil || req.IsNotification() {
+		return errors.New("progress can only be reported for a call")
+	}
+	info := ProgressInfo{ID: json.RawMessage(req.ID())}
+	if value != nil {
+		bits, err := s.jcodec.Marshal(value)
+		if err != nil {
+			return err
+		}
+		info.Value = bits
+	}
+	_, err := s.pushReq(ctx, ctx, false /* no ID */, rpcProgress, info)
+	return err
+}
+
 // CancelRequest requests the server associated with ctx to cancel the pending
 // or in-flight request with the specified ID.  If no request exists with that
 // ID, this is a no-op without error.
@@ -67,8 +146,142 @@ func CancelRequest(ctx context.Context, id string) {
 	s.cancelRequests(ctx, []json.RawMessage{json.RawMessage(id)})
 }
 
+// ServerFromContext returns the server associated with the given context, or
+// nil if ctx does not have a server attached. The context passed to a handler
+// by *jrpc2.Server will include this value. This allows a handler to reach
+// the server, for example to post notifications reporting the progress of a
+// long-running method with the Notify method of the server.
+func ServerFromContext(ctx context.Context) *Server {
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s
+	}
+	return nil
+}
+
 type serverKey struct{}
 
 // ErrPushUnsupported is returned by PushNotify and PushCall if server pushes
 // are not enabled in the specified context.
 var ErrPushUnsupported = errors.New("server push is not enabled")
+
+// BatchContext returns the context shared by all the requests in the batch
+// containing the request whose context is ctx, or nil if ctx does not belong
+// to a batch. The context passed to a handler by *jrpc2.Server includes this
+// value. A request that is not part of a batch is treated as a batch of one.
+//
+// The batch context is cancelled once all the requests in the batch have
+// completed, and any completion hooks registered with BatchValue have run.
+func BatchContext(ctx context.Context) context.Context {
+	if b := batchFromContext(ctx); b != nil {
+		return b.ctx
+	}
+	return nil
+}
+
+// BatchValue returns the value associated with key in the batch containing the
+// request whose context is ctx. If no value is yet associated with key, init
+// is called with the batch context to create one. The value is shared by all
+// the handlers in the batch, and init is called at most once for each key.
+// Other callers for the same key wait until init returns. The init function
+// may itself call BatchValue for other keys, but not for its own key.
+//
+// If init returns a non-nil done function, it is called exactly once after the
+// last request in the batch has completed, and before the responses are sent
+// to the client. Its argument reports whether any request in the batch failed.
+// Done functions run in the reverse of the order in which they were created.
+//
+// If ctx does not belong to a batch, BatchValue calls init and returns the
+// value it reports without registering the done function.
+func BatchValue(ctx context.Context, key interface{}, init func(context.Context) (value interface{}, done func(failed bool))) interface{} {
+	b := batchFromContext(ctx)
+	if b == nil {
+		v, _ := init(ctx)
+		return v
+	}
+	return b.value(key, init)
+}
+
+type batchKey struct{}
+
+func batchFromContext(ctx context.Context) *batch {
+	if v := ctx.Value(batchKey{}); v != nil {
+		return v.(*batch)
+	}
+	return nil
+}
+
+// A batch carries state shared by the requests of a single inbound batch.
+type batch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	failed int32 // set to 1 (atomically) if any request failed
+
+	mu   sync.Mutex
+	vals map[interface{}]*batchValue
+	done []func(bool)
+}
+
+// A batchValue is the value associated with a key in a batch. It is
+// initialized without holding the lock of the batch, so that an init function
+// may look up other keys.
+type batchValue struct {
+	once sync.Once
+	v    interface{}
+}
+
+func newBatch(base context.Context) *batch {
+	ctx, cancel := context.WithCancel(base)
+	b := &batch{cancel: cancel}
+	b.ctx = context.WithValue(ctx, batchKey{}, b)
+	return b
+}
+
+func (b *batch) value(key interface{}, init func(context.Context) (interface{}, func(bool))) interface{} {
+	b.mu.Lock()
+	bv, ok := b.vals[key]
+	if !ok {
+		if b.vals == nil {
+			b.vals = make(map[interface{}]*batchValue)
+		}
+		bv = new(batchValue)
+		b.vals[key] = bv
+	}
+	b.mu.Unlock()
+
+	bv.once.Do(func() {
+		v, done := init(b.ctx)
+		bv.v = v
+		if done != nil {
+			b.mu.Lock()
+			b.done = append(b.done, done)
+			b.mu.Unlock()
+		}
+	})
+	return bv.v
+}
+
+// fail records that a request in the batch failed.
+func (b *batch) fail() { atomic.StoreInt32(&b.failed, 1) }
+
+// finish runs the completion hooks for b and cancels its context.
+func (b *batch) finish() {
+	defer b.cancel()
+	failed := atomic.LoadInt32(&b.failed) != 0
+	b.mu.Lock()
+	done := b.done
+	b.done = nil
+	b.mu.Unlock()
+	for i := len(done) - 1; i >= 0; i-- {
+		done[i](failed)
+	}
+}
+
+// CorrelationID returns the correlation ID assigned by the server to the
+// inbound request associated with the given context, or "" if ctx does not
+// have an inbound request. See Request.CorrelationID.
+func CorrelationID(ctx context.Context) string {
+	if req := InboundRequest(ctx); req != nil {
+		return req.cid
+	}
+	return ""
+}
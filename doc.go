@@ -113,7 +113,14 @@ To decode the result from a successful response use its UnmarshalResult method:
       log.Fatalln("UnmarshalResult:", err)
    }
 
-To close a client and discard all its pending work, call cli.Close().
+To close a client and discard all its pending work, call cli.Close(). Calls
+pending when the client's connection ends, whether by Close or by the server,
+fail with an error that wraps jrpc2.ErrConnTerminated, as do calls made after
+that:
+
+   if errors.Is(err, jrpc2.ErrConnTerminated) {
+      // the call was not answered; it may be retried on a new connection
+   }
 
 
 Notifications
@@ -149,7 +156,35 @@ handler whose ID is named.
 When the context associated with a client request is cancelled, the client
 sends an "rpc.cancel" notification to the server for that request's ID.  The
 "rpc.cancel" method is automatically handled (unless disabled) by the
-*jrpc2.Server implementation from this package.
+*jrpc2.Server implementation from this package. The server acts on it as soon
+as it is received, without waiting for the concurrency limit, since the
+requests it cancels may be holding all the slots.
+
+A handler that fails because its context ended, by returning ctx.Err() or an
+error that wraps it, is reported to the client with code.Cancelled or
+code.DeadlineExceeded, so the client can tell a cancellation or timeout apart
+from other failures of the server. The message of the original error is kept.
+The client reports these codes as context.Canceled and
+context.DeadlineExceeded, which code.FromError maps back to the codes. Thus,
+for example, a client may choose to retry a call whose deadline was exceeded,
+but not one that was cancelled.
+
+
+Graceful Shutdown
+
+A server that is about to go away, for example to be redeployed, may call its
+Shutdown method rather than Stop. The server finishes the requests it has
+already received, and then closes the connection. Calls that arrive in the
+meantime fail with code.ShuttingDown, with a ShutdownInfo as the error data,
+and notifications are discarded.
+
+The AnnounceShutdown method does the same with a grace period, but it first
+sends a non-standard "rpc.shutdown" notification to the client, with the grace
+period and a reason. A client reports the announcement to the OnShutdown
+callback of its ClientOptions, and treats the closing of the connection that
+follows as expected rather than as an error. A client that can reconnect (see
+the Redial client option) waits for the grace period before it redials, so
+that the clients of a restarting server do not all retry at once.
 
 
 Services with Multiple Methods
@@ -210,11 +245,17 @@ By default, a *jrpc2.Server exports the following built-in non-standard
 extension methods:
 
   rpc.serverInfo(null) ⇒ jrpc2.ServerInfo
-  Returns a jrpc2.ServerInfo value giving server metrics.
+  Returns a jrpc2.ServerInfo value giving server metrics, including the start
+  time, the methods exported, and counts of requests, responses, and errors by
+  code.
 
   rpc.cancel([]int)  [notification]
   Request cancellation of the specified in-flight request IDs.
 
+  rpc.ping(null) ⇒ null
+  Does nothing. A client calls it to check that the server is responsive
+  (see the KeepAlive client option).
+
 The rpc.cancel method works only as a notification, and will report an error if
 called as an ordinary method.
 
@@ -240,6 +281,12 @@ client. Otherwise, those methods will report an error:
 A method handler may use jrpc2.PushNotify and jrpc2.PushCall functions to
 access these methods from its context.
 
+A handler for a long-running call may also report its progress with the
+jrpc2.PushProgress function, which sends an "rpc.progress" notification
+whose parameter is a jrpc2.ProgressInfo carrying the ID of the call. Unless
+the server queues its pushes, the client receives these notifications before
+the response to the call.
+
 On the client side, the OnNotify and OnCallback options in jrpc2.ClientOptions
 provide hooks to which any server requests are delivered, if they are set.
 */
@@ -13,6 +13,7 @@ type Error struct {
 	message string
 	code    code.Code
 	data    json.RawMessage
+	err     error // the underlying error, if reported by the client
 }
 
 // Error renders e to a human-readable string for the error interface.
@@ -24,6 +25,15 @@ func (e Error) Code() code.Code { return e.code }
 // Message returns the message string associated with e.
 func (e Error) Message() string { return e.message }
 
+// Data returns the raw JSON error data associated with e, or nil if e has no
+// error data attached.
+func (e Error) Data() json.RawMessage { return e.data }
+
+// Unwrap returns the error underlying e, if e was reported by the client
+// rather than the server. For example, a call that failed because the client's
+// connection ended has an error that wraps ErrConnTerminated.
+func (e Error) Unwrap() error { return e.err }
+
 // HasData reports whether e has error data to unmarshal.
 func (e Error) HasData() bool { return len(e.data) != 0 }
 
@@ -53,6 +63,20 @@ func (e *Error) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// asError converts a non-nil error reported by a handler into an *Error.  If
+// err is or wraps an *Error, that value is used as given. Otherwise the code is
+// chosen by code.FromError, so that errors implementing code.Coder report their
+// own code, and the message is the text of err.
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	} else if c := code.FromError(err); c != code.NoError {
+		return &Error{code: c, message: err.Error()}
+	}
+	return &Error{code: code.InternalError, message: err.Error()}
+}
+
 // ErrNoData indicates that there are no data to unmarshal.
 var ErrNoData = errors.New("no data to unmarshal")
 
@@ -64,10 +88,36 @@ var errServerStopped = errors.New("the server has been stopped")
 // explicit call to its Close method.
 var errClientStopped = errors.New("the client has been stopped")
 
+// errHelloReserved is the error reported by a client for a call to the
+// rpc.hello method other than through RPCHello.
+var errHelloReserved = errors.New("rpc.hello may be called only through RPCHello")
+
+// errServerShutdown is the error reported when a client's connection is closed
+// by a server that announced its shutdown.
+var errServerShutdown = errors.New("the server has shut down")
+
 // ErrConnClosed is returned by a server's push-to-client methods if they are
 // called after the client connection is closed.
 var ErrConnClosed = errors.New("client connection is closed")
 
+// ErrConnTerminated is reported by a client for a call that was pending when
+// its connection to the server ended, and for calls and notifications made
+// after that. The errors reported wrap ErrConnTerminated with the reason the
+// connection ended, so callers should check for it using errors.Is.
+var ErrConnTerminated = errors.New("connection to server terminated")
+
+// ErrTooManyPending is reported by a client for a call that would exceed its
+// limit on pending calls (see ClientOptions.MaxPending).
+var ErrTooManyPending = errors.New("too many pending calls")
+
+// ErrRequestDone is returned by PushProgress if the request it reports on has
+// completed or been cancelled.
+var ErrRequestDone = errors.New("request is no longer in flight")
+
+// ErrIdleTimeout is returned by Server.Wait if the server stopped because the
+// client connection was idle for longer than ServerOptions.IdleTimeout.
+var ErrIdleTimeout = errors.New("client connection is idle")
+
 // Errorf returns an error value of concrete type *Error having the specified
 // code and formatted message string.
 // It is shorthand for DataErrorf(code, nil, msg, args...)
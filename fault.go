@@ -0,0 +1,153 @@
+package jrpc2
+
+import (
+	"errors"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// A FaultKind identifies the kind of fault injected by a FaultPolicy.
+type FaultKind int
+
+// Kinds of fault supported by a FaultPolicy.
+const (
+	FaultDelay      FaultKind = iota + 1 // delay the request before its handler runs
+	FaultError                           // fail the request without running its handler
+	FaultDrop                            // run the handler, but discard the response
+	FaultDisconnect                      // terminate the connection to the client
+)
+
+var faultKindName = map[FaultKind]string{
+	FaultDelay:      "delay",
+	FaultError:      "error",
+	FaultDrop:       "drop",
+	FaultDisconnect: "disconnect",
+}
+
+func (k FaultKind) String() string {
+	if s, ok := faultKindName[k]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// A Fault describes a fault to inject into the handling of a request.
+type Fault struct {
+	Kind FaultKind
+
+	// For FaultDelay, the request is delayed by Delay plus a random duration
+	// in [0, Jitter).
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// For FaultError, the request fails with this code and message. If Code
+	// is zero, code.SystemError is used; if Message is empty, a default
+	// message is used.
+	Code    code.Code
+	Message string
+}
+
+func (f *Fault) delay() time.Duration {
+	d := f.Delay
+	if f.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	return d
+}
+
+func (f *Fault) err() error {
+	c, msg := f.Code, f.Message
+	if c == 0 {
+		c = code.SystemError
+	}
+	if msg == "" {
+		msg = "injected fault"
+	}
+	return &Error{code: c, message: msg}
+}
+
+// A FaultRule describes a fault to inject into requests for methods matching
+// a pattern, with a given probability.
+type FaultRule struct {
+	// The method names to which the rule applies, as a path.Match pattern.
+	// An empty pattern matches all methods.
+	Method string
+
+	// The probability, between 0 and 1, that the fault is injected into a
+	// matching request.
+	Probability float64
+
+	Fault Fault
+}
+
+func (r FaultRule) matches(method string) bool {
+	if r.Method == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Method, method)
+	return ok
+}
+
+// A FaultPolicy describes faults for a server to inject into the requests it
+// handles, for testing how clients respond to a misbehaving server. Set the
+// policy in the Faults field of the ServerOptions. The rules of a policy may
+// be changed while the server is running. A FaultPolicy is safe for
+// concurrent use by multiple goroutines.
+//
+// The server logs and counts each fault it injects. The "rpc.faultsInjected"
+// metric counts all faults, and "rpc.faultsInjected.<kind>" counts the faults
+// of each kind.
+type FaultPolicy struct {
+	mu    sync.RWMutex
+	rules []FaultRule
+}
+
+// NewFaultPolicy constructs a FaultPolicy with the given rules.
+func NewFaultPolicy(rules ...FaultRule) *FaultPolicy {
+	p := new(FaultPolicy)
+	p.SetRules(rules...)
+	return p
+}
+
+// SetRules replaces the rules of p. The rules are consulted in order for each
+// request, and the first matching rule whose probability is satisfied selects
+// the fault for the request. Calling SetRules with no rules disables fault
+// injection.
+func (p *FaultPolicy) SetRules(rules ...FaultRule) {
+	cp := append([]FaultRule(nil), rules...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = cp
+}
+
+// Rules returns a copy of the current rules of p.
+func (p *FaultPolicy) Rules() []FaultRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]FaultRule(nil), p.rules...)
+}
+
+// choose returns the fault to inject into a request for the given method, or
+// nil if there is none. It is safe to call choose on a nil *FaultPolicy.
+func (p *FaultPolicy) choose(method string) *Fault {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.rules {
+		if r.matches(method) && rand.Float64() < r.Probability {
+			f := r.Fault
+			return &f
+		}
+	}
+	return nil
+}
+
+// errFaultDisconnect is the error recorded by a server whose connection was
+// terminated by an injected fault.
+var errFaultDisconnect = errors.New("connection terminated by injected fault")
@@ -3,11 +3,14 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	"bitbucket.org/creachadair/stringset"
@@ -33,6 +36,21 @@ func (m Map) Assign(_ context.Context, method string) jrpc2.Handler { return m[m
 // Names implements part of the jrpc2.Assigner interface.
 func (m Map) Names() []string { return stringset.FromKeys(m).Elements() }
 
+// Deprecations implements part of the jrpc2.DeprecationNamer interface. It
+// reports the methods of m whose handlers implement jrpc2.DeprecatedHandler.
+func (m Map) Deprecations() map[string]string {
+	var deps map[string]string
+	for name, h := range m {
+		if d, ok := h.(jrpc2.DeprecatedHandler); ok {
+			if deps == nil {
+				deps = make(map[string]string)
+			}
+			deps[name] = d.Deprecated()
+		}
+	}
+	return deps
+}
+
 // A ServiceMap combines multiple assigners into one, permitting a server to
 // export multiple services under different names.
 //
@@ -70,6 +88,143 @@ func (m ServiceMap) Names() []string {
 	return all.Elements()
 }
 
+// Deprecations implements part of the jrpc2.DeprecationNamer interface. It
+// reports the deprecated methods of each service whose assigner implements
+// jrpc2.DeprecationNamer, named Service.Method.
+func (m ServiceMap) Deprecations() map[string]string {
+	var deps map[string]string
+	for svc, assigner := range m {
+		d, ok := assigner.(jrpc2.DeprecationNamer)
+		if !ok {
+			continue
+		}
+		for name, note := range d.Deprecations() {
+			if deps == nil {
+				deps = make(map[string]string)
+			}
+			deps[svc+"."+name] = note
+		}
+	}
+	return deps
+}
+
+// Deprecated returns a jrpc2.Handler that delegates to h, and marks its method
+// as deprecated with the given note. The result implements the
+// jrpc2.DeprecatedHandler interface. For example:
+//
+//    m := handler.Map{
+//      "Add":    handler.New(Add),
+//      "OldAdd": handler.Deprecated(handler.New(Add), "use Add instead"),
+//    }
+//
+func Deprecated(h jrpc2.Handler, note string) jrpc2.Handler {
+	return deprecated{Handler: h, note: note}
+}
+
+type deprecated struct {
+	jrpc2.Handler
+	note string
+}
+
+// Deprecated implements part of the jrpc2.DeprecatedHandler interface.
+func (d deprecated) Deprecated() string { return d.note }
+
+// Alias returns a jrpc2.Assigner that delegates to next, but also accepts
+// alternative names for some of its methods. Each key of aliases is an
+// alternative name for the method named by its value. Aliases may be chained,
+// so that if a is an alias for b and b is an alias for c, then a refers to c.
+// Alias reports an error if the aliases contain a cycle.
+//
+// An alias takes precedence over a method of next having the same name.
+//
+// The handler assigned for an alias is marked as deprecated (see Deprecated),
+// so that the server counts calls to it, reports it in its ServerInfo, and
+// passes it to the OnDeprecatedCall hook if one is set. The Names method of
+// the resulting assigner includes the names of aliases whose target is
+// among the names of next.
+func Alias(next jrpc2.Assigner, aliases map[string]string) (jrpc2.Assigner, error) {
+	canon := make(map[string]string)
+	for name := range aliases {
+		seen := stringset.New(name)
+		target := aliases[name]
+		for {
+			if seen.Contains(target) {
+				return nil, fmt.Errorf("alias %q has a cycle through %q", name, target)
+			}
+			seen.Add(target)
+			t, ok := aliases[target]
+			if !ok {
+				break
+			}
+			target = t
+		}
+		canon[name] = target
+	}
+	return aliasMap{next: next, canon: canon}, nil
+}
+
+type aliasMap struct {
+	next  jrpc2.Assigner
+	canon map[string]string // alias → canonical name
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (a aliasMap) Assign(ctx context.Context, method string) jrpc2.Handler {
+	target, ok := a.canon[method]
+	if !ok {
+		return a.next.Assign(ctx, method)
+	}
+	h := a.next.Assign(ctx, target)
+	if h == nil {
+		return nil
+	}
+	var inner string
+	if d, ok := h.(jrpc2.DeprecatedHandler); ok {
+		inner = d.Deprecated()
+	}
+	return Deprecated(h, aliasNote(target, inner))
+}
+
+// aliasNote returns the deprecation note for an alias of target, whose own
+// deprecation note (if any) is inner.
+func aliasNote(target, inner string) string {
+	note := fmt.Sprintf("alias for %q", target)
+	if inner != "" {
+		note += "; " + inner
+	}
+	return note
+}
+
+// Names implements part of the jrpc2.Assigner interface.
+func (a aliasMap) Names() []string {
+	names := stringset.New(a.next.Names()...)
+	for alias, target := range a.canon {
+		if names.Contains(target) {
+			names.Add(alias)
+		}
+	}
+	return names.Elements()
+}
+
+// Deprecations implements part of the jrpc2.DeprecationNamer interface. It
+// reports the aliases included by Names, along with the deprecated methods of
+// next if it implements jrpc2.DeprecationNamer.
+func (a aliasMap) Deprecations() map[string]string {
+	deps := make(map[string]string)
+	if d, ok := a.next.(jrpc2.DeprecationNamer); ok {
+		for name, note := range d.Deprecations() {
+			deps[name] = note
+		}
+	}
+	names := stringset.New(a.next.Names()...)
+	for alias, target := range a.canon {
+		if names.Contains(target) {
+			deps[alias] = aliasNote(target, deps[target])
+		}
+	}
+	return deps
+}
+
 // New adapts a function to a jrpc2.Handler. The concrete value of fn must be a
 // function with one of the following type signatures:
 //
@@ -257,9 +412,16 @@ func checkFunctionType(fn interface{}) (reflect.Type, error) {
 // corresponding v[i] succeeds.  As a special case, if v[i] == nil the
 // corresponding value is discarded.
 //
+// Trailing elements of v may be wrapped with Optional, in which case the array
+// may omit the corresponding values, and the final element of v may be wrapped
+// with Rest, in which case any values beyond the others are unmarshaled into
+// it as an array. Unmarshaling fails if the JSON encodes an object, since
+// named parameters should be decoded into a struct or an Obj instead.
+//
 // Marshaling an Args value v into JSON succeeds if each element of the slice
 // is JSON marshalable, and yields a JSON array of length len(v) containing the
-// JSON values corresponding to the elements of v.
+// JSON values corresponding to the elements of v. Optional and Rest affect
+// only unmarshaling.
 //
 // Usage example:
 //
@@ -277,22 +439,180 @@ type Args []interface{}
 
 // UnmarshalJSON supports JSON unmarshaling for a.
 func (a Args) UnmarshalJSON(data []byte) error {
+	min, max, err := a.arity()
+	if err != nil {
+		return err
+	}
 	var elts []json.RawMessage
 	if err := json.Unmarshal(data, &elts); err != nil {
+		if isObject(data) {
+			return errWantPositional
+		}
 		return fmt.Errorf("decoding args: %w", err)
-	} else if len(elts) != len(a) {
-		return fmt.Errorf("wrong number of args (got %d, want %d)", len(elts), len(a))
+	} else if len(elts) < min || (max >= 0 && len(elts) > max) {
+		return fmt.Errorf("wrong number of args (got %d, want %s)", len(elts), wantArgs(min, max))
 	}
-	for i, elt := range elts {
-		if a[i] == nil {
+	for i, arg := range a {
+		switch t := arg.(type) {
+		case nil:
 			continue
-		} else if err := json.Unmarshal(elt, a[i]); err != nil {
-			return fmt.Errorf("decoding argument %d: %w", i+1, err)
+		case rest:
+			if t.v == nil {
+				return nil // discard the remaining arguments
+			}
+			var extra []json.RawMessage
+			if i < len(elts) {
+				extra = elts[i:]
+			}
+			if err := json.Unmarshal(joinArray(extra), t.v); err != nil {
+				return decodeError(fmt.Sprintf("arguments %d and after", i+1), t.v, err)
+			}
+			return nil
+		case optional:
+			arg = t.v
+		}
+		if i >= len(elts) {
+			continue // an omitted optional argument
+		} else if arg == nil {
+			continue // discard this argument
+		} else if err := json.Unmarshal(elts[i], arg); err != nil {
+			return decodeError(fmt.Sprintf("argument %d", i+1), arg, err)
+		}
+	}
+	return nil
+}
+
+// arity reports the minimum and maximum number of values accepted by a, where
+// max < 0 means there is no maximum. It reports an error if the Optional and
+// Rest wrappers in a are misplaced.
+func (a Args) arity() (min, max int, _ error) {
+	max = len(a)
+	for i, arg := range a {
+		switch arg.(type) {
+		case optional:
+		case rest:
+			if i != len(a)-1 {
+				return 0, 0, fmt.Errorf("argument %d: Rest must be the last argument", i+1)
+			}
+			max = -1
+		default:
+			if min != i {
+				return 0, 0, fmt.Errorf("argument %d: required argument follows an optional one", i+1)
+			}
+			min = i + 1
 		}
 	}
+	return min, max, nil
+}
+
+func wantArgs(min, max int) string {
+	if min == max {
+		return strconv.Itoa(min)
+	} else if max < 0 {
+		return fmt.Sprintf("at least %d", min)
+	}
+	return fmt.Sprintf("%d to %d", min, max)
+}
+
+// Optional wraps v, a location for an element of an Args value or a field of
+// an UnmarshalObj call, to mark the corresponding argument as optional. If the
+// argument is omitted, v is not modified. Only trailing elements of an Args
+// value may be optional.
+func Optional(v interface{}) interface{} { return optional{v} }
+
+type optional struct{ v interface{} }
+
+// MarshalJSON supports JSON marshaling of an optional value.
+func (o optional) MarshalJSON() ([]byte, error) { return json.Marshal(o.v) }
+
+// Rest wraps v, a pointer to a slice, to mark it as the final location of an
+// Args value. Any arguments not consumed by the other locations are decoded
+// into v as an array, which is empty if there are none.
+func Rest(v interface{}) interface{} { return rest{v} }
+
+type rest struct{ v interface{} }
+
+// MarshalJSON supports JSON marshaling of a rest value.
+func (r rest) MarshalJSON() ([]byte, error) { return json.Marshal(r.v) }
+
+// UnmarshalArgs decodes the positional parameters of req into the given
+// locations, as if by unmarshaling them into Args(targets). A request without
+// parameters is treated as an empty array. If decoding fails, UnmarshalArgs
+// reports an error with code.InvalidParams, suitable for a handler to return
+// to the caller.
+//
+// Usage example:
+//
+//    func Handler(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+//       var name string
+//       var count int
+//       var tags []string
+//
+//       err := handler.UnmarshalArgs(req, &name, handler.Optional(&count), handler.Rest(&tags))
+//       if err != nil {
+//          return nil, err
+//       }
+//       // do useful work with name, count, and tags
+//    }
+//
+func UnmarshalArgs(req *jrpc2.Request, targets ...interface{}) error {
+	params := json.RawMessage(req.ParamString())
+	if len(params) == 0 {
+		params = json.RawMessage("[]")
+	}
+	if err := Args(targets).UnmarshalJSON(params); err != nil {
+		return jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+	}
 	return nil
 }
 
+var (
+	errWantPositional = errors.New("got named parameters, want positional parameters (use a struct or handler.Obj)")
+	errWantNamed      = errors.New("got positional parameters, want named parameters (use handler.Args)")
+)
+
+// decodeError reports an error decoding the parameter described by what into
+// the location v.
+func decodeError(what string, v interface{}, err error) error {
+	return fmt.Errorf("decoding %s (%s): %w", what, targetType(v), err)
+}
+
+// isObject reports whether data encodes a JSON object.
+func isObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) != 0 && data[0] == '{'
+}
+
+// isArray reports whether data encodes a JSON array.
+func isArray(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) != 0 && data[0] == '['
+}
+
+// joinArray encodes elts as a JSON array.
+func joinArray(elts []json.RawMessage) []byte {
+	buf := []byte{'['}
+	for i, elt := range elts {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, elt...)
+	}
+	return append(buf, ']')
+}
+
+// targetType returns the name of the type a location v decodes, for use in
+// error messages.
+func targetType(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return "nil"
+	} else if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
 // MarshalJSON supports JSON marshaling for a.
 func (a Args) MarshalJSON() ([]byte, error) {
 	if len(a) == 0 {
@@ -305,23 +625,87 @@ func (a Args) MarshalJSON() ([]byte, error) {
 //
 // Unmarshaling a JSON text into an Obj value v succeeds if the JSON encodes an
 // object, and unmarshaling the value for each key k of the object into v[k]
-// succeeds. If k does not exist in v, it is ignored.
+// succeeds. If k does not exist in v, it is ignored. If v[k] == nil, the value
+// is discarded. A location wrapped with Optional is treated as the location
+// itself, since every field of an Obj is optional.
 //
 // Marshaling an Obj into JSON works as for an ordinary map.
 type Obj map[string]interface{}
 
 // UnmarshalJSON supports JSON unmarshaling into o.
-func (o Obj) UnmarshalJSON(data []byte) error {
+func (o Obj) UnmarshalJSON(data []byte) error { return decodeObj(data, o, false) }
+
+// UnmarshalObj decodes the named parameters of req into the given locations,
+// mapped by field name. Each field must be present in the parameters unless
+// its location is wrapped with Optional. Fields not named in fields are
+// ignored, regardless of whether the server enforces strict field checking.
+// A *json.RawMessage location captures the encoding of its field as-is. A
+// null value leaves its location unmodified, except for *json.RawMessage.
+// If decoding fails, UnmarshalObj reports an error with code.InvalidParams,
+// suitable for a handler to return to the caller.
+//
+// Usage example:
+//
+//    func Handler(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+//       var name string
+//       var opts json.RawMessage
+//
+//       err := handler.UnmarshalObj(req, map[string]interface{}{
+//          "name":    &name,
+//          "options": handler.Optional(&opts),
+//       })
+//       if err != nil {
+//          return nil, err
+//       }
+//       // do useful work with name and opts
+//    }
+//
+func UnmarshalObj(req *jrpc2.Request, fields map[string]interface{}) error {
+	params := json.RawMessage(req.ParamString())
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+	if err := decodeObj(params, fields, true); err != nil {
+		return jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+	}
+	return nil
+}
+
+// decodeObj decodes the JSON object in data into the locations in fields. If
+// required is true, fields whose locations are not wrapped with Optional must
+// be present.
+func decodeObj(data []byte, fields map[string]interface{}, required bool) error {
 	var base map[string]json.RawMessage
 	if err := json.Unmarshal(data, &base); err != nil {
+		if isArray(data) {
+			return errWantNamed
+		}
 		return fmt.Errorf("decoding object: %v", err)
 	}
-	for key, val := range base {
-		arg, ok := o[key]
+
+	// Visit the fields in a fixed order, so that the error reported for a
+	// value with multiple problems does not vary.
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		arg := fields[key]
+		opt, isOpt := arg.(optional)
+		if isOpt {
+			arg = opt.v
+		}
+		val, ok := base[key]
 		if !ok {
+			if required && !isOpt {
+				return fmt.Errorf("missing required field %q", key)
+			}
+			continue
+		} else if arg == nil {
 			continue
 		} else if err := json.Unmarshal(val, arg); err != nil {
-			return fmt.Errorf("decoding %q: %v", key, err)
+			return decodeError(fmt.Sprintf("field %q", key), arg, err)
 		}
 	}
 	return nil
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/code"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -190,6 +191,106 @@ func TestArgs(t *testing.T) {
 	}
 }
 
+// Verify that optional and rest arguments, and the UnmarshalArgs helper, work.
+func TestUnmarshalArgs(t *testing.T) {
+	type stuff struct {
+		S    string
+		Z    int
+		Rest []int
+	}
+	var tmp stuff
+	tests := []struct {
+		params string
+		args   []interface{}
+		want   stuff
+		errtxt string // if nonempty, the expected error contains this
+	}{
+		// No parameters are equivalent to an empty array.
+		{``, nil, stuff{}, ""},
+		{``, []interface{}{Optional(&tmp.S)}, stuff{}, ""},
+		{``, []interface{}{&tmp.S}, stuff{}, "got 0, want 1"},
+		{`[]`, []interface{}{Rest(&tmp.Rest)}, stuff{Rest: []int{}}, ""},
+
+		// Optional trailing arguments.
+		{`["a"]`, []interface{}{&tmp.S, Optional(&tmp.Z)}, stuff{S: "a"}, ""},
+		{`["a", 2]`, []interface{}{&tmp.S, Optional(&tmp.Z)}, stuff{S: "a", Z: 2}, ""},
+		{`["a", 2, 3]`, []interface{}{&tmp.S, Optional(&tmp.Z)}, stuff{}, "got 3, want 1 to 2"},
+		{`[]`, []interface{}{&tmp.S, Optional(&tmp.Z)}, stuff{}, "got 0, want 1 to 2"},
+
+		// Rest absorbs the remaining arguments, if any.
+		{`["a"]`, []interface{}{&tmp.S, Optional(&tmp.Z), Rest(&tmp.Rest)},
+			stuff{S: "a", Rest: []int{}}, ""},
+		{`["a", 1, 2, 3]`, []interface{}{&tmp.S, Optional(&tmp.Z), Rest(&tmp.Rest)},
+			stuff{S: "a", Z: 1, Rest: []int{2, 3}}, ""},
+		{`[]`, []interface{}{&tmp.S, Rest(&tmp.Rest)}, stuff{}, "got 0, want at least 1"},
+		{`["a", 1, "b"]`, []interface{}{&tmp.S, Rest(&tmp.Rest)}, stuff{},
+			"arguments 2 and after ([]int)"},
+
+		// Nil locations discard their values, even if wrapped.
+		{`["a", 1]`, []interface{}{&tmp.S, nil}, stuff{S: "a"}, ""},
+		{`["a", 1]`, []interface{}{&tmp.S, Optional(nil)}, stuff{S: "a"}, ""},
+		{`["a"]`, []interface{}{&tmp.S, Optional(nil)}, stuff{S: "a"}, ""},
+		{`["a", 1, "b"]`, []interface{}{&tmp.S, Rest(nil)}, stuff{S: "a"}, ""},
+		{`["a", 1, "b"]`, []interface{}{&tmp.S, Optional(nil), Rest(nil)}, stuff{S: "a"}, ""},
+
+		// Null values leave their targets unmodified.
+		{`[null, null]`, []interface{}{&tmp.S, Optional(&tmp.Z)}, stuff{}, ""},
+
+		// Type errors report the argument position and type.
+		{`["a", "b"]`, []interface{}{&tmp.S, &tmp.Z}, stuff{}, "argument 2 (int)"},
+		{`[1]`, []interface{}{Optional(&tmp.S)}, stuff{}, "argument 1 (string)"},
+
+		// Named parameters are not accepted.
+		{`{"s": "a"}`, []interface{}{&tmp.S}, stuff{}, "want positional parameters"},
+
+		// Misplaced wrappers.
+		{`["a", 1]`, []interface{}{Optional(&tmp.S), &tmp.Z}, stuff{}, "follows an optional"},
+		{`[[1], "a"]`, []interface{}{Rest(&tmp.Rest), &tmp.S}, stuff{}, "must be the last"},
+	}
+	for _, test := range tests {
+		tmp = stuff{} // reset
+		msg := `{"jsonrpc":"2.0","id":1,"method":"X"}`
+		if test.params != "" {
+			msg = `{"jsonrpc":"2.0","id":1,"method":"X","params":` + test.params + `}`
+		}
+		reqs, err := jrpc2.ParseRequests([]byte(msg))
+		if err != nil {
+			t.Fatalf("ParseRequests %#q: %v", msg, err)
+		}
+		err = UnmarshalArgs(reqs[0], test.args...)
+		if test.errtxt != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errtxt) {
+				t.Errorf("UnmarshalArgs %#q: got error %v, want %q", test.params, err, test.errtxt)
+			} else if c := code.FromError(err); c != code.InvalidParams {
+				t.Errorf("UnmarshalArgs %#q: got code %v, want %v", test.params, c, code.InvalidParams)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("UnmarshalArgs %#q: unexpected error: %v", test.params, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, tmp); diff != "" {
+			t.Errorf("UnmarshalArgs %#q: (-want, +got)\n%s", test.params, diff)
+		}
+	}
+}
+
+func TestTargetType(t *testing.T) {
+	tests := []struct {
+		input interface{}
+		want  string
+	}{
+		{nil, "nil"},
+		{new(int), "int"},
+		{new([]string), "[]string"},
+	}
+	for _, test := range tests {
+		if got := targetType(test.input); got != test.want {
+			t.Errorf("targetType(%T): got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
 func TestArgsMarshal(t *testing.T) {
 	tests := []struct {
 		input []interface{}
@@ -275,6 +376,81 @@ func TestObjUnmarshal(t *testing.T) {
 	}
 }
 
+// Verify that UnmarshalObj decodes selected fields and reports errors.
+func TestUnmarshalObj(t *testing.T) {
+	type values struct {
+		S   string
+		Z   int
+		Raw json.RawMessage
+	}
+	var v values
+	tests := []struct {
+		params string
+		fields map[string]interface{}
+		want   values
+		errtxt string // if nonempty, the expected error contains this
+	}{
+		// No parameters are equivalent to an empty object.
+		{``, nil, values{}, ""},
+		{``, map[string]interface{}{"s": Optional(&v.S)}, values{}, ""},
+		{``, map[string]interface{}{"s": &v.S}, values{}, `missing required field "s"`},
+
+		// Select only the requested fields.
+		{`{"s":"a", "z":2, "other":[1,2,3]}`, map[string]interface{}{"s": &v.S},
+			values{S: "a"}, ""},
+		{`{"s":"a", "z":2}`, map[string]interface{}{"s": &v.S, "z": Optional(&v.Z)},
+			values{S: "a", Z: 2}, ""},
+		{`{"s":"a"}`, map[string]interface{}{"s": &v.S, "z": Optional(&v.Z)},
+			values{S: "a"}, ""},
+		{`{"z":2}`, map[string]interface{}{"s": &v.S, "z": &v.Z},
+			values{}, `missing required field "s"`},
+
+		// Null values are present, but leave their targets unmodified.
+		{`{"s":null}`, map[string]interface{}{"s": &v.S}, values{}, ""},
+
+		// Raw capture of nested values.
+		{`{"s":"a", "raw":{"x":[1, 2]}}`, map[string]interface{}{"s": &v.S, "raw": &v.Raw},
+			values{S: "a", Raw: json.RawMessage(`{"x":[1, 2]}`)}, ""},
+		{`{"raw":null}`, map[string]interface{}{"raw": &v.Raw},
+			values{Raw: json.RawMessage(`null`)}, ""},
+
+		// Type errors report the field name and type.
+		{`{"s":"a", "z":"b"}`, map[string]interface{}{"s": &v.S, "z": &v.Z},
+			values{}, `field "z" (int)`},
+		{`{"s":1}`, map[string]interface{}{"s": Optional(&v.S)},
+			values{}, `field "s" (string)`},
+
+		// Positional parameters are not accepted.
+		{`["a"]`, map[string]interface{}{"s": &v.S}, values{}, "want named parameters"},
+	}
+	for _, test := range tests {
+		v = values{} // reset
+		msg := `{"jsonrpc":"2.0","id":1,"method":"X"}`
+		if test.params != "" {
+			msg = `{"jsonrpc":"2.0","id":1,"method":"X","params":` + test.params + `}`
+		}
+		reqs, err := jrpc2.ParseRequests([]byte(msg))
+		if err != nil {
+			t.Fatalf("ParseRequests %#q: %v", msg, err)
+		}
+		err = UnmarshalObj(reqs[0], test.fields)
+		if test.errtxt != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errtxt) {
+				t.Errorf("UnmarshalObj %#q: got error %v, want %q", test.params, err, test.errtxt)
+			} else if c := code.FromError(err); c != code.InvalidParams {
+				t.Errorf("UnmarshalObj %#q: got code %v, want %v", test.params, c, code.InvalidParams)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("UnmarshalObj %#q: unexpected error: %v", test.params, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, v); diff != "" {
+			t.Errorf("UnmarshalObj %#q: (-want, +got)\n%s", test.params, diff)
+		}
+	}
+}
+
 func ExampleArgs_unmarshal() {
 	const input = `[25, false, "apple"]`
 
@@ -315,3 +491,130 @@ func ExampleObj_unmarshal() {
 	// Output:
 	// uid=501, name="P. T. Barnum"
 }
+
+func TestDeprecated(t *testing.T) {
+	h := Deprecated(New(func(context.Context) string { return "ok" }), "gone soon")
+	d, ok := h.(jrpc2.DeprecatedHandler)
+	if !ok {
+		t.Fatalf("Deprecated(...) = %T, does not implement jrpc2.DeprecatedHandler", h)
+	}
+	if got := d.Deprecated(); got != "gone soon" {
+		t.Errorf("Deprecated note: got %q, want %q", got, "gone soon")
+	}
+	req, err := jrpc2.ParseRequests([]byte(`{"jsonrpc":"2.0","id":1,"method":"X"}`))
+	if err != nil {
+		t.Fatalf("ParseRequests: %v", err)
+	}
+	if got, err := h.Handle(context.Background(), req[0]); err != nil || got != "ok" {
+		t.Errorf("Handle: got (%v, %v), want (ok, nil)", got, err)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	base := Map{
+		"Add": New(func(context.Context) string { return "add" }),
+		"Sub": Deprecated(New(func(context.Context) string { return "sub" }), "use Add"),
+	}
+	a, err := Alias(base, map[string]string{
+		"Plus":     "Add",
+		"OldPlus":  "Plus", // chained: OldPlus → Plus → Add
+		"Minus":    "Sub",
+		"Multiply": "Mul", // target does not exist
+	})
+	if err != nil {
+		t.Fatalf("Alias: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	req, err := jrpc2.ParseRequests([]byte(`{"jsonrpc":"2.0","id":1,"method":"X"}`))
+	if err != nil {
+		t.Fatalf("ParseRequests: %v", err)
+	}
+
+	tests := []struct {
+		method, want, note string
+	}{
+		{"Add", "add", ""},
+		{"Plus", "add", `alias for "Add"`},
+		{"OldPlus", "add", `alias for "Add"`},
+		{"Sub", "sub", "use Add"},
+		{"Minus", "sub", `alias for "Sub"; use Add`},
+	}
+	for _, test := range tests {
+		h := a.Assign(ctx, test.method)
+		if h == nil {
+			t.Errorf("Assign(%q): got nil, want handler", test.method)
+			continue
+		}
+		if got, err := h.Handle(ctx, req[0]); err != nil || got != test.want {
+			t.Errorf("Assign(%q).Handle: got (%v, %v), want (%q, nil)", test.method, got, err, test.want)
+		}
+		var note string
+		if d, ok := h.(jrpc2.DeprecatedHandler); ok {
+			note = d.Deprecated()
+		}
+		if note != test.note {
+			t.Errorf("Assign(%q) deprecation: got %q, want %q", test.method, note, test.note)
+		}
+	}
+	for _, method := range []string{"Multiply", "Mul", "Nonesuch"} {
+		if h := a.Assign(ctx, method); h != nil {
+			t.Errorf("Assign(%q): got %v, want nil", method, h)
+		}
+	}
+
+	want := []string{"Add", "Minus", "OldPlus", "Plus", "Sub"}
+	if diff := cmp.Diff(want, a.Names()); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+
+	// The deprecations match the notes of the assigned handlers.
+	deps := a.(jrpc2.DeprecationNamer).Deprecations()
+	if diff := cmp.Diff(map[string]string{
+		"Plus":    `alias for "Add"`,
+		"OldPlus": `alias for "Add"`,
+		"Sub":     "use Add",
+		"Minus":   `alias for "Sub"; use Add`,
+	}, deps); diff != "" {
+		t.Errorf("Wrong deprecations: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestDeprecations(t *testing.T) {
+	ok := New(func(context.Context) string { return "ok" })
+	m := Map{
+		"Keep": ok,
+		"Drop": Deprecated(ok, "use Keep"),
+	}
+	if diff := cmp.Diff(map[string]string{"Drop": "use Keep"}, m.Deprecations()); diff != "" {
+		t.Errorf("Map deprecations: (-want, +got)\n%s", diff)
+	}
+	if deps := (Map{"Keep": ok}).Deprecations(); len(deps) != 0 {
+		t.Errorf("Map deprecations: got %v, want none", deps)
+	}
+
+	sm := ServiceMap{
+		"A": m,
+		"B": Map{"Old": Deprecated(ok, "gone")},
+	}
+	if diff := cmp.Diff(map[string]string{
+		"A.Drop": "use Keep",
+		"B.Old":  "gone",
+	}, sm.Deprecations()); diff != "" {
+		t.Errorf("ServiceMap deprecations: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestAliasCycle(t *testing.T) {
+	tests := []map[string]string{
+		{"A": "A"},
+		{"A": "B", "B": "A"},
+		{"A": "B", "B": "C", "C": "A", "D": "A"},
+	}
+	for _, aliases := range tests {
+		if a, err := Alias(Map{}, aliases); err == nil {
+			t.Errorf("Alias(%v): got %v, want error", aliases, a)
+		} else {
+			t.Logf("Alias(%v): got expected error: %v", aliases, err)
+		}
+	}
+}
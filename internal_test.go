@@ -168,7 +168,10 @@ func TestClientCancellation(t *testing.T) {
 				return false, nil
 			}
 		}),
-	}, nil).Start(spipe)
+	}, &ServerOptions{
+		// Ensure rpc.cancel can run while the hanging handler is active.
+		Concurrency: 2,
+	}).Start(spipe)
 	c := NewClient(cpipe, nil)
 	defer func() {
 		c.Close()
@@ -297,18 +300,17 @@ func TestMarshalResponse(t *testing.T) {
 		result string
 		want   string
 	}{
-		{"", nil, "", `{"jsonrpc":"2.0"}`},
-		{"null", nil, "", `{"jsonrpc":"2.0","id":null}`},
+		{"", nil, "", `{"jsonrpc":"2.0","result":null}`},
+		{"null", nil, "", `{"jsonrpc":"2.0","id":null,"result":null}`},
 		{"123", Errorf(code.ParseError, "failed").(*Error), "",
 			`{"jsonrpc":"2.0","id":123,"error":{"code":-32700,"message":"failed"}}`},
+		{"789", Errorf(code.SystemError, "both").(*Error), "true",
+			`{"jsonrpc":"2.0","id":789,"error":{"code":-32098,"message":"both"}}`},
 		{"456", nil, `{"ok":true,"values":[4,5,6]}`,
 			`{"jsonrpc":"2.0","id":456,"result":{"ok":true,"values":[4,5,6]}}`},
 	}
 	for _, test := range tests {
-		rsp := &Response{id: test.id, err: test.err}
-		if test.err == nil {
-			rsp.result = json.RawMessage(test.result)
-		}
+		rsp := &Response{id: test.id, err: test.err, result: json.RawMessage(test.result)}
 
 		got, err := json.Marshal(rsp)
 		if err != nil {
@@ -318,3 +320,123 @@ func TestMarshalResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestIDKey(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", ""},
+		{"null", ""},
+		{`"a b"`, "sa b"},
+		{`"\u0061"`, "sa"},
+		{`""`, "s"},
+		{"0", "n0"},
+		{"-0.0e5", "n0"},
+		{"1", "n1e0"},
+		{"-1", "n-1e0"},
+		{"100", "n1e2"},
+		{"1E+2", "n1e2"},
+		{"0.0100", "n1e-2"},
+		{"12.5e-3", "n125e-4"},
+		{"1e99999999999999999999", "?1e99999999999999999999"},
+	}
+	for _, test := range tests {
+		if got := idKey(json.RawMessage(test.input)); got != test.want {
+			t.Errorf("idKey(%#q): got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestEncodeMessages(t *testing.T) {
+	// The direct encoding of response messages must agree with the standard
+	// encoding of the message structure.
+	tests := []*jmessage{
+		{V: Version, R: json.RawMessage("null")},
+		{V: Version, ID: json.RawMessage("null"), R: json.RawMessage("null")},
+		{V: Version, ID: json.RawMessage(`"<a & b>"`), R: json.RawMessage(`{"x":1}`)},
+		{V: Version, ID: json.RawMessage("1"), R: json.RawMessage(`"\u003chtml\u003e"`)},
+		{V: Version, ID: json.RawMessage("2"), R: json.RawMessage("null")},
+		{V: Version, ID: json.RawMessage("3"), E: &Error{code: code.InvalidParams, message: "bad <params>"}},
+		{V: Version, ID: json.RawMessage("4"),
+			E: &Error{code: 99, message: "data", data: json.RawMessage(`[1,2,3]`)}},
+		{V: Version, ID: json.RawMessage("5"), M: "Method", P: json.RawMessage(`{"a":true}`)},
+		{V: Version, M: "Notify"},
+	}
+	for _, msg := range tests {
+		want, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal %+v: %v", msg, err)
+		}
+		got, err := jmessages{msg}.toJSON()
+		if err != nil {
+			t.Errorf("Encoding %+v: unexpected error: %v", msg, err)
+		} else if string(got) != string(want) {
+			t.Errorf("Encoding %+v:\n got %#q\nwant %#q", msg, got, want)
+		}
+	}
+
+	// Check the encoding of a batch against the standard encoding.
+	batch := jmessages(tests)
+	want, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("Marshal batch: %v", err)
+	}
+	got, err := batch.toJSON()
+	if err != nil {
+		t.Errorf("Encoding batch: unexpected error: %v", err)
+	} else if string(got) != string(want) {
+		t.Errorf("Encoding batch:\n got %#q\nwant %#q", got, want)
+	}
+}
+
+func TestEncodeResponseShape(t *testing.T) {
+	// A response has exactly one of "result" or "error", and a missing result
+	// is reported as null.
+	tests := []struct {
+		msg  *jmessage
+		want string
+	}{
+		{&jmessage{V: Version, ID: json.RawMessage("1")},
+			`{"jsonrpc":"2.0","id":1,"result":null}`},
+		{&jmessage{V: Version, ID: json.RawMessage("2"), R: json.RawMessage("{}")},
+			`{"jsonrpc":"2.0","id":2,"result":{}}`},
+		{&jmessage{V: Version, ID: json.RawMessage("3"), E: &Error{code: 5, message: "bad"}},
+			`{"jsonrpc":"2.0","id":3,"error":{"code":5,"message":"bad"}}`},
+		{&jmessage{V: Version, ID: json.RawMessage("4"), E: &Error{code: 6, message: "worse"},
+			R: json.RawMessage("true")},
+			`{"jsonrpc":"2.0","id":4,"error":{"code":6,"message":"worse"}}`},
+	}
+	for _, test := range tests {
+		got, err := jmessages{test.msg}.toJSON()
+		if err != nil {
+			t.Errorf("Encoding %+v: unexpected error: %v", test.msg, err)
+		} else if string(got) != test.want {
+			t.Errorf("Encoding %+v:\n got %#q\nwant %#q", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestEncodeV1Responses(t *testing.T) {
+	// A response with no version has the JSON-RPC 1.0 format.
+	tests := []struct {
+		msg  *jmessage
+		want string
+	}{
+		{&jmessage{ID: json.RawMessage("6"), R: json.RawMessage("[]")},
+			`{"id":6,"result":[],"error":null}`},
+		{&jmessage{ID: json.RawMessage(`"a"`), R: json.RawMessage("null")},
+			`{"id":"a","result":null,"error":null}`},
+		{&jmessage{ID: json.RawMessage("7"), E: &Error{code: code.InvalidParams, message: "bad"}},
+			`{"id":7,"result":null,"error":{"code":-32602,"message":"bad"}}`},
+		{&jmessage{E: &Error{code: code.InvalidRequest, message: "oops"}},
+			`{"id":null,"result":null,"error":{"code":-32600,"message":"oops"}}`},
+	}
+	for _, test := range tests {
+		got, err := jmessages{test.msg}.toJSON()
+		if err != nil {
+			t.Errorf("Encoding %+v: unexpected error: %v", test.msg, err)
+		} else if string(got) != test.want {
+			t.Errorf("Encoding %+v:\n got %#q\nwant %#q", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package jctx
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// An Authorizer generates an authorization token for a request with the given
+// method name and parameters. The parameters are those of the original
+// request, before they are wrapped by the encoder.
+type Authorizer func(ctx context.Context, method string, params []byte) (string, error)
+
+// A Verifier checks the authorization token attached to ctx (see AuthToken)
+// for a request with the given method name and parameters, and reports the
+// principal on whose behalf the request was issued. It reports an error if the
+// token is missing or does not authorize the request.
+type Verifier func(ctx context.Context, method string, params []byte) (principal string, err error)
+
+// Authorize reports whether v accepts the token attached to ctx. If so, it
+// returns a copy of ctx that records the verified principal (see Principal).
+// It is suitable for use as the Authorize hook of a jrpc2.ServerOptions value
+// whose DecodeContext hook is Decode, so that handlers can find out on whose
+// behalf they were called without verifying the token again.
+func (v Verifier) Authorize(ctx context.Context, method string, params []byte) (context.Context, error) {
+	principal, err := v(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, principalKey{}, principal), nil
+}
+
+type principalKey struct{}
+
+// Principal returns the principal recorded in ctx by the Authorize method of a
+// Verifier, or "" if ctx has none.
+func Principal(ctx context.Context) string {
+	if v := ctx.Value(principalKey{}); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+// EncodeAuth returns a function that encodes a context and request parameters
+// in the same manner as Encode, and in addition attaches an authorization
+// token for the request generated by auth. The result is suitable for use as
+// the EncodeContext hook of a jrpc2.ClientOptions value.
+func EncodeAuth(auth Authorizer) func(context.Context, string, json.RawMessage) (json.RawMessage, error) {
+	return func(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+		token, err := auth(ctx, method, params)
+		if err != nil {
+			return nil, err
+		}
+		c := newWireContext(ctx, params)
+		c.Auth = token
+		return json.Marshal(c)
+	}
+}
+
+type authKey struct{}
+
+// AuthToken returns the authorization token attached to the request whose
+// context was decoded into ctx, or "" if the request had no token.
+func AuthToken(ctx context.Context) string {
+	if v := ctx.Value(authKey{}); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+// ErrInvalidToken is reported by the Verifier returned by HMACVerifier when
+// the authorization token for a request is missing or invalid. Errors wrapping
+// ErrInvalidToken have code.Unauthorized.
+var ErrInvalidToken = code.Unauthorized.Err()
+
+// ErrReplayedToken is reported by the Verifier returned by NewHMACVerifier when
+// replay protection is enabled and the authorization token for a request has
+// already been used. Errors wrapping ErrReplayedToken have code.Replayed.
+var ErrReplayedToken = code.Replayed.Err()
+
+// DefaultMaxSkew is the maximum clock skew permitted by HMACVerifier if the
+// caller does not specify a positive value.
+const DefaultMaxSkew = 5 * time.Minute
+
+const hmacVersion = "jctx-hmac-v1"
+
+// timeNow returns the current time. It is a variable to support testing.
+var timeNow = time.Now
+
+// HMACAuthorizer returns an Authorizer that signs requests on behalf of the
+// specified principal with an HMAC-SHA256 of the given key. The signature
+// covers the method name, a digest of the request parameters, the current
+// time, a random nonce, and the principal. Use HMACVerifier or
+// NewHMACVerifier to check the resulting tokens.
+func HMACAuthorizer(key []byte, principal string) Authorizer {
+	key = append([]byte(nil), key...) // copy
+	return func(_ context.Context, method string, params []byte) (string, error) {
+		pd, err := paramDigest(params)
+		if err != nil {
+			return "", err
+		}
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", fmt.Errorf("generating nonce: %v", err)
+		}
+		tok := hmacToken{
+			principal: base64.RawURLEncoding.EncodeToString([]byte(principal)),
+			issued:    strconv.FormatInt(timeNow().Unix(), 10),
+			nonce:     base64.RawURLEncoding.EncodeToString(buf[:]),
+		}
+		mac := tok.sign(key, pd, method)
+		return tok.principal + "." + tok.issued + "." + tok.nonce + "." +
+			base64.RawURLEncoding.EncodeToString(mac), nil
+	}
+}
+
+// HMACVerifier returns a Verifier that checks tokens generated by
+// HMACAuthorizer. A token is accepted if it was signed by any of the given
+// keys, and if its timestamp differs from the current time by no more than
+// maxSkew. If maxSkew <= 0, DefaultMaxSkew is used. The map keys name the
+// signing keys, and are not otherwise interpreted; providing more than one key
+// allows a new key to be rolled out before the old one is retired.
+//
+// Signatures are compared in constant time. Note, however, that this verifier
+// does not prevent a valid request from being replayed within the skew
+// interval. Use NewHMACVerifier with a NonceStore for replay protection.
+//
+// Errors reported by the verifier wrap ErrInvalidToken.
+func HMACVerifier(keys map[string][]byte, maxSkew time.Duration) Verifier {
+	return NewHMACVerifier(keys, &HMACOptions{MaxSkew: maxSkew})
+}
+
+// HMACOptions are optional settings for a Verifier constructed by
+// NewHMACVerifier. A nil *HMACOptions is valid and provides default values.
+type HMACOptions struct {
+	// The maximum permitted difference between the clocks of the client and
+	// the server. If MaxSkew <= 0, DefaultMaxSkew is used.
+	MaxSkew time.Duration
+
+	// How long a token remains valid after it is issued, in addition to the
+	// permitted clock skew. If Window <= 0, a token is valid only while its
+	// timestamp is within MaxSkew of the current time.
+	Window time.Duration
+
+	// If set, the verifier records the nonce of each valid token in this
+	// store until the token expires, and rejects a token whose nonce has
+	// already been recorded with ErrReplayedToken.
+	Nonces NonceStore
+
+	// If true, a token is accepted if Nonces reports an error, as if its
+	// nonce had not been seen. By default, the token is rejected.
+	FailOpen bool
+}
+
+func (o *HMACOptions) maxSkew() time.Duration {
+	if o == nil || o.MaxSkew <= 0 {
+		return DefaultMaxSkew
+	}
+	return o.MaxSkew
+}
+
+func (o *HMACOptions) window() time.Duration {
+	if o == nil || o.Window <= 0 {
+		return 0
+	}
+	return o.Window
+}
+
+func (o *HMACOptions) nonces() NonceStore {
+	if o == nil {
+		return nil
+	}
+	return o.Nonces
+}
+
+func (o *HMACOptions) failOpen() bool { return o != nil && o.FailOpen }
+
+// NewHMACVerifier returns a Verifier that checks tokens generated by
+// HMACAuthorizer, as HMACVerifier does, with the given options. A token is
+// accepted if it was signed by any of the given keys, and if it was issued no
+// more than MaxSkew in the future and no more than Window+MaxSkew in the past.
+//
+// If opts specifies a NonceStore, each token can be used only once: The
+// verifier rejects a token whose nonce the store has already seen. Nonces are
+// recorded only for tokens that are otherwise valid. If the store reports an
+// error, the verifier rejects the request with that error, unless FailOpen is
+// true.
+//
+// Errors reported by the verifier for invalid tokens wrap ErrInvalidToken,
+// and errors for replayed tokens wrap ErrReplayedToken.
+func NewHMACVerifier(keys map[string][]byte, opts *HMACOptions) Verifier {
+	maxSkew, window := opts.maxSkew(), opts.window()
+	store, failOpen := opts.nonces(), opts.failOpen()
+	var secrets [][]byte
+	for _, key := range keys {
+		secrets = append(secrets, append([]byte(nil), key...))
+	}
+	return func(ctx context.Context, method string, params []byte) (string, error) {
+		token := AuthToken(ctx)
+		if token == "" {
+			return "", fmt.Errorf("%w: no token", ErrInvalidToken)
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 4 {
+			return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+		}
+		tok := hmacToken{principal: parts[0], issued: parts[1], nonce: parts[2]}
+		principal, err := base64.RawURLEncoding.DecodeString(tok.principal)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid principal: %v", ErrInvalidToken, err)
+		}
+		unix, err := strconv.ParseInt(tok.issued, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid timestamp: %v", ErrInvalidToken, err)
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid signature: %v", ErrInvalidToken, err)
+		}
+		pd, err := paramDigest(params)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid parameters: %v", ErrInvalidToken, err)
+		}
+
+		// Check all the keys, so that the time taken does not reveal which of
+		// them (if any) matched.
+		ok := false
+		for _, key := range secrets {
+			if hmac.Equal(sig, tok.sign(key, pd, method)) {
+				ok = true
+			}
+		}
+		if !ok {
+			return "", fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+
+		// Check the timestamp only after the signature, since an unsigned
+		// timestamp is not meaningful.
+		issued := time.Unix(unix, 0)
+		age := timeNow().Sub(issued)
+		if age < -maxSkew || age > window+maxSkew {
+			return "", fmt.Errorf("%w: token issued outside permitted interval (age %v)", ErrInvalidToken, age)
+		}
+
+		if store != nil {
+			fresh, err := store.Add(ctx, tok.nonce, issued.Add(window+maxSkew))
+			if err != nil && !failOpen {
+				return "", fmt.Errorf("checking nonce: %w", err)
+			} else if err == nil && !fresh {
+				return "", fmt.Errorf("%w: nonce %q already used", ErrReplayedToken, tok.nonce)
+			}
+		}
+		return string(principal), nil
+	}
+}
+
+// A NonceStore records the nonces of authorization tokens for replay
+// protection. Its methods must be safe for concurrent use. A store may be
+// shared by multiple servers, for example to protect a replicated service.
+type NonceStore interface {
+	// Add records nonce, which must be retained until at least the specified
+	// expiration time. It reports false if nonce was already recorded and has
+	// not yet expired. If the store is unavailable, Add reports an error.
+	Add(ctx context.Context, nonce string, expires time.Time) (bool, error)
+}
+
+// MemoryNonceStore is an in-memory NonceStore that discards nonces after
+// they expire. The zero value is ready for use.
+type MemoryNonceStore struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce → expiration
+	live int                  // number of entries after the last sweep
+}
+
+// NewMemoryNonceStore returns a new empty in-memory NonceStore.
+func NewMemoryNonceStore() *MemoryNonceStore { return new(MemoryNonceStore) }
+
+// Add implements the NonceStore interface. It never reports an error.
+func (m *MemoryNonceStore) Add(_ context.Context, nonce string, expires time.Time) (bool, error) {
+	now := timeNow()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if exp, ok := m.seen[nonce]; ok && now.Before(exp) {
+		return false, nil
+	}
+	if m.seen == nil {
+		m.seen = make(map[string]time.Time)
+	}
+
+	// Sweep out expired nonces whenever the store has doubled in size since
+	// the last sweep, so that the cost is amortized over the additions.
+	if len(m.seen) >= 2*m.live && len(m.seen) >= 64 {
+		for key, exp := range m.seen {
+			if !now.Before(exp) {
+				delete(m.seen, key)
+			}
+		}
+		m.live = len(m.seen)
+	}
+	m.seen[nonce] = expires
+	return true, nil
+}
+
+// Len reports the number of nonces currently held by m, including any that
+// have expired but have not yet been discarded.
+func (m *MemoryNonceStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.seen)
+}
+
+// An hmacToken holds the encoded fields of a token other than its signature.
+type hmacToken struct {
+	principal string // base64url
+	issued    string // decimal seconds since the Unix epoch
+	nonce     string // base64url
+}
+
+// sign computes an HMAC-SHA256 with key over the fields of t, the digest of
+// the request parameters, and the method name. The method name is last, since
+// it alone may contain arbitrary characters.
+func (t hmacToken) sign(key, digest []byte, method string) []byte {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n%s", hmacVersion,
+		t.principal, t.issued, t.nonce, hex.EncodeToString(digest), method)
+	return h.Sum(nil)
+}
+
+// paramDigest returns a SHA-256 digest of the canonical encoding of params.
+// The canonical encoding is compacted with HTML characters escaped, matching
+// what the server recovers from a wrapper encoded by this package.
+func paramDigest(params []byte) ([]byte, error) {
+	var compact, canon bytes.Buffer
+	if len(params) != 0 {
+		if err := json.Compact(&compact, params); err != nil {
+			return nil, err
+		}
+	}
+	json.HTMLEscape(&canon, compact.Bytes())
+	sum := sha256.Sum256(canon.Bytes())
+	return sum[:], nil
+}
@@ -17,7 +17,8 @@
 //      "jctx": "1",
 //      "payload":  <original-params>,
 //      "deadline": <rfc-3339-timestamp>,
-//      "meta":     <json-value>
+//      "meta":     <json-value>,
+//      "auth":     <token-string>
 //    }
 //
 // Of these, only the "jctx" marker is required; the others are assumed to be
@@ -57,12 +58,19 @@ type wireContext struct {
 	Deadline *time.Time      `json:"deadline,omitempty"` // encoded in UTC
 	Payload  json.RawMessage `json:"payload,omitempty"`
 	Metadata json.RawMessage `json:"meta,omitempty"`
+	Auth     string          `json:"auth,omitempty"`
 }
 
 // Encode encodes the specified context and request parameters for transmission.
 // If a deadline is set on ctx, it is converted to UTC before encoding.
 // If metadata are set on ctx (see jctx.WithMetadata), they are included.
 func Encode(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(newWireContext(ctx, params))
+}
+
+// newWireContext constructs a wrapper for params with the deadline and
+// metadata from ctx.
+func newWireContext(ctx context.Context, params json.RawMessage) wireContext {
 	v := wireVersion
 	c := wireContext{V: &v, Payload: params}
 	if dl, ok := ctx.Deadline(); ok {
@@ -74,8 +82,7 @@ func Encode(ctx context.Context, method string, params json.RawMessage) (json.Ra
 	if v := ctx.Value(metadataKey{}); v != nil {
 		c.Metadata = v.(json.RawMessage)
 	}
-
-	return json.Marshal(c)
+	return c
 }
 
 // Decode decodes the specified request message as a context-wrapped request,
@@ -86,7 +93,8 @@ func Encode(ctx context.Context, method string, params json.RawMessage) (json.Ra
 // context value returned.
 //
 // If the request includes context metadata, they are attached and can be
-// recovered using jctx.UnmarshalMetadata.
+// recovered using jctx.UnmarshalMetadata. Likewise, an authorization token can
+// be recovered using jctx.AuthToken.
 func Decode(ctx context.Context, method string, req json.RawMessage) (context.Context, json.RawMessage, error) {
 	if len(req) == 0 || req[0] != '{' {
 		return ctx, req, nil // an empty message or non-object has no wrapper
@@ -100,6 +108,9 @@ func Decode(ctx context.Context, method string, req json.RawMessage) (context.Co
 	if c.Metadata != nil {
 		ctx = context.WithValue(ctx, metadataKey{}, c.Metadata)
 	}
+	if c.Auth != "" {
+		ctx = context.WithValue(ctx, authKey{}, c.Auth)
+	}
 	if c.Deadline != nil && !c.Deadline.IsZero() {
 		var ignored context.CancelFunc
 		ctx, ignored = context.WithDeadline(ctx, (*c.Deadline).In(time.UTC))
@@ -2,9 +2,15 @@ package jctx
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/creachadair/jrpc2/code"
 )
 
 var bicent = time.Date(1976, 7, 4, 1, 2, 3, 4, time.UTC)
@@ -151,3 +157,233 @@ func TestMetadata(t *testing.T) {
 		t.Errorf("Metadata(clr): got %+v, %v; want %v", bad, err, ErrNoMetadata)
 	}
 }
+
+func TestHMACAuth(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	start := bicent.Truncate(time.Second) // tokens have 1-second resolution
+	now := start
+	timeNow = func() time.Time { return now }
+
+	oldKey, newKey := []byte("old secret"), []byte("new secret")
+	verify := HMACVerifier(map[string][]byte{"old": oldKey, "new": newKey}, time.Minute)
+	base := context.Background()
+
+	// Simulate transmission of a request with the given authorizer.
+	send := func(auth Authorizer, method, params string) context.Context {
+		t.Helper()
+		enc, err := EncodeAuth(auth)(base, method, json.RawMessage(params))
+		if err != nil {
+			t.Fatalf("Encoding context failed: %v", err)
+		}
+		t.Logf("Encoded context is: %#q", string(enc))
+		ctx, _, err := Decode(base, method, enc)
+		if err != nil {
+			t.Fatalf("Decoding context failed: %v", err)
+		}
+		return ctx
+	}
+	const params = `{"query": "a < b"}`
+
+	t.Run("Valid", func(t *testing.T) {
+		for _, key := range [][]byte{oldKey, newKey} {
+			ctx := send(HMACAuthorizer(key, "alice.example"), "Search", params)
+			// The server sees the payload as re-encoded by the wrapper.
+			got, err := verify(ctx, "Search", []byte(`{"query":"a < b"}`))
+			if err != nil {
+				t.Errorf("Verify: unexpected error: %v", err)
+			} else if got != "alice.example" {
+				t.Errorf("Verify principal: got %q, want alice.example", got)
+			}
+		}
+	})
+
+	t.Run("Authorize", func(t *testing.T) {
+		ctx := send(HMACAuthorizer(newKey, "alice"), "Search", params)
+		if got := Principal(ctx); got != "" {
+			t.Errorf("Principal before Authorize: got %q, want empty", got)
+		}
+		actx, err := verify.Authorize(ctx, "Search", []byte(`{"query":"a < b"}`))
+		if err != nil {
+			t.Errorf("Authorize: unexpected error: %v", err)
+		} else if got := Principal(actx); got != "alice" {
+			t.Errorf("Principal: got %q, want alice", got)
+		}
+		if _, err := verify.Authorize(ctx, "Delete", []byte(params)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authorize: got %v, want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("TamperedParams", func(t *testing.T) {
+		ctx := send(HMACAuthorizer(newKey, "alice"), "Search", params)
+		if got, err := verify(ctx, "Search", []byte(`{"query":"a > b"}`)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify: got (%q, %v), want %v", got, err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("WrongMethod", func(t *testing.T) {
+		ctx := send(HMACAuthorizer(newKey, "alice"), "Search", params)
+		if got, err := verify(ctx, "Delete", []byte(params)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify: got (%q, %v), want %v", got, err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		ctx := send(HMACAuthorizer([]byte("retired"), "alice"), "Search", params)
+		if got, err := verify(ctx, "Search", []byte(params)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify: got (%q, %v), want %v", got, err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("TamperedPrincipal", func(t *testing.T) {
+		ctx := send(HMACAuthorizer(newKey, "alice"), "Search", params)
+		tok := strings.SplitN(AuthToken(ctx), ".", 2)
+		forged := base64.RawURLEncoding.EncodeToString([]byte("root")) + "." + tok[1]
+		ctx = context.WithValue(ctx, authKey{}, forged)
+		if got, err := verify(ctx, "Search", []byte(params)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify: got (%q, %v), want %v", got, err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("Skew", func(t *testing.T) {
+		ctx := send(HMACAuthorizer(newKey, "alice"), "Search", "")
+		for _, d := range []time.Duration{-time.Minute, time.Minute} {
+			now = start.Add(d)
+			if _, err := verify(ctx, "Search", nil); err != nil {
+				t.Errorf("Verify at %v: unexpected error: %v", d, err)
+			}
+		}
+		for _, d := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+			now = start.Add(d)
+			if got, err := verify(ctx, "Search", nil); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify at %v: got (%q, %v), want %v", d, got, err, ErrInvalidToken)
+			}
+		}
+		now = start
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		for _, tok := range []string{"", "bogus", "a.b.c", "YQ.1.!!"} {
+			ctx := base
+			if tok != "" {
+				ctx = context.WithValue(base, authKey{}, tok)
+			}
+			if got, err := verify(ctx, "Search", nil); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify %q: got (%q, %v), want %v", tok, got, err, ErrInvalidToken)
+			}
+		}
+	})
+}
+
+type brokenStore struct{}
+
+func (brokenStore) Add(context.Context, string, time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestHMACReplay(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	start := bicent.Truncate(time.Second)
+	now := start
+	timeNow = func() time.Time { return now }
+
+	key := []byte("secret")
+	keys := map[string][]byte{"k": key}
+	auth := HMACAuthorizer(key, "bob")
+	base := context.Background()
+	sign := func() context.Context {
+		t.Helper()
+		enc, err := EncodeAuth(auth)(base, "Mutate", nil)
+		if err != nil {
+			t.Fatalf("Encoding context failed: %v", err)
+		}
+		ctx, _, err := Decode(base, "Mutate", enc)
+		if err != nil {
+			t.Fatalf("Decoding context failed: %v", err)
+		}
+		return ctx
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		store := NewMemoryNonceStore()
+		verify := NewHMACVerifier(keys, &HMACOptions{
+			MaxSkew: time.Second,
+			Window:  time.Minute,
+			Nonces:  store,
+		})
+		ctx := sign()
+		if _, err := verify(ctx, "Mutate", nil); err != nil {
+			t.Fatalf("Verify: unexpected error: %v", err)
+		}
+
+		// Within the window, the same token is rejected as a replay, but a
+		// fresh token is accepted.
+		now = start.Add(30 * time.Second)
+		if got, err := verify(ctx, "Mutate", nil); !errors.Is(err, ErrReplayedToken) {
+			t.Errorf("Verify replay: got (%q, %v), want %v", got, err, ErrReplayedToken)
+		} else if c := code.FromError(err); c != code.Replayed {
+			t.Errorf("Verify replay: got code %v, want %v", c, code.Replayed)
+		}
+		if _, err := verify(sign(), "Mutate", nil); err != nil {
+			t.Errorf("Verify fresh: unexpected error: %v", err)
+		}
+
+		// After the window, the original token is expired.
+		now = start.Add(time.Minute + 2*time.Second)
+		if got, err := verify(ctx, "Mutate", nil); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify expired: got (%q, %v), want %v", got, err, ErrInvalidToken)
+		} else if c := code.FromError(err); c != code.Unauthorized {
+			t.Errorf("Verify expired: got code %v, want %v", c, code.Unauthorized)
+		}
+		if n := store.Len(); n != 2 {
+			t.Errorf("Store size: got %d, want 2", n)
+		}
+		now = start
+	})
+
+	t.Run("FailClosed", func(t *testing.T) {
+		verify := NewHMACVerifier(keys, &HMACOptions{Nonces: brokenStore{}})
+		if got, err := verify(sign(), "Mutate", nil); err == nil {
+			t.Errorf("Verify: got %q, want error", got)
+		} else {
+			t.Logf("Verify: got expected error: %v", err)
+		}
+	})
+
+	t.Run("FailOpen", func(t *testing.T) {
+		verify := NewHMACVerifier(keys, &HMACOptions{Nonces: brokenStore{}, FailOpen: true})
+		if got, err := verify(sign(), "Mutate", nil); err != nil {
+			t.Errorf("Verify: unexpected error: %v", err)
+		} else if got != "bob" {
+			t.Errorf("Verify principal: got %q, want bob", got)
+		}
+	})
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := bicent
+	timeNow = func() time.Time { return now }
+
+	var store MemoryNonceStore
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if ok, err := store.Add(ctx, strconv.Itoa(i), now.Add(time.Minute)); !ok || err != nil {
+			t.Fatalf("Add %d: got (%v, %v), want (true, nil)", i, ok, err)
+		}
+	}
+	if ok, _ := store.Add(ctx, "5", now.Add(time.Minute)); ok {
+		t.Error("Add 5: got true for a duplicate nonce")
+	}
+
+	// Once the nonces expire, they are accepted again and eventually swept.
+	now = now.Add(time.Hour)
+	if ok, _ := store.Add(ctx, "5", now.Add(time.Minute)); !ok {
+		t.Error("Add 5: got false for an expired nonce")
+	}
+	for i := 100; i < 200; i++ {
+		store.Add(ctx, strconv.Itoa(i), now.Add(time.Minute))
+	}
+	if n := store.Len(); n > 150 {
+		t.Errorf("Store size: got %d, want expired nonces swept", n)
+	}
+}
@@ -5,10 +5,13 @@ package jhttp
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/creachadair/jrpc2"
 )
@@ -27,16 +30,65 @@ import (
 // Allowed). If the Content-Type is not application/json, the bridge reports
 // 415 (Unsupported Media Type).
 //
+// If BridgeOptions.GetMethods is set, the bridge also accepts GET requests for
+// the listed methods, with the call encoded in the URL query:
+//
+//	GET /rpc?method=Foo.Bar&params=<url-encoded JSON>&id=<optional ID>
+//
+// The response carries the ID from the query, or a null ID if the query does
+// not specify one.
+//
+// If the query has no "params" field, any query fields other than "method"
+// and "id" are gathered into a params object with string values, so that
+//
+//	GET /rpc?method=Foo.Bar&name=alice&mode=quick
+//
+// calls Foo.Bar with params {"mode":"quick","name":"alice"}. Batches are not
+// supported via GET: A query naming more than one method is rejected with 400
+// (Bad Request). A GET for a method that is not listed reports 403
+// (Forbidden), and a query longer than BridgeOptions.MaxQueryLen reports 414
+// (Request URI Too Long).
+//
+// If BridgeOptions.AllowOrigins or AllowOrigin is set, the bridge supports
+// cross-origin requests: It answers CORS preflight (OPTIONS) requests itself,
+// and attaches Access-Control-* headers to the responses for requests from an
+// allowed origin, including error responses.
+//
+// The bridge shares its client among all its callers, so it does not forward
+// calls to the built-in rpc.hello method, which would select an encoding of
+// results for all of them (see jrpc2.RPCHello); such a request fails as if it
+// could not be sent.
+//
 // The bridge attaches the inbound HTTP request to the context passed to the
 // client, allowing an EncodeContext callback to retrieve state from the HTTP
 // headers. Use jhttp.HTTPRequest to retrieve the request from the context.
+//
+// The server behind a bridge does not see the HTTP request by default. To make
+// it available to handlers via jrpc2.ChannelMetadata, as for an SSEBridge, set
+// jhttp.EncodeContext as the EncodeContext hook of the bridge's client, and
+// jhttp.DecodeContext as the DecodeContext hook of the server.
 type Bridge struct {
-	cli *jrpc2.Client
+	cli      *jrpc2.Client
+	getOK    map[string]bool // methods that may be called via GET
+	maxQuery int             // maximum query length for GET
+	cacheCtl string          // Cache-Control header for GET responses
+	cors     *corsPolicy     // if nil, CORS is not enabled
 }
 
 // ServeHTTP implements the required method of http.Handler.
 func (b *Bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+	if b.cors != nil {
+		if isPreflight(req) {
+			b.cors.preflight(w, req, b.allowMethods())
+			return
+		}
+		b.cors.setHeaders(w.Header(), req.Header.Get("Origin"))
+	}
+	if req.Method == "GET" && len(b.getOK) != 0 {
+		b.serveGet(w, req)
+		return
+	} else if req.Method != "POST" {
+		w.Header().Set("Allow", b.allowMethods())
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	} else if req.Header.Get("Content-Type") != "application/json" {
@@ -122,14 +174,214 @@ func (b *Bridge) serveInternal(w http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// allowMethods reports the HTTP methods accepted by b.
+func (b *Bridge) allowMethods() string {
+	if len(b.getOK) != 0 {
+		return "GET, POST"
+	}
+	return "POST"
+}
+
+// errBatchGet is reported for a GET query that names more than one method.
+var errBatchGet = errors.New("batch requests are not supported via GET")
+
+// serveGet handles a GET request whose query encodes a single call.
+func (b *Bridge) serveGet(w http.ResponseWriter, req *http.Request) {
+	fail := func(code int, err error) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, err.Error())
+	}
+	if len(req.URL.RawQuery) > b.maxQuery {
+		fail(http.StatusRequestURITooLong, fmt.Errorf("query length %d exceeds limit %d",
+			len(req.URL.RawQuery), b.maxQuery))
+		return
+	}
+	method, id, params, err := parseQuery(req.URL.RawQuery)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	} else if !b.getOK[method] {
+		fail(http.StatusForbidden, fmt.Errorf("method %q may not be called via GET", method))
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), httpReqKey{}, req)
+	rsps, err := b.cli.Batch(ctx, []jrpc2.Spec{{Method: method, Params: params}})
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	if id == "" {
+		id = "null" // a response must have an ID
+	}
+	rsps[0].SetID(id)
+	reply, err := json.Marshal(rsps[0])
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	if rsps[0].Error() != nil {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", b.cacheCtl)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.Write(reply)
+}
+
+// parseQuery decodes a call from the query string of a GET request. The id is
+// returned as JSON text, and is empty if the query does not specify one.
+func parseQuery(query string) (method, id string, params json.RawMessage, err error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", nil, err
+	}
+	switch ms := q["method"]; len(ms) {
+	case 0:
+		return "", "", nil, errors.New("missing method name")
+	case 1:
+		method = ms[0]
+	default:
+		return "", "", nil, errBatchGet
+	}
+	if ids := q["id"]; len(ids) > 1 {
+		return "", "", nil, errors.New("multiple request IDs")
+	} else if len(ids) == 1 {
+		// Keep a numeric or quoted ID as given; otherwise encode it as a string.
+		var v interface{}
+		if json.Unmarshal([]byte(ids[0]), &v) == nil {
+			switch v.(type) {
+			case float64, string:
+				id = ids[0]
+			}
+		}
+		if id == "" {
+			bits, _ := json.Marshal(ids[0])
+			id = string(bits)
+		}
+	}
+	delete(q, "method")
+	delete(q, "id")
+
+	if ps, ok := q["params"]; ok {
+		if len(ps) != 1 || len(q) != 1 {
+			return "", "", nil, errors.New("params must be the only argument field")
+		} else if !json.Valid([]byte(ps[0])) {
+			return "", "", nil, errors.New("params are not valid JSON")
+		}
+		return method, id, json.RawMessage(ps[0]), nil
+	} else if len(q) == 0 {
+		return method, id, nil, nil
+	}
+	fields := make(map[string]string)
+	for key, vs := range q {
+		if len(vs) != 1 {
+			return "", "", nil, fmt.Errorf("multiple values for parameter %q", key)
+		}
+		fields[key] = vs[0]
+	}
+	params, err = json.Marshal(fields)
+	return method, id, params, err
+}
+
 // Close shuts down the client associated with b and reports the result from
 // its Close method.
 func (b *Bridge) Close() error { return b.cli.Close() }
 
 // NewBridge constructs a new Bridge that dispatches requests through c.  It is
 // safe for the caller to continue to use c concurrently with the bridge, as
-// long as it does not close the client.
-func NewBridge(c *jrpc2.Client) *Bridge { return &Bridge{cli: c} }
+// long as it does not close the client. To specify BridgeOptions, use
+// NewBridgeWithOptions.
+func NewBridge(c *jrpc2.Client) *Bridge { return NewBridgeWithOptions(c, nil) }
+
+// NewBridgeWithOptions constructs a new Bridge that dispatches requests
+// through c, as NewBridge does, with the given options. A nil *BridgeOptions
+// provides sensible defaults.
+func NewBridgeWithOptions(c *jrpc2.Client, opts *BridgeOptions) *Bridge {
+	b := &Bridge{
+		cli:      c,
+		maxQuery: opts.maxQueryLen(),
+		cacheCtl: opts.cacheControl(),
+		cors:     opts.corsPolicy(),
+	}
+	if ms := opts.getMethods(); len(ms) != 0 {
+		b.getOK = make(map[string]bool)
+		for _, m := range ms {
+			b.getOK[m] = true
+		}
+	}
+	return b
+}
+
+// BridgeOptions are optional settings for a Bridge. A nil pointer is ready for
+// use and provides default values as described.
+type BridgeOptions struct {
+	// If non-empty, the bridge accepts GET requests for the methods listed.
+	// Only methods that are safe to call without side-effects should be
+	// listed, since browsers may issue GET requests on behalf of other sites.
+	// By default, GET requests are not accepted.
+	GetMethods []string
+
+	// The maximum length in bytes of the query string of a GET request.
+	// If zero, a default limit of 4096 bytes is used.
+	MaxQueryLen int
+
+	// The value of the Cache-Control header for successful GET responses.
+	// If empty, "no-store" is used. Error responses are always "no-store".
+	CacheControl string
+
+	// Origins from which cross-origin requests are allowed. An entry "*"
+	// allows requests from any origin. If neither this nor AllowOrigin is
+	// set, the bridge does not handle CORS.
+	AllowOrigins []string
+
+	// If set, this function is called to decide whether cross-origin requests
+	// are allowed from an origin not matched by AllowOrigins.
+	AllowOrigin func(origin string) bool
+
+	// Request headers a cross-origin client is allowed to send, in addition to
+	// Content-Type, which is always allowed.
+	AllowHeaders []string
+
+	// If true, cross-origin requests may include credentials such as cookies.
+	// Per the CORS specification, credentials are never allowed for an origin
+	// that is matched only by the wildcard "*".
+	AllowCredentials bool
+
+	// How long a client may cache the result of a preflight request. If zero,
+	// no Access-Control-Max-Age header is sent.
+	CORSMaxAge time.Duration
+}
+
+func (o *BridgeOptions) getMethods() []string {
+	if o == nil {
+		return nil
+	}
+	return o.GetMethods
+}
+
+func (o *BridgeOptions) maxQueryLen() int {
+	if o == nil || o.MaxQueryLen <= 0 {
+		return 4096
+	}
+	return o.MaxQueryLen
+}
+
+func (o *BridgeOptions) corsPolicy() *corsPolicy {
+	if o == nil || (len(o.AllowOrigins) == 0 && o.AllowOrigin == nil) {
+		return nil
+	}
+	return newCORSPolicy(o)
+}
+
+func (o *BridgeOptions) cacheControl() string {
+	if o == nil || o.CacheControl == "" {
+		return "no-store"
+	}
+	return o.CacheControl
+}
 
 type httpReqKey struct{}
 
@@ -0,0 +1,83 @@
+package jhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// wireRequest is the encoded representation of the HTTP request that carried
+// a call through a Bridge. The body is not included, since the bridge has
+// already consumed it.
+type wireRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+}
+
+// wireParams is the wrapper around the parameters of a call that carries the
+// HTTP request along with them.
+type wireParams struct {
+	Req     *wireRequest    `json:"jhttp"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// EncodeContext is a client EncodeContext hook for use with a Bridge. If ctx
+// has an HTTP request attached (see HTTPRequest), it wraps params in a message
+// carrying the method, URL, host, headers, and remote address of the request,
+// which jhttp.DecodeContext removes at the server. Otherwise it returns params
+// unmodified.
+func EncodeContext(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	req := HTTPRequest(ctx)
+	if req == nil {
+		return params, nil
+	}
+	return json.Marshal(wireParams{
+		Req: &wireRequest{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Host:       req.Host,
+			Header:     req.Header,
+			RemoteAddr: req.RemoteAddr,
+		},
+		Payload: params,
+	})
+}
+
+// DecodeContext is a server DecodeContext hook that removes the wrapper added
+// by jhttp.EncodeContext, and returns a context in which jrpc2.ChannelMetadata
+// reports the HTTP request as an *http.Request without a body. A request
+// without a wrapper is returned as-is.
+//
+// The server trusts the wrapper as sent, so it should use this hook only if
+// its clients are bridges or are otherwise trusted.
+func DecodeContext(ctx context.Context, method string, params json.RawMessage) (context.Context, json.RawMessage, error) {
+	if len(params) == 0 || params[0] != '{' {
+		return ctx, params, nil // an empty message or non-object has no wrapper
+	}
+	var w wireParams
+	if err := json.Unmarshal(params, &w); err != nil || w.Req == nil {
+		return ctx, params, nil // fall back assuming an un-wrapped message
+	}
+	u, err := url.Parse(w.Req.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &http.Request{
+		Method:     w.Req.Method,
+		URL:        u,
+		Host:       w.Req.Host,
+		Header:     w.Req.Header,
+		RemoteAddr: w.Req.RemoteAddr,
+		Body:       http.NoBody,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	return jrpc2.WithChannelMetadata(ctx, req), w.Payload, nil
+}
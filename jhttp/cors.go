@@ -0,0 +1,88 @@
+package jhttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A corsPolicy implements cross-origin resource sharing for a Bridge.
+type corsPolicy struct {
+	origins  map[string]bool          // origins allowed by name
+	anyOK    bool                     // whether the wildcard "*" is allowed
+	originOK func(origin string) bool // optional origin predicate
+	headers  string                   // value for Access-Control-Allow-Headers
+	maxAge   string                   // value for Access-Control-Max-Age
+	creds    bool                     // whether to allow credentials
+}
+
+func newCORSPolicy(o *BridgeOptions) *corsPolicy {
+	p := &corsPolicy{
+		origins:  make(map[string]bool),
+		originOK: o.AllowOrigin,
+		creds:    o.AllowCredentials,
+	}
+	for _, origin := range o.AllowOrigins {
+		if origin == "*" {
+			p.anyOK = true
+		} else {
+			p.origins[origin] = true
+		}
+	}
+	hdrs := []string{"Content-Type"}
+	for _, h := range o.AllowHeaders {
+		if !strings.EqualFold(h, "Content-Type") {
+			hdrs = append(hdrs, h)
+		}
+	}
+	p.headers = strings.Join(hdrs, ", ")
+	if secs := int(o.CORSMaxAge.Seconds()); secs > 0 {
+		p.maxAge = strconv.Itoa(secs)
+	}
+	return p
+}
+
+// isPreflight reports whether req is a CORS preflight request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setHeaders adds the CORS response headers for a request from origin to h,
+// and reports whether the origin is allowed. For any request with an origin,
+// it adds "Vary: Origin", since the response depends on the origin whether or
+// not it is allowed; if the origin is not allowed, no other headers are added.
+func (p *corsPolicy) setHeaders(h http.Header, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	h.Add("Vary", "Origin")
+	if p.origins[origin] || (p.originOK != nil && p.originOK(origin)) {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if p.creds {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		return true
+	} else if p.anyOK {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	return false
+}
+
+// preflight answers a CORS preflight request. The allow argument lists the
+// HTTP methods supported by the bridge.
+func (p *corsPolicy) preflight(w http.ResponseWriter, req *http.Request, allow string) {
+	h := w.Header()
+	if !p.setHeaders(h, req.Header.Get("Origin")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.Set("Access-Control-Allow-Methods", allow)
+	h.Set("Access-Control-Allow-Headers", p.headers)
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
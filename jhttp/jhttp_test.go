@@ -8,8 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/creachadair/jrpc2"
 	"github.com/creachadair/jrpc2/handler"
@@ -158,6 +160,100 @@ func TestBridge(t *testing.T) {
 	})
 }
 
+func TestBridgeHello(t *testing.T) {
+	// The server compresses results, but the bridge client cannot decode them.
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(ctx context.Context, ss ...string) (string, error) {
+			return strings.Join(ss, " "), nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Codecs:      []jrpc2.Codec{jrpc2.GzipCodec},
+			CompressMin: 100,
+		},
+	})
+	defer loc.Close()
+
+	b := NewBridge(loc.Client)
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	// Verify that the bridge does not forward rpc.hello.
+	rsp, err := http.Post(hsrv.URL, "application/json", strings.NewReader(
+		`{"jsonrpc":"2.0","id":1,"method":"rpc.hello","params":{"encodings":["gzip"]}}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode == http.StatusOK {
+		t.Errorf("POST rpc.hello: got status %v, want error", rsp.StatusCode)
+	}
+
+	// Verify that later callers still get plain results.
+	big := strings.Repeat("compressible ", 100)
+	rsp, err = http.Post(hsrv.URL, "application/json", strings.NewReader(
+		`{"jsonrpc":"2.0","id":2,"method":"Echo","params":["`+big+`"]}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		t.Errorf("Reading POST body: %v", err)
+	}
+	want := `{"jsonrpc":"2.0","id":2,"result":"` + big + `"}`
+	if got := string(body); got != want {
+		t.Errorf("POST Echo: got %#q, want %#q", got, want)
+	}
+}
+
+func TestBridgeMetadata(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Who": handler.New(func(ctx context.Context, ss []string) (string, error) {
+			req, ok := jrpc2.ChannelMetadata(ctx).(*http.Request)
+			if !ok {
+				return "", errors.New("no HTTP request in metadata")
+			}
+			return req.Method + " " + req.Header.Get("X-User") + " " + strings.Join(ss, ","), nil
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{EncodeContext: EncodeContext},
+		Server: &jrpc2.ServerOptions{DecodeContext: DecodeContext},
+	})
+	defer loc.Close()
+	b := NewBridge(loc.Client)
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	for _, user := range []string{"alice", "bob"} {
+		req, err := http.NewRequest("POST", hsrv.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Who","params":["a","b"]}`))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		want := `{"jsonrpc":"2.0","id":1,"result":"POST ` + user + ` a,b"}`
+		if got := string(body); got != want {
+			t.Errorf("POST body: got %#q, want %#q", got, want)
+		}
+	}
+
+	// A call that does not come through the bridge has no wrapper, so its
+	// parameters are delivered unmodified, without metadata.
+	_, err := loc.Client.Call(context.Background(), "Who", []string{"c"})
+	if err == nil || !strings.Contains(err.Error(), "no HTTP request in metadata") {
+		t.Errorf("Direct call: got error %v, want no HTTP request", err)
+	}
+}
+
 func TestChannel(t *testing.T) {
 	loc := server.NewLocal(handler.Map{
 		"Test": handler.New(func(ctx context.Context, arg json.RawMessage) (int, error) {
@@ -202,3 +298,470 @@ func TestChannel(t *testing.T) {
 		t.Errorf("Recv = (%#q, %v), want (nil, %v", string(got), err, io.EOF)
 	}
 }
+
+func TestBridgeGet(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, ss ...string) (string, error) {
+			return strings.Join(ss, " "), nil
+		}),
+		"Greet": handler.New(func(ctx context.Context, arg map[string]string) (string, error) {
+			return "hello, " + arg["name"], nil
+		}),
+		"Unsafe": handler.New(func(ctx context.Context) (bool, error) {
+			t.Error("Unsafe method was called via GET")
+			return false, nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	b := NewBridgeWithOptions(loc.Client, &BridgeOptions{
+		GetMethods:   []string{"Test", "Greet", "Missing"},
+		MaxQueryLen:  100,
+		CacheControl: "max-age=60",
+	})
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	tests := []struct {
+		query, cache string
+		code         int
+		want         string
+	}{
+		// Params given explicitly as JSON.
+		{"method=Test&params=%5B%22a%22%2C%22b%22%5D&id=5", "max-age=60", http.StatusOK,
+			`{"jsonrpc":"2.0","id":5,"result":"a b"}`},
+
+		// Params gathered from the remaining query fields.
+		{"method=Greet&name=alice", "max-age=60", http.StatusOK,
+			`{"jsonrpc":"2.0","id":null,"result":"hello, alice"}`},
+
+		// A non-JSON ID is encoded as a string.
+		{"method=Test&id=abc", "max-age=60", http.StatusOK,
+			`{"jsonrpc":"2.0","id":"abc","result":""}`},
+
+		// A JSON-RPC error is reported in the body, and not cached.
+		{"method=Missing&id=1", "no-store", http.StatusOK,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"no such method \"Missing\""}}`},
+
+		// Methods not listed may not be called via GET.
+		{"method=Unsafe", "no-store", http.StatusForbidden, ""},
+
+		// Batches are not supported via GET.
+		{"method=Test&method=Greet", "no-store", http.StatusBadRequest, ""},
+
+		// Malformed queries.
+		{"", "no-store", http.StatusBadRequest, ""},
+		{"method=Test&params=%5B", "no-store", http.StatusBadRequest, ""},
+		{"method=Test&params=%5B%5D&x=y", "no-store", http.StatusBadRequest, ""},
+		{"method=Greet&name=a&name=b", "no-store", http.StatusBadRequest, ""},
+
+		// Queries exceeding the length limit.
+		{"method=Test&x=" + strings.Repeat("x", 100), "no-store", http.StatusRequestURITooLong, ""},
+	}
+	for _, test := range tests {
+		rsp, err := http.Get(hsrv.URL + "?" + test.query)
+		if err != nil {
+			t.Fatalf("GET %q failed: %v", test.query, err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Errorf("Reading GET %q body: %v", test.query, err)
+		}
+		if got := rsp.StatusCode; got != test.code {
+			t.Errorf("GET %q status: got %v, want %v", test.query, got, test.code)
+		}
+		if got := rsp.Header.Get("Cache-Control"); got != test.cache {
+			t.Errorf("GET %q Cache-Control: got %q, want %q", test.query, got, test.cache)
+		}
+		if test.want != "" && string(body) != test.want {
+			t.Errorf("GET %q body: got %#q, want %#q", test.query, string(body), test.want)
+		}
+	}
+
+	// POST requests should still work, and other methods are rejected.
+	req, err := http.NewRequest("PUT", hsrv.URL, strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("PUT status: got %v, want %v", got, want)
+	}
+	if got, want := rsp.Header.Get("Allow"), "GET, POST"; got != want {
+		t.Errorf("PUT Allow: got %q, want %q", got, want)
+	}
+}
+
+func TestBridgeCORS(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, ss ...string) (string, error) {
+			return strings.Join(ss, " "), nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	newServer := func(opts *BridgeOptions) *httptest.Server {
+		b := NewBridgeWithOptions(loc.Client, opts)
+		return httptest.NewServer(b)
+	}
+	do := func(t *testing.T, url, method, origin, ctype string, hdrs map[string]string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Test"}`))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		for key, val := range hdrs {
+			req.Header.Set(key, val)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", method, err)
+		}
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return rsp
+	}
+	checkHeaders := func(t *testing.T, rsp *http.Response, want map[string]string) {
+		t.Helper()
+		for key, val := range want {
+			if got := rsp.Header.Get(key); got != val {
+				t.Errorf("Header %s: got %q, want %q", key, got, val)
+			}
+		}
+	}
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type, x-token",
+	}
+
+	hsrv := newServer(&BridgeOptions{
+		AllowOrigins:     []string{"https://good.example"},
+		AllowOrigin:      func(o string) bool { return strings.HasSuffix(o, ".trusted.example") },
+		AllowHeaders:     []string{"X-Token"},
+		AllowCredentials: true,
+		CORSMaxAge:       10 * time.Minute,
+	})
+	defer hsrv.Close()
+
+	t.Run("Preflight", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "OPTIONS", "https://good.example", "", preflight)
+		if got, want := rsp.StatusCode, http.StatusNoContent; got != want {
+			t.Errorf("Preflight status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":      "https://good.example",
+			"Access-Control-Allow-Methods":     "POST",
+			"Access-Control-Allow-Headers":     "Content-Type, X-Token",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Max-Age":           "600",
+			"Vary":                             "Origin",
+		})
+	})
+
+	t.Run("PreflightPredicate", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "OPTIONS", "https://a.trusted.example", "", preflight)
+		if got, want := rsp.StatusCode, http.StatusNoContent; got != want {
+			t.Errorf("Preflight status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin": "https://a.trusted.example",
+		})
+	})
+
+	t.Run("PreflightDisallowed", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "OPTIONS", "https://evil.example", "", preflight)
+		if got, want := rsp.StatusCode, http.StatusForbidden; got != want {
+			t.Errorf("Preflight status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+		})
+	})
+
+	t.Run("SimpleRequest", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "POST", "https://good.example", "application/json", nil)
+		if got, want := rsp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("POST status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":      "https://good.example",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "", // only on preflight
+		})
+	})
+
+	t.Run("ErrorResponse", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "POST", "https://good.example", "text/plain", nil)
+		if got, want := rsp.StatusCode, http.StatusUnsupportedMediaType; got != want {
+			t.Errorf("POST status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin": "https://good.example",
+		})
+	})
+
+	t.Run("DisallowedOrigin", func(t *testing.T) {
+		rsp := do(t, hsrv.URL, "POST", "https://evil.example", "application/json", nil)
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":      "",
+			"Access-Control-Allow-Credentials": "",
+		})
+	})
+
+	t.Run("Wildcard", func(t *testing.T) {
+		wsrv := newServer(&BridgeOptions{
+			AllowOrigins:     []string{"*", "https://good.example"},
+			AllowCredentials: true,
+		})
+		defer wsrv.Close()
+
+		// A wildcard match does not permit credentials.
+		rsp := do(t, wsrv.URL, "OPTIONS", "https://any.example", "", preflight)
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "",
+			"Access-Control-Max-Age":           "",
+		})
+
+		// An explicitly-named origin does.
+		rsp = do(t, wsrv.URL, "POST", "https://good.example", "application/json", nil)
+		checkHeaders(t, rsp, map[string]string{
+			"Access-Control-Allow-Origin":      "https://good.example",
+			"Access-Control-Allow-Credentials": "true",
+		})
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		dsrv := newServer(nil)
+		defer dsrv.Close()
+
+		rsp := do(t, dsrv.URL, "OPTIONS", "https://good.example", "", preflight)
+		if got, want := rsp.StatusCode, http.StatusMethodNotAllowed; got != want {
+			t.Errorf("Preflight status: got %v, want %v", got, want)
+		}
+		checkHeaders(t, rsp, map[string]string{"Access-Control-Allow-Origin": ""})
+	})
+}
+
+func TestSSEBridge(t *testing.T) {
+	b := NewSSEBridge(handler.Map{
+		"Work": handler.New(func(ctx context.Context, ss []string) (string, error) {
+			for _, s := range ss {
+				if err := jrpc2.PushNotify(ctx, "progress", []string{s}); err != nil {
+					return "", err
+				}
+			}
+			rsp, err := jrpc2.PushCall(ctx, "confirm", []string{"proceed?"})
+			if err != nil {
+				return "", err
+			}
+			var answer string
+			if err := rsp.UnmarshalResult(&answer); err != nil {
+				return "", err
+			}
+			return "done: " + answer, nil
+		}),
+	}, nil)
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	notes := make(chan string, 3)
+	ch := NewSSEChannel(hsrv.URL)
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+		OnNotify: func(req *jrpc2.Request) {
+			var ss []string
+			if err := req.UnmarshalParams(&ss); err != nil {
+				t.Errorf("Invalid notification params: %v", err)
+			}
+			notes <- req.Method() + ":" + strings.Join(ss, ",")
+		},
+		OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			if req.Method() != "confirm" {
+				return nil, errors.New("unexpected callback")
+			}
+			return "yes", nil
+		},
+	})
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Work", []string{"a", "b", "c"}, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if want := "done: yes"; got != want {
+		t.Errorf("Call: got %q, want %q", got, want)
+	}
+	if ch.Session() == "" {
+		t.Error("No session token was assigned")
+	}
+
+	// The client does not guarantee the order of delivery for notifications.
+	var recv []string
+	for len(recv) < 3 {
+		select {
+		case note := <-notes:
+			recv = append(recv, note)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for notifications; got %q", recv)
+		}
+	}
+	cli.Close()
+	sort.Strings(recv)
+	if want := []string{"progress:a", "progress:b", "progress:c"}; strings.Join(recv, " ") != strings.Join(want, " ") {
+		t.Errorf("Notifications: got %q, want %q", recv, want)
+	}
+	if n := b.Dropped(); n != 0 {
+		t.Errorf("Dropped: got %d, want 0", n)
+	}
+}
+
+func TestSSEBridgeResume(t *testing.T) {
+	b := NewSSEBridge(handler.Map{
+		"Emit": handler.New(func(ctx context.Context, ss []string) error {
+			for _, s := range ss {
+				if err := jrpc2.PushNotify(ctx, "note", []string{s}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}, &SSEOptions{BufferSize: 2})
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	do := func(method, session, lastID, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, hsrv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if session != "" {
+			req.Header.Set(SessionHeader, session)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", method, err)
+		}
+		return rsp
+	}
+	// readN reads n events from the stream, then closes it.
+	readN := func(rsp *http.Response, n int) []string {
+		t.Helper()
+		defer rsp.Body.Close()
+		var got []string
+		err := readEvents(rsp.Body, func(id string, data []byte) {
+			got = append(got, id+"="+string(data))
+			if len(got) == n {
+				rsp.Body.Close()
+			}
+		})
+		if err == nil || len(got) != n {
+			t.Errorf("Reading events: got %d, err=%v", len(got), err)
+		}
+		return got
+	}
+
+	// With no stream connected, pushes are buffered and the oldest dropped.
+	rsp := do("POST", "", "", `{"jsonrpc":"2.0","id":1,"method":"Emit","params":["x","y","z"]}`)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("POST status: got %v, want OK", rsp.Status)
+	}
+	session := rsp.Header.Get(SessionHeader)
+	if session == "" {
+		t.Fatal("No session token in POST response")
+	}
+	if n := b.Dropped(); n != 1 {
+		t.Errorf("Dropped: got %d, want 1", n)
+	}
+
+	const (
+		noteY = `{"jsonrpc":"2.0","method":"note","params":["y"]}`
+		noteZ = `{"jsonrpc":"2.0","method":"note","params":["z"]}`
+	)
+	got := readN(do("GET", session, "", ""), 2)
+	if want := []string{"2=" + noteY, "3=" + noteZ}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Events: got %q, want %q", got, want)
+	}
+
+	// Reconnecting with Last-Event-ID replays the events that follow it.
+	got = readN(do("GET", session, "2", ""), 1)
+	if want := []string{"3=" + noteZ}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Resumed events: got %q, want %q", got, want)
+	}
+
+	// A notification posted by the client gets no content.
+	rsp = do("POST", session, "", `{"jsonrpc":"2.0","method":"Emit","params":[]}`)
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("POST notification status: got %v, want %v", got, want)
+	}
+
+	// Unknown sessions are rejected, and a deleted session is gone.
+	rsp = do("GET", "bogus", "", "")
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("GET unknown session: got %v, want %v", got, want)
+	}
+	rsp = do("DELETE", session, "", "")
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("DELETE status: got %v, want %v", got, want)
+	}
+	rsp = do("POST", session, "", `{"jsonrpc":"2.0","id":2,"method":"Emit"}`)
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("POST after DELETE: got %v, want %v", got, want)
+	}
+}
+
+func TestSSEBridgeMetadata(t *testing.T) {
+	b := NewSSEBridge(handler.Map{
+		"Who": handler.New(func(ctx context.Context) (string, error) {
+			req, ok := jrpc2.ChannelMetadata(ctx).(*http.Request)
+			if !ok {
+				return "", errors.New("no HTTP request in metadata")
+			}
+			return req.Header.Get("X-User"), nil
+		}),
+	}, nil)
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	for _, user := range []string{"alice", "bob"} {
+		req, err := http.NewRequest("POST", hsrv.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Who"}`))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		want := `{"jsonrpc":"2.0","id":1,"result":"` + user + `"}`
+		if got := string(body); got != want {
+			t.Errorf("POST body: got %#q, want %#q", got, want)
+		}
+	}
+}
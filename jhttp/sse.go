@@ -0,0 +1,726 @@
+package jhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// SessionHeader is the HTTP header used by an SSEBridge to identify a session.
+const SessionHeader = "X-JSON-RPC-Session"
+
+// An SSEBridge is a http.Handler that serves a separate JSON-RPC server for
+// each client session, and delivers server push messages (notifications and
+// callbacks) to the client as a stream of Server-Sent Events (SSE).
+//
+// A session is created by the first request that does not carry a session
+// token. The bridge reports the token for the new session in the
+// X-JSON-RPC-Session response header, and the client must include it with
+// each subsequent request. For a GET request the token may instead be given
+// as the "session" query parameter, since browser EventSource clients cannot
+// set request headers.
+//
+// A POST request delivers JSON-RPC messages to the server for the session,
+// and its response contains the replies, as for a Bridge. The session channel
+// implements channel.Metadata, so handlers can retrieve the *http.Request for
+// the POST that delivered a call using jrpc2.ChannelMetadata. A POST may also
+// carry the client's replies to server callbacks, in which case the bridge
+// reports 204 (No Content).
+//
+// A GET request opens the event stream for the session. Each push message
+// from the server is sent as a single event whose data is the JSON-RPC
+// message and whose ID is a sequence number. While no stream is connected,
+// pushes are buffered, up to SSEOptions.BufferSize messages; once the buffer
+// is full the oldest messages are discarded. A client that reconnects with a
+// Last-Event-ID header receives the buffered messages that follow that ID.
+// Only one stream may be connected to a session at a time; a new stream
+// replaces the old one.
+//
+// A DELETE request ends the session.
+type SSEBridge struct {
+	mux     jrpc2.Assigner
+	opts    *jrpc2.ServerOptions
+	bufSize int
+	dropped int64 // atomic: count of push messages discarded
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewSSEBridge constructs a new SSEBridge that serves the methods of mux.  A
+// nil *SSEOptions provides sensible defaults.
+func NewSSEBridge(mux jrpc2.Assigner, opts *SSEOptions) *SSEBridge {
+	var sopts jrpc2.ServerOptions
+	if s := opts.serverOptions(); s != nil {
+		sopts = *s
+	}
+	sopts.AllowPush = true
+	return &SSEBridge{
+		mux:      mux,
+		opts:     &sopts,
+		bufSize:  opts.bufferSize(),
+		sessions: make(map[string]*session),
+	}
+}
+
+// SSEOptions are optional settings for an SSEBridge. A nil pointer is ready for
+// use and provides default values as described.
+type SSEOptions struct {
+	// Options for the server started for each session. The AllowPush option is
+	// always enabled.
+	Server *jrpc2.ServerOptions
+
+	// The maximum number of push messages buffered for each session.
+	// If zero, a default of 64 is used.
+	BufferSize int
+}
+
+func (o *SSEOptions) serverOptions() *jrpc2.ServerOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Server
+}
+
+func (o *SSEOptions) bufferSize() int {
+	if o == nil || o.BufferSize <= 0 {
+		return 64
+	}
+	return o.BufferSize
+}
+
+// Dropped reports the total number of push messages that were discarded
+// before they could be delivered to a client, across all sessions.
+func (b *SSEBridge) Dropped() int64 { return atomic.LoadInt64(&b.dropped) }
+
+// Close ends all active sessions and waits for their servers to exit.
+func (b *SSEBridge) Close() error {
+	b.mu.Lock()
+	var active []*session
+	for _, s := range b.sessions {
+		active = append(active, s)
+	}
+	b.mu.Unlock()
+	for _, s := range active {
+		s.Close()
+		s.srv.Wait()
+	}
+	return nil
+}
+
+// ServeHTTP implements the required method of http.Handler.
+func (b *SSEBridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(SessionHeader)
+	if token == "" && req.Method == "GET" {
+		token = req.URL.Query().Get("session")
+	}
+	switch req.Method {
+	case "POST":
+		if req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+	case "GET":
+	case "DELETE":
+		if s := b.session(token); s != nil {
+			b.mu.Lock()
+			delete(b.sessions, s.id)
+			b.mu.Unlock()
+			s.Close()
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	default:
+		w.Header().Set("Allow", "DELETE, GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var s *session
+	if token == "" {
+		var err error
+		s, err = b.newSession()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+	} else if s = b.session(token); s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "unknown session %q\n", token)
+		return
+	}
+	w.Header().Set(SessionHeader, s.id)
+	if req.Method == "GET" {
+		s.stream(w, req)
+	} else if code, err := s.post(w, req); err != nil {
+		w.WriteHeader(code)
+		fmt.Fprintln(w, err.Error())
+	}
+}
+
+func (b *SSEBridge) session(token string) *session {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sessions[token]
+}
+
+func (b *SSEBridge) newSession() (*session, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:      hex.EncodeToString(buf[:]),
+		in:      make(chan posted),
+		done:    make(chan struct{}),
+		wait:    make(map[string]chan json.RawMessage),
+		bufSize: b.bufSize,
+		dropped: &b.dropped,
+		next:    1,
+		ready:   make(chan struct{}),
+	}
+	s.srv = jrpc2.NewServer(b.mux, b.opts).Start(s)
+
+	b.mu.Lock()
+	b.sessions[s.id] = s
+	b.mu.Unlock()
+	go func() {
+		s.srv.Wait()
+		s.Close()
+		b.mu.Lock()
+		delete(b.sessions, s.id)
+		b.mu.Unlock()
+	}()
+	return s, nil
+}
+
+// A session is the server side of an SSEBridge session.  It implements the
+// channel.Channel interface for the session server: Messages posted by the
+// client are delivered by Recv, responses sent by the server are routed back
+// to the waiting POST requests, and push messages are buffered for the event
+// stream.
+type session struct {
+	id      string
+	srv     *jrpc2.Server
+	in      chan posted   // messages posted by the client
+	done    chan struct{} // closed when the session ends
+	meta    *http.Request // the request for the last message received
+	once    sync.Once
+	bufSize int
+	dropped *int64
+
+	mu     sync.Mutex
+	wait   map[string]chan json.RawMessage // pending replies, by request ID
+	events []event                         // buffered push messages, oldest first
+	next   int64                           // ID of the next event
+	sent   int64                           // highest event ID written to a stream
+	ready  chan struct{}                   // closed and replaced when events are added
+	stop   chan struct{}                   // closed to end the current stream
+}
+
+// A posted message is the body of a POST request to the session.
+type posted struct {
+	data []byte
+	req  *http.Request
+}
+
+type event struct {
+	id   int64
+	data []byte
+}
+
+// Recv implements part of the channel.Channel interface.
+func (s *session) Recv() ([]byte, error) {
+	select {
+	case msg := <-s.in:
+		s.meta = msg.req
+		return msg.data, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+// Send implements part of the channel.Channel interface. Responses are routed
+// to the requests waiting for them, and other messages are buffered as events.
+func (s *session) Send(msg []byte) error {
+	msgs, _, err := splitMessages(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range msgs {
+		// Copy the message, since the caller may reuse msg. Compaction also
+		// ensures the message fits on a single line of the event stream.
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, m.raw); err != nil {
+			return err
+		}
+		if m.Method != "" {
+			s.pushLocked(buf.Bytes())
+		} else if ch, ok := s.wait[m.id()]; ok {
+			delete(s.wait, m.id())
+			ch <- buf.Bytes() // buffered
+		}
+	}
+	return nil
+}
+
+// Metadata implements the channel.Metadata interface. It returns the HTTP
+// request that delivered the message most recently returned by Recv.
+func (s *session) Metadata() interface{} { return s.meta }
+
+// Close implements part of the channel.Channel interface.
+func (s *session) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+// pushLocked adds an event to the buffer, discarding the oldest buffered event
+// if the buffer is full. The caller must hold s.mu.
+func (s *session) pushLocked(data []byte) {
+	if len(s.events) == s.bufSize {
+		if s.events[0].id > s.sent {
+			atomic.AddInt64(s.dropped, 1) // never delivered
+		}
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, event{id: s.next, data: data})
+	s.next++
+	close(s.ready)
+	s.ready = make(chan struct{})
+}
+
+// post delivers the body of req to the session server, and writes the replies
+// to w. If it fails, post returns an HTTP status code and an error.
+func (s *session) post(w http.ResponseWriter, req *http.Request) (int, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	msgs, batch, err := splitMessages(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// Register a reply slot for each request that expects a response, so that
+	// they are in place before the server can answer.
+	var ids []string
+	reply := make(map[string]chan json.RawMessage)
+	s.mu.Lock()
+	for _, m := range msgs {
+		id := m.id()
+		if m.Method == "" || id == "" || id == "null" {
+			continue // notification or callback reply
+		} else if _, ok := s.wait[id]; ok {
+			s.mu.Unlock()
+			s.cancel(ids)
+			return http.StatusConflict, fmt.Errorf("duplicate request ID %s", id)
+		}
+		ch := make(chan json.RawMessage, 1)
+		s.wait[id] = ch
+		reply[id] = ch
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.in <- posted{data: body, req: req}:
+	case <-s.done:
+		s.cancel(ids)
+		return http.StatusGone, errors.New("session closed")
+	case <-req.Context().Done():
+		s.cancel(ids)
+		return http.StatusServiceUnavailable, req.Context().Err()
+	}
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+
+	rsps := make([]json.RawMessage, len(ids))
+	for i, id := range ids {
+		select {
+		case rsps[i] = <-reply[id]:
+		case <-s.done:
+			s.cancel(ids)
+			return http.StatusGone, errors.New("session closed")
+		case <-req.Context().Done():
+			s.cancel(ids)
+			return http.StatusServiceUnavailable, req.Context().Err()
+		}
+	}
+	var out []byte
+	if len(rsps) == 1 && !batch {
+		out = rsps[0]
+	} else if out, err = json.Marshal(rsps); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+	return 0, nil
+}
+
+// cancel discards the reply slots for the specified request IDs.
+func (s *session) cancel(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.wait, id)
+	}
+}
+
+// stream writes buffered and subsequent events to w until the client goes
+// away, the session ends, or another stream replaces this one.
+func (s *session) stream(w http.ResponseWriter, req *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "streaming is not supported")
+		return
+	}
+
+	stop := make(chan struct{})
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.stop = stop
+	last := s.sent
+	if v := req.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid Last-Event-ID %q\n", v)
+			return
+		}
+		last = id
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		s.mu.Lock()
+		var next []event
+		for _, e := range s.events {
+			if e.id > last {
+				next = append(next, e)
+			}
+		}
+		ready := s.ready
+		s.mu.Unlock()
+
+		for _, e := range next {
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.id, e.data); err != nil {
+				return
+			}
+			last = e.id
+		}
+		if len(next) != 0 {
+			f.Flush()
+			s.mu.Lock()
+			if last > s.sent {
+				s.sent = last
+			}
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-ready:
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// A message records the parts of a JSON-RPC message needed to route it.
+type message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	raw    json.RawMessage
+}
+
+// id returns the compacted encoding of the message ID, or "" if it has none.
+func (m *message) id() string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, m.ID) != nil {
+		return string(m.ID)
+	}
+	return buf.String()
+}
+
+// splitMessages decodes a single JSON-RPC message or a batch, and reports
+// whether the input was a batch.
+func splitMessages(data []byte) ([]*message, bool, error) {
+	var raw []json.RawMessage
+	batch := len(bytes.TrimSpace(data)) != 0 && bytes.TrimSpace(data)[0] == '['
+	if batch {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, false, err
+		}
+	} else {
+		raw = []json.RawMessage{data}
+	}
+	msgs := make([]*message, len(raw))
+	for i, r := range raw {
+		var m message
+		if err := json.Unmarshal(r, &m); err != nil {
+			return nil, false, err
+		}
+		m.raw = r
+		msgs[i] = &m
+	}
+	return msgs, batch, nil
+}
+
+// An SSEChannel implements a channel.Channel that communicates with an
+// SSEBridge at a user-provided URL. Messages sent to the channel are posted
+// to the bridge, and both the replies and the push messages received from the
+// session event stream are delivered by Recv. This allows a *jrpc2.Client to
+// receive server notifications and callbacks via its OnNotify and OnCallback
+// hooks.
+//
+// If the event stream is interrupted, the channel reconnects and resumes from
+// the last event received. If the session has ended, Recv reports an error.
+type SSEChannel struct {
+	url    string
+	cli    *http.Client
+	msgs   chan sseMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	session string // set once the stream is connected
+}
+
+type sseMessage struct {
+	data []byte
+	err  error
+}
+
+// NewSSEChannel constructs a new channel that communicates with an SSEBridge
+// at the specified URL. The session is created by the first Send.
+func NewSSEChannel(url string) *SSEChannel {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SSEChannel{
+		url:    url,
+		cli:    http.DefaultClient,
+		msgs:   make(chan sseMessage),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Session returns the session token for c, or "" if c is not yet connected.
+func (c *SSEChannel) Session() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// Send forwards msg to the bridge as the body of an HTTP POST request. The
+// first call to Send also connects the event stream for the session.
+func (c *SSEChannel) Send(msg []byte) error {
+	session, err := c.connect()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SessionHeader, session)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		rsp, err := c.cli.Do(req)
+		if err != nil {
+			c.deliver(sseMessage{err: err})
+			return
+		}
+		data, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		switch rsp.StatusCode {
+		case http.StatusOK:
+			c.deliver(sseMessage{data: data, err: err})
+		case http.StatusNoContent:
+			// ok, but no message to report
+		default:
+			c.deliver(sseMessage{err: fmt.Errorf("unexpected HTTP status %s", rsp.Status)})
+		}
+	}()
+	return nil
+}
+
+// Recv receives the next available reply or push message.
+func (c *SSEChannel) Recv() ([]byte, error) {
+	select {
+	case m := <-c.msgs:
+		return m.data, m.err
+	case <-c.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+// Close ends the session and shuts down the channel, discarding any pending
+// messages.
+func (c *SSEChannel) Close() error {
+	if session := c.Session(); session != "" {
+		if req, err := http.NewRequest("DELETE", c.url, nil); err == nil {
+			req.Header.Set(SessionHeader, session)
+			if rsp, err := c.cli.Do(req); err == nil {
+				rsp.Body.Close()
+			}
+		}
+	}
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *SSEChannel) deliver(m sseMessage) {
+	select {
+	case c.msgs <- m:
+	case <-c.ctx.Done():
+	}
+}
+
+// connect opens the event stream for c, if it is not already open, and
+// returns the session token.
+func (c *SSEChannel) connect() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != "" {
+		return c.session, nil
+	} else if c.ctx.Err() != nil {
+		return "", errors.New("channel is closed")
+	}
+	rsp, err := c.openStream("", "")
+	if err != nil {
+		return "", err
+	}
+	c.session = rsp.Header.Get(SessionHeader)
+	c.wg.Add(1)
+	go c.readStream(c.session, rsp.Body)
+	return c.session, nil
+}
+
+func (c *SSEChannel) openStream(session, lastID string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if session != "" {
+		req.Header.Set(SessionHeader, session)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	rsp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, err
+	} else if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status %s", rsp.Status)
+	}
+	return rsp, nil
+}
+
+// readStream delivers events from the stream body to the receiver, and
+// reconnects if the stream is interrupted before the channel is closed.
+func (c *SSEChannel) readStream(session string, body io.ReadCloser) {
+	defer c.wg.Done()
+	var lastID string
+	for {
+		err := readEvents(body, func(id string, data []byte) {
+			if id != "" {
+				lastID = id
+			}
+			c.deliver(sseMessage{data: data})
+		})
+		body.Close()
+		if c.ctx.Err() != nil {
+			return
+		}
+		rsp, rerr := c.openStream(session, lastID)
+		if rerr != nil {
+			if c.ctx.Err() == nil {
+				c.deliver(sseMessage{err: fmt.Errorf("event stream: %v (reconnect: %v)", err, rerr)})
+			}
+			return
+		}
+		body = rsp.Body
+	}
+}
+
+// readEvents parses server-sent events from r and calls f for each event that
+// has data, until r reports an error.
+func readEvents(r io.Reader, f func(id string, data []byte)) error {
+	br := bufio.NewReader(r)
+	var id string
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if data != nil {
+				f(id, data)
+			}
+			id, data = "", nil
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i == 0 {
+			continue // comment
+		} else if i > 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		}
+	}
+}
@@ -1,10 +1,23 @@
 package jrpc2_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -14,6 +27,7 @@ import (
 	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/handler"
 	"github.com/creachadair/jrpc2/jctx"
+	"github.com/creachadair/jrpc2/metrics/expmetrics"
 	"github.com/creachadair/jrpc2/server"
 	"github.com/google/go-cmp/cmp"
 )
@@ -169,6 +183,28 @@ func TestCallResult(t *testing.T) {
 			t.Errorf("CallResult %q %v: got %v, want %v", test.method, test.params, got, test.want)
 		}
 	}
+
+	// A nil result discards the value, reporting only success.
+	if err := c.CallResult(ctx, "Test.Nil", nil, nil); err != nil {
+		t.Errorf("CallResult Test.Nil with nil result: unexpected error: %v", err)
+	}
+
+	// An error from the server is reported as such.
+	var got int
+	err := c.CallResult(ctx, "Test.Max", nil, &got)
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InvalidParams {
+		t.Errorf("CallResult Test.Max: got %v, want %v error", err, code.InvalidParams)
+	}
+	if err := c.CallResult(ctx, "Test.Max", nil, nil); err == nil {
+		t.Error("CallResult Test.Max with nil result: got nil error, want failure")
+	}
+
+	// A result of the wrong type is reported as a decoding error.
+	var wrong struct{ X int }
+	err = c.CallResult(ctx, "Test.Nil", nil, &wrong)
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		t.Errorf("CallResult Test.Nil into %T: got %v, want *json.UnmarshalTypeError", wrong, err)
+	}
 }
 
 func TestBatch(t *testing.T) {
@@ -221,6 +257,50 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+// Verify that the responses to a batch are returned in the order of their
+// specs, omitting notifications, and that the failure of one call is reported
+// by its own response without affecting the others.
+func TestBatchResponses(t *testing.T) {
+	var notes int32
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(_ context.Context, ss []string) string { return strings.Join(ss, " ") }),
+		"Fail": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.Code(-29999), "failed")
+		}),
+		"Note": handler.New(func(context.Context) error {
+			atomic.AddInt32(&notes, 1)
+			return nil
+		}),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{Concurrency: 4}})
+	defer loc.Close()
+
+	rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Echo", Params: []string{"first"}},
+		{Method: "Note", Notify: true},
+		{Method: "Fail"},
+		{Method: "Echo", Params: []string{"last"}},
+	})
+	if err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+	var got []string
+	for _, rsp := range rsps {
+		if err := rsp.Error(); err != nil {
+			got = append(got, fmt.Sprintf("error %d", err.Code()))
+		} else {
+			got = append(got, rsp.ResultString())
+		}
+	}
+	want := []string{`"first"`, "error -29999", `"last"`}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Batch responses (-want, +got):\n%s", diff)
+	}
+	loc.Close()
+	if n := atomic.LoadInt32(&notes); n != 1 {
+		t.Errorf("Notification handled %d times, want 1", n)
+	}
+}
+
 // Verify that notifications respect order of arrival.
 func TestNotificationOrder(t *testing.T) {
 	var last int32
@@ -331,799 +411,6730 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
-// Verify that stopping the server terminates in-flight requests.
-func TestServerStopCancellation(t *testing.T) {
-	started := make(chan struct{})
-	stopped := make(chan error, 1)
-	loc := server.NewLocal(handler.Map{
-		"Hang": handler.New(func(ctx context.Context) (bool, error) {
-			close(started) // signal that the method handler is running
-			<-ctx.Done()
-			return true, ctx.Err()
+// Verify that context errors returned by handlers, including wrapped ones,
+// are reported with the standard codes for cancellation and deadlines, and
+// that the client reports them as context errors.
+func TestContextErrorCodes(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"Cancel": handler.New(func(context.Context) error {
+			return fmt.Errorf("fetch: %w", context.Canceled)
 		}),
-	}, nil)
-	defer loc.Close()
-	s, c := loc.Server, loc.Client
-
-	// Call the server. The method will hang until its context is cancelled,
-	// which should happen when the server stops.
-	go func() {
-		defer close(stopped)
-		_, err := c.Call(context.Background(), "Hang", nil)
-		stopped <- err
+		"Deadline": handler.New(func(context.Context) error {
+			return fmt.Errorf("fetch: %w", context.DeadlineExceeded)
+		}),
+		"Coded": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.SystemError, "wrapped: %v", context.Canceled)
+		}),
+	}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
 	}()
 
-	// Wait until the client method is running so we know we are testing at the
-	// right time, i.e., with a request in flight.
-	<-started
-	s.Stop()
-	select {
-	case <-time.After(30 * time.Second):
-		t.Error("Timed out waiting for service handler to fail")
-	case err := <-stopped:
-		if ec := code.FromError(err); ec != code.Cancelled {
-			t.Errorf("Client error: got %v (%v), wanted code %v", err, ec, code.Cancelled)
+	tests := []struct {
+		method, want string
+	}{
+		{"Cancel", `{"jsonrpc":"2.0","id":1,"error":{"code":-32097,"message":"fetch: context canceled"}}`},
+		{"Deadline", `{"jsonrpc":"2.0","id":1,"error":{"code":-32096,"message":"fetch: context deadline exceeded"}}`},
+		{"Coded", `{"jsonrpc":"2.0","id":1,"error":{"code":-32098,"message":"wrapped: context canceled"}}`},
+	}
+	for _, test := range tests {
+		req := `{"jsonrpc":"2.0","id":1,"method":"` + test.method + `"}`
+		if err := cli.Send([]byte(req)); err != nil {
+			t.Fatalf("Send %s: %v", test.method, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv %s: %v", test.method, err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("%s: got %#q, want %#q", test.method, got, test.want)
 		}
 	}
-}
 
-// Test that a handler can cancel an in-flight request with jrpc2.CancelRequest.
-func TestHandlerCancel(t *testing.T) {
-	ready := make(chan struct{})
+	// The client maps the codes back to context errors.
 	loc := server.NewLocal(handler.Map{
-		"Stall": handler.New(func(ctx context.Context) error {
-			close(ready)
-			t.Log("Stall handler: waiting for context cancellation")
-			<-ctx.Done()
-			return ctx.Err()
+		"Cancel": handler.New(func(context.Context) error {
+			return fmt.Errorf("fetch: %w", context.Canceled)
 		}),
-		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) error {
-			var id string
-			if err := req.UnmarshalParams(&handler.Args{&id}); err != nil {
-				return err
-			}
-			t.Logf("Test handler: cancelling %q...", id)
-			jrpc2.CancelRequest(ctx, id)
-			return nil
+		"Deadline": handler.New(func(context.Context) error {
+			return fmt.Errorf("fetch: %w", context.DeadlineExceeded)
 		}),
 	}, nil)
 	defer loc.Close()
-
 	ctx := context.Background()
+	for _, test := range []struct {
+		method string
+		want   error
+		code   code.Code
+	}{
+		{"Cancel", context.Canceled, code.Cancelled},
+		{"Deadline", context.DeadlineExceeded, code.DeadlineExceeded},
+	} {
+		_, err := loc.Client.Call(ctx, test.method, nil)
+		if !errors.Is(err, test.want) {
+			t.Errorf("Call %s: got error %v, want %v", test.method, err, test.want)
+		}
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("Call %s: got code %v, want %v", test.method, c, test.code)
+		}
+	}
+}
 
-	// Start a call in the background that will stall until cancelled.
-	errc := make(chan error, 1)
-	go func() {
-		_, err := loc.Client.Call(ctx, "Stall", nil)
-		errc <- err
-		close(errc)
-	}()
-
-	// Wait until the handler is in progress.
-	<-ready
+// Verify that interceptors are applied around each handler in order, that
+// they may rewrite the request and the error, and that they observe calls to
+// methods that do not exist.
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) jrpc2.Interceptor {
+		return func(ctx context.Context, req *jrpc2.Request, next func(context.Context, *jrpc2.Request) (interface{}, error)) (interface{}, error) {
+			mu.Lock()
+			trace = append(trace, name+" "+req.Method())
+			mu.Unlock()
+			return next(ctx, req)
+		}
+	}
 
-	// Call the test method to cancel the stalled method, and verify that we got
-	// back the expected error.
-	if _, err := loc.Client.Call(ctx, "Test", []string{"1"}); err != nil {
-		t.Errorf("Test call failed: %v", err)
+	// Convert plain errors and unknown methods to custom codes.
+	convert := func(ctx context.Context, req *jrpc2.Request, next func(context.Context, *jrpc2.Request) (interface{}, error)) (interface{}, error) {
+		v, err := next(ctx, req)
+		if code.FromError(err) == code.MethodNotFound {
+			return nil, jrpc2.Errorf(404, "not here: %s", req.Method())
+		} else if _, ok := err.(*jrpc2.Error); err != nil && !ok {
+			return nil, jrpc2.Errorf(500, "converted: %v", err)
+		}
+		return v, err
 	}
 
-	err := <-errc
-	got := code.FromError(err)
-	if got != code.Cancelled {
-		t.Errorf("Stall: got %v (%v), want %v", err, got, code.Cancelled)
-	} else {
-		t.Logf("Cancellation succeeded, got expected error: %v", err)
+	// Add an extra summand to the parameters of Sum.
+	rewrite := func(ctx context.Context, req *jrpc2.Request, next func(context.Context, *jrpc2.Request) (interface{}, error)) (interface{}, error) {
+		if req.Method() == "Sum" {
+			var vs []int
+			if err := req.UnmarshalParams(&vs); err != nil {
+				return nil, err
+			}
+			nreq, err := req.WithParams(append(vs, 100))
+			if err != nil {
+				return nil, err
+			}
+			req = nreq
+		}
+		return next(ctx, req)
 	}
-}
 
-// Test that an error with data attached to it is correctly propagated back
-// from the server to the client, in a value of concrete type *Error.
-func TestErrors(t *testing.T) {
-	const errCode = -32000
-	const errData = `{"caroline":452}`
-	const errMessage = "error thingy"
 	loc := server.NewLocal(handler.Map{
-		"Err": handler.New(func(_ context.Context) (int, error) {
-			return 17, jrpc2.DataErrorf(errCode, json.RawMessage(errData), errMessage)
-		}),
-		"Push": handler.New(func(ctx context.Context) (bool, error) {
-			return false, jrpc2.PushNotify(ctx, "PushBack", nil)
+		"Sum": handler.New(func(_ context.Context, vs []int) int {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
 		}),
-		"Code": handler.New(func(ctx context.Context) error {
-			return code.Code(12345).Err()
+		"Fail": handler.New(func(context.Context) error {
+			return errors.New("boom")
 		}),
 	}, &server.LocalOptions{
-		Client: &jrpc2.ClientOptions{
-			OnNotify: func(req *jrpc2.Request) {
-				t.Errorf("Client received unexpected push: %#v", req)
-			},
+		Server: &jrpc2.ServerOptions{
+			Interceptors: []jrpc2.Interceptor{record("A"), convert, rewrite, record("B")},
 		},
 	})
 	defer loc.Close()
-	c := loc.Client
+	ctx := context.Background()
 
-	if got, err := c.Call(context.Background(), "Err", nil); err == nil {
-		t.Errorf("Call(Push): got %#v, wanted error", got)
-	} else if e, ok := err.(*jrpc2.Error); ok {
-		if e.Code() != errCode {
-			t.Errorf("Error code: got %d, want %d", e.Code(), errCode)
-		}
-		if e.Message() != errMessage {
-			t.Errorf("Error message: got %q, want %q", e.Message(), errMessage)
-		}
-		var data json.RawMessage
-		if err := e.UnmarshalData(&data); err != nil {
-			t.Errorf("Unmarshaling error data: %v", err)
-		} else if s := string(data); s != errData {
-			t.Errorf("Error data: got %q, want %q", s, errData)
-		}
-	} else {
-		t.Fatalf("Call(Err): unexpected error: %v", err)
+	var sum int
+	if err := loc.Client.CallResult(ctx, "Sum", []int{1, 2, 3}, &sum); err != nil {
+		t.Errorf("Call Sum: unexpected error: %v", err)
+	} else if sum != 106 {
+		t.Errorf("Call Sum: got %d, want 106", sum)
 	}
-
-	if got, err := c.Call(context.Background(), "Push", nil); err == nil {
-		t.Errorf("Call(Push): got %#v, wanted error", got)
-	} else {
-		t.Logf("Call(Push): got expected error: %v", err)
+	if _, err := loc.Client.Call(ctx, "Fail", nil); code.FromError(err) != 500 {
+		t.Errorf("Call Fail: got %v, want code 500", err)
+	} else if e := err.(*jrpc2.Error); e.Message() != "converted: boom" {
+		t.Errorf("Call Fail: got message %q, want %q", e.Message(), "converted: boom")
+	}
+	if _, err := loc.Client.Call(ctx, "Missing", nil); code.FromError(err) != 404 {
+		t.Errorf("Call Missing: got %v, want code 404", err)
 	}
 
-	if got, err := c.Call(context.Background(), "Code", nil); err == nil {
-		t.Errorf("Call(Code): got %#v, wanted error", got)
-	} else if s, exp := err.Error(), "[12345] error code 12345"; s != exp {
-		t.Errorf("Call(Code): got error %q, want %q", s, exp)
+	want := []string{"A Sum", "B Sum", "A Fail", "B Fail", "A Missing", "B Missing"}
+	if diff := cmp.Diff(want, trace); diff != "" {
+		t.Errorf("Interceptor trace (-want, +got):\n%s", diff)
 	}
 }
 
-// Test that a client correctly reports bad parameters.
-func TestBadCallParams(t *testing.T) {
-	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(_ context.Context, v interface{}) error {
-			return jrpc2.Errorf(129, "this should not be reached")
+// Verify that when the client disconnects, the contexts of the requests still
+// in flight are cancelled.
+func TestDisconnectCancels(t *testing.T) {
+	started, stopped := make(chan struct{}), make(chan error, 1)
+	cconn, sconn := net.Pipe()
+	s := jrpc2.NewServer(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				stopped <- ctx.Err()
+			case <-time.After(10 * time.Second):
+				stopped <- errors.New("context was not cancelled")
+			}
+			return ctx.Err()
 		}),
-	}, nil)
-	defer loc.Close()
+	}, nil).Start(channel.Line(sconn, sconn))
 
-	rsp, err := loc.Client.Call(context.Background(), "Test", "bogus")
-	if err == nil {
-		t.Errorf("Call(Test): got %+v, wanted error", rsp)
-	} else if got, want := code.FromError(err), code.InvalidRequest; got != want {
-		t.Errorf("Call(Test): got code %v, want %v", got, want)
-	} else {
-		t.Logf("Call(Test): got expected error: %v", err)
+	cli := channel.Line(cconn, cconn)
+	if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Slow"}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	<-started
+	cli.Close()
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("Handler context: got %v, want %v", err, context.Canceled)
 	}
+	s.Wait()
 }
 
-// Verify that metrics are correctly propagated to server info.
-func TestServerInfo(t *testing.T) {
-	loc := server.NewLocal(handler.Map{
-		"Metricize": handler.New(func(ctx context.Context) (bool, error) {
-			m := jrpc2.ServerMetrics(ctx)
-			if m == nil {
-				t.Error("Request context does not contain a metrics writer")
-				return false, nil
-			}
-			m.Count("counters-written", 1)
-			m.Count("counters-written", 2)
+var errReset = errors.New("connection reset")
 
-			// Max value trackers are not accumulative.
-			m.SetMaxValue("max-metric-value", 1)
-			m.SetMaxValue("max-metric-value", 5)
-			m.SetMaxValue("max-metric-value", 3)
-			m.SetMaxValue("max-metric-value", -30337)
+// brokenSender is a channel whose Send method always fails with errReset.
+// If failed != nil, it is closed by the first call to Send.
+type brokenSender struct {
+	channel.Channel
+	failed chan struct{}
+}
 
-			// Counters are accumulative, and negative deltas subtract.
-			m.Count("zero-sum", 0)
-			m.Count("zero-sum", 15)
-			m.Count("zero-sum", -16)
-			m.Count("zero-sum", 1)
-			return true, nil
+func (b brokenSender) Send([]byte) error {
+	if b.failed != nil {
+		close(b.failed)
+	}
+	return errReset
+}
+
+// Verify that when a response cannot be written, the server stops and the
+// contexts of the requests still in flight are cancelled.
+func TestWriteErrorCancels(t *testing.T) {
+	started, stopped := make(chan struct{}), make(chan error, 1)
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				stopped <- ctx.Err()
+			case <-time.After(10 * time.Second):
+				stopped <- errors.New("context was not cancelled")
+			}
+			return ctx.Err()
 		}),
-	}, nil)
-	s, c := loc.Server, loc.Client
+		"Quick": testOK,
+	}, &jrpc2.ServerOptions{Concurrency: 2}).Start(brokenSender{Channel: srv})
 
-	ctx := context.Background()
-	if _, err := c.Call(ctx, "Metricize", nil); err != nil {
-		t.Fatalf("Call(Metricize) failed: %v", err)
+	if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Slow"}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
 	}
-	loc.Close()
+	<-started
+	if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":2,"method":"Quick"}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("Handler context: got %v, want %v", err, context.Canceled)
+	}
+	cli.Close()
+	if err := s.Wait(); err != errReset {
+		t.Errorf("Server wait: got %v, want %v", err, errReset)
+	}
+}
 
-	info := s.ServerInfo()
+// limitConn is a net.Conn whose Write method fails with errReset once more
+// than left bytes have been written.
+type limitConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	left int
+}
+
+func (c *limitConn) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) > c.left {
+		c.left = 0
+		return 0, errReset
+	}
+	c.left -= len(data)
+	return c.Conn.Write(data)
+}
+
+// Verify that whatever the server is writing when its connection fails, the
+// server stops promptly and reports the write error from Wait.
+func TestWriteFailureStops(t *testing.T) {
+	const okReply = `{"jsonrpc":"2.0","id":1,"result":"OK"}` + "\n"
 	tests := []struct {
-		input map[string]int64
 		name  string
-		want  int64 // use < 0 to test for existence only
+		limit int
+		send  string // a message sent by the client, if not ""
+		push  bool   // whether to send a notification from the server
+		want  string // the expected reply, if any, before the failure
 	}{
-		{info.Counter, "rpc.requests", 1},
-		{info.Counter, "counters-written", 3},
-		{info.Counter, "zero-sum", 0},
-		{info.Counter, "rpc.bytesRead", -1},
-		{info.Counter, "rpc.bytesWritten", -1},
-		{info.MaxValue, "max-metric-value", 5},
-		{info.MaxValue, "rpc.bytesRead", -1},
-		{info.MaxValue, "rpc.bytesWritten", -1},
+		{"Response", 0, `{"jsonrpc":"2.0","id":1,"method":"OK"}`, false, ""},
+		{"ParseError", 0, `{"bogus`, false, ""},
+		{"Notify", 0, "", true, ""},
+		{"SecondResponse", len(okReply),
+			`{"jsonrpc":"2.0","id":1,"method":"OK"}`, false, okReply},
 	}
 	for _, test := range tests {
-		got, ok := test.input[test.name]
-		if !ok {
-			t.Errorf("Metric %q is not defined, but was expected", test.name)
-			continue
-		}
-		if test.want >= 0 && got != test.want {
-			t.Errorf("Wrong value for metric %q: got %d, want %d", test.name, got, test.want)
-		}
-	}
-}
+		t.Run(test.name, func(t *testing.T) {
+			cconn, sconn := net.Pipe()
+			defer cconn.Close()
+			srv := jrpc2.NewServer(handler.Map{"OK": testOK}, &jrpc2.ServerOptions{
+				AllowPush: true,
+			}).Start(channel.Line(sconn, &limitConn{Conn: sconn, left: test.limit}))
+			cli := channel.Line(cconn, cconn)
 
-// Ensure that a correct request not sent via the *Client type will still
-// elicit a correct response from the server. Here we simulate a "different"
-// client by writing requests directly into the channel.
-func TestOtherClient(t *testing.T) {
-	srv, cli := channel.Direct()
-	s := jrpc2.NewServer(handler.Map{
-		"X": testOK,
-		"Y": handler.New(func(context.Context) (interface{}, error) {
-			return nil, nil
-		}),
-	}, nil).Start(srv)
-	defer func() {
-		cli.Close()
-		if err := s.Wait(); err != nil {
-			t.Errorf("Server wait: unexpected error %v", err)
-		}
-	}()
+			if test.want != "" {
+				if err := cli.Send([]byte(test.send)); err != nil {
+					t.Fatalf("Send failed: %v", err)
+				}
+				got, err := cli.Recv()
+				if err != nil {
+					t.Fatalf("Recv failed: %v", err)
+				} else if s := string(got) + "\n"; s != test.want {
+					t.Errorf("First reply: got %#q, want %#q", s, test.want)
+				}
+			}
+			if test.send != "" {
+				if err := cli.Send([]byte(test.send)); err != nil {
+					t.Fatalf("Send failed: %v", err)
+				}
+			}
+			if test.push {
+				if err := srv.Notify(context.Background(), "hey", nil); err != errReset {
+					t.Errorf("Notify: got %v, want %v", err, errReset)
+				}
+			}
 
+			// The server must stop by itself; the client does not close its end.
+			if err := srv.Wait(); err != errReset {
+				t.Errorf("Server wait: got %v, want %v", err, errReset)
+			}
+		})
+	}
+}
+
+// Verify that a handler that panics is reported as an internal error, and
+// that the server continues to serve other requests.
+func TestHandlerPanic(t *testing.T) {
+	methods := handler.Map{
+		"Panic": handler.New(func(context.Context) error {
+			panic("the secret is 12345")
+		}),
+		"Test": testOK,
+	}
 	tests := []struct {
-		input, want string
+		opts      *jrpc2.ServerOptions
+		wantStack bool
 	}{
-		// Missing version marker (and therefore wrong).
-		{`{"id":0}`,
-			`{"jsonrpc":"2.0","id":0,"error":{"code":-32600,"message":"incorrect version marker"}}`},
+		{nil, false},
+		{&jrpc2.ServerOptions{PanicStack: true}, true},
+	}
+	for _, test := range tests {
+		loc := server.NewLocal(methods, &server.LocalOptions{Server: test.opts})
+		ctx := context.Background()
 
-		// Version marker is present, but wrong.
-		{`{"jsonrpc":"1.5","id":1}`,
-			`{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"incorrect version marker"}}`},
+		_, err := loc.Client.Call(ctx, "Panic", nil)
+		if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InternalError {
+			t.Errorf("Call Panic: got %v, want code %v", err, code.InternalError)
+		} else {
+			if strings.Contains(e.Message(), "secret") {
+				t.Errorf("Call Panic: error message %q includes the panic value", e.Message())
+			}
+			var stack string
+			e.UnmarshalData(&stack)
+			if got := strings.Contains(stack, "TestHandlerPanic"); got != test.wantStack {
+				t.Errorf("Call Panic: error data %q, want stack %v", stack, test.wantStack)
+			}
+		}
 
-		// No method was specified.
-		{`{"jsonrpc":"2.0","id":2}`,
-			`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"empty method name"}}`},
+		// A notification that panics is discarded.
+		if err := loc.Client.Notify(ctx, "Panic", nil); err != nil {
+			t.Errorf("Notify Panic: unexpected error: %v", err)
+		}
 
-		// The method specified doesn't exist.
-		{`{"jsonrpc":"2.0", "id": 3, "method": "NoneSuch"}`,
-			`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"no such method \"NoneSuch\""}}`},
+		// The connection is still usable.
+		if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
+			t.Errorf("Call Test: unexpected error: %v", err)
+		}
+		if got := loc.Server.ServerInfo().Counter["rpc.panics"]; got != 2 {
+			t.Errorf("Panics: got %d, want 2", got)
+		}
+		if err := loc.Close(); err != nil {
+			t.Errorf("Server wait: unexpected error: %v", err)
+		}
+	}
+}
 
-		// The parameters are of the wrong form.
-		{`{"jsonrpc":"2.0", "id": 4, "method": "X", "params": "bogus"}`,
-			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"parameters must be array or object"}}`},
+// Verify that a result that cannot be marshaled is reported as an error that
+// names the method.
+func TestResultMarshalError(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Bad": handler.New(func(context.Context) (chan int, error) {
+			return make(chan int), nil
+		}),
+		"Test": testOK,
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
 
-		// The parameters are absent, but as null.
-		{`{"jsonrpc": "2.0", "id": 6, "method": "X", "params": null}`,
-			`{"jsonrpc":"2.0","id":6,"result":"OK"}`},
+	_, err := loc.Client.Call(ctx, "Bad", nil)
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InternalError {
+		t.Errorf("Call Bad: got %v, want code %v", err, code.InternalError)
+	} else if msg := e.Message(); !strings.Contains(msg, `"Bad"`) || !strings.Contains(msg, "chan int") {
+		t.Errorf("Call Bad: got message %q, want the method and type", msg)
+	}
+	if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
+		t.Errorf("Call Test: unexpected error: %v", err)
+	}
+}
 
-		// Correct requests, one with a non-null response, one with a null response.
-		{`{"jsonrpc":"2.0","id": 5, "method": "X"}`, `{"jsonrpc":"2.0","id":5,"result":"OK"}`},
-		{`{"jsonrpc":"2.0","id":21,"method":"Y"}`, `{"jsonrpc":"2.0","id":21,"result":null}`},
+// Verify that stopping the server terminates in-flight requests, which the
+// client reports as the end of its connection.
+func TestServerStopCancellation(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	loc := server.NewLocal(handler.Map{
+		"Hang": handler.New(func(ctx context.Context) (bool, error) {
+			close(started) // signal that the method handler is running
+			<-ctx.Done()
+			return true, ctx.Err()
+		}),
+	}, nil)
+	defer loc.Close()
+	s, c := loc.Server, loc.Client
 
-		// A batch of correct requests.
-		{`[{"jsonrpc":"2.0", "id":"a1", "method":"X"}, {"jsonrpc":"2.0", "id":"a2", "method": "X"}]`,
-			`[{"jsonrpc":"2.0","id":"a1","result":"OK"},{"jsonrpc":"2.0","id":"a2","result":"OK"}]`},
+	// Call the server. The method will hang until its context is cancelled,
+	// which should happen when the server stops.
+	go func() {
+		defer close(stopped)
+		_, err := c.Call(context.Background(), "Hang", nil)
+		stopped <- err
+	}()
 
-		// Extra fields on an otherwise-correct request.
-		{`{"jsonrpc":"2.0","id": 7, "method": "Z", "params":[], "bogus":true}`,
-			`{"jsonrpc":"2.0","id":7,"error":{"code":-32600,"message":"extra fields in request","data":["bogus"]}}`},
+	// Wait until the client method is running so we know we are testing at the
+	// right time, i.e., with a request in flight.
+	<-started
+	s.Stop()
+	select {
+	case <-time.After(30 * time.Second):
+		t.Error("Timed out waiting for service handler to fail")
+	case err := <-stopped:
+		if !errors.Is(err, jrpc2.ErrConnTerminated) {
+			t.Errorf("Client error: got %v, want %v", err, jrpc2.ErrConnTerminated)
+		}
+	}
+}
 
-		// An empty batch request should report a single error object.
-		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+// Verify that the calls pending when a client's connection ends, and the calls
+// and notifications made after that, report ErrConnTerminated.
+func TestConnTerminated(t *testing.T) {
+	ctx := context.Background()
 
-		// An invalid batch request should report a single error object.
-		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"request is not a JSON object"}}]`},
+	// newClient returns a client whose server reads requests but never
+	// replies. Each request received is sent to recv, and the server end of
+	// the connection is returned so the test can close it.
+	newClient := func() (*jrpc2.Client, net.Conn, chan string) {
+		cconn, sconn := net.Pipe()
+		srv := channel.Line(sconn, sconn)
+		recv := make(chan string, 4)
+		go func() {
+			for {
+				msg, err := srv.Recv()
+				if err != nil {
+					return
+				}
+				recv <- string(msg)
+			}
+		}()
+		return jrpc2.NewClient(channel.Line(cconn, cconn), nil), sconn, recv
+	}
+	checkAfter := func(t *testing.T, cli *jrpc2.Client) {
+		t.Helper()
+		if _, err := cli.Call(ctx, "Test", nil); !errors.Is(err, jrpc2.ErrConnTerminated) {
+			t.Errorf("Call after close: got %v, want %v", err, jrpc2.ErrConnTerminated)
+		}
+		if err := cli.Notify(ctx, "Test", nil); !errors.Is(err, jrpc2.ErrConnTerminated) {
+			t.Errorf("Notify after close: got %v, want %v", err, jrpc2.ErrConnTerminated)
+		}
+	}
 
-		// A batch of invalid requests returns a batch of errors.
-		{`[{"jsonrpc": "2.0", "id": 6, "method":"bogus"}]`,
-			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"no such method \"bogus\""}}]`},
+	t.Run("ServerClose", func(t *testing.T) {
+		cli, sconn, recv := newClient()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := cli.Call(ctx, "Hang", nil)
+			errc <- err
+		}()
+		<-recv
+		sconn.Close()
+		if err := <-errc; !errors.Is(err, jrpc2.ErrConnTerminated) {
+			t.Errorf("Call Hang: got %v, want %v", err, jrpc2.ErrConnTerminated)
+		}
+		checkAfter(t, cli)
+		if err := cli.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+	})
 
-		// Batch requests return batch responses, even for a singleton.
-		{`[{"jsonrpc": "2.0", "id": 7, "method": "X"}]`, `[{"jsonrpc":"2.0","id":7,"result":"OK"}]`},
+	t.Run("ClientClose", func(t *testing.T) {
+		cli, sconn, recv := newClient()
+		defer sconn.Close()
+		rspc := make(chan []*jrpc2.Response, 1)
+		go func() {
+			rsps, err := cli.Batch(ctx, []jrpc2.Spec{
+				{Method: "Hang"},
+				{Method: "Hang"},
+			})
+			if err != nil {
+				t.Errorf("Batch: unexpected error: %v", err)
+			}
+			rspc <- rsps
+		}()
+		<-recv
+		if err := cli.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+		for _, rsp := range <-rspc {
+			if err := rsp.Error(); err == nil || err.Code() != code.SystemError {
+				t.Errorf("Response %s: got %v, want code %v", rsp.ID(), err, code.SystemError)
+			} else if !errors.Is(err, jrpc2.ErrConnTerminated) {
+				t.Errorf("Response %s: got %v, want %v", rsp.ID(), err, jrpc2.ErrConnTerminated)
+			}
+		}
+		checkAfter(t, cli)
+	})
+}
 
-		// Notifications are not reflected in a batch response.
-		{`[{"jsonrpc": "2.0", "method": "note"}, {"jsonrpc": "2.0", "id": 8, "method": "X"}]`,
-			`[{"jsonrpc":"2.0","id":8,"result":"OK"}]`},
+// Verify the order of shutdown when the server is stopped with requests still
+// waiting in its queue: Queued calls are discarded, but queued notifications
+// are handled before the server exits.
+func TestServerStopDrain(t *testing.T) {
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var ran []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, s)
+	}
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Hold": handler.New(func(ctx context.Context) error {
+			close(holding)
+			<-release
+			record("Hold")
+			return nil
+		}),
+		"Note": handler.New(func(ctx context.Context, ss []string) error {
+			record("Note " + strings.Join(ss, ""))
+			return nil
+		}),
+		"Call": handler.New(func(ctx context.Context, ss []string) error {
+			record("Call " + strings.Join(ss, ""))
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 4}).Start(spipe)
 
-		// Invalid structure for a version is reported, with and without ID.
-		{`{"jsonrpc": false}`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid version key"}}`},
-		{`{"jsonrpc": false, "id": 747}`,
-			`{"jsonrpc":"2.0","id":747,"error":{"code":-32700,"message":"invalid version key"}}`},
+	send := func(msg string) {
+		t.Helper()
+		if err := cpipe.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %#q: %v", msg, err)
+		}
+	}
 
-		// Invalid structure for a method name is reported, with and without ID.
-		{`{"jsonrpc":"2.0", "method": [false]}`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid method name"}}`},
-		{`{"jsonrpc":"2.0", "method": [false], "id": 252}`,
-			`{"jsonrpc":"2.0","id":252,"error":{"code":-32700,"message":"invalid method name"}}`},
+	// The Hold notification blocks the dispatcher until it is released, since
+	// later batches must wait for earlier notifications to complete.
+	send(`{"jsonrpc":"2.0","method":"Hold"}`)
+	<-holding
 
-		// A broken batch request should report a single top-level error.
-		{`[{"jsonrpc":"2.0", "method":"A", "id": 1}, {"jsonrpc":"2.0"]`, // N.B. syntax error
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request batch"}}`},
+	// This call is blocked in dispatch behind Hold. The remaining messages are
+	// left in the request queue.
+	send(`{"jsonrpc":"2.0","id":1,"method":"Call","params":["1"]}`)
+	send(`{"jsonrpc":"2.0","method":"Note","params":["A"]}`)
+	send(`{"jsonrpc":"2.0","id":2,"method":"Call","params":["2"]}`)
+	send(`{"jsonrpc":"2.0","method":"Note","params":["B"]}`)
 
-		// A broken single request should report a top-level error.
-		{`{"bogus"][++`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request message"}}`},
+	done := make(chan jrpc2.ServerStatus, 1)
+	go func() { done <- srv.WaitStatus() }()
+
+	srv.Stop()
+	close(release)
+	cpipe.Close() // unblock the reader
+
+	select {
+	case stat := <-done:
+		if !stat.Stopped() {
+			t.Errorf("Server status: got %+v, want stopped", stat)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the server to exit")
 	}
-	for _, test := range tests {
-		if err := cli.Send([]byte(test.input)); err != nil {
-			t.Fatalf("Send %#q failed: %v", test.input, err)
+
+	// Hold must finish first. Call 1 was already dispatched when the server
+	// stopped and may or may not run (its context is cancelled), but the
+	// queued call 2 must not run, and both notifications must.
+	mu.Lock()
+	defer mu.Unlock()
+	var got []string
+	for _, s := range ran {
+		if s != "Call 1" {
+			got = append(got, s)
 		}
-		raw, err := cli.Recv()
-		if err != nil {
-			t.Fatalf("Recv failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Hold", "Note A", "Note B"}, got); diff != "" {
+		t.Errorf("Handlers run (-want, +got):\n%s", diff)
+	}
+}
+
+// Verify that a server can be restarted after it exits, and that a fresh
+// request queue is used for each run.
+func TestServerRestart(t *testing.T) {
+	srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil)
+	for i := 0; i < 3; i++ {
+		cpipe, spipe := channel.Direct()
+		srv.Start(spipe)
+		cli := jrpc2.NewClient(cpipe, nil)
+		if _, err := cli.Call(context.Background(), "OK", nil); err != nil {
+			t.Errorf("Run %d: call failed: %v", i+1, err)
 		}
-		if got := string(raw); got != test.want {
-			t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+		if i%2 == 0 {
+			srv.Stop()
+		}
+		cli.Close()
+		if err := srv.Wait(); err != nil {
+			t.Errorf("Run %d: server exited with error: %v", i+1, err)
 		}
 	}
 }
 
-// Verify that server-side push notifications work.
-func TestPushNotify(t *testing.T) {
-	// Set up a server and client with server-side notification support.  Here
-	// we're just capturing the name of the notification method, as a sign we
-	// got the right thing.
-	var notes []string
-	loc := server.NewLocal(handler.Map{
-		"NoteMe": handler.New(func(ctx context.Context) (bool, error) {
-			// When this method is called, it posts a notification back to the
-			// client before returning.
-			if err := jrpc2.PushNotify(ctx, "method", nil); err != nil {
-				t.Errorf("PushNotify unexpectedly failed: %v", err)
-				return false, err
+// Verify that the state of one session does not carry over into the next
+// when a server is restarted on a new connection.
+func TestServerRestartSessions(t *testing.T) {
+	srv := jrpc2.NewServer(handler.Map{"OK": testOK}, &jrpc2.ServerOptions{
+		MaxNotificationFailures: 2,
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		cconn, sconn := net.Pipe()
+		srv.Start(channel.Line(sconn, sconn))
+		cli := jrpc2.NewClient(channel.Line(cconn, cconn), nil)
+
+		// One failed notification per session is within the limit, unless the
+		// count from the previous session was retained.
+		if err := cli.Notify(ctx, "NoSuchMethod", nil); err != nil {
+			t.Fatalf("Session %d: Notify failed: %v", i+1, err)
+		}
+		if _, err := cli.Call(ctx, "OK", nil); err != nil {
+			t.Errorf("Session %d: call failed: %v", i+1, err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Session %d: Start on a running server did not panic", i+1)
+				}
+			}()
+			srv.Start(channel.Line(sconn, sconn))
+		}()
+
+		cli.Close()
+		if err := srv.Wait(); err != nil {
+			t.Errorf("Session %d: server exited with error: %v", i+1, err)
+		}
+		if held := srv.Metrics().Held; held != 0 {
+			t.Errorf("Session %d: %d batches held after exit, want 0", i+1, held)
+		}
+	}
+}
+
+// Verify that handlers see the values of the context passed to StartContext,
+// and that the server stops when that context ends.
+func TestStartContext(t *testing.T) {
+	type connKey struct{}
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	srv := jrpc2.NewServer(handler.Map{
+		"Conn": handler.New(func(ctx context.Context) (string, error) {
+			v, _ := ctx.Value(connKey{}).(string)
+			return v, nil
+		}),
+		"Hang": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return ctx.Err()
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 2})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), connKey{}, "conn-1"))
+	defer cancel()
+	cconn, sconn := net.Pipe()
+	srv.StartContext(ctx, channel.Line(sconn, sconn))
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), nil)
+	defer cli.Close()
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Conn", nil, &got); err != nil {
+		t.Fatalf("Call Conn failed: %v", err)
+	} else if got != "conn-1" {
+		t.Errorf("Call Conn: got %q, want %q", got, "conn-1")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), "Hang", nil)
+		errc <- err
+	}()
+	<-started
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("Handler context: got %v, want %v", err, context.Canceled)
+	}
+	if err := <-errc; err == nil {
+		t.Error("Call Hang: got nil error, want failure")
+	}
+	if err := srv.Wait(); err != context.Canceled {
+		t.Errorf("Server wait: got %v, want %v", err, context.Canceled)
+	}
+}
+
+// Verify that with StrictOrder set, the response to a slow call is sent
+// before the response to a fast call received after it, while by default the
+// fast response is sent as soon as it is ready.
+func TestStrictOrder(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Strict=%v", strict), func(t *testing.T) {
+			release, fastDone := make(chan struct{}), make(chan struct{})
+			cli, srv := channel.Direct()
+			s := jrpc2.NewServer(handler.Map{
+				"Slow": handler.New(func(context.Context) (string, error) {
+					<-release
+					return "slow", nil
+				}),
+				"Fast": handler.New(func(context.Context) (string, error) {
+					defer close(fastDone)
+					return "fast", nil
+				}),
+			}, &jrpc2.ServerOptions{Concurrency: 2, StrictOrder: strict}).Start(srv)
+			defer func() { cli.Close(); s.Wait() }()
+
+			for _, req := range []string{
+				`{"jsonrpc":"2.0","id":1,"method":"Slow"}`,
+				`{"jsonrpc":"2.0","id":2,"method":"Fast"}`,
+			} {
+				if err := cli.Send([]byte(req)); err != nil {
+					t.Fatalf("Send %#q failed: %v", req, err)
+				}
 			}
-			return true, nil
+			recv := func() string {
+				t.Helper()
+				msg, err := cli.Recv()
+				if err != nil {
+					t.Fatalf("Recv failed: %v", err)
+				}
+				return string(msg)
+			}
+			const (
+				slowReply = `{"jsonrpc":"2.0","id":1,"result":"slow"}`
+				fastReply = `{"jsonrpc":"2.0","id":2,"result":"fast"}`
+			)
+
+			var got []string
+			<-fastDone
+			if !strict {
+				got = append(got, recv()) // the fast reply does not wait
+			}
+			close(release)
+			for len(got) < 2 {
+				got = append(got, recv())
+			}
+			want := []string{slowReply, fastReply}
+			if !strict {
+				want = []string{fastReply, slowReply}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Responses (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// Verify that when the server stops, requests waiting for a concurrency slot
+// fail without running their handlers.
+func TestStopQueuedRequests(t *testing.T) {
+	const numQueued = 3
+	started, queued := make(chan struct{}), make(chan struct{}, numQueued)
+	var ran int32
+	srv := jrpc2.NewServer(handler.Map{
+		"Block": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
 		}),
-	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{
-			AllowPush: true,
-		},
-		Client: &jrpc2.ClientOptions{
-			OnNotify: func(req *jrpc2.Request) {
-				notes = append(notes, req.Method())
-				t.Logf("OnNotify handler saw method %q", req.Method())
-			},
+		"Quick": handler.New(func(context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{
+		Concurrency: 1,
+		CheckRequest: func(_ context.Context, req *jrpc2.Request) error {
+			if req.Method() == "Quick" {
+				queued <- struct{}{}
+			}
+			return nil
 		},
 	})
-	s, c := loc.Server, loc.Client
+	cconn, sconn := net.Pipe()
+	srv.Start(channel.Line(sconn, sconn))
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), nil)
+	defer cli.Close()
+
+	ctx := context.Background()
+	errc := make(chan error, numQueued+1)
+	call := func(method string) {
+		_, err := cli.Call(ctx, method, nil)
+		errc <- err
+	}
+	go call("Block")
+	<-started
+	for i := 0; i < numQueued; i++ {
+		go call("Quick")
+		<-queued
+	}
+
+	srv.Stop()
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Server wait: unexpected error: %v", err)
+	}
+	for i := 0; i < numQueued+1; i++ {
+		if err := <-errc; err == nil {
+			t.Error("Call: got nil error, want failure")
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("Queued handlers ran %d times after stop, want 0", n)
+	}
+}
+
+// Verify that stopping the server cancels the contexts of notification
+// handlers that are running.
+func TestServerStopCancelsNotifications(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	loc := server.NewLocal(handler.Map{
+		"Hang": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return ctx.Err()
+		}),
+	}, nil)
+	defer loc.Close()
+
+	if err := loc.Client.Notify(context.Background(), "Hang", nil); err != nil {
+		t.Fatalf("Notify Hang: unexpected error: %v", err)
+	}
+	<-started
+	loc.Server.Stop()
+	select {
+	case <-time.After(30 * time.Second):
+		t.Error("Timed out waiting for notification handler to be cancelled")
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Errorf("Handler context: got error %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+// Test that a handler can cancel an in-flight request with jrpc2.CancelRequest.
+func TestHandlerCancel(t *testing.T) {
+	ready := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Stall": handler.New(func(ctx context.Context) error {
+			close(ready)
+			t.Log("Stall handler: waiting for context cancellation")
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) error {
+			var id string
+			if err := req.UnmarshalParams(&handler.Args{&id}); err != nil {
+				return err
+			}
+			t.Logf("Test handler: cancelling %q...", id)
+			jrpc2.CancelRequest(ctx, id)
+			return nil
+		}),
+	}, &server.LocalOptions{
+		// Ensure the canceller can run while the stalled handler is active.
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer loc.Close()
+
+	ctx := context.Background()
+
+	// Start a call in the background that will stall until cancelled.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(ctx, "Stall", nil)
+		errc <- err
+		close(errc)
+	}()
+
+	// Wait until the handler is in progress.
+	<-ready
+
+	// Call the test method to cancel the stalled method, and verify that we got
+	// back the expected error.
+	if _, err := loc.Client.Call(ctx, "Test", []string{"1"}); err != nil {
+		t.Errorf("Test call failed: %v", err)
+	}
+
+	err := <-errc
+	got := code.FromError(err)
+	if got != code.Cancelled {
+		t.Errorf("Stall: got %v (%v), want %v", err, got, code.Cancelled)
+	} else {
+		t.Logf("Cancellation succeeded, got expected error: %v", err)
+	}
+}
+
+// Verify that requests in the same batch share batch values, and that the
+// completion hooks run once per batch and observe failures.
+func TestBatchValue(t *testing.T) {
+	type doneInfo struct {
+		id     int
+		failed bool
+	}
+	var nextID int32
+	done := make(chan doneInfo, 10)
+	newState := func(ctx context.Context) (interface{}, func(bool)) {
+		id := int(atomic.AddInt32(&nextID, 1))
+		return id, func(failed bool) {
+			if jrpc2.BatchContext(ctx) == nil {
+				t.Error("Batch context is missing in completion hook")
+			} else if err := ctx.Err(); err != nil {
+				t.Errorf("Batch context ended before completion: %v", err)
+			}
+			done <- doneInfo{id: id, failed: failed}
+		}
+	}
+	loc := server.NewLocal(handler.Map{
+		"State": handler.New(func(ctx context.Context, fail []bool) (int, error) {
+			id := jrpc2.BatchValue(ctx, "state", newState).(int)
+			if len(fail) != 0 && fail[0] {
+				return 0, errors.New("failed as requested")
+			}
+			return id, nil
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	checkDone := func(t *testing.T, want doneInfo) {
+		t.Helper()
+		select {
+		case got := <-done:
+			if got != want {
+				t.Errorf("Completion: got %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for batch completion")
+		}
+		select {
+		case extra := <-done:
+			t.Errorf("Unexpected extra completion: %+v", extra)
+		default:
+		}
+	}
+
+	t.Run("Batch", func(t *testing.T) {
+		rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+			{Method: "State", Params: []bool{false}},
+			{Method: "State", Params: []bool{false}},
+			{Method: "State", Params: []bool{false}},
+		})
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		for i, rsp := range rsps {
+			var id int
+			if err := rsp.UnmarshalResult(&id); err != nil {
+				t.Errorf("Response %d: %v", i+1, err)
+			} else if id != 1 {
+				t.Errorf("Response %d: got state %d, want 1", i+1, id)
+			}
+		}
+		checkDone(t, doneInfo{id: 1, failed: false})
+	})
+
+	t.Run("BatchFailed", func(t *testing.T) {
+		if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+			{Method: "State", Params: []bool{false}},
+			{Method: "State", Params: []bool{true}},
+		}); err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		checkDone(t, doneInfo{id: 2, failed: true})
+	})
+
+	t.Run("Single", func(t *testing.T) {
+		var id int
+		if err := loc.Client.CallResult(ctx, "State", []bool{false}, &id); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if id != 3 {
+			t.Errorf("Call: got state %d, want 3", id)
+		}
+		checkDone(t, doneInfo{id: 3, failed: false})
+	})
+}
+
+// Verify that the init function for a batch value can look up other values in
+// the same batch.
+func TestBatchValueNested(t *testing.T) {
+	var order []string
+	newValue := func(name string) func(context.Context) (interface{}, func(bool)) {
+		return func(context.Context) (interface{}, func(bool)) {
+			return name, func(bool) { order = append(order, name) }
+		}
+	}
+	loc := server.NewLocal(handler.Map{
+		"Nest": handler.New(func(ctx context.Context) (string, error) {
+			v := jrpc2.BatchValue(ctx, "outer", func(ctx context.Context) (interface{}, func(bool)) {
+				inner := jrpc2.BatchValue(ctx, "inner", newValue("inner")).(string)
+				return "outer+" + inner, func(bool) { order = append(order, "outer") }
+			})
+			return v.(string), nil
+		}),
+	}, nil)
+	ctx := context.Background()
+
+	var got string
+	if err := loc.Client.CallResult(ctx, "Nest", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "outer+inner" {
+		t.Errorf("Call: got %q, want outer+inner", got)
+	}
+	loc.Close()
+
+	// The inner value was created first, so its done function runs last.
+	if diff := cmp.Diff([]string{"outer", "inner"}, order); diff != "" {
+		t.Errorf("Completion order: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that a server can retain the raw encoding of each request, and that a
+// signature computed over the original request bytes verifies in the handler.
+func TestRawRequest(t *testing.T) {
+	key := []byte("the hills are alive")
+	sign := func(data []byte) string {
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	// The elements of the batch, encoded exactly as they will be sent.  The
+	// signatures are transmitted out of band, indexed by request ID.
+	elts := []string{
+		`{"jsonrpc":"2.0", "id":1, "method":"Verify", "params":{"a": 1}}`,
+		`{ "id": 2,"method":"Verify","jsonrpc":"2.0","params":[ 2, 3 ] }`,
+	}
+	sigs := map[string]string{
+		"1": sign([]byte(elts[0])),
+		"2": sign([]byte(elts[1])),
+	}
+
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Verify": handler.New(func(ctx context.Context, req *jrpc2.Request) (bool, error) {
+			raw := jrpc2.RawRequest(ctx)
+			if raw == nil {
+				return false, errors.New("no raw request available")
+			}
+			want, err := hex.DecodeString(sigs[req.ID()])
+			if err != nil {
+				return false, err
+			}
+			got, _ := hex.DecodeString(sign(raw))
+			return hmac.Equal(got, want), nil
+		}),
+	}, &jrpc2.ServerOptions{RetainRawRequest: true}).Start(spipe)
+	defer func() { cpipe.Close(); srv.Wait() }()
+
+	if err := cpipe.Send([]byte("[" + strings.Join(elts, ",") + "]")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	rsp, err := cpipe.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	var got []struct {
+		ID     int  `json:"id"`
+		Result bool `json:"result"`
+	}
+	if err := json.Unmarshal(rsp, &got); err != nil {
+		t.Fatalf("Decoding response %#q: %v", string(rsp), err)
+	}
+	if len(got) != len(elts) {
+		t.Errorf("Got %d responses, want %d: %#q", len(got), len(elts), string(rsp))
+	}
+	for _, r := range got {
+		if !r.Result {
+			t.Errorf("Request %d: signature did not verify", r.ID)
+		}
+	}
+}
+
+// Verify that the raw request is not available unless the server retains it.
+func TestRawRequestDisabled(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) (bool, error) {
+			return jrpc2.RawRequest(ctx) == nil, nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	var ok bool
+	if err := loc.Client.CallResult(context.Background(), "Test", nil, &ok); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if !ok {
+		t.Error("RawRequest reported a value when retention is disabled")
+	}
+}
+
+// metaChannel is a channel.Channel that reports a sequence number as the
+// metadata for each message received.
+type metaChannel struct {
+	channel.Channel
+	seq int
+}
+
+func (m *metaChannel) Recv() ([]byte, error) {
+	msg, err := m.Channel.Recv()
+	m.seq++
+	return msg, err
+}
+
+func (m *metaChannel) Metadata() interface{} { return m.seq }
+
+func TestChannelMetadata(t *testing.T) {
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Meta": handler.New(func(ctx context.Context) (interface{}, error) {
+			return jrpc2.ChannelMetadata(ctx), nil
+		}),
+	}, nil).Start(&metaChannel{Channel: spipe})
+	cli := jrpc2.NewClient(cpipe, nil)
+	defer func() { cli.Close(); srv.Wait() }()
+
+	ctx := context.Background()
+	for want := 1; want <= 3; want++ {
+		var got int
+		if err := cli.CallResult(ctx, "Meta", nil, &got); err != nil {
+			t.Errorf("Call Meta: unexpected error: %v", err)
+		} else if got != want {
+			t.Errorf("Call Meta: got %d, want %d", got, want)
+		}
+	}
+
+	// All the requests in a batch share the metadata of their message.
+	rsps, err := cli.Batch(ctx, []jrpc2.Spec{{Method: "Meta"}, {Method: "Meta"}})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	for i, rsp := range rsps {
+		var got int
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Response %d: unexpected error: %v", i, err)
+		} else if got != 4 {
+			t.Errorf("Response %d: got %d, want 4", i, got)
+		}
+	}
+
+	// A channel without metadata reports nil.
+	loc := server.NewLocal(handler.Map{
+		"Meta": handler.New(func(ctx context.Context) (bool, error) {
+			return jrpc2.ChannelMetadata(ctx) == nil, nil
+		}),
+	}, nil)
+	defer loc.Close()
+	var ok bool
+	if err := loc.Client.CallResult(ctx, "Meta", nil, &ok); err != nil {
+		t.Errorf("Call Meta: unexpected error: %v", err)
+	} else if !ok {
+		t.Error("ChannelMetadata: got non-nil metadata without a Metadata channel")
+	}
+
+	// Metadata attached to the context take precedence.
+	if got := jrpc2.ChannelMetadata(jrpc2.WithChannelMetadata(ctx, "x")); got != "x" {
+		t.Errorf("ChannelMetadata: got %v, want x", got)
+	}
+}
+
+// Test that an error with data attached to it is correctly propagated back
+// from the server to the client, in a value of concrete type *Error.
+func TestErrors(t *testing.T) {
+	const errCode = -32000
+	const errData = `{"caroline":452}`
+	const errMessage = "error thingy"
+	loc := server.NewLocal(handler.Map{
+		"Err": handler.New(func(_ context.Context) (int, error) {
+			return 17, jrpc2.DataErrorf(errCode, json.RawMessage(errData), errMessage)
+		}),
+		"Push": handler.New(func(ctx context.Context) (bool, error) {
+			return false, jrpc2.PushNotify(ctx, "PushBack", nil)
+		}),
+		"Code": handler.New(func(ctx context.Context) error {
+			return code.Code(12345).Err()
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				t.Errorf("Client received unexpected push: %#v", req)
+			},
+		},
+	})
+	defer loc.Close()
+	c := loc.Client
+
+	if got, err := c.Call(context.Background(), "Err", nil); err == nil {
+		t.Errorf("Call(Push): got %#v, wanted error", got)
+	} else if e, ok := err.(*jrpc2.Error); ok {
+		if e.Code() != errCode {
+			t.Errorf("Error code: got %d, want %d", e.Code(), errCode)
+		}
+		if e.Message() != errMessage {
+			t.Errorf("Error message: got %q, want %q", e.Message(), errMessage)
+		}
+		var data json.RawMessage
+		if err := e.UnmarshalData(&data); err != nil {
+			t.Errorf("Unmarshaling error data: %v", err)
+		} else if s := string(data); s != errData {
+			t.Errorf("Error data: got %q, want %q", s, errData)
+		}
+	} else {
+		t.Fatalf("Call(Err): unexpected error: %v", err)
+	}
+
+	if got, err := c.Call(context.Background(), "Push", nil); err == nil {
+		t.Errorf("Call(Push): got %#v, wanted error", got)
+	} else {
+		t.Logf("Call(Push): got expected error: %v", err)
+	}
+
+	if got, err := c.Call(context.Background(), "Code", nil); err == nil {
+		t.Errorf("Call(Code): got %#v, wanted error", got)
+	} else if s, exp := err.Error(), "[12345] error code 12345"; s != exp {
+		t.Errorf("Call(Code): got error %q, want %q", s, exp)
+	}
+}
+
+// Test that error data survive the wire in each element of a batch response.
+func TestBatchErrorData(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Fail": handler.New(func(_ context.Context, vs []string) error {
+			return jrpc2.DataErrorf(code.InvalidParams, map[string][]string{
+				"fields": vs,
+			}, "invalid fields")
+		}),
+		"Plain": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.SystemError, "no data")
+		}),
+	}, nil)
+	defer loc.Close()
+
+	rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Fail", Params: []string{"name"}},
+		{Method: "Plain"},
+		{Method: "Fail", Params: []string{"age", "size"}},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	want := []string{`{"fields":["name"]}`, "", `{"fields":["age","size"]}`}
+	if len(rsps) != len(want) {
+		t.Fatalf("Batch: got %d responses, want %d", len(rsps), len(want))
+	}
+	for i, rsp := range rsps {
+		e := rsp.Error()
+		if e == nil {
+			t.Errorf("Response %d: got result %q, want error", i, rsp.ResultString())
+			continue
+		}
+		if got := string(e.Data()); got != want[i] {
+			t.Errorf("Response %d: got data %#q, want %#q", i, got, want[i])
+		}
+		if got := e.HasData(); got != (want[i] != "") {
+			t.Errorf("Response %d: HasData = %v, want %v", i, got, !got)
+		}
+	}
+}
+
+// quotaError is a domain error type that reports its own error code.
+type quotaError struct{ limit int }
+
+func (q quotaError) Error() string { return fmt.Sprintf("quota of %d exceeded", q.limit) }
+func (quotaError) Code() code.Code { return -32010 }
+
+// Test that handler errors are mapped to response codes, messages, and data.
+func TestHandlerErrorCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode code.Code
+		wantMsg  string
+		wantData string
+	}{
+		{"Plain", errors.New("bad thing"), code.SystemError, "bad thing", ""},
+		{"Coded", code.Code(-32020).Err(), -32020, "error code -32020", ""},
+		{"WrappedCode", fmt.Errorf("oops: %w", code.InvalidParams.Err()),
+			code.InvalidParams, "oops: invalid parameters", ""},
+		{"Error", jrpc2.DataErrorf(-32030, "x", "direct"), -32030, "direct", `"x"`},
+		{"WrappedError", fmt.Errorf("context: %w", jrpc2.DataErrorf(-32040, []int{1}, "inner")),
+			-32040, "inner", "[1]"},
+		{"Coder", quotaError{5}, -32010, "quota of 5 exceeded", ""},
+		{"WrappedCoder", fmt.Errorf("while saving: %w", quotaError{3}),
+			-32010, "while saving: quota of 3 exceeded", ""},
+	}
+	methods := make(handler.Map)
+	for _, test := range tests {
+		err := test.err
+		methods[test.name] = handler.New(func(context.Context) error { return err })
+	}
+	loc := server.NewLocal(methods, nil)
+	defer loc.Close()
+
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loc.Client.Call(ctx, test.name, nil)
+			e, ok := err.(*jrpc2.Error)
+			if !ok {
+				t.Fatalf("Call %q: got %v, want *jrpc2.Error", test.name, err)
+			}
+			if e.Code() != test.wantCode {
+				t.Errorf("Code: got %d, want %d", e.Code(), test.wantCode)
+			}
+			if e.Message() != test.wantMsg {
+				t.Errorf("Message: got %q, want %q", e.Message(), test.wantMsg)
+			}
+			if got := string(e.Data()); got != test.wantData {
+				t.Errorf("Data: got %#q, want %#q", got, test.wantData)
+			}
+		})
+	}
+}
+
+// recordingCodec is a JSONCodec that records the types of the values it
+// encodes and decodes, and the options it decodes with.
+type recordingCodec struct {
+	mu   sync.Mutex
+	log  []string
+	opts []jrpc2.DecodeOptions
+}
+
+func (c *recordingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.mu.Lock()
+	c.log = append(c.log, fmt.Sprintf("M %T", v))
+	c.mu.Unlock()
+	return jrpc2.StdJSON.Marshal(v)
+}
+
+func (c *recordingCodec) Unmarshal(data []byte, v interface{}, opts jrpc2.DecodeOptions) error {
+	c.mu.Lock()
+	c.log = append(c.log, fmt.Sprintf("U %T", v))
+	c.opts = append(c.opts, opts)
+	c.mu.Unlock()
+	return jrpc2.StdJSON.Unmarshal(data, v, opts)
+}
+
+func (c *recordingCodec) reset() (log []string, opts []jrpc2.DecodeOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log, opts, c.log, c.opts = c.log, c.opts, nil, nil
+	return
+}
+
+// Verify that the server and client use the JSONCodec given in their options
+// to encode and decode parameters and results, but not raw values.
+func TestJSONCodec(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	scodec, ccodec := new(recordingCodec), new(recordingCodec)
+	loc := server.NewLocal(handler.Map{
+		"Strict": handler.New(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			var p point
+			if err := req.UnmarshalParams(jrpc2.StrictFields(&p)); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}),
+		"Any": handler.New(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			var v []interface{}
+			if err := req.UnmarshalParams(&v); err != nil {
+				return nil, err
+			}
+			return fmt.Sprintf("%T", v[0]), nil
+		}),
+		"Raw": handler.New(func(context.Context) jrpc2.RawResult {
+			return jrpc2.RawResult(`{"raw":true}`)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{JSONCodec: scodec, UseNumber: true},
+		Client: &jrpc2.ClientOptions{JSONCodec: ccodec},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Strict decoding gets the unwrapped value, and accepts known fields.
+	var p point
+	if err := loc.Client.CallResult(ctx, "Strict", point{X: 1, Y: 2}, &p); err != nil {
+		t.Errorf("Call Strict: unexpected error: %v", err)
+	} else if p != (point{1, 2}) {
+		t.Errorf("Call Strict: got %+v, want {1 2}", p)
+	}
+	slog, sopts := scodec.reset()
+	if diff := cmp.Diff([]string{"U *jrpc2_test.point", "M jrpc2_test.point"}, slog); diff != "" {
+		t.Errorf("Server codec calls (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]jrpc2.DecodeOptions{{UseNumber: true, DisallowUnknownFields: true}}, sopts); diff != "" {
+		t.Errorf("Server decode options (-want, +got):\n%s", diff)
+	}
+	clog, _ := ccodec.reset()
+	if diff := cmp.Diff([]string{"M jrpc2_test.point", "U *jrpc2_test.point"}, clog); diff != "" {
+		t.Errorf("Client codec calls (-want, +got):\n%s", diff)
+	}
+
+	// Unknown fields are still rejected.
+	if _, err := loc.Client.Call(ctx, "Strict", handler.Obj{"X": 1, "Z": 3}); code.FromError(err) != code.InvalidParams {
+		t.Errorf("Call Strict with unknown field: got %v, want InvalidParams", err)
+	}
+	scodec.reset()
+	ccodec.reset()
+
+	// The server's UseNumber option is passed to the codec.
+	var typ string
+	if err := loc.Client.CallResult(ctx, "Any", []int{1}, &typ); err != nil {
+		t.Errorf("Call Any: unexpected error: %v", err)
+	} else if typ != "json.Number" {
+		t.Errorf("Call Any: got %q, want json.Number", typ)
+	}
+	scodec.reset()
+	ccodec.reset()
+
+	// Raw results are passed through without using either codec.
+	var raw json.RawMessage
+	if err := loc.Client.CallResult(ctx, "Raw", nil, &raw); err != nil {
+		t.Errorf("Call Raw: unexpected error: %v", err)
+	} else if string(raw) != `{"raw":true}` {
+		t.Errorf("Call Raw: got %#q, want %#q", raw, `{"raw":true}`)
+	}
+	if slog, _ := scodec.reset(); len(slog) != 0 {
+		t.Errorf("Server codec used for a raw result: %q", slog)
+	}
+	if clog, _ := ccodec.reset(); len(clog) != 0 {
+		t.Errorf("Client codec used for a raw result: %q", clog)
+	}
+}
+
+// Test that a client correctly reports bad parameters.
+func TestBadCallParams(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(_ context.Context, v interface{}) error {
+			return jrpc2.Errorf(129, "this should not be reached")
+		}),
+	}, nil)
+	defer loc.Close()
+
+	rsp, err := loc.Client.Call(context.Background(), "Test", "bogus")
+	if err == nil {
+		t.Errorf("Call(Test): got %+v, wanted error", rsp)
+	} else if got, want := code.FromError(err), code.InvalidRequest; got != want {
+		t.Errorf("Call(Test): got code %v, want %v", got, want)
+	} else {
+		t.Logf("Call(Test): got expected error: %v", err)
+	}
+}
+
+// Verify that the Metrics method reports the work in progress, and the
+// metrics recorded by handlers.
+func TestServerMetrics(t *testing.T) {
+	if m := jrpc2.ServerMetrics(context.Background()); m != nil {
+		t.Errorf("ServerMetrics without a server: got %p, want nil", m)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(ctx context.Context) error {
+			jrpc2.ServerMetrics(ctx).Count("blocks", 1)
+			close(started)
+			<-release
+			return nil
+		}),
+	}, nil)
+	s := loc.Server
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(context.Background(), "Block", nil)
+		done <- err
+	}()
+	<-started
+	snap := s.Metrics()
+	if snap.Active != 1 || snap.Held != 1 {
+		t.Errorf("Metrics while blocked: got active %d, held %d; want 1, 1", snap.Active, snap.Held)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Call(Block) failed: %v", err)
+	}
+	loc.Close()
+
+	snap = s.Metrics()
+	if snap.Active != 0 || snap.Held != 0 {
+		t.Errorf("Metrics after stop: got active %d, held %d; want 0, 0", snap.Active, snap.Held)
+	}
+	tests := []struct {
+		input map[string]int64
+		name  string
+		want  int64
+	}{
+		{snap.Counter, "rpc.requests", 1},
+		{snap.Counter, "rpc.responses", 1},
+		{snap.Counter, "blocks", 1},
+		{snap.MaxValue, "rpc.activeHandlers", 1},
+		{snap.MaxValue, "rpc.heldBatches", 1},
+	}
+	for _, test := range tests {
+		if got, ok := test.input[test.name]; !ok {
+			t.Errorf("Metric %q is not defined, but was expected", test.name)
+		} else if got != test.want {
+			t.Errorf("Wrong value for metric %q: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Verify that a server that allows v1 requests replies to each in the v1
+// format, including in batches that mix v1 and v2 requests.
+func TestV1Responses(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, &jrpc2.ServerOptions{AllowV1: true}).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	tests := []struct {
+		input, want string
+	}{
+		{`{"id":1,"method":"X"}`, `{"id":1,"result":"OK","error":null}`},
+		{`{"jsonrpc":"2.0","id":2,"method":"X"}`, `{"jsonrpc":"2.0","id":2,"result":"OK"}`},
+		{`{"id":3,"method":"Missing"}`,
+			`{"id":3,"result":null,"error":{"code":-32601,"message":"no such method \"Missing\""}}`},
+		{`[{"id":4,"method":"X"},{"jsonrpc":"2.0","id":5,"method":"X"},{"id":6,"method":""}]`,
+			`[{"id":4,"result":"OK","error":null},{"jsonrpc":"2.0","id":5,"result":"OK"},` +
+				`{"id":6,"result":null,"error":{"code":-32600,"message":"empty method name"}}]`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("Send %#q:\n got %#q\nwant %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that ServerInfo reports whether the server is running, before it
+// starts, while it runs, and after it stops, including concurrently with Stop.
+func TestServerInfoRunning(t *testing.T) {
+	s := jrpc2.NewServer(handler.Map{"Test": testOK}, &jrpc2.ServerOptions{AllowV1: true})
+	if info := s.ServerInfo(); info.Running || !info.StartTime.IsZero() || !info.AllowV1 {
+		t.Errorf("Before start: got running %v, start %v, allowV1 %v; want false, zero, true",
+			info.Running, info.StartTime, info.AllowV1)
+	}
+
+	cli, srv := channel.Direct()
+	s.Start(srv)
+	info := s.ServerInfo()
+	if !info.Running || info.StartTime.IsZero() {
+		t.Errorf("After start: got running %v, start %v; want true, non-zero", info.Running, info.StartTime)
+	}
+	start := info.StartTime
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.ServerInfo()
+		}
+	}()
+	s.Stop()
+	<-done
+	cli.Close()
+	s.Wait()
+
+	if info := s.ServerInfo(); info.Running || !info.StartTime.Equal(start) {
+		t.Errorf("After stop: got running %v, start %v; want false, %v", info.Running, info.StartTime, start)
+	}
+}
+
+// Verify that metrics are correctly propagated to server info.
+func TestServerInfo(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Metricize": handler.New(func(ctx context.Context) (bool, error) {
+			m := jrpc2.ServerMetrics(ctx)
+			if m == nil {
+				t.Error("Request context does not contain a metrics writer")
+				return false, nil
+			}
+			m.Count("counters-written", 1)
+			m.Count("counters-written", 2)
+
+			// Max value trackers are not accumulative.
+			m.SetMaxValue("max-metric-value", 1)
+			m.SetMaxValue("max-metric-value", 5)
+			m.SetMaxValue("max-metric-value", 3)
+			m.SetMaxValue("max-metric-value", -30337)
+
+			// Counters are accumulative, and negative deltas subtract.
+			m.Count("zero-sum", 0)
+			m.Count("zero-sum", 15)
+			m.Count("zero-sum", -16)
+			m.Count("zero-sum", 1)
+			return true, nil
+		}),
+	}, nil)
+	s, c := loc.Server, loc.Client
+
+	ctx := context.Background()
+	if _, err := c.Call(ctx, "Metricize", nil); err != nil {
+		t.Fatalf("Call(Metricize) failed: %v", err)
+	}
+	loc.Close()
+
+	info := s.ServerInfo()
+	tests := []struct {
+		input map[string]int64
+		name  string
+		want  int64 // use < 0 to test for existence only
+	}{
+		{info.Counter, "rpc.requests", 1},
+		{info.Counter, "counters-written", 3},
+		{info.Counter, "zero-sum", 0},
+		{info.Counter, "rpc.bytesRead", -1},
+		{info.Counter, "rpc.bytesWritten", -1},
+		{info.MaxValue, "max-metric-value", 5},
+		{info.MaxValue, "rpc.bytesRead", -1},
+		{info.MaxValue, "rpc.bytesWritten", -1},
+	}
+	for _, test := range tests {
+		got, ok := test.input[test.name]
+		if !ok {
+			t.Errorf("Metric %q is not defined, but was expected", test.name)
+			continue
+		}
+		if test.want >= 0 && got != test.want {
+			t.Errorf("Wrong value for metric %q: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Ensure that a correct request not sent via the *Client type will still
+// elicit a correct response from the server. Here we simulate a "different"
+// client by writing requests directly into the channel.
+func TestOtherClient(t *testing.T) {
+	srv, cli := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"X": testOK,
+		"Y": handler.New(func(context.Context) (interface{}, error) {
+			return nil, nil
+		}),
+	}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	tests := []struct {
+		input, want string
+	}{
+		// Missing version marker (and therefore wrong).
+		{`{"id":0}`,
+			`{"jsonrpc":"2.0","id":0,"error":{"code":-32600,"message":"incorrect version marker"}}`},
+
+		// Version marker is present, but wrong.
+		{`{"jsonrpc":"1.5","id":1}`,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"incorrect version marker"}}`},
+
+		// No method was specified.
+		{`{"jsonrpc":"2.0","id":2}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"empty method name"}}`},
+
+		// The method specified doesn't exist.
+		{`{"jsonrpc":"2.0", "id": 3, "method": "NoneSuch"}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"no such method \"NoneSuch\""}}`},
+
+		// The parameters are of the wrong form.
+		{`{"jsonrpc":"2.0", "id": 4, "method": "X", "params": "bogus"}`,
+			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"parameters must be array or object"}}`},
+
+		// The parameters are absent, but as null.
+		{`{"jsonrpc": "2.0", "id": 6, "method": "X", "params": null}`,
+			`{"jsonrpc":"2.0","id":6,"result":"OK"}`},
+
+		// A null ID is reported as invalid, rather than treated as a
+		// notification. A missing ID is a notification, with no response.
+		{`{"jsonrpc":"2.0", "id": null, "method": "X"}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request ID must not be null"}}`},
+		{`[{"jsonrpc":"2.0", "method": "X"}, {"jsonrpc":"2.0", "id": null, "method": "X"}]`,
+			`[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request ID must not be null"}}]`},
+
+		// Correct requests, one with a non-null response, one with a null response.
+		{`{"jsonrpc":"2.0","id": 5, "method": "X"}`, `{"jsonrpc":"2.0","id":5,"result":"OK"}`},
+		{`{"jsonrpc":"2.0","id":21,"method":"Y"}`, `{"jsonrpc":"2.0","id":21,"result":null}`},
+
+		// A batch of correct requests.
+		{`[{"jsonrpc":"2.0", "id":"a1", "method":"X"}, {"jsonrpc":"2.0", "id":"a2", "method": "X"}]`,
+			`[{"jsonrpc":"2.0","id":"a1","result":"OK"},{"jsonrpc":"2.0","id":"a2","result":"OK"}]`},
+
+		// Extra fields on an otherwise-correct request are ignored by default
+		// (see TestStrictSpec).
+		{`{"jsonrpc":"2.0","id": 7, "method": "X", "bogus":true}`,
+			`{"jsonrpc":"2.0","id":7,"result":"OK"}`},
+
+		// An empty batch request should report a single error object.
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+
+		// An invalid element of a batch request is reported in a batch.
+		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request is not a JSON object"}}]`},
+
+		// A batch of invalid requests returns a batch of errors.
+		{`[{"jsonrpc": "2.0", "id": 6, "method":"bogus"}]`,
+			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"no such method \"bogus\""}}]`},
+
+		// Batch requests return batch responses, even for a singleton.
+		{`[{"jsonrpc": "2.0", "id": 7, "method": "X"}]`, `[{"jsonrpc":"2.0","id":7,"result":"OK"}]`},
+
+		// Notifications are not reflected in a batch response.
+		{`[{"jsonrpc": "2.0", "method": "note"}, {"jsonrpc": "2.0", "id": 8, "method": "X"}]`,
+			`[{"jsonrpc":"2.0","id":8,"result":"OK"}]`},
+
+		// Invalid structure for a version is reported, with and without ID.
+		{`{"jsonrpc": false}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid version key"}}`},
+		{`{"jsonrpc": false, "id": 747}`,
+			`{"jsonrpc":"2.0","id":747,"error":{"code":-32600,"message":"invalid version key"}}`},
+
+		// Invalid structure for a method name is reported, with and without ID.
+		{`{"jsonrpc":"2.0", "method": [false]}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid method name"}}`},
+		{`{"jsonrpc":"2.0", "method": [false], "id": 252}`,
+			`{"jsonrpc":"2.0","id":252,"error":{"code":-32600,"message":"invalid method name"}}`},
+
+		// A broken batch request reports errors for the requests preceding the
+		// syntax error, which are not processed, and an error for the rest.
+		{`[{"jsonrpc":"2.0", "method":"A", "id": 1}, {"jsonrpc":"2.0"]`, // N.B. syntax error
+			`[{"jsonrpc":"2.0","id":1,"error":{"code":-32700,"message":"request not processed: invalid request batch"}},` +
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request batch",` +
+				`"data":"invalid character ']' after object key:value pair"}}]`},
+
+		// A broken single request should report a top-level error.
+		{`{"bogus"][++`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request message"}}`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that the StrictSpec option rejects requests with extra members, and
+// that the elements of a batch are checked individually.
+func TestStrictSpec(t *testing.T) {
+	const input = `[{"jsonrpc":"2.0","id":1,"method":"X","meta":{"trace":"abc"}},` +
+		`{"jsonrpc":"2.0","id":2,"method":"X"}]`
+	tests := []struct {
+		strict bool
+		want   string
+	}{
+		{false, `[{"jsonrpc":"2.0","id":1,"result":"OK"},{"jsonrpc":"2.0","id":2,"result":"OK"}]`},
+		{true, `[{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"extra fields in request: meta",` +
+			`"data":["meta"]}},{"jsonrpc":"2.0","id":2,"result":"OK"}]`},
+	}
+	for _, test := range tests {
+		cli, srv := channel.Direct()
+		s := jrpc2.NewServer(handler.Map{"X": testOK}, &jrpc2.ServerOptions{
+			StrictSpec: test.strict,
+		}).Start(srv)
+		if err := cli.Send([]byte(input)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Errorf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("StrictSpec=%v: got %#q, want %#q", test.strict, got, test.want)
+		}
+		cli.Close()
+		s.Wait()
+	}
+}
+
+// Verify that a request ID may be reused once its earlier call is complete,
+// but not while it is in flight, and that rejecting a duplicate does not
+// disturb the original.
+func TestRequestIDReuse(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"X": testOK,
+		"Wait": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 2}).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	call := func(input, want string) {
+		t.Helper()
+		if err := cli.Send([]byte(input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != want {
+			t.Errorf("Call %#q: got %#q, want %#q", input, got, want)
+		}
+	}
+
+	// Sequential calls may reuse an ID.
+	for i := 0; i < 3; i++ {
+		call(`{"jsonrpc":"2.0","id":1,"method":"X"}`, `{"jsonrpc":"2.0","id":1,"result":"OK"}`)
+	}
+
+	// A call may not reuse the ID of a call in flight.
+	if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":2,"method":"Wait"}`)); err != nil {
+		t.Fatalf("Send Wait failed: %v", err)
+	}
+	<-started
+	call(`{"jsonrpc":"2.0","id":2,"method":"X"}`,
+		`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"duplicate request id \"2\""}}`)
+
+	// The original call is not affected, and its ID is released when it is
+	// complete.
+	close(release)
+	if raw, err := cli.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	} else if got, want := string(raw), `{"jsonrpc":"2.0","id":2,"result":"done"}`; got != want {
+		t.Errorf("Call Wait: got %#q, want %#q", got, want)
+	}
+	call(`{"jsonrpc":"2.0","id":2,"method":"X"}`, `{"jsonrpc":"2.0","id":2,"result":"OK"}`)
+}
+
+// Verify that duplicate request IDs are detected by value, so that string and
+// number IDs are distinct, as are large or fractional numbers that differ
+// only in their least significant digits. Requests in the batch that share an
+// ID get a single error response, in place of the first of them.
+func TestRequestIDValues(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	ids := []struct {
+		id    string
+		dupOf string // if set, the earlier ID with the same value
+	}{
+		{`1`, ""},
+		{`"1"`, ""},
+		{`1.0`, `1`},
+		{`"\u0031"`, `"1"`},
+		{`12345678901234567890`, ""},
+		{`12345678901234567891`, ""},
+		{`1234567890123456789e1`, `12345678901234567890`},
+		{`1.5`, ""},
+		{`15e-1`, `1.5`},
+		{`0.15000000000000000001`, ""},
+	}
+	var reqs, rsps []string
+	pos := make(map[string]int) // ID → index of its response
+	for _, elt := range ids {
+		reqs = append(reqs, `{"jsonrpc":"2.0","id":`+elt.id+`,"method":"X"}`)
+		if first := elt.dupOf; first != "" {
+			msg, _ := json.Marshal("duplicate request id " + strconv.Quote(first) + " in batch")
+			rsps[pos[first]] = `{"jsonrpc":"2.0","id":` + first + `,"error":{"code":-32600,"message":` + string(msg) + `}}`
+		} else {
+			pos[elt.id] = len(rsps)
+			rsps = append(rsps, `{"jsonrpc":"2.0","id":`+elt.id+`,"result":"OK"}`)
+		}
+	}
+	if err := cli.Send([]byte("[" + strings.Join(reqs, ",") + "]")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	raw, err := cli.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	var got []json.RawMessage
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("Invalid response %#q: %v", raw, err)
+	}
+	if len(got) != len(rsps) {
+		t.Fatalf("Got %d responses, want %d", len(got), len(rsps))
+	}
+	for i, want := range rsps {
+		if string(got[i]) != want {
+			t.Errorf("Response %d: got %#q, want %#q", i+1, got[i], want)
+		}
+	}
+}
+
+// Verify that requests sharing an ID within one batch are not handled, and
+// that the batch reply has exactly one error response for each such ID.
+func TestBatchDuplicateIDs(t *testing.T) {
+	var calls int32
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"X": handler.New(func(context.Context) string {
+			atomic.AddInt32(&calls, 1)
+			return "OK"
+		}),
+	}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	tests := []struct {
+		input, want string
+		calls       int32
+	}{
+		{`[{"jsonrpc":"2.0","id":1,"method":"X"},{"jsonrpc":"2.0","id":1,"method":"X"}]`,
+			`[{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"duplicate request id \"1\" in batch"}}]`, 0},
+		{`[{"jsonrpc":"2.0","id":"a","method":"X"},{"jsonrpc":"2.0","id":2,"method":"X"},` +
+			`{"jsonrpc":"2.0","id":"a","method":"X"},{"jsonrpc":"2.0","method":"X"},` +
+			`{"jsonrpc":"2.0","id":"a","method":"X"}]`,
+			`[{"jsonrpc":"2.0","id":"a","error":{"code":-32600,"message":"duplicate request id \"\\\"a\\\"\" in batch"}},` +
+				`{"jsonrpc":"2.0","id":2,"result":"OK"}]`, 2},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&calls, 0)
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("Batch %#q:\n got %#q\nwant %#q", test.input, got, test.want)
+		}
+		if got := atomic.LoadInt32(&calls); got != test.calls {
+			t.Errorf("Batch %#q: handler called %d times, want %d", test.input, got, test.calls)
+		}
+	}
+}
+
+// Verify that a batch larger than the MaxBatchSize limit is rejected without
+// handling any of its requests.
+func TestMaxBatchSize(t *testing.T) {
+	var calls int32
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"X": handler.New(func(context.Context) string {
+			atomic.AddInt32(&calls, 1)
+			return "OK"
+		}),
+	}, &jrpc2.ServerOptions{MaxBatchSize: 2}).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	tests := []struct {
+		input, want string
+		calls       int32
+	}{
+		{`[{"jsonrpc":"2.0","id":1,"method":"X"},{"jsonrpc":"2.0","id":2,"method":"X"},{"jsonrpc":"2.0","method":"X"}]`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32088,"message":"batch of 3 requests exceeds limit 2",` +
+				`"data":{"limit":"batchSize","size":3,"max":2}}}`, 0},
+		{`[{"jsonrpc":"2.0","id":1,"method":"X"},{"jsonrpc":"2.0","id":2,"method":"X"}]`,
+			`[{"jsonrpc":"2.0","id":1,"result":"OK"},{"jsonrpc":"2.0","id":2,"result":"OK"}]`, 2},
+		{`{"jsonrpc":"2.0","id":3,"method":"X"}`, `{"jsonrpc":"2.0","id":3,"result":"OK"}`, 3},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("Send %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+		if got := atomic.LoadInt32(&calls); got != test.calls {
+			t.Errorf("After %#q: got %d calls, want %d", test.input, got, test.calls)
+		}
+	}
+}
+
+// Verify that a message larger than the MaxRequestSize limit is discarded,
+// and that the server continues to serve the connection.
+func TestMaxRequestSize(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, &jrpc2.ServerOptions{
+		MaxRequestSize: 50,
+	}).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+
+	big := `{"jsonrpc":"2.0","id":2,"method":"X","params":["` + strings.Repeat("x", 50) + `"]}`
+	tests := []struct {
+		input, want string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"X"}`, `{"jsonrpc":"2.0","id":1,"result":"OK"}`},
+		{big, `{"jsonrpc":"2.0","id":null,"error":{"code":-32088,"message":"message size 101 exceeds limit 50",` +
+			`"data":{"limit":"requestSize","size":101,"max":50}}}`},
+		{`{"jsonrpc":"2.0","id":3,"method":"X"}`, `{"jsonrpc":"2.0","id":3,"result":"OK"}`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("Send %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that a server holding MaxQueuedBatches batches sheds the load from a
+// client that floods it, and recovers once its handlers catch up.
+func TestMaxQueuedBatches(t *testing.T) {
+	release := make(chan struct{})
+	var notes int32
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"Block": handler.New(func(context.Context) string {
+			<-release
+			return "OK"
+		}),
+		"X": testOK,
+		"N": handler.New(func(context.Context) error {
+			atomic.AddInt32(&notes, 1)
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{
+		MaxQueuedBatches: 2,
+	}).Start(srv)
+	defer func() {
+		cli.Close()
+		s.Wait()
+	}()
+	send := func(msg string) {
+		if err := cli.Send([]byte(msg)); err != nil {
+			t.Errorf("Send %#q failed: %v", msg, err)
+		}
+	}
+	recv := func() string {
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		return string(raw)
+	}
+
+	// Two calls block, so the server holds as many batches as it may.
+	send(`{"jsonrpc":"2.0","id":1,"method":"Block"}`)
+	send(`{"jsonrpc":"2.0","id":2,"method":"Block"}`)
+
+	// Flood the server. Since the server replies to the calls at once, send
+	// from another goroutine so the replies can be received as they arrive.
+	const numFlood = 20
+	go func() {
+		for i := 0; i < numFlood; i++ {
+			send(fmt.Sprintf(`[{"jsonrpc":"2.0","method":"N"},{"jsonrpc":"2.0","id":%d,"method":"X"}]`, i+10))
+		}
+	}()
+	for i := 0; i < numFlood; i++ {
+		want := fmt.Sprintf(`[{"jsonrpc":"2.0","id":%d,"error":{"code":-32086,"message":"server overloaded"}}]`, i+10)
+		if got := recv(); got != want {
+			t.Errorf("Flood %d: got %#q, want %#q", i, got, want)
+		}
+	}
+
+	// Once the calls are released they complete, in either order, and the
+	// server accepts new requests.
+	close(release)
+	want := map[string]bool{
+		`{"jsonrpc":"2.0","id":1,"result":"OK"}`: true,
+		`{"jsonrpc":"2.0","id":2,"result":"OK"}`: true,
+	}
+	for i := 0; i < 2; i++ {
+		if got := recv(); !want[got] {
+			t.Errorf("Queued call: got unexpected reply %#q", got)
+		}
+	}
+	send(`{"jsonrpc":"2.0","id":3,"method":"X"}`)
+	if got, want := recv(), `{"jsonrpc":"2.0","id":3,"result":"OK"}`; got != want {
+		t.Errorf("After recovery: got %#q, want %#q", got, want)
+	}
+
+	if got := atomic.LoadInt32(&notes); got != 0 {
+		t.Errorf("Notifications handled: got %d, want 0", got)
+	}
+	if got := s.ServerInfo().Counter["rpc.overloaded"]; got != numFlood {
+		t.Errorf("Overloaded count: got %d, want %d", got, numFlood)
+	}
+}
+
+// Verify that server-side push notifications work.
+func TestPushNotify(t *testing.T) {
+	// Set up a server and client with server-side notification support.  Here
+	// we're just capturing the name of the notification method, as a sign we
+	// got the right thing.
+	var notes []string
+	loc := server.NewLocal(handler.Map{
+		"NoteMe": handler.New(func(ctx context.Context) (bool, error) {
+			// When this method is called, it posts a notification back to the
+			// client before returning.
+			if err := jrpc2.PushNotify(ctx, "method", nil); err != nil {
+				t.Errorf("PushNotify unexpectedly failed: %v", err)
+				return false, err
+			}
+			return true, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			AllowPush: true,
+		},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				notes = append(notes, req.Method())
+				t.Logf("OnNotify handler saw method %q", req.Method())
+			},
+		},
+	})
+	s, c := loc.Server, loc.Client
+	ctx := context.Background()
+
+	// Post an explicit notification.
+	if err := s.Notify(ctx, "explicit", nil); err != nil {
+		t.Errorf("Notify explicit: unexpected error: %v", err)
+	}
+
+	// Call the method that posts a notification.
+	if _, err := c.Call(ctx, "NoteMe", nil); err != nil {
+		t.Errorf("Call NoteMe: unexpected error: %v", err)
+	}
+
+	// Shut everything down to be sure the callbacks have settled.
+	loc.Close()
+
+	want := []string{"explicit", "method"}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Server notifications: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that client notification handlers are dispatched by method, run
+// without stalling the delivery of responses, respect the concurrency limit,
+// and fall back to OnNotify for other methods.
+func TestNotifyHandlers(t *testing.T) {
+	push := func(methods ...string) jrpc2.Handler {
+		return handler.New(func(ctx context.Context) error {
+			for _, m := range methods {
+				if err := jrpc2.PushNotify(ctx, m, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	var active, peak int32
+	started, finished := make(chan struct{}, 3), make(chan struct{}, 3)
+	release, fast := make(chan struct{}), make(chan string, 2)
+	var mu sync.Mutex
+	var other []string
+
+	loc := server.NewLocal(handler.Map{
+		"Start": push("slow", "fast", "fast", "other"),
+		"Flood": push("slow", "slow"),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			NotifyHandlers: map[string]func(*jrpc2.Request){
+				"slow": func(*jrpc2.Request) {
+					n := atomic.AddInt32(&active, 1)
+					for {
+						old := atomic.LoadInt32(&peak)
+						if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+							break
+						}
+					}
+					started <- struct{}{}
+					<-release
+					atomic.AddInt32(&active, -1)
+					finished <- struct{}{}
+				},
+				"fast": func(req *jrpc2.Request) { fast <- req.Method() },
+			},
+			HandlerConcurrency: 2,
+			OnNotify: func(req *jrpc2.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				other = append(other, req.Method())
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// While the slow handler is blocked, the call completes and the fast
+	// handlers run.
+	if _, err := loc.Client.Call(ctx, "Start", nil); err != nil {
+		t.Fatalf("Call Start: unexpected error: %v", err)
+	}
+	<-started
+	for i := 0; i < 2; i++ {
+		if got := <-fast; got != "fast" {
+			t.Errorf("Fast handler: got method %q, want fast", got)
+		}
+	}
+	mu.Lock()
+	if diff := cmp.Diff([]string{"other"}, other); diff != "" {
+		t.Errorf("OnNotify fallback (-want, +got):\n%s", diff)
+	}
+	mu.Unlock()
+
+	// No more than two handlers run at once.
+	if _, err := loc.Client.Call(ctx, "Flood", nil); err != nil {
+		t.Fatalf("Call Flood: unexpected error: %v", err)
+	}
+	<-started
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-finished
+	}
+	if n := atomic.LoadInt32(&peak); n != 2 {
+		t.Errorf("Peak concurrent handlers: got %d, want 2", n)
+	}
+}
+
+// Verify that a flood of notifications waiting for busy handlers does not
+// start a goroutine for each notification.
+func TestNotifyHandlersQueued(t *testing.T) {
+	const numNotes = 200
+	var handled int32
+	release := make(chan struct{})
+	done := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Flood": handler.New(func(ctx context.Context) error {
+			for i := 0; i < numNotes; i++ {
+				if err := jrpc2.PushNotify(ctx, "slow", nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			NotifyHandlers: map[string]func(*jrpc2.Request){
+				"slow": func(*jrpc2.Request) {
+					<-release
+					if atomic.AddInt32(&handled, 1) == numNotes {
+						close(done)
+					}
+				},
+			},
+			HandlerConcurrency: 2,
+		},
+	})
+	defer loc.Close()
+
+	// The response to Flood is delivered after the notifications it sent, so
+	// once the call returns, all of them have been received.
+	base := runtime.NumGoroutine()
+	if _, err := loc.Client.Call(context.Background(), "Flood", nil); err != nil {
+		t.Fatalf("Call Flood: unexpected error: %v", err)
+	}
+	if n := runtime.NumGoroutine() - base; n > numNotes/10 {
+		t.Errorf("Goroutines while handlers are busy: got %d more, want at most %d", n, numNotes/10)
+	}
+
+	close(release)
+	<-done
+}
+
+// Verify that a handler can reach its server from the context, to post
+// progress notifications, and that Notify fails on a server that is not
+// running.
+func TestServerFromContext(t *testing.T) {
+	if s := jrpc2.ServerFromContext(context.Background()); s != nil {
+		t.Errorf("ServerFromContext(background): got %p, want nil", s)
+	}
+
+	var notes []string
+	loc := server.NewLocal(handler.Map{
+		"Work": handler.New(func(ctx context.Context, arg struct{ Steps int }) (string, error) {
+			srv := jrpc2.ServerFromContext(ctx)
+			for i := 1; i <= arg.Steps; i++ {
+				if err := srv.Notify(ctx, "progress", []int{i, arg.Steps}); err != nil {
+					return "", err
+				}
+			}
+			return "done", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				notes = append(notes, req.Method()+" "+req.ParamString())
+			},
+		},
+	})
+	ctx := context.Background()
+	var got string
+	if err := loc.Client.CallResult(ctx, "Work", handler.Obj{"steps": 3}, &got); err != nil {
+		t.Errorf("Call Work: unexpected error: %v", err)
+	} else if got != "done" {
+		t.Errorf("Call Work: got %q, want done", got)
+	}
+	s := loc.Server
+	loc.Close()
+
+	want := []string{"progress [1,3]", "progress [2,3]", "progress [3,3]"}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Progress notifications: (-want, +got)\n%s", diff)
+	}
+
+	// A server that has stopped, or was never started, cannot notify.
+	if err := s.Notify(ctx, "late", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Notify after stop: got %v, want %v", err, jrpc2.ErrConnClosed)
+	}
+	idle := jrpc2.NewServer(handler.Map{}, &jrpc2.ServerOptions{AllowPush: true})
+	if err := idle.Notify(ctx, "early", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Notify before start: got %v, want %v", err, jrpc2.ErrConnClosed)
+	}
+}
+
+// Verify that a handler can report the progress of a call with PushProgress,
+// and that it cannot do so once the call has completed.
+func TestPushProgress(t *testing.T) {
+	var notes []string
+	done := make(chan context.Context, 1)
+	loc := server.NewLocal(handler.Map{
+		"Work": handler.New(func(ctx context.Context, arg struct{ Steps int }) (string, error) {
+			defer func() { done <- ctx }()
+			for i := 1; i <= arg.Steps; i++ {
+				if err := jrpc2.PushProgress(ctx, []int{i, arg.Steps}); err != nil {
+					return "", err
+				}
+			}
+			return "done", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				var info jrpc2.ProgressInfo
+				if req.Method() != "rpc.progress" {
+					t.Errorf("OnNotify: unexpected method %q", req.Method())
+				} else if err := req.UnmarshalParams(&info); err != nil {
+					t.Errorf("OnNotify: invalid progress: %v", err)
+				} else {
+					notes = append(notes, string(info.ID)+" "+string(info.Value))
+				}
+			},
+		},
+	})
+	ctx := context.Background()
+	rsp, err := loc.Client.Call(ctx, "Work", handler.Obj{"steps": 3})
+	if err != nil {
+		t.Fatalf("Call Work: unexpected error: %v", err)
+	} else if got := rsp.ResultString(); got != `"done"` {
+		t.Errorf("Call Work: got %s, want %q", got, "done")
+	}
+
+	// Once the call has completed, its progress can no longer be reported.
+	if err := jrpc2.PushProgress(<-done, "late"); err != jrpc2.ErrRequestDone {
+		t.Errorf("PushProgress after completion: got %v, want %v", err, jrpc2.ErrRequestDone)
+	}
+	loc.Close()
+
+	id := rsp.ID()
+	want := []string{id + " [1,3]", id + " [2,3]", id + " [3,3]"}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Progress notifications: (-want, +got)\n%s", diff)
+	}
+
+	// Without the AllowPush option, progress is not reported.
+	loc = server.NewLocal(handler.Map{
+		"Work": handler.New(func(ctx context.Context) error {
+			return jrpc2.PushProgress(ctx, 1)
+		}),
+	}, nil)
+	defer loc.Close()
+	if _, err := loc.Client.Call(ctx, "Work", nil); err == nil ||
+		!strings.Contains(err.Error(), jrpc2.ErrPushUnsupported.Error()) {
+		t.Errorf("Call Work without push: got %v, want %v", err, jrpc2.ErrPushUnsupported)
+	}
+}
+
+// Verify that the client delivers notifications and responses in the order
+// the server sent them, even when each arrives in a message of its own.
+func TestClientDeliveryOrder(t *testing.T) {
+	cch, sch := channel.Direct()
+	var notes []string
+	cli := jrpc2.NewClient(cch, &jrpc2.ClientOptions{
+		OnNotify: func(req *jrpc2.Request) { notes = append(notes, req.Method()) },
+	})
+	defer cli.Close()
+	defer sch.Close()
+
+	// Wait for the call, then send a run of notifications before its reply.
+	const numNotes = 50
+	go func() {
+		if _, err := sch.Recv(); err != nil {
+			t.Errorf("Server Recv: unexpected error: %v", err)
+			return
+		}
+		for i := 0; i < numNotes; i++ {
+			sch.Send([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"note%d"}`, i)))
+		}
+		sch.Send([]byte(`{"jsonrpc":"2.0","id":1,"result":"done"}`))
+	}()
+
+	if _, err := cli.Call(context.Background(), "Test", nil); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+
+	// The response was delivered after all the notifications that preceded it.
+	var want []string
+	for i := 0; i < numNotes; i++ {
+		want = append(want, fmt.Sprintf("note%d", i))
+	}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Notifications: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that a response the server sends just before it closes the
+// connection is delivered, rather than the call failing because the
+// connection closed.
+func TestClientResponseBeforeClose(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		cch, sch := channel.Direct()
+		cli := jrpc2.NewClient(cch, nil)
+		go func() {
+			defer sch.Close()
+			if _, err := sch.Recv(); err == nil {
+				sch.Send([]byte(`{"jsonrpc":"2.0","id":1,"result":"done"}`))
+			}
+		}()
+
+		var got string
+		if err := cli.CallResult(ctx, "Test", nil, &got); err != nil {
+			t.Errorf("Call %d: unexpected error: %v", i+1, err)
+		} else if got != "done" {
+			t.Errorf("Call %d: got %q, want done", i+1, got)
+		}
+		cli.Close()
+	}
+}
+
+// Verify that server-side callbacks work.
+func TestPushCall(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"CallMeMaybe": handler.New(func(ctx context.Context) error {
+			if rsp, err := jrpc2.PushCall(ctx, "succeed", nil); err != nil {
+				t.Errorf("Callback failed: %v", err)
+			} else {
+				t.Logf("Callback succeeded: %v", rsp.ResultString())
+			}
+
+			if rsp, err := jrpc2.PushCall(ctx, "fail", nil); err == nil {
+				t.Errorf("Callback did not fail: got %v, want error", rsp)
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				t.Logf("OnCallback invoked for method %q", req.Method())
+				switch req.Method() {
+				case "succeed":
+					return true, nil
+				case "fail":
+					return false, errors.New("here is your requested error")
+				}
+				panic("broken test: you should not see this")
+			},
+		},
+	})
+	defer loc.Close()
+	s, c := loc.Server, loc.Client
+	ctx := context.Background()
+
+	// Post an explicit callback.
+	if _, err := s.Callback(ctx, "succeed", nil); err != nil {
+		t.Errorf("Callback explicit: unexpected error: %v", err)
+	}
+
+	// Call the method that posts a callback.
+	if _, err := c.Call(ctx, "CallMeMaybe", nil); err != nil {
+		t.Errorf("Call CallMeMaybe: unexpected error: %v", err)
+	}
+}
+
+// Verify that client callback handlers are dispatched by method, may call
+// back into the server while the callback is pending, and that the client
+// replies with an error for a method it does not handle.
+func TestCallbackHandlers(t *testing.T) {
+	var loc server.Local
+	loc = server.NewLocal(handler.Map{
+		"Ask": handler.New(func(ctx context.Context, vals []int) (int, error) {
+			var sum int
+			rsp, err := jrpc2.PushCall(ctx, "Sum", vals)
+			if err != nil {
+				return 0, err
+			} else if err := rsp.UnmarshalResult(&sum); err != nil {
+				return 0, err
+			}
+			return sum, nil
+		}),
+		"Double": handler.New(func(_ context.Context, vals []int) int { return 2 * vals[0] }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true, Concurrency: 2},
+		Client: &jrpc2.ClientOptions{
+			CallbackHandlers: map[string]func(context.Context, *jrpc2.Request) (interface{}, error){
+				"Sum": func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+					var vals []int
+					if err := req.UnmarshalParams(&vals); err != nil {
+						return nil, err
+					}
+					var sum int
+					for _, v := range vals {
+						sum += v
+					}
+					// Call the server while its callback is still waiting.
+					var dbl int
+					if err := loc.Client.CallResult(ctx, "Double", []int{sum}, &dbl); err != nil {
+						return nil, err
+					}
+					return dbl, nil
+				},
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	var got int
+	if err := loc.Client.CallResult(ctx, "Ask", []int{1, 2, 3}, &got); err != nil {
+		t.Errorf("Call Ask: unexpected error: %v", err)
+	} else if got != 12 {
+		t.Errorf("Call Ask: got %d, want 12", got)
+	}
+
+	_, err := loc.Server.Callback(ctx, "Unknown", nil)
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.MethodNotFound {
+		t.Errorf("Callback Unknown: got %v, want %v", err, code.MethodNotFound)
+	}
+}
+
+// Verify that the reply to a callback is not mistaken for a duplicate request
+// when its ID matches a request from the client that is still pending.
+func TestPushCallSameID(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Ask": handler.New(func(ctx context.Context) (string, error) {
+			rsp, err := jrpc2.PushCall(ctx, "answer", nil)
+			if err != nil {
+				return "", err
+			}
+			var s string
+			err = rsp.UnmarshalResult(&s)
+			return s, err
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				return "forty-two", nil
+			},
+		},
+	})
+	defer loc.Close()
+
+	// The first request from the client and the first callback from the
+	// server both have ID 1.
+	var got string
+	if err := loc.Client.CallResult(context.Background(), "Ask", nil, &got); err != nil {
+		t.Errorf("Call Ask: unexpected error: %v", err)
+	} else if got != "forty-two" {
+		t.Errorf("Call Ask: got %q, want forty-two", got)
+	}
+}
+
+// Verify that a callback stops waiting for its reply when its context ends,
+// or when the server stops.
+func TestCallbackCancel(t *testing.T) {
+	release := make(chan struct{})
+	loc := server.NewLocal(make(handler.Map), &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				<-release
+				return "late", nil
+			},
+		},
+	})
+	defer loc.Close()
+	s := loc.Server
+
+	// The reply does not arrive before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if rsp, err := s.Callback(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Errorf("Callback with deadline: got (%v, %v), want %v", rsp, err, context.DeadlineExceeded)
+	}
+
+	// The reply does not arrive before the server stops.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Callback(context.Background(), "stuck", nil)
+		errc <- err
+	}()
+	for s.ServerInfo().Counter["rpc.calls"] < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	select {
+	case err := <-errc:
+		if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.SystemError {
+			t.Errorf("Callback after stop: got %v, want code %v", err, code.SystemError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Callback did not return after the server stopped")
+	}
+	close(release)
+}
+
+// Verify that a server push after the client closes does not trigger a panic.
+func TestDeadServerPush(t *testing.T) {
+	loc := server.NewLocal(make(handler.Map), &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+	})
+	loc.Client.Close()
+	ctx := context.Background()
+	if err := loc.Server.Notify(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Notify(whatever): got %v, want %v", err, jrpc2.ErrConnClosed)
+	}
+	if rsp, err := loc.Server.Callback(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Callback(whatever): got %v, %v; want %v", rsp, err, jrpc2.ErrConnClosed)
+	}
+}
+
+// Verify that rpc.cancel takes effect even if the request it cancels holds
+// the only slot allowed by the concurrency limit.
+func TestCancelAtConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	loc := server.NewLocal(handler.Map{
+		"Hang": handler.New(func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				stopped <- ctx.Err()
+			case <-time.After(10 * time.Second): // shouldn't happen
+				stopped <- errors.New("timed out waiting for cancellation")
+			}
+			return ctx.Err()
+		}),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{Concurrency: 1}})
+	defer loc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(ctx, "Hang", nil)
+		errc <- err
+	}()
+	<-started
+	cancel()
+
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Call Hang: got error %v, want %v", err, context.Canceled)
+	}
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("Handler context: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// Verify that an OnCancel hook is called when expected.
+func TestOnCancel(t *testing.T) {
+	// Set up a plumbing context so the test can unblock the server.
+	sctx, cancelServer := context.WithCancel(context.Background())
+	defer cancelServer()
+	loc := server.NewLocal(handler.Map{
+		// Block until explicitly cancelled, via sctx.
+		"Stall": handler.New(func(_ context.Context) error {
+			select {
+			case <-sctx.Done():
+				t.Logf("Server unblocked; returning err=%v", sctx.Err())
+				return sctx.Err()
+			case <-time.After(10 * time.Second): // shouldn't happen
+				t.Error("Timeout waiting for server cancellation")
+			}
+			return nil
+		}),
+
+		// Verify that setting the cancellation hook prevents the client from
+		// sending the default rpc.cancel notification.
+		"rpc.cancel": handler.New(func(ctx context.Context, ids json.RawMessage) error {
+			t.Errorf("Server-side rpc.cancel unexpectedly called: %s", string(ids))
+			return nil
+		}),
+	}, &server.LocalOptions{
+		// Disable handling of built-in methods on the server.
+		Server: &jrpc2.ServerOptions{DisableBuiltin: true},
+		Client: &jrpc2.ClientOptions{
+			OnCancel: func(cli *jrpc2.Client, rsp *jrpc2.Response) {
+				t.Logf("OnCancel hook called with id=%q, err=%v", rsp.ID(), rsp.Error())
+				cancelServer()
+			},
+		},
+	})
+
+	// Call a method on the server that will stall until cancelServer is called.
+	// On the client side, set a deadline to expire the caller's context.
+	// The cancellation hook will unblock the server.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	got, err := loc.Client.Call(ctx, "Stall", nil)
+	if err == nil {
+		t.Errorf("Stall: got %+v, wanted error", got)
+	} else if err != context.DeadlineExceeded {
+		t.Errorf("Stall: got error %v, want %v", err, context.Canceled)
+	}
+	loc.Client.Close()
+	if err := loc.Server.Wait(); err != nil {
+		t.Errorf("Server exit status: %v", err)
+	}
+}
+
+// Verify that the context encoding/decoding hooks work.
+func TestContextPlumbing(t *testing.T) {
+	want := time.Now().Add(10 * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), want)
+	defer cancel()
+
+	loc := server.NewLocal(handler.Map{
+		"X": handler.New(func(ctx context.Context) (bool, error) {
+			got, ok := ctx.Deadline()
+			if !ok {
+				return false, errors.New("no deadline was set")
+			} else if !got.Equal(want) {
+				return false, fmt.Errorf("deadline: got %v, want %v", got, want)
+			}
+			t.Logf("Got expected deadline: %v", got)
+			return true, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{DecodeContext: jctx.Decode},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer loc.Close()
+
+	if _, err := loc.Client.Call(ctx, "X", nil); err != nil {
+		t.Errorf("Call X failed: %v", err)
+	}
+}
+
+// Verify that a context encoded by the client is decoded by the server, over
+// a connection through a pipe, and that an invalid context is reported with
+// code.InvalidParams.
+func TestDecodeContextPipe(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	srv := jrpc2.NewServer(handler.Map{
+		"Echo": handler.New(func(ctx context.Context, vs []int) (interface{}, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, errors.New("no deadline was set")
+			}
+			var meta string
+			if err := jctx.UnmarshalMetadata(ctx, &meta); err != nil {
+				return nil, err
+			}
+			return []interface{}{meta, vs}, nil
+		}),
+	}, &jrpc2.ServerOptions{DecodeContext: jctx.Decode}).Start(channel.Line(sconn, sconn))
+	defer srv.Wait()
+
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), &jrpc2.ClientOptions{
+		EncodeContext: jctx.Encode,
+	})
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctx, err := jctx.WithMetadata(ctx, "hello")
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	var got json.RawMessage
+	if err := cli.CallResult(ctx, "Echo", []int{1, 2}, &got); err != nil {
+		t.Errorf("Call Echo: unexpected error: %v", err)
+	} else if want := `["hello",[1,2]]`; string(got) != want {
+		t.Errorf("Call Echo: got %s, want %s", got, want)
+	}
+
+	// A context with an unknown version is invalid. Since the client wraps
+	// the parameters in a context of its own, send the message directly.
+	dcli, dsrv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"Echo": testOK}, &jrpc2.ServerOptions{
+		DecodeContext: jctx.Decode,
+	}).Start(dsrv)
+	defer func() { dcli.Close(); s.Wait() }()
+	if err := dcli.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Echo","params":{"jctx":"99"}}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	const want = `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid request context: invalid context version \"99\""}}`
+	if raw, err := dcli.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	} else if string(raw) != want {
+		t.Errorf("Invalid context:\n got %#q\nwant %#q", raw, want)
+	}
+}
+
+// Verify that the request-checking hook works.
+func TestRequestHook(t *testing.T) {
+	const wantResponse = "Hey girl"
+	const wantToken = "OK"
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) (string, error) {
+			return wantResponse, nil
+		}),
+	}, &server.LocalOptions{
+		// Enable auth checking and context decoding for the server.
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.Decode,
+			CheckRequest: func(ctx context.Context, req *jrpc2.Request) error {
+				var token []byte
+				switch err := jctx.UnmarshalMetadata(ctx, &token); err {
+				case nil:
+					t.Logf("Metadata present: value=%q", string(token))
+				case jctx.ErrNoMetadata:
+					t.Log("Metadata not set")
+				default:
+					return err
+				}
+				if s := string(token); s != wantToken {
+					return jrpc2.Errorf(notAuthorized, "not authorized")
+				}
+				return nil
+			},
+		},
+
+		// Enable context encoding for the client.
+		Client: &jrpc2.ClientOptions{
+			EncodeContext: jctx.Encode,
+		},
+	})
+	defer loc.Close()
+	c := loc.Client
+
+	// Call without a token and verify that we get an error.
+	t.Run("NoToken", func(t *testing.T) {
+		var rsp string
+		err := c.CallResult(context.Background(), "Test", nil, &rsp)
+		if err == nil {
+			t.Errorf("Call(Test): got %q, wanted error", rsp)
+		} else if ec := code.FromError(err); ec != notAuthorized {
+			t.Errorf("Call(Test): got code %v, want %v", ec, notAuthorized)
+		}
+	})
+
+	// Call with a valid token and verify that we get a response.
+	t.Run("GoodToken", func(t *testing.T) {
+		ctx, err := jctx.WithMetadata(context.Background(), []byte(wantToken))
+		if err != nil {
+			t.Fatalf("Call(Test): attaching metadata: %v", err)
+		}
+		var rsp string
+		if err := c.CallResult(ctx, "Test", nil, &rsp); err != nil {
+			t.Errorf("Call(Test): unexpected error: %v", err)
+		}
+		if rsp != wantResponse {
+			t.Errorf("Call(Test): got %q, want %q", rsp, wantResponse)
+		}
+	})
+
+	// Call with an invalid token and verify that we get an error.
+	t.Run("BadToken", func(t *testing.T) {
+		ctx, err := jctx.WithMetadata(context.Background(), []byte("BAD"))
+		if err != nil {
+			t.Fatalf("Call(Test): attaching metadata: %v", err)
+		}
+		var rsp string
+		if err := c.CallResult(ctx, "Test", nil, &rsp); err == nil {
+			t.Errorf("Call(Test): got %q, wanted error", rsp)
+		} else if ec := code.FromError(err); ec != notAuthorized {
+			t.Errorf("Call(Test): got code %v, want %v", ec, notAuthorized)
+		}
+	})
+}
+
+// Verify that the Authorize hook can check the token attached by the client,
+// that unauthorized calls fail without invoking their handlers, and that
+// unauthorized notifications are discarded.
+func TestAuthorize(t *testing.T) {
+	type tokenKey struct{}
+	var calls int32
+	count := handler.New(func(context.Context, []string) int32 {
+		return atomic.AddInt32(&calls, 1)
+	})
+	loc := server.NewLocal(handler.Map{
+		"Public":  count,
+		"Private": count,
+		"Replay":  count,
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.Decode,
+			Authorize: func(ctx context.Context, method string, params []byte) (context.Context, error) {
+				token := jctx.AuthToken(ctx)
+				switch {
+				case method == "Public":
+					return nil, nil
+				case method == "Replay":
+					return nil, fmt.Errorf("%w: token reused", jctx.ErrReplayedToken)
+				case string(params) != `["x"]`:
+					return nil, fmt.Errorf("unexpected parameters %s", params)
+				case token != "secret":
+					return nil, fmt.Errorf("invalid token %q", token)
+				}
+				return nil, nil
+			},
+		},
+		Client: &jrpc2.ClientOptions{
+			EncodeContext: jctx.EncodeAuth(func(ctx context.Context, _ string, _ []byte) (string, error) {
+				tok, _ := ctx.Value(tokenKey{}).(string)
+				return tok, nil
+			}),
+		},
+	})
+	defer loc.Close()
+
+	withToken := context.WithValue(context.Background(), tokenKey{}, "secret")
+	badToken := context.WithValue(context.Background(), tokenKey{}, "guess")
+	tests := []struct {
+		ctx    context.Context
+		method string
+		want   code.Code
+	}{
+		{context.Background(), "Public", code.NoError},
+		{context.Background(), "Private", code.Unauthorized},
+		{badToken, "Private", code.Unauthorized},
+		{withToken, "Private", code.NoError},
+		{withToken, "Replay", code.Replayed},
+	}
+	for _, test := range tests {
+		_, err := loc.Client.Call(test.ctx, test.method, []string{"x"})
+		if got := code.FromError(err); got != test.want {
+			t.Errorf("Call %s: got %v, want code %v", test.method, err, test.want)
+		}
+	}
+
+	// An unauthorized notification is discarded.
+	if err := loc.Client.Notify(badToken, "Private", []string{"x"}); err != nil {
+		t.Errorf("Notify Private: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Call(context.Background(), "Public", []string{"x"}); err != nil {
+		t.Errorf("Call Public: unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("Handler calls: got %d, want 3", got)
+	}
+	if got := loc.Server.ServerInfo().Counter["rpc.unauthorized"]; got != 4 {
+		t.Errorf("Unauthorized requests: got %d, want 4", got)
+	}
+}
+
+// Verify that a handler can learn the principal verified by the Authorize
+// hook, even when replay protection prevents verifying the token again.
+func TestAuthorizePrincipal(t *testing.T) {
+	key := []byte("shared secret")
+	verify := jctx.NewHMACVerifier(map[string][]byte{"k1": key}, &jctx.HMACOptions{
+		Window: time.Minute,
+		Nonces: jctx.NewMemoryNonceStore(),
+	})
+	loc := server.NewLocal(handler.Map{
+		"Whoami": handler.New(func(ctx context.Context) (string, error) {
+			return jctx.Principal(ctx), nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.Decode,
+			Authorize:     verify.Authorize,
+		},
+		Client: &jrpc2.ClientOptions{
+			EncodeContext: jctx.EncodeAuth(jctx.HMACAuthorizer(key, "alice")),
+		},
+	})
+	defer loc.Close()
+
+	for i := 0; i < 2; i++ {
+		var got string
+		if err := loc.Client.CallResult(context.Background(), "Whoami", nil, &got); err != nil {
+			t.Errorf("Call Whoami: unexpected error: %v", err)
+		} else if got != "alice" {
+			t.Errorf("Call Whoami: got %q, want alice", got)
+		}
+	}
+}
+
+// Verify that a signed request re-sent verbatim is rejected as a replay.
+func TestAuthReplay(t *testing.T) {
+	key := []byte("shared secret")
+	verify := jctx.NewHMACVerifier(map[string][]byte{"k1": key}, &jctx.HMACOptions{
+		Window: time.Minute,
+		Nonces: jctx.NewMemoryNonceStore(),
+	})
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Mutate": handler.New(func(context.Context) string { return "ok" }),
+	}, &jrpc2.ServerOptions{
+		DecodeContext: jctx.Decode,
+		CheckRequest: func(ctx context.Context, req *jrpc2.Request) error {
+			_, err := verify(ctx, req.Method(), []byte(req.ParamString()))
+			return err
+		},
+	}).Start(spipe)
+	defer srv.Stop()
+
+	encode := jctx.EncodeAuth(jctx.HMACAuthorizer(key, "bob"))
+	frame := func() string {
+		params, err := encode(context.Background(), "Mutate", nil)
+		if err != nil {
+			t.Fatalf("Encoding context failed: %v", err)
+		}
+		return `{"jsonrpc":"2.0","id":1,"method":"Mutate","params":` + string(params) + `}`
+	}
+	call := func(msg string) (json.RawMessage, *jrpc2.Error) {
+		t.Helper()
+		if err := cpipe.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		bits, err := cpipe.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		var rsp struct {
+			R json.RawMessage `json:"result"`
+			E *jrpc2.Error    `json:"error"`
+		}
+		if err := json.Unmarshal(bits, &rsp); err != nil {
+			t.Fatalf("Decoding response: %v", err)
+		}
+		return rsp.R, rsp.E
+	}
+
+	first := frame()
+	if got, err := call(first); err != nil {
+		t.Errorf("First call: unexpected error: %v", err)
+	} else if string(got) != `"ok"` {
+		t.Errorf("First call: got %s, want %q", got, "ok")
+	}
+	if got, err := call(first); err == nil || err.Code() != code.Replayed {
+		t.Errorf("Replayed call: got (%s, %v), want code %v", got, err, code.Replayed)
+	}
+	if _, err := call(frame()); err != nil {
+		t.Errorf("Fresh call: unexpected error: %v", err)
+	}
+}
+
+// Verify that calling a wrapped method which takes no parameters, but in which
+// the caller provided parameters, will correctly report an error.
+func TestNoParams(t *testing.T) {
+	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer loc.Close()
+
+	var rsp string
+	if err := loc.Client.CallResult(context.Background(), "Test", []int{1, 2, 3}, &rsp); err == nil {
+		t.Errorf("Call(Test): got %q, wanted error", rsp)
+	} else if ec := code.FromError(err); ec != code.InvalidParams {
+		t.Errorf("Call(Test): got code %v, wanted %v", ec, code.InvalidParams)
+	}
+}
+
+// Verify that the rpc.serverInfo handler and client wrapper work together.
+func TestRPCServerInfo(t *testing.T) {
+	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer loc.Close()
+
+	ctx := context.Background()
+	if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
+		t.Fatalf("Call Test: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Call(ctx, "Nonesuch", nil); err == nil {
+		t.Fatal("Call Nonesuch: got nil error, want failure")
+	}
+
+	si, err := jrpc2.RPCServerInfo(ctx, loc.Client)
+	if err != nil {
+		t.Fatalf("RPCServerInfo failed: %v", err)
+	}
+	{
+		got, want := si.Methods, []string{"Test"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+		}
+	}
+	if si.StartTime.IsZero() {
+		t.Error("StartTime is not set")
+	}
+	for key, want := range map[string]int64{
+		"rpc.requests":          3, // including rpc.serverInfo
+		"rpc.responses":         2, // the response to rpc.serverInfo is not sent yet
+		"rpc.errorCodes.-32601": 1,
+		"rpc.errorCodes.-32602": 0,
+	} {
+		if got := si.Counter[key]; got != want {
+			t.Errorf("Counter %q: got %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", "unix"},
+		{":", "unix"},
+
+		{"nothing", "unix"},        // no colon
+		{"like/a/file", "unix"},    // no colon
+		{"no-port:", "unix"},       // empty port
+		{"file/with:port", "unix"}, // slashes in host
+		{"path/with:404", "unix"},  // slashes in host
+		{"mangled:@3", "unix"},     // non-alphanumerics in port
+
+		{":80", "tcp"},            // numeric port
+		{":dumb-crud", "tcp"},     // service name
+		{"localhost:80", "tcp"},   // host and numeric port
+		{"localhost:http", "tcp"}, // host and service name
+	}
+	for _, test := range tests {
+		got := jrpc2.Network(test.input)
+		if got != test.want {
+			t.Errorf("Network(%q): got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		input, network, address string
+	}{
+		// Addresses without a scheme use the heuristic.
+		{"localhost:8080", "tcp", "localhost:8080"},
+		{":http", "tcp", ":http"},
+		{"[::1]:8080", "tcp", "[::1]:8080"},
+		{"/tmp/service.sock", "unix", "/tmp/service.sock"},
+		{"/tmp/with:colon", "unix", "/tmp/with:colon"},
+		{"rel/path:80", "unix", "rel/path:80"},
+		{"service", "unix", "service"},
+
+		// Explicit schemes override the heuristic.
+		{"tcp://localhost:8080", "tcp", "localhost:8080"},
+		{"tcp://[::1]:8080", "tcp", "[::1]:8080"},
+		{"tcp://[fe80::1%eth0]:http", "tcp", "[fe80::1%eth0]:http"},
+		{"tcp4://127.0.0.1:80", "tcp4", "127.0.0.1:80"},
+		{"tcp6://[::]:80", "tcp6", "[::]:80"},
+		{"unix:///tmp/service.sock", "unix", "/tmp/service.sock"},
+		{"unix:///tmp/with:80", "unix", "/tmp/with:80"},
+		{"unix://sock:80", "unix", "sock:80"},
+		{"unix://[::1]:8080", "unix", "[::1]:8080"},
+
+		// A "://" that does not follow a valid scheme is not a scheme.
+		{"/odd/path://x", "unix", "/odd/path://x"},
+	}
+	for _, test := range tests {
+		network, address, err := jrpc2.ParseAddress(test.input)
+		if err != nil {
+			t.Errorf("ParseAddress(%q): unexpected error: %v", test.input, err)
+		} else if network != test.network || address != test.address {
+			t.Errorf("ParseAddress(%q): got (%q, %q), want (%q, %q)",
+				test.input, network, address, test.network, test.address)
+		}
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"tcp://localhost",     // missing port
+		"tcp://localhost:",    // empty port
+		"tcp://::1:8080",      // unbracketed IPv6 literal
+		"unix://",             // empty path
+		"ws://localhost:8080", // unsupported scheme
+		"tls+tcp://host:443",  // unsupported scheme
+	}
+	for _, input := range tests {
+		network, address, err := jrpc2.ParseAddress(input)
+		if err == nil {
+			t.Errorf("ParseAddress(%q): got (%q, %q), want error", input, network, address)
+		} else {
+			t.Logf("ParseAddress(%q): got expected error: %v", input, err)
+		}
+	}
+}
+
+// Verify that the context passed to an assigner has the correct structure.
+func TestAssignContext(t *testing.T) {
+	loc := server.NewLocal(assignFunc(func(ctx context.Context, method string) jrpc2.Handler {
+		req := jrpc2.InboundRequest(ctx)
+		if req == nil {
+			t.Errorf("No inbound request for assignment of %q", method)
+		} else if req.Method() != method {
+			t.Errorf("Assign inbound: got %q, want %q", req.Method(), method)
+		} else {
+			t.Logf("Inbound request id=%v method=%q OK", req.ID(), req.Method())
+		}
+		return testOK
+	}), nil)
+	defer loc.Close()
+
+	ctx := context.Background()
+	var got string
+	if err := loc.Client.CallResult(ctx, "NerbleFleeger", nil, &got); err != nil {
+		t.Errorf("CallResult unexpectedly failed: %v", err)
+	} else if got != "OK" {
+		t.Errorf("CallResult: got %q, want %q", got, "OK")
+	}
+}
+
+type assignFunc func(context.Context, string) jrpc2.Handler
+
+func (a assignFunc) Assign(ctx context.Context, m string) jrpc2.Handler { return a(ctx, m) }
+func (assignFunc) Names() []string                                      { return nil }
+
+// Verify that user methods cannot shadow the reserved rpc.* namespace unless
+// the built-in methods are disabled, and that the assigner is not consulted
+// for reserved names.
+func TestReservedMethods(t *testing.T) {
+	shadow := handler.New(func(context.Context) string { return "shadow" })
+	mux := handler.Map{"rpc.serverInfo": shadow, "rpc.custom": shadow, "Plain": shadow}
+
+	tests := []struct {
+		disable bool
+		method  string
+		want    string    // expected result, or "" for any non-shadow result
+		code    code.Code // expected error code, or 0
+	}{
+		{false, "rpc.serverInfo", "", 0},
+		{false, "rpc.custom", "", code.MethodNotFound},
+		{false, "Plain", `"shadow"`, 0},
+		{true, "rpc.serverInfo", `"shadow"`, 0},
+		{true, "rpc.custom", `"shadow"`, 0},
+		{true, "Plain", `"shadow"`, 0},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%s/Disable=%v", test.method, test.disable)
+		t.Run(name, func(t *testing.T) {
+			var asked []string
+			loc := server.NewLocal(assignFunc(func(ctx context.Context, m string) jrpc2.Handler {
+				asked = append(asked, m)
+				return mux.Assign(ctx, m)
+			}), &server.LocalOptions{
+				Server: &jrpc2.ServerOptions{DisableBuiltin: test.disable},
+			})
+			defer loc.Close()
+
+			rsp, err := loc.Client.Call(context.Background(), test.method, nil)
+			if test.code != 0 {
+				if got := code.FromError(err); got != test.code {
+					t.Errorf("Call %q: got error %v, want code %v", test.method, err, test.code)
+				}
+			} else if err != nil {
+				t.Errorf("Call %q: unexpected error: %v", test.method, err)
+			} else if got := rsp.ResultString(); test.want == "" && got == `"shadow"` {
+				t.Errorf("Call %q: reached the user handler, want built-in", test.method)
+			} else if test.want != "" && got != test.want {
+				t.Errorf("Call %q: got %#q, want %#q", test.method, got, test.want)
+			}
+
+			reserved := strings.HasPrefix(test.method, "rpc.") && !test.disable
+			if reserved && len(asked) != 0 {
+				t.Errorf("Assigner was consulted for %q", asked)
+			} else if !reserved && len(asked) == 0 {
+				t.Errorf("Assigner was not consulted for %q", test.method)
+			}
+		})
+	}
+}
+
+func TestWaitStatus(t *testing.T) {
+	check := func(t *testing.T, stat jrpc2.ServerStatus, closed, stopped bool, wantErr error) {
+		t.Helper()
+		t.Logf("Server status: %+v", stat)
+		if got, want := stat.Success(), wantErr == nil; got != want {
+			t.Errorf("Status success: got %v, want %v", got, want)
+		}
+		if got := stat.Closed(); got != closed {
+			t.Errorf("Status closed: got %v, want %v", got, closed)
+		}
+		if got := stat.Stopped(); got != stopped {
+			t.Errorf("Status stopped: got %v, want %v", got, stopped)
+		}
+		if stat.Err != wantErr {
+			t.Errorf("Status error: got %v, want %v", stat.Err, wantErr)
+		}
+	}
+	t.Run("ChannelClosed", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
+		loc.Client.Close()
+		check(t, loc.Server.WaitStatus(), true, false, nil)
+	})
+
+	t.Run("ServerStopped", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
+		loc.Server.Stop()
+		check(t, loc.Server.WaitStatus(), false, true, nil)
+	})
+
+	t.Run("ChannelFailed", func(t *testing.T) {
+		wantErr := errors.New("failed")
+		ch := buggyChannel{data: "bogus", err: wantErr}
+		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(ch)
+		check(t, srv.WaitStatus(), false, false, wantErr)
+	})
+
+	t.Run("ChannelEOF", func(t *testing.T) {
+		ch := buggyChannel{err: fmt.Errorf("reading: %w", io.EOF)}
+		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(ch)
+		check(t, srv.WaitStatus(), true, false, nil)
+	})
+
+	t.Run("WriteFailed", func(t *testing.T) {
+		cli, sch := channel.Direct()
+		failed := make(chan struct{})
+		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(brokenSender{sch, failed})
+		if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"OK"}`)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		<-failed
+
+		// The write error wins over the later Stop and disconnect.
+		srv.Stop()
+		cli.Close()
+		check(t, srv.WaitStatus(), false, false, errReset)
+	})
+}
+
+type buggyChannel struct {
+	data string
+	err  error
+}
+
+func (buggyChannel) Send([]byte) error       { panic("should not be called") }
+func (b buggyChannel) Recv() ([]byte, error) { return []byte(b.data), b.err }
+func (buggyChannel) Close() error            { return nil }
+
+func TestStrictFields(t *testing.T) {
+	type other struct {
+		C bool `json:"charlie"`
+	}
+	type params struct {
+		A string `json:"alpha"`
+		B int    `json:"bravo"`
+		other
+	}
+	type result struct {
+		X string `json:"xray"`
+	}
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			var ps, qs params
+
+			if err := req.UnmarshalParams(jrpc2.StrictFields(&ps)); err == nil {
+				t.Errorf("Unmarshal strict: got %+v, want error", ps)
+			}
+
+			if err := req.UnmarshalParams(&qs); err != nil {
+				t.Errorf("Unmarshal non-strict (default): unexpected error: %v", err)
+			} else {
+				t.Logf("Parameters OK: %+v", qs)
+			}
+
+			return map[string]string{
+				"xray":  "ok",
+				"gamma": "not ok",
+			}, nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	ctx := context.Background()
+	rsp, err := loc.Client.Call(ctx, "Test", handler.Obj{
+		"alpha":   "foo",
+		"bravo":   25,
+		"charlie": true, // exercise embedding
+		"delta":   31.5, // unknown field
+	})
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+
+	t.Run("NonStrictResult", func(t *testing.T) {
+		var res result
+		if err := rsp.UnmarshalResult(&res); err != nil {
+			t.Errorf("UnmarshalResult: %v", err)
+		}
+		t.Logf("Result: %+v", res)
+	})
+
+	t.Run("StrictResult", func(t *testing.T) {
+		var res result
+		if err := rsp.UnmarshalResult(jrpc2.StrictFields(&res)); err == nil {
+			t.Errorf("UnmarshalResult: got %+v, want error", res)
+		} else {
+			t.Logf("UnmarshalResult: got expected error: %v", err)
+		}
+	})
+}
+
+// Verify that strict decoding fills in the value wrapped by StrictFields, and
+// accepts the fields it knows.
+func TestStrictFieldsKnown(t *testing.T) {
+	type point struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			var p point
+			if err := req.UnmarshalParams(jrpc2.StrictFields(&p)); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	want := point{X: 1, Y: 2}
+	rsp, err := loc.Client.Call(context.Background(), "Echo", want)
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	var got point
+	if err := rsp.UnmarshalResult(jrpc2.StrictFields(&got)); err != nil {
+		t.Errorf("UnmarshalResult: unexpected error: %v", err)
+	} else if got != want {
+		t.Errorf("UnmarshalResult: got %+v, want %+v", got, want)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	notes := make(chan string, 1)
+	cancelled := make(chan bool, 1)
+	up := server.NewLocal(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) int {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+		"Fail": handler.New(func(context.Context) error {
+			return jrpc2.DataErrorf(notAuthorized, []string{"no", "way"}, "go away")
+		}),
+		"Note": handler.New(func(_ context.Context, ss []string) error {
+			notes <- strings.Join(ss, " ")
+			return nil
+		}),
+		"Meta": handler.New(func(ctx context.Context) (string, error) {
+			var meta string
+			err := jctx.UnmarshalMetadata(ctx, &meta)
+			return meta, err
+		}),
+		"Hang": handler.New(func(ctx context.Context) error {
+			<-ctx.Done()
+			cancelled <- true
+			return ctx.Err()
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{DecodeContext: jctx.Decode, Concurrency: 4},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer up.Close()
+
+	// Forward methods named "up.X" to method "X" on the upstream server.
+	p := jrpc2.NewProxy(up.Client, &jrpc2.ProxyOptions{
+		RewriteMethod: func(method string) string {
+			if strings.HasPrefix(method, "up.") {
+				return strings.TrimPrefix(method, "up.")
+			}
+			return ""
+		},
+	})
+	loc := server.NewLocal(p, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{DecodeContext: jctx.Decode, Concurrency: 4},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer loc.Close()
+	cli := loc.Client
+	ctx := context.Background()
+
+	t.Run("Call", func(t *testing.T) {
+		var got int
+		if err := cli.CallResult(ctx, "up.Add", []int{1, 2, 3}, &got); err != nil {
+			t.Errorf("Call up.Add: unexpected error: %v", err)
+		} else if got != 6 {
+			t.Errorf("Call up.Add: got %d, want 6", got)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := cli.Call(ctx, "up.Fail", nil)
+		e, ok := err.(*jrpc2.Error)
+		if !ok {
+			t.Fatalf("Call up.Fail: got %v, want *jrpc2.Error", err)
+		}
+		var data []string
+		if e.Code() != notAuthorized || e.Message() != "go away" {
+			t.Errorf("Call up.Fail: got %v, want code %v and message %q", e, notAuthorized, "go away")
+		} else if err := e.UnmarshalData(&data); err != nil {
+			t.Errorf("Error data: %v", err)
+		} else if got := strings.Join(data, " "); got != "no way" {
+			t.Errorf("Error data: got %q, want %q", got, "no way")
+		}
+	})
+
+	t.Run("Notify", func(t *testing.T) {
+		if err := cli.Notify(ctx, "up.Note", []string{"hello", "there"}); err != nil {
+			t.Fatalf("Notify up.Note: unexpected error: %v", err)
+		}
+		select {
+		case got := <-notes:
+			if got != "hello there" {
+				t.Errorf("Notification: got %q, want %q", got, "hello there")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Timed out waiting for notification")
+		}
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		mctx, err := jctx.WithMetadata(ctx, "the password is swordfish")
+		if err != nil {
+			t.Fatalf("WithMetadata: %v", err)
+		}
+		var got string
+		if err := cli.CallResult(mctx, "up.Meta", nil, &got); err != nil {
+			t.Errorf("Call up.Meta: unexpected error: %v", err)
+		} else if got != "the password is swordfish" {
+			t.Errorf("Call up.Meta: got %q, want swordfish", got)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		// Use an explicit cancellation rather than a deadline, so that the
+		// upstream handler ends only if the cancellation is forwarded.
+		cctx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if _, err := cli.Call(cctx, "up.Hang", nil); err != context.Canceled {
+			t.Errorf("Call up.Hang: got %v, want %v", err, context.Canceled)
+		}
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Error("Upstream handler was not cancelled")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := cli.Call(ctx, "Add", []int{1})
+		if got := code.FromError(err); got != code.MethodNotFound {
+			t.Errorf("Call Add: got %v, want %v", err, code.MethodNotFound)
+		}
+	})
+}
+
+func TestDeprecated(t *testing.T) {
+	add := handler.New(func(_ context.Context, vs []int) int {
+		sum := 0
+		for _, v := range vs {
+			sum += v
+		}
+		return sum
+	})
+	mux := handler.Map{
+		"Add":    add,
+		"OldAdd": handler.Deprecated(add, "use Add instead"),
+	}
+	ctx := context.Background()
+
+	t.Run("Allowed", func(t *testing.T) {
+		var calls []string
+		loc := server.NewLocal(mux, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				OnDeprecatedCall: func(_ context.Context, req *jrpc2.Request, note string) {
+					calls = append(calls, req.Method()+": "+note)
+				},
+			},
+		})
+		defer loc.Close()
+
+		// Calls to the deprecated method work normally.
+		for _, method := range []string{"Add", "OldAdd", "OldAdd"} {
+			var got int
+			if err := loc.Client.CallResult(ctx, method, []int{1, 2}, &got); err != nil {
+				t.Errorf("Call %q: unexpected error: %v", method, err)
+			} else if got != 3 {
+				t.Errorf("Call %q: got %d, want 3", method, got)
+			}
+		}
+		if diff := cmp.Diff([]string{"OldAdd: use Add instead", "OldAdd: use Add instead"}, calls); diff != "" {
+			t.Errorf("Deprecated calls (-want, +got):\n%s", diff)
+		}
+
+		info, err := jrpc2.RPCServerInfo(ctx, loc.Client)
+		if err != nil {
+			t.Fatalf("RPCServerInfo failed: %v", err)
+		}
+		if diff := cmp.Diff(map[string]string{"OldAdd": "use Add instead"}, info.Deprecated); diff != "" {
+			t.Errorf("ServerInfo deprecated (-want, +got):\n%s", diff)
+		}
+		if got := info.Counter["rpc.deprecatedCalls.OldAdd"]; got != 2 {
+			t.Errorf("Deprecated call count: got %d, want 2", got)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		loc := server.NewLocal(mux, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				RejectDeprecated: true,
+				OnDeprecatedCall: func(context.Context, *jrpc2.Request, string) {
+					t.Error("OnDeprecatedCall was called for a rejected method")
+				},
+			},
+		})
+		defer loc.Close()
+
+		if _, err := loc.Client.Call(ctx, "OldAdd", []int{1}); code.FromError(err) != code.Deprecated {
+			t.Errorf("Call OldAdd: got %v, want code %v", err, code.Deprecated)
+		}
+		if _, err := loc.Client.Call(ctx, "Add", []int{1}); err != nil {
+			t.Errorf("Call Add: unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMaxResultSize(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(_ context.Context, ss []string) string {
+			return strings.Join(ss, "")
+		}),
+		"Raw": handler.New(func(_ context.Context, ss []string) json.RawMessage {
+			return json.RawMessage(`"` + strings.Join(ss, "") + `"`)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{MaxResultSize: 10},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// A result whose encoding fits within the limit is delivered.
+	var got string
+	if err := loc.Client.CallResult(ctx, "Echo", []string{"12345678"}, &got); err != nil {
+		t.Errorf("Call Echo: unexpected error: %v", err)
+	} else if got != "12345678" {
+		t.Errorf("Call Echo: got %q, want 12345678", got)
+	}
+
+	// The encoded result is 11 bytes, including quotes.
+	for _, method := range []string{"Echo", "Raw"} {
+		_, err := loc.Client.Call(ctx, method, []string{"123456789"})
+		e, ok := err.(*jrpc2.Error)
+		if !ok || e.Code() != code.ResultTooLarge {
+			t.Errorf("Call %s: got %v, want code %v", method, err, code.ResultTooLarge)
+			continue
+		}
+		var data jrpc2.ResultSizeError
+		if err := e.UnmarshalData(&data); err != nil {
+			t.Errorf("Error data: %v", err)
+		} else if want := (jrpc2.ResultSizeError{Method: method, Size: 11, Limit: 10}); data != want {
+			t.Errorf("Error data: got %+v, want %+v", data, want)
+		}
+	}
+
+	// Notifications are not affected.
+	if err := loc.Client.Notify(ctx, "Echo", []string{"123456789"}); err != nil {
+		t.Errorf("Notify Echo: unexpected error: %v", err)
+	}
+
+	info := loc.Server.ServerInfo()
+	if got := info.Counter["rpc.resultTooLarge.Echo"]; got != 1 {
+		t.Errorf("Oversize count for Echo: got %d, want 1", got)
+	}
+	if got := info.Counter["rpc.resultTooLarge"]; got != 2 {
+		t.Errorf("Oversize count: got %d, want 2", got)
+	}
+}
+
+func TestDisableMethods(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var notes int32
+	loc := server.NewLocal(handler.Map{
+		"Export": handler.New(func(ctx context.Context) string {
+			if jrpc2.InboundRequest(ctx).IsNotification() {
+				atomic.AddInt32(&notes, 1)
+				return ""
+			}
+			started <- struct{}{}
+			<-release
+			return "done"
+		}),
+		"Other": handler.New(func(context.Context) string { return "ok" }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 4},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Start a call to Export, and disable the method while it is in flight.
+	inflight := make(chan error, 1)
+	go func() {
+		var got string
+		err := loc.Client.CallResult(ctx, "Export", nil, &got)
+		if err == nil && got != "done" {
+			err = fmt.Errorf("got %q, want done", got)
+		}
+		inflight <- err
+	}()
+	<-started
+	loc.Server.DisableMethodsRetry(5*time.Second, "Export")
+
+	// A new call to Export is refused, but other methods are unaffected.
+	_, err := loc.Client.Call(ctx, "Export", nil)
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.Unavailable {
+		t.Errorf("Call Export: got %v, want code %v", err, code.Unavailable)
+	} else {
+		var data jrpc2.UnavailableError
+		if err := e.UnmarshalData(&data); err != nil {
+			t.Errorf("Error data: %v", err)
+		} else if want := (jrpc2.UnavailableError{Method: "Export", RetryAfter: 5}); data != want {
+			t.Errorf("Error data: got %+v, want %+v", data, want)
+		}
+	}
+	// Notifications to a disabled method are discarded.
+	if err := loc.Client.Notify(ctx, "Export", nil); err != nil {
+		t.Errorf("Notify Export: unexpected error: %v", err)
+	}
+	// The server checks requests in order of receipt, so once this call
+	// completes the notification has been dropped.
+	if _, err := loc.Client.Call(ctx, "Other", nil); err != nil {
+		t.Errorf("Call Other: unexpected error: %v", err)
+	}
+
+	info := loc.Server.ServerInfo()
+	if diff := cmp.Diff([]string{"Export"}, info.Disabled); diff != "" {
+		t.Errorf("Disabled methods (-want, +got):\n%s", diff)
+	}
+	if got := info.Counter["rpc.unavailableCalls.Export"]; got != 2 {
+		t.Errorf("Unavailable count: got %d, want 2", got)
+	}
+
+	// The in-flight call has not finished, so draining does not succeed.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := loc.Server.DrainMethods(tctx, "Export"); err != context.DeadlineExceeded {
+		t.Errorf("DrainMethods: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := loc.Server.DrainMethods(ctx, "Other", "Nonesuch"); err != nil {
+		t.Errorf("DrainMethods(Other): unexpected error: %v", err)
+	}
+
+	// Once the in-flight call is released, draining completes.
+	close(release)
+	if err := loc.Server.DrainMethods(ctx, "Export"); err != nil {
+		t.Errorf("DrainMethods: unexpected error: %v", err)
+	}
+	if err := <-inflight; err != nil {
+		t.Errorf("In-flight call Export: %v", err)
+	}
+
+	// After re-enabling the method, calls succeed again.
+	loc.Server.EnableMethods("Export")
+	if _, err := loc.Client.Call(ctx, "Export", nil); err != nil {
+		t.Errorf("Call Export: unexpected error: %v", err)
+	}
+	<-started
+	if err := loc.Client.Notify(ctx, "Export", nil); err != nil {
+		t.Errorf("Notify Export: unexpected error: %v", err)
+	}
+
+	// Calls wait for earlier notifications to complete (see #24).
+	if _, err := loc.Client.Call(ctx, "Other", nil); err != nil {
+		t.Errorf("Call Other: unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&notes); got != 1 {
+		t.Errorf("Notifications handled: got %d, want 1", got)
+	}
+	if info := loc.Server.ServerInfo(); len(info.Disabled) != 0 {
+		t.Errorf("Disabled methods: got %q, want none", info.Disabled)
+	}
+}
+
+func TestRawResult(t *testing.T) {
+	type result struct {
+		Name  string `json:"name"`
+		Value []int  `json:"value"`
+	}
+	const encoded = `{
+  "name": "<raw>",
+  "value": [1, 2, 3]
+}`
+	mux := handler.Map{
+		"Value": handler.New(func(context.Context) result {
+			return result{Name: "<raw>", Value: []int{1, 2, 3}}
+		}),
+		"RawMessage": handler.New(func(context.Context) json.RawMessage {
+			return json.RawMessage(encoded)
+		}),
+		"RawResult": handler.New(func(context.Context) jrpc2.RawResult {
+			return jrpc2.RawResult(encoded)
+		}),
+		"OneLine": handler.New(func(context.Context) jrpc2.RawResult {
+			return jrpc2.RawResult(`{"name": "<raw>"}`)
+		}),
+		"Empty": handler.New(func(context.Context) jrpc2.RawResult {
+			return nil
+		}),
+		"Invalid": handler.New(func(context.Context) jrpc2.RawResult {
+			return jrpc2.RawResult(`{"bad":`)
+		}),
+	}
+	ctx := context.Background()
+
+	// A json.RawMessage is encoded like any other result. A RawResult is not
+	// HTML escaped, and is compacted only if it spans multiple lines.
+	loc := server.NewLocal(mux, nil)
+	defer loc.Close()
+	for _, test := range []struct {
+		method, want string
+	}{
+		{"Value", `{"name":"\u003craw\u003e","value":[1,2,3]}`},
+		{"RawMessage", `{"name":"\u003craw\u003e","value":[1,2,3]}`},
+		{"RawResult", `{"name":"<raw>","value":[1,2,3]}`},
+		{"OneLine", `{"name": "<raw>"}`},
+		{"Empty", `null`},
+	} {
+		rsp, err := loc.Client.Call(ctx, test.method, nil)
+		if err != nil {
+			t.Errorf("Call %s: unexpected error: %v", test.method, err)
+			continue
+		}
+		var got json.RawMessage
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Call %s: unmarshal result: %v", test.method, err)
+		} else if string(got) != test.want {
+			t.Errorf("Call %s: got %#q, want %#q", test.method, got, test.want)
+		}
+	}
+
+	// An invalid pre-encoded result is reported as an internal error.
+	if _, err := loc.Client.Call(ctx, "Invalid", nil); code.FromError(err) != code.InternalError {
+		t.Errorf("Call Invalid: got %v, want %v", err, code.InternalError)
+	}
+
+	// A server that trusts raw results copies them verbatim.
+	var got json.RawMessage
+	trusted := server.NewLocal(mux, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{TrustRawResults: true},
+	})
+	defer trusted.Close()
+	if err := trusted.Client.CallResult(ctx, "RawResult", nil, &got); err != nil {
+		t.Errorf("Call RawResult: unexpected error: %v", err)
+	} else if string(got) != encoded {
+		t.Errorf("Call RawResult: got %#q, want %#q", got, encoded)
+	}
+}
+
+// Test that the response to a call whose result is a json.RawMessage has the
+// same encoding as the result marshaled with encoding/json.
+func TestRawMessageResult(t *testing.T) {
+	const encoded = `{ "text": "<a & b>", "list": [1, 2] }`
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Raw": handler.New(func(context.Context) json.RawMessage {
+			return json.RawMessage(encoded)
+		}),
+	}, nil).Start(spipe)
+	defer srv.Stop()
+
+	if err := cpipe.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Raw"}`)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got, err := cpipe.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	result, err := json.Marshal(json.RawMessage(encoded))
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	want := `{"jsonrpc":"2.0","id":1,"result":` + string(result) + `}`
+	if string(got) != want {
+		t.Errorf("Response: got %#q, want %#q", got, want)
+	}
+}
+
+// nilMarshaler implements json.Marshaler with a value receiver, so that a nil
+// pointer to it cannot be dereferenced to call MarshalJSON.
+type nilMarshaler struct{}
+
+func (nilMarshaler) MarshalJSON() ([]byte, error) { return []byte(`"value"`), nil }
+
+func TestNilResults(t *testing.T) {
+	type empty struct{}
+	mux := handler.Map{
+		"Nil": handler.Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+			return nil, nil
+		}),
+		"NilPtr": handler.New(func(context.Context) (*empty, error) {
+			return nil, nil
+		}),
+		"NilInIface": handler.Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+			return (*nilMarshaler)(nil), nil
+		}),
+		"NilSlice": handler.New(func(context.Context) ([]int, error) {
+			return nil, nil
+		}),
+		"EmptyStruct": handler.New(func(context.Context) (empty, error) {
+			return empty{}, nil
+		}),
+		"EmptySlice": handler.New(func(context.Context) ([]int, error) {
+			return []int{}, nil
+		}),
+	}
+	tests := []struct {
+		method, want string
+	}{
+		{"Nil", `null`},
+		{"NilPtr", `null`},
+		{"NilInIface", `null`},
+		{"NilSlice", `null`},
+		{"EmptyStruct", `{}`},
+		{"EmptySlice", `[]`},
+	}
+
+	// Check the exact encoding of each response on the wire.
+	t.Run("Wire", func(t *testing.T) {
+		cpipe, spipe := channel.Direct()
+		srv := jrpc2.NewServer(mux, nil).Start(spipe)
+		defer func() {
+			cpipe.Close()
+			if err := srv.Wait(); err != nil {
+				t.Errorf("Server wait: unexpected error %v", err)
+			}
+		}()
+		for i, test := range tests {
+			req := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":%q}`, i, test.method)
+			if err := cpipe.Send([]byte(req)); err != nil {
+				t.Fatalf("Send %#q failed: %v", req, err)
+			}
+			rsp, err := cpipe.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			want := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":%s}`, i, test.want)
+			if got := string(rsp); got != want {
+				t.Errorf("Call %s:\n got %#q\nwant %#q", test.method, got, want)
+			}
+		}
+	})
+
+	// Check that the client decodes each result correctly.
+	t.Run("Client", func(t *testing.T) {
+		loc := server.NewLocal(mux, nil)
+		defer loc.Close()
+		ctx := context.Background()
+
+		for _, test := range tests {
+			rsp, err := loc.Client.Call(ctx, test.method, nil)
+			if err != nil {
+				t.Errorf("Call %s: unexpected error: %v", test.method, err)
+				continue
+			}
+			var raw json.RawMessage
+			if err := rsp.UnmarshalResult(&raw); err != nil {
+				t.Errorf("Call %s: unmarshal raw result: %v", test.method, err)
+			} else if got := string(raw); got != test.want {
+				t.Errorf("Call %s: got result %#q, want %#q", test.method, got, test.want)
+			}
+		}
+
+		// A null result decodes to a nil pointer without error.
+		ptr := &struct{}{}
+		if err := loc.Client.CallResult(ctx, "NilPtr", nil, &ptr); err != nil {
+			t.Errorf("CallResult NilPtr: unexpected error: %v", err)
+		} else if ptr != nil {
+			t.Errorf("CallResult NilPtr: got %+v, want nil", ptr)
+		}
+
+		// Empty results decode to empty values.
+		var ss []int
+		if err := loc.Client.CallResult(ctx, "EmptySlice", nil, &ss); err != nil {
+			t.Errorf("CallResult EmptySlice: unexpected error: %v", err)
+		} else if ss == nil || len(ss) != 0 {
+			t.Errorf("CallResult EmptySlice: got %#v, want empty", ss)
+		}
+		var es *struct{}
+		if err := loc.Client.CallResult(ctx, "EmptyStruct", nil, &es); err != nil {
+			t.Errorf("CallResult EmptyStruct: unexpected error: %v", err)
+		} else if es == nil {
+			t.Error("CallResult EmptyStruct: got nil, want non-nil")
+		}
+	})
+}
+
+func TestClientUseNumber(t *testing.T) {
+	const big = int64(1)<<53 + 1 // not exactly representable as float64
+
+	notes := make(chan interface{}, 1)
+	loc := server.NewLocal(handler.Map{
+		"Big": handler.New(func(ctx context.Context) (map[string]int64, error) {
+			v := map[string]int64{"value": big}
+			if err := jrpc2.PushNotify(ctx, "big", v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			UseNumber: true,
+			OnNotify: func(req *jrpc2.Request) {
+				var params map[string]interface{}
+				if err := req.UnmarshalParams(&params); err != nil {
+					t.Errorf("Notification params: %v", err)
+				}
+				notes <- params["value"]
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	want := json.Number(strconv.FormatInt(big, 10))
+
+	// Decoding into an interface value preserves the exact value.
+	var got map[string]interface{}
+	if err := loc.Client.CallResult(ctx, "Big", nil, &got); err != nil {
+		t.Fatalf("Call Big: unexpected error: %v", err)
+	} else if v := got["value"]; v != want {
+		t.Errorf("Call Big: got %v (%T), want %v", v, v, want)
+	}
+	select {
+	case v := <-notes:
+		if v != want {
+			t.Errorf("Notification: got %v (%T), want %v", v, v, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for notification")
+	}
+
+	// Decoding into a concrete type is not affected.
+	var val struct {
+		V int64 `json:"value"`
+	}
+	if err := loc.Client.CallResult(ctx, "Big", nil, &val); err != nil {
+		t.Fatalf("Call Big: unexpected error: %v", err)
+	} else if val.V != big {
+		t.Errorf("Call Big: got %d, want %d", val.V, big)
+	}
+	<-notes
+}
+
+func TestServerUseNumber(t *testing.T) {
+	types := func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		var params map[string]interface{}
+		if err := req.UnmarshalParams(&params); err != nil {
+			return nil, err
+		}
+		out := make(map[string]string)
+		for key, val := range params {
+			out[key] = fmt.Sprintf("%T", val)
+		}
+		return out, nil
+	}
+	params := map[string]interface{}{"int": 12345, "float": 1.5}
+	tests := []struct {
+		useNumber bool
+		want      string
+	}{
+		{false, "float64"},
+		{true, "json.Number"},
+	}
+	for _, test := range tests {
+		loc := server.NewLocal(handler.Map{"Types": handler.Func(types)}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{UseNumber: test.useNumber},
+		})
+		var got map[string]string
+		if err := loc.Client.CallResult(context.Background(), "Types", params, &got); err != nil {
+			t.Errorf("UseNumber=%v: call failed: %v", test.useNumber, err)
+		} else {
+			for key, typ := range got {
+				if typ != test.want {
+					t.Errorf("UseNumber=%v: param %q has type %s, want %s", test.useNumber, key, typ, test.want)
+				}
+			}
+			if len(got) != len(params) {
+				t.Errorf("UseNumber=%v: got %d params, want %d", test.useNumber, len(got), len(params))
+			}
+		}
+		loc.Close()
+	}
+}
+
+func TestClientMethodPrefix(t *testing.T) {
+	logged := make(chan string, 1)
+	notes := make(chan string, 1)
+	loc := server.NewLocal(handler.ServiceMap{
+		"Billing": handler.Map{
+			"Charge": handler.New(func(ctx context.Context, amounts []int) (int, error) {
+				total := 0
+				for _, v := range amounts {
+					total += v
+				}
+				if err := jrpc2.PushNotify(ctx, "Billing.Charged", []int{total}); err != nil {
+					return 0, err
+				}
+				return total, nil
+			}),
+			"Log": handler.New(func(_ context.Context, ss []string) error {
+				logged <- strings.Join(ss, " ")
+				return nil
+			}),
+		},
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			MethodPrefix: "Billing.",
+			OnNotify: func(req *jrpc2.Request) {
+				notes <- req.Method()
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	checkNote := func() {
+		t.Helper()
+		select {
+		case got := <-notes:
+			if got != "Charged" {
+				t.Errorf("OnNotify: got method %q, want Charged", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for notification")
+		}
+	}
+
+	var total int
+	if err := loc.Client.CallResult(ctx, "Charge", []int{1, 2, 3}, &total); err != nil {
+		t.Errorf("Call Charge: unexpected error: %v", err)
+	} else if total != 6 {
+		t.Errorf("Call Charge: got %d, want 6", total)
+	}
+	checkNote()
+
+	if err := loc.Client.Notify(ctx, "Log", []string{"hello", "world"}); err != nil {
+		t.Errorf("Notify Log: unexpected error: %v", err)
+	} else if got := <-logged; got != "hello world" {
+		t.Errorf("Notify Log: got %q, want %q", got, "hello world")
+	}
+
+	rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Charge", Params: []int{10, 20}},
+		{Method: "Log", Params: []string{"batch"}, Notify: true},
+	})
+	if err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	} else if len(rsps) != 1 {
+		t.Fatalf("Batch: got %d responses, want 1", len(rsps))
+	} else if err := rsps[0].UnmarshalResult(&total); err != nil {
+		t.Errorf("Batch Charge: unexpected error: %v", err)
+	} else if total != 30 {
+		t.Errorf("Batch Charge: got %d, want 30", total)
+	}
+	checkNote()
+	if got := <-logged; got != "batch" {
+		t.Errorf("Batch Log: got %q, want batch", got)
+	}
+
+	// Reserved method names are not prefixed.
+	if _, err := jrpc2.RPCServerInfo(ctx, loc.Client); err != nil {
+		t.Errorf("RPCServerInfo: unexpected error: %v", err)
+	}
+}
+
+func TestAliasedMethods(t *testing.T) {
+	mux, err := handler.Alias(handler.Map{
+		"Echo": handler.New(func(_ context.Context, ss []string) string {
+			return strings.Join(ss, " ")
+		}),
+	}, map[string]string{"Repeat": "Echo", "Say": "Repeat"})
+	if err != nil {
+		t.Fatalf("Alias: unexpected error: %v", err)
+	}
+	var calls []string
+	loc := server.NewLocal(mux, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			OnDeprecatedCall: func(_ context.Context, req *jrpc2.Request, note string) {
+				calls = append(calls, req.Method()+": "+note)
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	for _, method := range []string{"Echo", "Repeat", "Say", "Say"} {
+		var got string
+		if err := loc.Client.CallResult(ctx, method, []string{"a", "b"}, &got); err != nil {
+			t.Errorf("Call %q: unexpected error: %v", method, err)
+		} else if got != "a b" {
+			t.Errorf("Call %q: got %q, want %q", method, got, "a b")
+		}
+	}
+	if diff := cmp.Diff([]string{
+		`Repeat: alias for "Echo"`, `Say: alias for "Echo"`, `Say: alias for "Echo"`,
+	}, calls); diff != "" {
+		t.Errorf("Alias calls (-want, +got):\n%s", diff)
+	}
+
+	// The aliases are discoverable, but flagged as deprecated.
+	info, err := jrpc2.RPCServerInfo(ctx, loc.Client)
+	if err != nil {
+		t.Fatalf("RPCServerInfo failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Echo", "Repeat", "Say"}, info.Methods); diff != "" {
+		t.Errorf("ServerInfo methods (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{
+		"Repeat": `alias for "Echo"`,
+		"Say":    `alias for "Echo"`,
+	}, info.Deprecated); diff != "" {
+		t.Errorf("ServerInfo deprecated (-want, +got):\n%s", diff)
+	}
+	if got := info.Counter["rpc.deprecatedCalls.Say"]; got != 2 {
+		t.Errorf("Alias call count for Say: got %d, want 2", got)
+	}
+}
+
+func TestNotificationErrors(t *testing.T) {
+	mux := handler.Map{
+		"OK":   handler.New(func(context.Context) error { return nil }),
+		"Fail": handler.New(func(context.Context) error { return errors.New("failed") }),
+		"Args": handler.New(func(_ context.Context, ss []string) error { return nil }),
+	}
+
+	t.Run("Observe", func(t *testing.T) {
+		var mu sync.Mutex
+		var failed []string
+		cpipe, spipe := channel.Direct()
+		srv := jrpc2.NewServer(mux, &jrpc2.ServerOptions{
+			OnNotificationError: func(req *jrpc2.Request, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, req.Method()+": "+code.FromError(err).String())
+			},
+		}).Start(spipe)
+		defer func() {
+			cpipe.Close()
+			if err := srv.Wait(); err != nil {
+				t.Errorf("Server wait: unexpected error %v", err)
+			}
+		}()
+
+		// None of the notifications elicits a response; only the call does.
+		const batch = `[
+  {"jsonrpc":"2.0","method":"OK"},
+  {"jsonrpc":"2.0","method":"Fail"},
+  {"jsonrpc":"2.0","method":"Args","params":{"bad":true}},
+  {"jsonrpc":"2.0","method":"NoSuch"},
+  {"jsonrpc":"2.0","id":1,"method":"OK"}
+]`
+		if err := cpipe.Send([]byte(batch)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		rsp, err := cpipe.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got, want := string(rsp), `[{"jsonrpc":"2.0","id":1,"result":null}]`; got != want {
+			t.Errorf("Response:\n got %#q\nwant %#q", got, want)
+		}
+
+		sort.Strings(failed)
+		if diff := cmp.Diff([]string{
+			"Args: " + code.InvalidParams.String(),
+			"Fail: " + code.SystemError.String(),
+			"NoSuch: " + code.MethodNotFound.String(),
+		}, failed); diff != "" {
+			t.Errorf("Failed notifications (-want, +got):\n%s", diff)
+		}
+
+		info := srv.ServerInfo()
+		for name, want := range map[string]int64{
+			"rpc.notifications":                     4,
+			"rpc.notificationsDispatched":           3,
+			"rpc.notificationErrors":                3,
+			"rpc.notificationErrors.handlerError":   1,
+			"rpc.notificationErrors.invalidParams":  1,
+			"rpc.notificationErrors.methodNotFound": 1,
+		} {
+			if got := info.Counter[name]; got != want {
+				t.Errorf("Counter %q: got %d, want %d", name, got, want)
+			}
+		}
+	})
+
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		loc := server.NewLocal(mux, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{MaxNotificationFailures: 3},
+		})
+		defer loc.Close()
+		ctx := context.Background()
+		notify := func(methods ...string) {
+			t.Helper()
+			for _, method := range methods {
+				if err := loc.Client.Notify(ctx, method, nil); err != nil {
+					t.Fatalf("Notify %q: unexpected error: %v", method, err)
+				}
+			}
+			// Notifications are handled in order, so a call issued after them
+			// completes after they are handled.
+			loc.Client.Call(ctx, "OK", nil)
+		}
+
+		// A success resets the count of consecutive failures.
+		notify("Fail", "NoSuch", "OK", "Fail", "Fail")
+		if _, err := loc.Client.Call(ctx, "OK", nil); err != nil {
+			t.Fatalf("Call OK: unexpected error: %v", err)
+		}
+
+		// Calls do not affect the count.
+		notify("Fail")
+		err := loc.Server.Wait()
+		if err == nil {
+			t.Fatal("Server did not stop after consecutive notification failures")
+		}
+		t.Logf("Server stopped: %v", err)
+	})
+}
+
+// Verify the responses to malformed input, including the invalid batch
+// examples from the JSON-RPC 2.0 specification.
+func TestDecodeConformance(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	const (
+		notObject  = `{"code":-32600,"message":"request must be an object or array"}`
+		badElement = `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request is not a JSON object"}}`
+		notRun     = `"error":{"code":-32700,"message":"request not processed: invalid request batch"}}`
+	)
+	tests := []struct {
+		input, want string
+	}{
+		// Spec: rpc call Batch, invalid JSON. The specification calls for a
+		// single error, but the request preceding the syntax error is also
+		// reported, so the caller knows it was not processed.
+		{`[
+  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+  {"jsonrpc": "2.0", "method"
+]`, `[{"jsonrpc":"2.0","id":"1",` + notRun + `,` +
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request batch",` +
+			`"data":"invalid character ']' after object key"}}]`},
+
+		// Spec: rpc call with an empty Array.
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+
+		// Spec: rpc call with an invalid Batch (but not empty).
+		{`[1]`, `[` + badElement + `]`},
+
+		// Spec: rpc call with invalid Batch.
+		{`[1,2,3]`, `[` + badElement + `,` + badElement + `,` + badElement + `]`},
+
+		// Top-level values other than objects and arrays.
+		{`true`, `{"jsonrpc":"2.0","id":null,"error":` + notObject + `}`},
+		{`"request"`, `{"jsonrpc":"2.0","id":null,"error":` + notObject + `}`},
+		{`17`, `{"jsonrpc":"2.0","id":null,"error":` + notObject + `}`},
+		{`null`, `{"jsonrpc":"2.0","id":null,"error":` + notObject + `}`},
+
+		// Nested arrays are not requests.
+		{`[[[[{"jsonrpc":"2.0","id":1,"method":"X"}]]]]`, `[` + badElement + `]`},
+
+		// Nesting too deep to decode.
+		{strings.Repeat("[", 20000), `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,` +
+			`"message":"invalid request batch","data":"exceeded max depth"}}`},
+
+		// Leading whitespace does not obscure a batch.
+		{"\n\t [" + `{"jsonrpc":"2.0","id":1,"method":"X"}]`, `[{"jsonrpc":"2.0","id":1,"result":"OK"}]`},
+
+		// Trailing garbage after a single request.
+		{`{"jsonrpc":"2.0","id":1,"method":"X"} junk`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request message"}}`},
+
+		// Trailing garbage after a batch.
+		{`[{"jsonrpc":"2.0","id":1,"method":"X"}] junk`, `[{"jsonrpc":"2.0","id":1,` + notRun + `,` +
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request batch",` +
+			`"data":"extra data after batch"}}]`},
+
+		// A syntax error in a later element of a batch.
+		{`[{"jsonrpc":"2.0","id":1,"method":"X"},{"jsonrpc":"2.0","method":"X"},{"jsonrpc":"2.0","id":3,"method":]`,
+			`[{"jsonrpc":"2.0","id":1,` + notRun + `,{"jsonrpc":"2.0","id":null,` + notRun + `,` +
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request batch",` +
+				`"data":"invalid character ']' looking for beginning of value"}}]`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("Input %#.60q:\n got %#q\nwant %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that the framing of a reply matches the framing of its request: A
+// single request object gets a single response object, and a batch gets an
+// array, even if it has only one element.
+func TestReplyFraming(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	tests := []struct {
+		desc, input, want string
+	}{
+		{"SingleCall", `{"jsonrpc":"2.0","id":1,"method":"X"}`,
+			`{"jsonrpc":"2.0","id":1,"result":"OK"}`},
+		{"SingleNotification", `{"jsonrpc":"2.0","method":"X"}`, ""},
+		{"SingleError", `{"jsonrpc":"2.0","id":2,"method":"Y"}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"no such method \"Y\""}}`},
+		{"SingleInvalid", `{"jsonrpc":"2.0","id":3}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32600,"message":"empty method name"}}`},
+		{"SingleParseError", `{"jsonrpc":"2.0",`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request message"}}`},
+		{"Batch", `[{"jsonrpc":"2.0","id":4,"method":"X"},{"jsonrpc":"2.0","id":5,"method":"Y"}]`,
+			`[{"jsonrpc":"2.0","id":4,"result":"OK"},` +
+				`{"jsonrpc":"2.0","id":5,"error":{"code":-32601,"message":"no such method \"Y\""}}]`},
+		{"BatchOfOne", `[{"jsonrpc":"2.0","id":6,"method":"Y"}]`,
+			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"no such method \"Y\""}}]`},
+		{"BatchWithNotification", `[{"jsonrpc":"2.0","method":"X"},{"jsonrpc":"2.0","id":7,"method":"X"}]`,
+			`[{"jsonrpc":"2.0","id":7,"result":"OK"}]`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("%s: send failed: %v", test.desc, err)
+		}
+		if test.want == "" {
+			continue // no reply; the next case verifies nothing was sent
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("%s: recv failed: %v", test.desc, err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("%s: got %#q, want %#q", test.desc, got, test.want)
+		}
+	}
+}
+
+// Verify that an error for an invalid batch element echoes the element's ID,
+// if it has a valid one, and otherwise uses null.
+func TestBatchElementIDs(t *testing.T) {
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	const invalidID = `{"code":-32600,"message":"invalid request ID"}`
+	tests := []struct {
+		desc, input, want string
+	}{
+		{"GoodID/BadMethod", `{"jsonrpc":"2.0","id":1,"method":5}`,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"invalid method name"}}`},
+		{"GoodID/BadParams", `{"jsonrpc":"2.0","id":"a","method":"X","params":"p"}`,
+			`{"jsonrpc":"2.0","id":"a","error":{"code":-32600,"message":"parameters must be array or object"}}`},
+		{"GoodID/BadVersion", `{"jsonrpc":2,"id":-2.5,"method":"X"}`,
+			`{"jsonrpc":"2.0","id":-2.5,"error":{"code":-32600,"message":"invalid version key"}}`},
+		{"BadID/GoodMethod", `{"jsonrpc":"2.0","id":{"x":1},"method":"X"}`,
+			`{"jsonrpc":"2.0","id":null,"error":` + invalidID + `}`},
+		{"BadID/Bool", `{"jsonrpc":"2.0","id":true,"method":"X"}`,
+			`{"jsonrpc":"2.0","id":null,"error":` + invalidID + `}`},
+		{"BadID/BadMethod", `{"jsonrpc":"2.0","id":[1],"method":5}`,
+			`{"jsonrpc":"2.0","id":null,"error":` + invalidID + `}`},
+		{"NoID/BadMethod", `{"jsonrpc":"2.0","method":5}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid method name"}}`},
+	}
+
+	// Send each element singly, then all together in a batch.
+	var ins, wants []string
+	for _, test := range tests {
+		ins = append(ins, test.input)
+		wants = append(wants, test.want)
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("%s: send failed: %v", test.desc, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("%s: recv failed: %v", test.desc, err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("%s: got %#q, want %#q", test.desc, got, test.want)
+		}
+	}
+	if err := cli.Send([]byte("[" + strings.Join(ins, ",") + "]")); err != nil {
+		t.Fatalf("Batch: send failed: %v", err)
+	}
+	raw, err := cli.Recv()
+	if err != nil {
+		t.Fatalf("Batch: recv failed: %v", err)
+	}
+	if got, want := string(raw), "["+strings.Join(wants, ",")+"]"; got != want {
+		t.Errorf("Batch: got %#q, want %#q", got, want)
+	}
+}
+
+// Verify that single (non-batch) requests are handled per the examples in
+// the JSON-RPC 2.0 specification. The inputs are copied verbatim from the
+// specification. The error messages in the specification are only examples,
+// so responses are compared on their structure, ID, result, and error code.
+func TestSpecSingleCalls(t *testing.T) {
+	type subArgs struct {
+		Minuend    int `json:"minuend"`
+		Subtrahend int `json:"subtrahend"`
+	}
+	cli, srv := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"subtract": handler.Func(func(_ context.Context, req *jrpc2.Request) (interface{}, error) {
+			var pos []int
+			if err := req.UnmarshalParams(&pos); err == nil && len(pos) == 2 {
+				return pos[0] - pos[1], nil
+			}
+			var named subArgs
+			if err := req.UnmarshalParams(&named); err != nil {
+				return nil, err
+			}
+			return named.Minuend - named.Subtrahend, nil
+		}),
+		"update": handler.New(func(context.Context, []int) error { return nil }),
+	}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	type response struct {
+		V  string          `json:"jsonrpc"`
+		ID json.RawMessage `json:"id"`
+		R  json.RawMessage `json:"result"`
+		E  *struct {
+			Code code.Code `json:"code"`
+		} `json:"error"`
+	}
+	parse := func(s string) response {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(s)); err != nil {
+			t.Fatalf("Invalid response %#q: %v", s, err)
+		}
+		if buf.Bytes()[0] != '{' {
+			t.Fatalf("Response %#q is not a single object", s)
+		}
+		var rsp response
+		if err := json.Unmarshal(buf.Bytes(), &rsp); err != nil {
+			t.Fatalf("Decoding response %#q: %v", s, err)
+		}
+		return rsp
+	}
+
+	tests := []struct {
+		input, want string // want == "" for a notification
+	}{
+		// rpc call with positional parameters
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`,
+			`{"jsonrpc": "2.0", "result": 19, "id": 1}`},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": [23, 42], "id": 2}`,
+			`{"jsonrpc": "2.0", "result": -19, "id": 2}`},
+
+		// rpc call with named parameters
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`,
+			`{"jsonrpc": "2.0", "result": 19, "id": 3}`},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": {"minuend": 42, "subtrahend": 23}, "id": 4}`,
+			`{"jsonrpc": "2.0", "result": 19, "id": 4}`},
+
+		// a Notification
+		{`{"jsonrpc": "2.0", "method": "update", "params": [1,2,3,4,5]}`, ""},
+		{`{"jsonrpc": "2.0", "method": "foobar"}`, ""},
+
+		// rpc call of non-existent method
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+			`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "1"}`},
+
+		// rpc call with invalid JSON
+		{`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+			`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+
+		// rpc call with invalid Request object
+		{`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+			`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if test.want == "" {
+			continue // notifications get no response; see the next test case
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if diff := cmp.Diff(parse(test.want), parse(string(raw))); diff != "" {
+			t.Errorf("Input %#q: response %#q (-want, +got):\n%s", test.input, raw, diff)
+		}
+	}
+}
+
+// fakeClock is a jrpc2.Clock whose time advances only when told to.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock { return &fakeClock{now: now} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{when: c.now.Add(d), ch: ch})
+	}
+	return ch
+}
+
+// waiting reports the number of timers that have not yet expired.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// Advance moves the clock forward by d, firing any timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	keep := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.when.After(c.now) {
+			keep = append(keep, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = keep
+}
+
+// Verify that the IdleTimeout option stops a server whose client sends nothing
+// for too long, and that requests in flight pause the timer.
+func TestIdleTimeout(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	started, release := make(chan struct{}), make(chan struct{})
+	cconn, sconn := net.Pipe()
+	srv := jrpc2.NewServer(handler.Map{
+		"OK": testOK,
+		"Block": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{
+		Clock:       clock,
+		IdleTimeout: 10 * time.Second,
+	}).Start(channel.Line(sconn, sconn))
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), nil)
+	defer cli.Close()
+	ctx := context.Background()
+
+	// advance moves the clock forward, then waits for the idle timer to be
+	// set again.
+	advance := func(d time.Duration) {
+		clock.Advance(d)
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// call issues a call, and waits until the server has finished with it,
+	// since the reply may arrive before then.
+	call := func(method string) {
+		t.Helper()
+		if _, err := cli.Call(ctx, method, nil); err != nil {
+			t.Fatalf("Call %s: unexpected error: %v", method, err)
+		}
+		for srv.Metrics().Held != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Each request restarts the timer.
+	call("OK")
+	advance(6 * time.Second)
+	call("OK")
+	advance(6 * time.Second)
+	call("OK")
+
+	// A request in flight pauses the timer.
+	done := make(chan error, 1)
+	go func() { _, err := cli.Call(ctx, "Block", nil); done <- err }()
+	<-started
+	advance(10 * time.Second)
+	advance(10 * time.Second)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Call Block: unexpected error: %v", err)
+	}
+	for srv.Metrics().Held != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	advance(6 * time.Second)
+	call("OK")
+
+	// With no further traffic, the server stops.
+	clock.Advance(10 * time.Second)
+	if err := srv.Wait(); err != jrpc2.ErrIdleTimeout {
+		t.Errorf("Server wait: got %v, want %v", err, jrpc2.ErrIdleTimeout)
+	}
+	if got := srv.Metrics().Counter["rpc.idleTimeouts"]; got != 1 {
+		t.Errorf("rpc.idleTimeouts: got %d, want 1", got)
+	}
+}
+
+// Verify that the CallTimeout option fails a call to an unresponsive server
+// whose context has no deadline, and tells the server to cancel it, but does
+// not override a deadline set by the caller.
+func TestCallTimeout(t *testing.T) {
+	const timeout = 5 * time.Second
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// The server reads requests, but never replies.
+	cconn, sconn := net.Pipe()
+	srv := channel.Line(sconn, sconn)
+	recv := make(chan string, 4)
+	go func() {
+		defer close(recv)
+		for {
+			msg, err := srv.Recv()
+			if err != nil {
+				return
+			}
+			recv <- string(msg)
+		}
+	}()
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), &jrpc2.ClientOptions{
+		CallTimeout: timeout,
+		Clock:       clock,
+	})
+	defer cli.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), "Hang", nil)
+		errc <- err
+	}()
+	if got, want := <-recv, `{"jsonrpc":"2.0","id":1,"method":"Hang"}`; got != want {
+		t.Errorf("Request: got %#q, want %#q", got, want)
+	}
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(timeout - time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("Call returned early: %v", err)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Errorf("Call: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got, want := <-recv, `{"jsonrpc":"2.0","method":"rpc.cancel","params":[1]}`; got != want {
+		t.Errorf("Cancellation: got %#q, want %#q", got, want)
+	}
+
+	// A deadline from the caller is used instead of the default.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cli.Call(ctx, "Hang", nil); err != context.DeadlineExceeded {
+		t.Errorf("Call with deadline: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := clock.waiting(); n != 0 {
+		t.Errorf("Call with deadline: %d timers started, want 0", n)
+	}
+}
+
+// Verify that a client with a Redial function reconnects when its channel
+// fails, failing the calls in flight and resuming new calls on the new
+// channel, with a backoff between failed attempts.
+func TestRedial(t *testing.T) {
+	const delay = time.Second
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	started := make(chan struct{}, 1)
+	assigner := handler.Map{
+		"Test": testOK,
+		"Hang": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}
+
+	// Each successful dial starts a fresh server, and sends the server end of
+	// its connection to conns so the test can break it.
+	var mu sync.Mutex
+	var failures int
+	errDial := errors.New("dial failed")
+	conns := make(chan net.Conn, 4)
+	dial := func(context.Context) (channel.Channel, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return nil, errDial
+		}
+		cconn, sconn := net.Pipe()
+		jrpc2.NewServer(assigner, nil).Start(channel.Line(sconn, sconn))
+		conns <- sconn
+		return channel.Line(cconn, cconn), nil
+	}
+	setFailures := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = n
+	}
+
+	ch, err := dial(context.Background())
+	if err != nil {
+		t.Fatalf("Initial dial: %v", err)
+	}
+	connected := make(chan struct{}, 1)
+	disconnected := make(chan error, 1)
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+		Redial:         dial,
+		RedialDelay:    delay,
+		RedialAttempts: 3,
+		Clock:          clock,
+		OnConnect:      func() { connected <- struct{}{} },
+		OnDisconnect:   func(err error) { disconnected <- err },
+	})
+	ctx := context.Background()
+	if _, err := cli.Call(ctx, "Test", nil); err != nil {
+		t.Fatalf("Call Test: unexpected error: %v", err)
+	}
+
+	// Break the connection while a call is in flight, and fail the first
+	// attempt to redial.
+	setFailures(1)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(ctx, "Hang", nil)
+		errc <- err
+	}()
+	<-started
+	(<-conns).Close()
+
+	if err := <-errc; !errors.Is(err, jrpc2.ErrConnTerminated) {
+		t.Errorf("Call Hang: got %v, want %v", err, jrpc2.ErrConnTerminated)
+	}
+	if err := <-disconnected; err == nil {
+		t.Error("OnDisconnect: got nil error")
+	}
+
+	// A call made while the client is reconnecting waits for the new channel.
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		_, err := cli.Call(ctx, "Test", nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("Call returned before reconnecting: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(delay)
+	<-connected
+	if err := <-errc; err != nil {
+		t.Errorf("Call after reconnecting: unexpected error: %v", err)
+	}
+
+	// After RedialAttempts consecutive failures, the client stops, and calls
+	// waiting for the new channel fail.
+	setFailures(3)
+	(<-conns).Close()
+	<-disconnected
+	for _, d := range []time.Duration{delay, 2 * delay} {
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(d)
+	}
+	if _, err := cli.Call(ctx, "Test", nil); !errors.Is(err, jrpc2.ErrConnTerminated) {
+		t.Errorf("Call after stopping: got %v, want %v", err, jrpc2.ErrConnTerminated)
+	}
+	if err := cli.Close(); err != errDial {
+		t.Errorf("Close: got %v, want %v", err, errDial)
+	}
+}
+
+// Verify that a client whose server announced its shutdown waits for the
+// grace period before it redials.
+func TestRedialAfterShutdown(t *testing.T) {
+	const grace = 10 * time.Second
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// Each dial starts a fresh server, and sends it to srvs so the test can
+	// shut it down.
+	var dials int32
+	srvs := make(chan *jrpc2.Server, 2)
+	dial := func(context.Context) (channel.Channel, error) {
+		atomic.AddInt32(&dials, 1)
+		cpipe, spipe := channel.Direct()
+		srvs <- jrpc2.NewServer(handler.Map{"Test": testOK}, &jrpc2.ServerOptions{
+			AllowPush: true,
+		}).Start(spipe)
+		return cpipe, nil
+	}
+	ch, _ := dial(context.Background())
+	connected := make(chan struct{}, 1)
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+		Redial:      dial,
+		RedialDelay: time.Second,
+		Clock:       clock,
+		OnConnect:   func() { connected <- struct{}{} },
+	})
+	defer cli.Close()
+	ctx := context.Background()
+
+	srv := <-srvs
+	if err := srv.AnnounceShutdown(grace, "deploy"); err != nil {
+		t.Fatalf("AnnounceShutdown: unexpected error: %v", err)
+	}
+
+	// The client does not redial until the grace period has elapsed.
+	for clock.waiting() == 0 && atomic.LoadInt32(&dials) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("Client redialed before the grace period: got %d dials, want 1", n)
+	}
+	clock.Advance(grace - time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Dials before the grace period ended: got %d, want 1", n)
+	}
+	clock.Advance(time.Second)
+	<-connected
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("Dials after the grace period: got %d, want 2", n)
+	}
+	if _, err := cli.Call(ctx, "Test", nil); err != nil {
+		t.Errorf("Call after reconnecting: unexpected error: %v", err)
+	}
+	(<-srvs).Stop()
+}
+
+// Verify that the MaxPending option limits the number of calls a client has
+// pending at once, against a server that is slow to reply.
+func TestMaxPending(t *testing.T) {
+	const maxPending = 4
+	ctx := context.Background()
+
+	// newLocal starts a server whose Slow method takes a while to reply, and
+	// whose Hang method blocks until release is closed. It records the peak
+	// number of concurrent Slow calls, and the number of Hang calls begun.
+	// Notifications are not pending calls, so they go to Note instead.
+	type state struct {
+		active, peak, hung int32
+		release            chan struct{}
+	}
+	newLocal := func(opts *jrpc2.ClientOptions) (server.Local, *state) {
+		st := &state{release: make(chan struct{})}
+		return server.NewLocal(handler.Map{
+			"Slow": handler.New(func(ctx context.Context) error {
+				n := atomic.AddInt32(&st.active, 1)
+				defer atomic.AddInt32(&st.active, -1)
+				for {
+					old := atomic.LoadInt32(&st.peak)
+					if n <= old || atomic.CompareAndSwapInt32(&st.peak, old, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				return nil
+			}),
+			"Note": handler.New(func(ctx context.Context) error { return nil }),
+			"Hang": handler.New(func(ctx context.Context) error {
+				atomic.AddInt32(&st.hung, 1)
+				<-st.release
+				return nil
+			}),
+		}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{Concurrency: 4 * maxPending},
+			Client: opts,
+		}), st
+	}
+	waitHung := func(st *state) {
+		for atomic.LoadInt32(&st.hung) < maxPending {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("Wait", func(t *testing.T) {
+		loc, st := newLocal(&jrpc2.ClientOptions{MaxPending: maxPending})
+		defer loc.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if _, err := loc.Client.Call(ctx, "Slow", nil); err != nil {
+						t.Errorf("Call Slow: unexpected error: %v", err)
+					}
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+					{Method: "Slow"}, {Method: "Slow"}, {Method: "Note", Notify: true},
+				})
+				if err != nil {
+					t.Errorf("Batch: unexpected error: %v", err)
+				}
+			}
+		}()
+		wg.Wait()
+		if p := atomic.LoadInt32(&st.peak); p > maxPending {
+			t.Errorf("Peak concurrent calls: got %d, want at most %d", p, maxPending)
+		}
+
+		// With the limit reached, a call waits until its context ends, or
+		// until a pending call completes.
+		done := make(chan struct{})
+		for i := 0; i < maxPending; i++ {
+			go func() {
+				loc.Client.Call(ctx, "Hang", nil)
+				done <- struct{}{}
+			}()
+		}
+		waitHung(st)
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, err := loc.Client.Call(tctx, "Slow", nil); err != context.DeadlineExceeded {
+			t.Errorf("Call over limit: got %v, want %v", err, context.DeadlineExceeded)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			_, err := loc.Client.Call(ctx, "Slow", nil)
+			errc <- err
+		}()
+		close(st.release)
+		if err := <-errc; err != nil {
+			t.Errorf("Call after release: unexpected error: %v", err)
+		}
+		for i := 0; i < maxPending; i++ {
+			<-done
+		}
+	})
+
+	t.Run("FailFast", func(t *testing.T) {
+		loc, st := newLocal(&jrpc2.ClientOptions{
+			MaxPending:         maxPending,
+			MaxPendingFailFast: true,
+		})
+		defer loc.Close()
+		defer close(st.release)
+
+		for i := 0; i < maxPending; i++ {
+			go loc.Client.Call(ctx, "Hang", nil)
+		}
+		waitHung(st)
+		if _, err := loc.Client.Call(ctx, "Slow", nil); err != jrpc2.ErrTooManyPending {
+			t.Errorf("Call over limit: got %v, want %v", err, jrpc2.ErrTooManyPending)
+		}
+		if err := loc.Client.Notify(ctx, "Slow", nil); err != nil {
+			t.Errorf("Notify over limit: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("BigBatch", func(t *testing.T) {
+		loc, _ := newLocal(&jrpc2.ClientOptions{MaxPending: maxPending})
+		defer loc.Close()
+
+		specs := make([]jrpc2.Spec, maxPending+1)
+		for i := range specs {
+			specs[i].Method = "Slow"
+		}
+		if _, err := loc.Client.Batch(ctx, specs); err != jrpc2.ErrTooManyPending {
+			t.Errorf("Batch over limit: got %v, want %v", err, jrpc2.ErrTooManyPending)
+		}
+	})
+}
+
+// Verify that the KeepAlive option checks a connection that has been idle,
+// that outgoing traffic defers the check, and that a failed check closes the
+// connection.
+func TestKeepAlive(t *testing.T) {
+	const interval = 10 * time.Second
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	// The server sends each message it receives to recv, and the test replies
+	// to the ones it chooses.
+	cconn, sconn := net.Pipe()
+	srv := channel.Line(sconn, sconn)
+	recv := make(chan string, 16)
+	go func() {
+		for {
+			msg, err := srv.Recv()
+			if err != nil {
+				return
+			}
+			recv <- string(msg)
+		}
+	}()
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), &jrpc2.ClientOptions{
+		KeepAlive: interval,
+		Clock:     clock,
+	})
+	defer cli.Close()
+	waitFor := func(n int) {
+		for clock.waiting() != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// After the interval with nothing sent, the client pings the server.
+	waitFor(1)
+	clock.Advance(interval)
+	if got, want := <-recv, `{"jsonrpc":"2.0","id":1,"method":"rpc.ping"}`; got != want {
+		t.Errorf("Ping: got %#q, want %#q", got, want)
+	}
+	if err := srv.Send([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`)); err != nil {
+		t.Fatalf("Send ping reply: %v", err)
+	}
+	waitFor(2) // the timeout of the ping, and the next check
+
+	// Sending a message defers the next check.
+	clock.Advance(interval / 2)
+	if err := cli.Notify(ctx, "Poke", nil); err != nil {
+		t.Fatalf("Notify Poke: unexpected error: %v", err)
+	}
+	<-recv
+	clock.Advance(interval / 2)
+	waitFor(1)
+	select {
+	case msg := <-recv:
+		t.Errorf("Unexpected message before the interval: %#q", msg)
+	default:
+	}
+
+	// A ping that gets no reply closes the connection.
+	clock.Advance(interval / 2)
+	if got, want := <-recv, `{"jsonrpc":"2.0","id":2,"method":"rpc.ping"}`; got != want {
+		t.Errorf("Ping: got %#q, want %#q", got, want)
+	}
+	waitFor(1)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(ctx, "Hang", nil)
+		errc <- err
+	}()
+	<-recv
+	clock.Advance(interval)
+	if err := <-errc; !errors.Is(err, jrpc2.ErrConnTerminated) {
+		t.Errorf("Call Hang: got %v, want %v", err, jrpc2.ErrConnTerminated)
+	}
+	if err := cli.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The server answers rpc.ping by default.
+	loc := server.NewLocal(make(handler.Map), nil)
+	defer loc.Close()
+	if _, err := loc.Client.Call(ctx, "rpc.ping", nil); err != nil {
+		t.Errorf("Call rpc.ping: unexpected error: %v", err)
+	}
+}
+
+// clientMetricsRuns numbers the runs of TestClientMetrics, whose expvar names
+// must be distinct.
+var clientMetricsRuns int32
+
+// Verify that a client reports its calls and notifications to the Metrics
+// option, using the expvar implementation from the expmetrics package.
+func TestClientMetrics(t *testing.T) {
+	name := fmt.Sprintf("TestClientMetrics.%d", atomic.AddInt32(&clientMetricsRuns, 1))
+	var _ jrpc2.ClientMetrics = (*expmetrics.Client)(nil)
+
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	loc := server.NewLocal(handler.Map{
+		"Test": testOK,
+		"Slow": handler.New(func(context.Context) error {
+			clock.Advance(2 * time.Second)
+			return nil
+		}),
+		"Fail": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.InvalidParams, "no")
+		}),
+		"Push": handler.New(func(ctx context.Context) error {
+			return jrpc2.PushNotify(ctx, "Pushed", nil)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			Clock:    clock,
+			Metrics:  expmetrics.NewClient(name),
+			OnNotify: func(*jrpc2.Request) {},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	for _, method := range []string{"Test", "Test", "Slow", "Fail", "Nope", "Push"} {
+		loc.Client.Call(ctx, method, nil)
+	}
+	if err := loc.Client.Notify(ctx, "Note", nil); err != nil {
+		t.Errorf("Notify Note: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Test"},
+		{Method: "Note", Notify: true},
+	}); err != nil {
+		t.Errorf("Batch: unexpected error: %v", err)
+	}
+
+	var got map[string]map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &got); err != nil {
+		t.Fatalf("Decoding metrics: %v", err)
+	}
+	want := map[string]map[string]int64{
+		"calls":      {"Test": 3, "Slow": 1, "Fail": 1, "Nope": 1, "Push": 1},
+		"callErrors": {"Fail": 1, "Nope": 1},
+		"callMicros": {"Test": 0, "Slow": 2000000, "Fail": 0, "Nope": 0, "Push": 0},
+		"errorCodes": {
+			strconv.Itoa(int(code.InvalidParams)):  1,
+			strconv.Itoa(int(code.MethodNotFound)): 1,
+		},
+		"notificationsSent":     {"Note": 2},
+		"notificationsReceived": {"Pushed": 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Metrics (-want, +got):\n%s", diff)
+	}
+}
+
+// Verify that the OnSend and OnReceive hooks of a client observe every message
+// it exchanges with the server, including batches, notifications, and the
+// replies to callbacks.
+func TestClientWireHooks(t *testing.T) {
+	var mu sync.Mutex
+	var sent, recv []string
+	capture := func(dst *[]string) func([]byte) {
+		return func(raw []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			*dst = append(*dst, string(raw)) // copies raw
+		}
+	}
+	loc := server.NewLocal(handler.Map{
+		"Test": testOK,
+		"Ask": handler.New(func(ctx context.Context) (string, error) {
+			if _, err := jrpc2.PushCall(ctx, "Q", nil); err != nil {
+				return "", err
+			}
+			return "OK", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: func(context.Context, *jrpc2.Request) (interface{}, error) {
+				return "A", nil
+			},
+			OnSend:    capture(&sent),
+			OnReceive: capture(&recv),
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	if _, err := loc.Client.Call(ctx, "Ask", nil); err != nil {
+		t.Errorf("Call Ask: unexpected error: %v", err)
+	}
+	if err := loc.Client.Notify(ctx, "Note", nil); err != nil {
+		t.Errorf("Notify Note: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Test"},
+		{Method: "Note", Notify: true},
+	}); err != nil {
+		t.Errorf("Batch: unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Each captured frame is a JSON-RPC message or a batch of them.
+	for _, frame := range append(append([]string(nil), sent...), recv...) {
+		var msgs []map[string]interface{}
+		if strings.HasPrefix(frame, "[") {
+			if err := json.Unmarshal([]byte(frame), &msgs); err != nil {
+				t.Errorf("Invalid batch %#q: %v", frame, err)
+			}
+		} else {
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(frame), &msg); err != nil {
+				t.Errorf("Invalid message %#q: %v", frame, err)
+			}
+			msgs = append(msgs, msg)
+		}
+		for _, msg := range msgs {
+			if v := msg["jsonrpc"]; v != "2.0" {
+				t.Errorf("Message %#q: got version %v, want 2.0", frame, v)
+			}
+		}
+	}
+
+	wantSent := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"Ask"}`,
+		`{"jsonrpc":"2.0","id":1,"result":"A"}`,
+		`{"jsonrpc":"2.0","method":"Note"}`,
+		`[{"jsonrpc":"2.0","id":2,"method":"Test"},{"jsonrpc":"2.0","method":"Note"}]`,
+	}
+	if diff := cmp.Diff(wantSent, sent); diff != "" {
+		t.Errorf("Sent messages (-want, +got):\n%s", diff)
+	}
+	wantRecv := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"Q"}`,
+		`{"jsonrpc":"2.0","id":1,"result":"OK"}`,
+		`[{"jsonrpc":"2.0","id":2,"result":"OK"}]`,
+	}
+	if diff := cmp.Diff(wantRecv, recv); diff != "" {
+		t.Errorf("Received messages (-want, +got):\n%s", diff)
+	}
+}
+
+// Verify that the RequestTimeout option ends the contexts of handlers that run
+// too long, measured by the server's clock.
+func TestRequestTimeout(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	started := make(chan struct{}, 1)
+	loc := server.NewLocal(handler.Map{
+		"Fast": testOK,
+		"Slow": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{
+		Clock:          clock,
+		RequestTimeout: time.Minute,
+		Concurrency:    2,
+	}})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// A handler that finishes within the deadline succeeds.
+	if _, err := loc.Client.Call(ctx, "Fast", nil); err != nil {
+		t.Errorf("Call Fast: unexpected error: %v", err)
+	}
+
+	// A handler that runs past the deadline fails.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(ctx, "Slow", nil)
+		errc <- err
+	}()
+	<-started
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case err := <-errc:
+		t.Fatalf("Call Slow: ended before the deadline: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Errorf("Call Slow: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The same applies to notifications, whose errors are discarded.
+	if err := loc.Client.Notify(ctx, "Slow", nil); err != nil {
+		t.Fatalf("Notify Slow: unexpected error: %v", err)
+	}
+	<-started
+	clock.Advance(time.Minute)
+	if _, err := loc.Client.Call(ctx, "Fast", nil); err != nil {
+		t.Errorf("Call Fast: unexpected error: %v", err)
+	}
+}
+
+// Verify that the timer for a request timeout is released when the request is
+// delivered, even if the context decoder detaches the request context from
+// the server.
+func TestRequestTimeoutRelease(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	ctxs := make(chan context.Context, 1)
+	loc := server.NewLocal(handler.Map{
+		"Note": handler.New(func(ctx context.Context) error {
+			ctxs <- ctx
+			return nil
+		}),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{
+		Clock:          clock,
+		RequestTimeout: time.Minute,
+		DecodeContext: func(_ context.Context, _ string, p json.RawMessage) (context.Context, json.RawMessage, error) {
+			return context.Background(), p, nil
+		},
+	}})
+	defer loc.Close()
+
+	if err := loc.Client.Notify(context.Background(), "Note", nil); err != nil {
+		t.Fatalf("Notify Note: unexpected error: %v", err)
+	}
+	ctx := <-ctxs
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Request context did not end after delivery")
+	}
+}
+
+// timingLogger is an RPCTimingLogger that records the callbacks it receives.
+type timingLogger struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (t *timingLogger) add(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.log = append(t.log, fmt.Sprintf(format, args...))
+}
+
+func (t *timingLogger) LogRequest(_ context.Context, req *jrpc2.Request) {
+	t.add("request %s %s", req.Method(), req.ID())
+}
+
+func (t *timingLogger) LogResponse(_ context.Context, rsp *jrpc2.Response) {
+	t.add("untimed response %s", rsp.ID())
+}
+
+func (t *timingLogger) LogResponseTime(_ context.Context, rsp *jrpc2.Response, elapsed time.Duration) {
+	status := "ok"
+	if e := rsp.Error(); e != nil {
+		status = strconv.Itoa(int(e.Code()))
+	}
+	t.add("response %s %s %v", rsp.ID(), status, elapsed)
+}
+
+// Verify that an RPCLog that implements RPCTimingLogger receives the time
+// taken by each request and notification, in order.
+func TestRPCTimingLogger(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	work := func(d time.Duration, err error) handler.Func {
+		return func(context.Context, *jrpc2.Request) (interface{}, error) {
+			clock.Advance(d)
+			return nil, err
+		}
+	}
+	rlog := new(timingLogger)
+	loc := server.NewLocal(handler.Map{
+		"Slow": work(3*time.Second, nil),
+		"Fail": work(time.Second, jrpc2.Errorf(99, "failed")),
+		"Note": work(2*time.Second, nil),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Clock: clock, RPCLog: rlog},
+	})
+	ctx := context.Background()
+	if _, err := loc.Client.Call(ctx, "Slow", nil); err != nil {
+		t.Errorf("Call(Slow) failed: %v", err)
+	}
+	if _, err := loc.Client.Call(ctx, "Fail", nil); err == nil {
+		t.Error("Call(Fail): got nil error, want failure")
+	}
+	if err := loc.Client.Notify(ctx, "Note", nil); err != nil {
+		t.Errorf("Notify(Note) failed: %v", err)
+	}
+	// N.B. The notification completes before the next call is dispatched.
+	if _, err := loc.Client.Call(ctx, "Missing", nil); err == nil {
+		t.Error("Call(Missing): got nil error, want failure")
+	}
+	loc.Close()
+
+	want := []string{
+		"request Slow 1",
+		"response 1 ok 3s",
+		"request Fail 2",
+		"response 2 99 1s",
+		"request Note ",
+		"response  ok 2s",
+		"response 3 -32601 0s",
+	}
+	if diff := cmp.Diff(want, rlog.log); diff != "" {
+		t.Errorf("RPC log (-want, +got):\n%s", diff)
+	}
+}
+
+// Verify that the RateLimit option refuses calls and discards notifications
+// received in excess of the rate, and that RateWait delays them instead.
+func TestRateLimit(t *testing.T) {
+	var notes int32
+	methods := handler.Map{
+		"X": testOK,
+		"N": handler.New(func(context.Context) error {
+			atomic.AddInt32(&notes, 1)
+			return nil
+		}),
+	}
+	const (
+		call = `{"jsonrpc":"2.0","id":%d,"method":"X"}`
+		note = `{"jsonrpc":"2.0","method":"N"}`
+		ok   = `{"jsonrpc":"2.0","id":%d,"result":"OK"}`
+		fail = `{"jsonrpc":"2.0","id":%d,"error":{"code":-32087,"message":"request rate limit exceeded"}}`
+	)
+	exchange := func(cli channel.Channel, input, want string) {
+		t.Helper()
+		if err := cli.Send([]byte(input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", input, err)
+		}
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != want {
+			t.Errorf("Send %#q: got %#q, want %#q", input, got, want)
+		}
+	}
+
+	t.Run("Refuse", func(t *testing.T) {
+		clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+		cli, srv := channel.Direct()
+		s := jrpc2.NewServer(methods, &jrpc2.ServerOptions{
+			Clock:     clock,
+			RateLimit: 1,
+			RateBurst: 2,
+		}).Start(srv)
+		defer func() { cli.Close(); s.Wait() }()
+
+		// The burst admits two requests; the rest are refused or discarded.
+		batch := "[" + note + "," + fmt.Sprintf(call, 1) + "," + note + "," + fmt.Sprintf(call, 2) + "]"
+		exchange(cli, batch, "["+fmt.Sprintf(ok, 1)+","+fmt.Sprintf(fail, 2)+"]")
+		if got := atomic.LoadInt32(&notes); got != 1 {
+			t.Errorf("Notifications handled: got %d, want 1", got)
+		}
+
+		// After a second, one more request is admitted.
+		clock.Advance(time.Second)
+		exchange(cli, fmt.Sprintf(call, 3), fmt.Sprintf(ok, 3))
+		exchange(cli, fmt.Sprintf(call, 4), fmt.Sprintf(fail, 4))
+		if got := s.ServerInfo().Counter["rpc.rateLimited"]; got != 3 {
+			t.Errorf("Rate limited: got %d, want 3", got)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+		cli, srv := channel.Direct()
+		s := jrpc2.NewServer(methods, &jrpc2.ServerOptions{
+			Clock:     clock,
+			RateLimit: 2,
+			RateWait:  750 * time.Millisecond,
+		}).Start(srv)
+		defer func() { cli.Close(); s.Wait() }()
+
+		// The first request is admitted at once, and the second is delayed
+		// half a second. The third would need a full second, which is too long,
+		// so it is refused.
+		exchange(cli, fmt.Sprintf(call, 1), fmt.Sprintf(ok, 1))
+		if err := cli.Send([]byte("[" + fmt.Sprintf(call, 2) + "," + fmt.Sprintf(call, 3) + "]")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond) // wait for the server to delay the batch
+		}
+		clock.Advance(500 * time.Millisecond)
+		if raw, err := cli.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got, want := string(raw), "["+fmt.Sprintf(ok, 2)+","+fmt.Sprintf(fail, 3)+"]"; got != want {
+			t.Errorf("Delayed batch: got %#q, want %#q", got, want)
+		}
+	})
+}
+
+func TestServerClock(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	loc := server.NewLocal(handler.Map{"X": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Clock: clock},
+	})
+	defer loc.Close()
+
+	clock.Advance(time.Hour)
+	info, err := jrpc2.RPCServerInfo(context.Background(), loc.Client)
+	if err != nil {
+		t.Fatalf("RPCServerInfo failed: %v", err)
+	}
+	if !info.StartTime.Equal(start) {
+		t.Errorf("Start time: got %v, want %v", info.StartTime, start)
+	}
+
+	// Check that timers from the fake clock fire when it is advanced.
+	ch := clock.After(time.Minute)
+	clock.Advance(30 * time.Second)
+	select {
+	case <-ch:
+		t.Error("Timer fired early")
+	default:
+	}
+	clock.Advance(30 * time.Second)
+	if got, want := <-ch, start.Add(time.Hour+time.Minute); !got.Equal(want) {
+		t.Errorf("Timer: got %v, want %v", got, want)
+	}
+}
+
+// Verify that the server records when requests are received, and reports the
+// time requests spend queued separately from the time spent in handlers.
+func TestQueueLatency(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	holding := make(chan struct{})
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var waited []time.Duration
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Hold": handler.New(func(ctx context.Context) error {
+			close(holding)
+			<-release
+			return nil
+		}),
+		"Check": handler.New(func(ctx context.Context) error {
+			req := jrpc2.InboundRequest(ctx)
+			if got := req.ReceivedAt(); !got.Equal(start) {
+				t.Errorf("ReceivedAt: got %v, want %v", got, start)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			waited = append(waited, clock.Now().Sub(req.ReceivedAt()))
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 1, Clock: clock}).Start(spipe)
+	defer srv.Stop()
+
+	send := func(msg string) {
+		t.Helper()
+		if err := cpipe.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %#q: %v", msg, err)
+		}
+	}
+
+	// With a concurrency limit of 1, the Check calls queue behind Hold. The
+	// Direct channel does not return from Send until the server has received
+	// the message, so once the last Send completes, all the calls have been
+	// received at the start time.
+	send(`{"jsonrpc":"2.0","id":1,"method":"Hold"}`)
+	<-holding
+	send(`{"jsonrpc":"2.0","id":2,"method":"Check"}`)
+	send(`{"jsonrpc":"2.0","id":3,"method":"Check"}`)
+
+	const delay = 2 * time.Second
+	clock.Advance(delay)
+	close(release)
+	for i := 0; i < 3; i++ {
+		if _, err := cpipe.Recv(); err != nil {
+			t.Fatalf("Recv %d: %v", i+1, err)
+		}
+	}
+
+	mu.Lock()
+	for i, got := range waited {
+		if got != delay {
+			t.Errorf("Check %d queue latency: got %v, want %v", i+1, got, delay)
+		}
+	}
+	mu.Unlock()
+
+	// Only Hold spent any (fake) time in its handler; the Check calls spent
+	// the same interval waiting in the queue.
+	info := srv.ServerInfo()
+	micros := delay.Microseconds()
+	for _, test := range []struct {
+		name       string
+		total, max int64
+	}{
+		{"rpc.queueMicros", 2 * micros, micros},
+		{"rpc.handlerMicros", micros, micros},
+	} {
+		if got := info.Counter[test.name]; got != test.total {
+			t.Errorf("Counter %q: got %d, want %d", test.name, got, test.total)
+		}
+		if got := info.MaxValue[test.name]; got != test.max {
+			t.Errorf("MaxValue %q: got %d, want %d", test.name, got, test.max)
+		}
+	}
+}
+
+// Verify that server pushes are queued, and that each overflow policy has the
+// expected effect when a client is slow to read.
+func TestPushQueue(t *testing.T) {
+	ctx := context.Background()
+
+	// Start a server with a push queue of size 2, whose client does not read
+	// until told to. Send one push and wait for the server to dequeue it; the
+	// sender is then blocked until the client reads. Then send two more to
+	// fill the queue.
+	start := func(t *testing.T, policy jrpc2.PushPolicy) (*jrpc2.Server, channel.Channel) {
+		t.Helper()
+		cli, srv := channel.Direct()
+		s := jrpc2.NewServer(handler.Map{"X": testOK}, &jrpc2.ServerOptions{
+			AllowPush:     true,
+			PushQueueSize: 2,
+			PushOverflow:  policy,
+		}).Start(srv)
+
+		if err := s.Notify(ctx, "N1", nil); err != nil {
+			t.Fatalf("Notify N1: unexpected error: %v", err)
+		}
+		for s.ServerInfo().PushQueue.Length != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, m := range []string{"N2", "N3"} {
+			if err := s.Notify(ctx, m, nil); err != nil {
+				t.Fatalf("Notify %s: unexpected error: %v", m, err)
+			}
+		}
+		if q := s.ServerInfo().PushQueue; q.Length != 2 || q.HighWater != 2 {
+			t.Errorf("PushQueue: got %+v, want length 2 and high water 2", q)
+		}
+		return s, cli
+	}
+
+	// Read n messages from the client and check their methods or IDs.
+	expect := func(t *testing.T, cli channel.Channel, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			raw, err := cli.Recv()
+			if err != nil {
+				t.Fatalf("Recv: unexpected error: %v", err)
+			}
+			var msg struct {
+				M  string          `json:"method"`
+				ID json.RawMessage `json:"id"`
+			}
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				t.Fatalf("Decoding %#q: %v", raw, err)
+			}
+			if got := msg.M; got != w && string(msg.ID) != w {
+				t.Errorf("Recv: got %#q, want %q", raw, w)
+			}
+		}
+	}
+	checkDropped := func(t *testing.T, s *jrpc2.Server, want int64) {
+		t.Helper()
+		if q := s.ServerInfo().PushQueue; q.Dropped != want {
+			t.Errorf("PushQueue: got %d dropped, want %d", q.Dropped, want)
+		}
+	}
+
+	t.Run("DropNewest", func(t *testing.T) {
+		s, cli := start(t, jrpc2.PushDropNewest)
+		defer func() { cli.Close(); s.Wait() }()
+
+		if err := s.Notify(ctx, "N4", nil); err != jrpc2.ErrPushDropped {
+			t.Errorf("Notify N4: got error %v, want %v", err, jrpc2.ErrPushDropped)
+		}
+		if _, err := s.Callback(ctx, "C5", nil); err != jrpc2.ErrPushDropped {
+			t.Errorf("Callback C5: got error %v, want %v", err, jrpc2.ErrPushDropped)
+		}
+		expect(t, cli, "N1", "N2", "N3")
+		checkDropped(t, s, 2)
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		s, cli := start(t, jrpc2.PushDropOldest)
+		defer func() { cli.Close(); s.Wait() }()
+
+		// The callback displaces N2, then N5 displaces N3, and N6 displaces
+		// the callback.
+		errc := make(chan error, 1)
+		go func() { _, err := s.Callback(ctx, "C4", nil); errc <- err }()
+		for s.ServerInfo().PushQueue.Dropped != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, m := range []string{"N5", "N6"} {
+			if err := s.Notify(ctx, m, nil); err != nil {
+				t.Errorf("Notify %s: unexpected error: %v", m, err)
+			}
+		}
+		if err := <-errc; err != jrpc2.ErrPushDropped {
+			t.Errorf("Callback C4: got error %v, want %v", err, jrpc2.ErrPushDropped)
+		}
+		expect(t, cli, "N1", "N5", "N6")
+		checkDropped(t, s, 3)
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		s, cli := start(t, jrpc2.PushDisconnect)
+		if err := s.Notify(ctx, "N4", nil); err != jrpc2.ErrPushOverflow {
+			t.Errorf("Notify N4: got error %v, want %v", err, jrpc2.ErrPushOverflow)
+		}
+		if _, err := cli.Recv(); err == nil {
+			t.Error("Recv: got nil error after disconnect")
+		}
+		cli.Close()
+		if err := s.Wait(); err != jrpc2.ErrPushOverflow {
+			t.Errorf("Wait: got error %v, want %v", err, jrpc2.ErrPushOverflow)
+		}
+	})
+
+	t.Run("ResponsesFirst", func(t *testing.T) {
+		s, cli := start(t, jrpc2.PushDropNewest)
+		defer func() { cli.Close(); s.Wait() }()
+
+		// A call made while pushes are queued is answered ahead of them, once
+		// the push being sent is read.
+		if err := cli.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"X"}`)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond) // let the response wait to be sent
+		expect(t, cli, "N1", "1", "N2", "N3")
+		checkDropped(t, s, 0)
+	})
+}
+
+// resetChannel is a channel that reports an error other than io.EOF when its
+// peer closes, as a network connection might.
+type resetChannel struct{ channel.Channel }
+
+func (r resetChannel) Recv() ([]byte, error) {
+	msg, err := r.Channel.Recv()
+	if err == io.EOF {
+		err = errors.New("connection reset by peer")
+	}
+	return msg, err
+}
+
+// Verify that Shutdown lets queued and in-flight requests finish and sends
+// their responses before closing, and refuses requests received after it
+// begins.
+func TestShutdown(t *testing.T) {
+	var logMu sync.Mutex
+	var logBuf bytes.Buffer
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			<-release
+			return "slow", nil
+		}),
+		"Test": testOK,
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{
+		Concurrency: 1,
+		Logger:      log.New(lockedWriter{&logMu, &logBuf}, "", 0),
+	}})
+	s, cli := loc.Server, loc.Client
 	ctx := context.Background()
 
-	// Post an explicit notification.
-	if err := s.Notify(ctx, "explicit", nil); err != nil {
-		t.Errorf("Notify explicit: unexpected error: %v", err)
+	// Slow is in flight, and Test is queued behind it.
+	type result struct {
+		val string
+		err error
+	}
+	results := make(chan result, 2)
+	call := func(method string) {
+		var val string
+		err := cli.CallResult(ctx, method, nil, &val)
+		results <- result{val, err}
+	}
+	go call("Slow")
+	<-started
+	go call("Test")
+	for s.ServerInfo().Counter["rpc.requests"] < 2 {
+		time.Sleep(time.Millisecond)
 	}
 
-	// Call the method that posts a notification.
-	if _, err := c.Call(ctx, "NoteMe", nil); err != nil {
-		t.Errorf("Call NoteMe: unexpected error: %v", err)
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+	for {
+		logMu.Lock()
+		draining := strings.Contains(logBuf.String(), "Server draining")
+		logMu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond) // Shutdown has not begun yet
+	}
+	if _, err := cli.Call(ctx, "Test", nil); err == nil {
+		t.Error("Call during shutdown: got nil error, want failure")
+	} else if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.ShuttingDown {
+		t.Errorf("Call during shutdown: got %v, want code %v", err, code.ShuttingDown)
+	} else {
+		var data jrpc2.ShutdownInfo
+		if err := e.UnmarshalData(&data); err != nil || data != (jrpc2.ShutdownInfo{}) {
+			t.Errorf("Error data: got %+v (%v), want zero", data, err)
+		}
 	}
 
-	// Shut everything down to be sure the callbacks have settled.
-	loc.Close()
+	close(release)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("Call: unexpected error: %v", r.err)
+		}
+		got[r.val] = true
+	}
+	if !got["slow"] || !got["OK"] {
+		t.Errorf("Results: got %v, want slow and OK", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	if err := loc.Close(); err != nil {
+		t.Errorf("Server wait: unexpected error: %v", err)
+	}
 
-	want := []string{"explicit", "method"}
-	if diff := cmp.Diff(want, notes); diff != "" {
-		t.Errorf("Server notifications: (-want, +got)\n%s", diff)
+	// Shutting down a stopped server does nothing, either way.
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown after stop: unexpected error: %v", err)
+	}
+	if err := s.AnnounceShutdown(time.Second, "again"); err != nil {
+		t.Errorf("AnnounceShutdown after stop: unexpected error: %v", err)
 	}
 }
 
-// Verify that server-side callbacks work.
-func TestPushCall(t *testing.T) {
+// Verify that Shutdown cancels the handlers still running when its context
+// ends.
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
 	loc := server.NewLocal(handler.Map{
-		"CallMeMaybe": handler.New(func(ctx context.Context) error {
-			if rsp, err := jrpc2.PushCall(ctx, "succeed", nil); err != nil {
-				t.Errorf("Callback failed: %v", err)
-			} else {
-				t.Logf("Callback succeeded: %v", rsp.ResultString())
-			}
+		"Stuck": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, nil)
+	defer loc.Close()
 
-			if rsp, err := jrpc2.PushCall(ctx, "fail", nil); err == nil {
-				t.Errorf("Callback did not fail: got %v, want error", rsp)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(context.Background(), "Stuck", nil)
+		errc <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := loc.Server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-errc; err == nil {
+		t.Error("Call Stuck: got nil error, want failure")
+	}
+}
+
+// Verify that a server announcing its shutdown finishes the calls in flight,
+// refuses new calls, and closes the connection, and that a client with a
+// Redial function waits out the grace period and reconnects to the restarted
+// server without logging a transport error.
+func TestAnnounceShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := jrpc2.NewServer(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
 			}
-			return nil
 		}),
-	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-		Client: &jrpc2.ClientOptions{
-			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-				t.Logf("OnCallback invoked for method %q", req.Method())
-				switch req.Method() {
-				case "succeed":
-					return true, nil
-				case "fail":
-					return false, errors.New("here is your requested error")
-				}
-				panic("broken test: you should not see this")
-			},
-		},
+		"Test": testOK,
+	}, &jrpc2.ServerOptions{AllowPush: true, Concurrency: 4})
+
+	var logMu sync.Mutex
+	var logBuf bytes.Buffer
+	announced := make(chan *jrpc2.ShutdownInfo, 1)
+	connected := make(chan struct{}, 1)
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// dial starts s on a new connection, as if the server had restarted.
+	dial := func(context.Context) (channel.Channel, error) {
+		cpipe, spipe := channel.Direct()
+		s.Start(spipe)
+		return resetChannel{cpipe}, nil
+	}
+	ch, _ := dial(context.Background())
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+		Logger:      log.New(lockedWriter{&logMu, &logBuf}, "", 0),
+		OnShutdown:  func(info *jrpc2.ShutdownInfo) { announced <- info },
+		Redial:      dial,
+		RedialDelay: time.Second,
+		Clock:       clock,
+		OnConnect:   func() { connected <- struct{}{} },
 	})
-	defer loc.Close()
-	s, c := loc.Server, loc.Client
 	ctx := context.Background()
 
-	// Post an explicit callback.
-	if _, err := s.Callback(ctx, "succeed", nil); err != nil {
-		t.Errorf("Callback explicit: unexpected error: %v", err)
+	slow := make(chan error, 1)
+	go func() {
+		var got string
+		err := cli.CallResult(ctx, "Slow", nil, &got)
+		if err == nil && got != "done" {
+			err = fmt.Errorf("got %q, want done", got)
+		}
+		slow <- err
+	}()
+	<-started
+
+	shut := make(chan error, 1)
+	go func() { shut <- s.AnnounceShutdown(5*time.Second, "deploy") }()
+
+	info := <-announced
+	if info.Grace != 5 || info.Reason != "deploy" {
+		t.Errorf("OnShutdown: got %+v, want grace 5, reason deploy", info)
 	}
 
-	// Call the method that posts a callback.
-	if _, err := c.Call(ctx, "CallMeMaybe", nil); err != nil {
-		t.Errorf("Call CallMeMaybe: unexpected error: %v", err)
+	// New calls are refused while the slow call is in flight.
+	_, err := cli.Call(ctx, "Test", nil)
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.ShuttingDown {
+		t.Errorf("Call after shutdown: got %v, want code %v", err, code.ShuttingDown)
+	} else {
+		var data jrpc2.ShutdownInfo
+		if err := e.UnmarshalData(&data); err != nil || data != *info {
+			t.Errorf("Error data: got %+v (%v), want %+v", data, err, info)
+		}
 	}
-}
 
-// Verify that a server push after the client closes does not trigger a panic.
-func TestDeadServerPush(t *testing.T) {
-	loc := server.NewLocal(make(handler.Map), &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-	})
-	loc.Client.Close()
-	ctx := context.Background()
-	if err := loc.Server.Notify(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
-		t.Errorf("Notify(whatever): got %v, want %v", err, jrpc2.ErrConnClosed)
+	// The slow call completes, after which the server stops.
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("Slow call failed: %v", err)
 	}
-	if rsp, err := loc.Server.Callback(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
-		t.Errorf("Callback(whatever): got %v, %v; want %v", rsp, err, jrpc2.ErrConnClosed)
+	if err := <-shut; err != nil {
+		t.Errorf("AnnounceShutdown: unexpected error: %v", err)
+	}
+	if st := s.WaitStatus(); !st.Stopped() {
+		t.Errorf("Server status: got %+v, want stopped", st)
+	}
+
+	// The client redials the restarted server once the grace period has
+	// elapsed, and the same client can use it.
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5 * time.Second)
+	<-connected
+	if _, err := cli.Call(ctx, "Test", nil); err != nil {
+		t.Errorf("Call after restart: unexpected error: %v", err)
+	}
+
+	logMu.Lock()
+	logs := logBuf.String()
+	logMu.Unlock()
+	if strings.Contains(logs, "error") {
+		t.Errorf("Client logged an error:\n%s", logs)
 	}
+	t.Logf("Client log:\n%s", logs)
+
+	if err := cli.Close(); err != nil {
+		t.Errorf("Client close: unexpected error: %v", err)
+	}
+	s.Wait()
 }
 
-// Verify that an OnCancel hook is called when expected.
-func TestOnCancel(t *testing.T) {
-	// Set up a plumbing context so the test can unblock the server.
-	sctx, cancelServer := context.WithCancel(context.Background())
-	defer cancelServer()
+// Verify that a server announcing its shutdown answers the calls it has queued
+// but not yet dispatched, and refuses later calls with the announcement.
+func TestAnnounceShutdownQueued(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	announced := make(chan struct{})
 	loc := server.NewLocal(handler.Map{
-		// Block until explicitly cancelled, via sctx.
-		"Stall": handler.New(func(_ context.Context) error {
-			select {
-			case <-sctx.Done():
-				t.Logf("Server unblocked; returning err=%v", sctx.Err())
-				return sctx.Err()
-			case <-time.After(10 * time.Second): // shouldn't happen
-				t.Error("Timeout waiting for server cancellation")
-			}
-			return nil
-		}),
-
-		// Verify that setting the cancellation hook prevents the client from
-		// sending the default rpc.cancel notification.
-		"rpc.cancel": handler.New(func(ctx context.Context, ids json.RawMessage) error {
-			t.Errorf("Server-side rpc.cancel unexpectedly called: %s", string(ids))
-			return nil
+		"Slow": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			<-release
+			return "slow", nil
 		}),
+		"Test": testOK,
 	}, &server.LocalOptions{
-		// Disable handling of built-in methods on the server.
-		Server: &jrpc2.ServerOptions{DisableBuiltin: true},
+		Server: &jrpc2.ServerOptions{AllowPush: true, Concurrency: 1},
 		Client: &jrpc2.ClientOptions{
-			OnCancel: func(cli *jrpc2.Client, rsp *jrpc2.Response) {
-				t.Logf("OnCancel hook called with id=%q, err=%v", rsp.ID(), rsp.Error())
-				cancelServer()
-			},
+			OnShutdown: func(*jrpc2.ShutdownInfo) { close(announced) },
 		},
 	})
+	s, cli := loc.Server, loc.Client
+	ctx := context.Background()
 
-	// Call a method on the server that will stall until cancelServer is called.
-	// On the client side, set a deadline to expire the caller's context.
-	// The cancellation hook will unblock the server.
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel()
+	// Slow is in flight, and Test is queued behind it.
+	results := make(chan string, 2)
+	call := func(method string) {
+		var val string
+		if err := cli.CallResult(ctx, method, nil, &val); err != nil {
+			t.Errorf("Call %q: unexpected error: %v", method, err)
+		}
+		results <- val
+	}
+	go call("Slow")
+	<-started
+	go call("Test")
+	for s.ServerInfo().Counter["rpc.requests"] < 2 {
+		time.Sleep(time.Millisecond)
+	}
 
-	got, err := loc.Client.Call(ctx, "Stall", nil)
-	if err == nil {
-		t.Errorf("Stall: got %+v, wanted error", got)
-	} else if err != context.DeadlineExceeded {
-		t.Errorf("Stall: got error %v, want %v", err, context.Canceled)
+	shut := make(chan error, 1)
+	go func() { shut <- s.AnnounceShutdown(time.Minute, "deploy") }()
+	<-announced
+
+	want := jrpc2.ShutdownInfo{Grace: 60, Reason: "deploy"}
+	if _, err := cli.Call(ctx, "Test", nil); err == nil {
+		t.Error("Call after shutdown: got nil error, want failure")
+	} else if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.ShuttingDown {
+		t.Errorf("Call after shutdown: got %v, want code %v", err, code.ShuttingDown)
+	} else {
+		var data jrpc2.ShutdownInfo
+		if err := e.UnmarshalData(&data); err != nil || data != want {
+			t.Errorf("Error data: got %+v (%v), want %+v", data, err, want)
+		}
 	}
-	loc.Client.Close()
-	if err := loc.Server.Wait(); err != nil {
-		t.Errorf("Server exit status: %v", err)
+
+	close(release)
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["slow"] || !got["OK"] {
+		t.Errorf("Results: got %v, want slow and OK", got)
 	}
+	if err := <-shut; err != nil {
+		t.Errorf("AnnounceShutdown: unexpected error: %v", err)
+	}
+	loc.Close()
 }
 
-// Verify that the context encoding/decoding hooks work.
-func TestContextPlumbing(t *testing.T) {
-	want := time.Now().Add(10 * time.Second)
-	ctx, cancel := context.WithDeadline(context.Background(), want)
-	defer cancel()
+// recvChannel is a channel that records the messages it receives.
+type recvChannel struct {
+	channel.Channel
 
-	loc := server.NewLocal(handler.Map{
-		"X": handler.New(func(ctx context.Context) (bool, error) {
-			got, ok := ctx.Deadline()
-			if !ok {
-				return false, errors.New("no deadline was set")
-			} else if !got.Equal(want) {
-				return false, fmt.Errorf("deadline: got %v, want %v", got, want)
-			}
-			t.Logf("Got expected deadline: %v", got)
-			return true, nil
-		}),
-	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{DecodeContext: jctx.Decode},
-		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
-	})
-	defer loc.Close()
+	mu   sync.Mutex
+	msgs []string
+}
 
-	if _, err := loc.Client.Call(ctx, "X", nil); err != nil {
-		t.Errorf("Call X failed: %v", err)
+func (r *recvChannel) Recv() ([]byte, error) {
+	msg, err := r.Channel.Recv()
+	if err == nil {
+		r.mu.Lock()
+		r.msgs = append(r.msgs, string(msg))
+		r.mu.Unlock()
 	}
+	return msg, err
 }
 
-// Verify that the request-checking hook works.
-func TestRequestHook(t *testing.T) {
-	const wantResponse = "Hey girl"
-	const wantToken = "OK"
+// take returns the messages received since the last call, and discards them.
+func (r *recvChannel) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.msgs
+	r.msgs = nil
+	return msgs
+}
 
-	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) (string, error) {
-			return wantResponse, nil
+// Verify that results are compressed once the client and server negotiate a
+// codec, and only then, and that only results above the threshold are
+// compressed.
+func TestCompression(t *testing.T) {
+	big := strings.Repeat("all work and no play makes jack a dull boy ", 50)
+	mux := handler.Map{
+		"Echo": handler.New(func(_ context.Context, ss []string) string {
+			return strings.Join(ss, "")
 		}),
-	}, &server.LocalOptions{
-		// Enable auth checking and context decoding for the server.
-		Server: &jrpc2.ServerOptions{
-			DecodeContext: jctx.Decode,
-			CheckRequest: func(ctx context.Context, req *jrpc2.Request) error {
-				var token []byte
-				switch err := jctx.UnmarshalMetadata(ctx, &token); err {
-				case nil:
-					t.Logf("Metadata present: value=%q", string(token))
-				case jctx.ErrNoMetadata:
-					t.Log("Metadata not set")
-				default:
-					return err
-				}
-				if s := string(token); s != wantToken {
-					return jrpc2.Errorf(notAuthorized, "not authorized")
-				}
-				return nil
-			},
-		},
+	}
+	ctx := context.Background()
 
-		// Enable context encoding for the client.
-		Client: &jrpc2.ClientOptions{
-			EncodeContext: jctx.Encode,
-		},
-	})
-	defer loc.Close()
-	c := loc.Client
+	// connect starts a server and returns a client connected to it, the
+	// channel on which the client receives, and a function to shut them down.
+	connect := func(t *testing.T, sopts *jrpc2.ServerOptions, copts *jrpc2.ClientOptions) (*jrpc2.Client, *recvChannel, func()) {
+		cpipe, spipe := channel.Direct()
+		srv := jrpc2.NewServer(mux, sopts).Start(spipe)
+		rc := &recvChannel{Channel: cpipe}
+		cli := jrpc2.NewClient(rc, copts)
+		return cli, rc, func() {
+			cli.Close()
+			if err := srv.Wait(); err != nil {
+				t.Errorf("Server wait: unexpected error: %v", err)
+			}
+		}
+	}
+	echo := func(t *testing.T, cli *jrpc2.Client, s string) {
+		t.Helper()
+		var got string
+		if err := cli.CallResult(ctx, "Echo", []string{s}, &got); err != nil {
+			t.Errorf("Echo failed: %v", err)
+		} else if got != s {
+			t.Errorf("Echo: got %d bytes, want %d", len(got), len(s))
+		}
+	}
+	// countEncoded reports how many of the responses in msgs are compressed.
+	countEncoded := func(msgs []string) int {
+		var n int
+		for _, msg := range msgs {
+			n += strings.Count(msg, `"encoding":"gzip"`)
+		}
+		return n
+	}
+	gzip := []jrpc2.Codec{jrpc2.GzipCodec}
 
-	// Call without a token and verify that we get an error.
-	t.Run("NoToken", func(t *testing.T) {
-		var rsp string
-		err := c.CallResult(context.Background(), "Test", nil, &rsp)
-		if err == nil {
-			t.Errorf("Call(Test): got %q, wanted error", rsp)
-		} else if ec := code.FromError(err); ec != notAuthorized {
-			t.Errorf("Call(Test): got code %v, want %v", ec, notAuthorized)
+	t.Run("Negotiated", func(t *testing.T) {
+		cli, rc, stop := connect(t, &jrpc2.ServerOptions{Codecs: gzip, CompressMin: 100},
+			&jrpc2.ClientOptions{Codecs: gzip})
+		defer stop()
+
+		// Before the codec is negotiated, results are not compressed.
+		echo(t, cli, big)
+		if n := countEncoded(rc.take()); n != 0 {
+			t.Errorf("Before rpc.hello: got %d compressed results, want 0", n)
 		}
-	})
 
-	// Call with a valid token and verify that we get a response.
-	t.Run("GoodToken", func(t *testing.T) {
-		ctx, err := jctx.WithMetadata(context.Background(), []byte(wantToken))
+		if enc, err := jrpc2.RPCHello(ctx, cli); err != nil || enc != "gzip" {
+			t.Fatalf("RPCHello: got (%q, %v), want gzip", enc, err)
+		}
+		rc.take()
+
+		// Only the large results of a batch are compressed.
+		rsps, err := cli.Batch(ctx, []jrpc2.Spec{
+			{Method: "Echo", Params: []string{"small"}},
+			{Method: "Echo", Params: []string{big}},
+			{Method: "Echo", Params: []string{"also small"}},
+		})
 		if err != nil {
-			t.Fatalf("Call(Test): attaching metadata: %v", err)
+			t.Fatalf("Batch failed: %v", err)
 		}
-		var rsp string
-		if err := c.CallResult(ctx, "Test", nil, &rsp); err != nil {
-			t.Errorf("Call(Test): unexpected error: %v", err)
+		for i, want := range []string{"small", big, "also small"} {
+			var got string
+			if err := rsps[i].UnmarshalResult(&got); err != nil {
+				t.Errorf("Response %d: unexpected error: %v", i, err)
+			} else if got != want {
+				t.Errorf("Response %d: got %d bytes, want %d", i, len(got), len(want))
+			}
 		}
-		if rsp != wantResponse {
-			t.Errorf("Call(Test): got %q, want %q", rsp, wantResponse)
+		if n := countEncoded(rc.take()); n != 1 {
+			t.Errorf("Batch: got %d compressed results, want 1", n)
 		}
-	})
 
-	// Call with an invalid token and verify that we get an error.
-	t.Run("BadToken", func(t *testing.T) {
-		ctx, err := jctx.WithMetadata(context.Background(), []byte("BAD"))
-		if err != nil {
-			t.Fatalf("Call(Test): attaching metadata: %v", err)
+		echo(t, cli, big)
+		echo(t, cli, "tiny")
+		if n := countEncoded(rc.take()); n != 1 {
+			t.Errorf("Calls: got %d compressed results, want 1", n)
 		}
-		var rsp string
-		if err := c.CallResult(ctx, "Test", nil, &rsp); err == nil {
-			t.Errorf("Call(Test): got %q, wanted error", rsp)
-		} else if ec := code.FromError(err); ec != notAuthorized {
-			t.Errorf("Call(Test): got code %v, want %v", ec, notAuthorized)
+
+		info, err := jrpc2.RPCServerInfo(ctx, cli)
+		if err != nil {
+			t.Fatalf("RPCServerInfo failed: %v", err)
+		} else if n := info.Counter["rpc.compressedResults"]; n != 2 {
+			t.Errorf("rpc.compressedResults: got %d, want 2", n)
 		}
 	})
-}
 
-// Verify that calling a wrapped method which takes no parameters, but in which
-// the caller provided parameters, will correctly report an error.
-func TestNoParams(t *testing.T) {
-	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
-	defer loc.Close()
+	// A client may be shared, so only RPCHello can select an encoding.
+	t.Run("HelloReserved", func(t *testing.T) {
+		cli, rc, stop := connect(t, &jrpc2.ServerOptions{Codecs: gzip, CompressMin: 100}, nil)
+		defer stop()
 
-	var rsp string
-	if err := loc.Client.CallResult(context.Background(), "Test", []int{1, 2, 3}, &rsp); err == nil {
-		t.Errorf("Call(Test): got %q, wanted error", rsp)
-	} else if ec := code.FromError(err); ec != code.InvalidParams {
-		t.Errorf("Call(Test): got code %v, wanted %v", ec, code.InvalidParams)
+		hello := handler.Obj{"encodings": []string{"gzip"}}
+		if rsp, err := cli.Call(ctx, "rpc.hello", hello); err == nil {
+			t.Errorf("Call rpc.hello: got %v, want error", rsp)
+		}
+		if rsps, err := cli.Batch(ctx, []jrpc2.Spec{{Method: "rpc.hello", Params: hello}}); err == nil {
+			t.Errorf("Batch rpc.hello: got %v, want error", rsps)
+		}
+		if err := cli.Notify(ctx, "rpc.hello", hello); err == nil {
+			t.Error("Notify rpc.hello: got nil, want error")
+		}
+		echo(t, cli, big)
+		if n := countEncoded(rc.take()); n != 0 {
+			t.Errorf("Got %d compressed results, want 0", n)
+		}
+	})
+
+	// Without a codec in common, RPCHello succeeds but selects none, and the
+	// peers communicate without compression.
+	tests := []struct {
+		name  string
+		sopts *jrpc2.ServerOptions
+		copts *jrpc2.ClientOptions
+	}{
+		{"ServerNoCodecs", nil, &jrpc2.ClientOptions{Codecs: gzip}},
+		{"ServerNoBuiltin", &jrpc2.ServerOptions{Codecs: gzip, DisableBuiltin: true},
+			&jrpc2.ClientOptions{Codecs: gzip}},
+		{"ClientNoCodecs", &jrpc2.ServerOptions{Codecs: gzip}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, rc, stop := connect(t, test.sopts, test.copts)
+			defer stop()
+			if enc, err := jrpc2.RPCHello(ctx, cli); err != nil || enc != "" {
+				t.Errorf("RPCHello: got (%q, %v), want none", enc, err)
+			}
+			echo(t, cli, big)
+			if n := countEncoded(rc.take()); n != 0 {
+				t.Errorf("Got %d compressed results, want 0", n)
+			}
+		})
 	}
 }
 
-// Verify that the rpc.serverInfo handler and client wrapper work together.
-func TestRPCServerInfo(t *testing.T) {
-	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
-	defer loc.Close()
+// Verify that requests exceeding the slow request threshold are reported
+// while in flight, and logged and counted when they complete.
+func TestSlowRequests(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	running := make(chan struct{})
+	release := make(chan struct{})
 
-	si, err := jrpc2.RPCServerInfo(context.Background(), loc.Client)
-	if err != nil {
-		t.Errorf("RPCServerInfo failed: %v", err)
+	var logBuf bytes.Buffer
+	var logMu sync.Mutex
+	cpipe, spipe := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Slow": handler.New(func(ctx context.Context, _ []int) error {
+			close(running)
+			<-release
+			return nil
+		}),
+		"Fast": handler.New(func(ctx context.Context) error { return nil }),
+	}, &jrpc2.ServerOptions{
+		Clock:                clock,
+		Logger:               log.New(lockedWriter{&logMu, &logBuf}, "", 0),
+		SlowRequestThreshold: time.Second,
+	}).Start(spipe)
+	defer srv.Stop()
+	cli := jrpc2.NewClient(cpipe, nil)
+	defer cli.Close()
+
+	ctx := context.Background()
+	if _, err := cli.Call(ctx, "Fast", nil); err != nil {
+		t.Fatalf("Call Fast: unexpected error: %v", err)
 	}
-	{
-		got, want := si.Methods, []string{"Test"}
-		if diff := cmp.Diff(want, got); diff != "" {
-			t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
-		}
+
+	errc := make(chan error, 1)
+	go func() { _, err := cli.Call(ctx, "Slow", []int{1, 2, 3}); errc <- err }()
+	select {
+	case <-running:
+	case err := <-errc:
+		t.Fatalf("Call Slow: unexpected error: %v", err)
 	}
-}
 
-func TestNetwork(t *testing.T) {
-	tests := []struct {
-		input, want string
-	}{
-		{"", "unix"},
-		{":", "unix"},
+	// The request has not yet exceeded the threshold.
+	if slow := srv.ServerInfo().SlowRequests; len(slow) != 0 {
+		t.Errorf("ServerInfo: got slow requests %+v, want none", slow)
+	}
 
-		{"nothing", "unix"},        // no colon
-		{"like/a/file", "unix"},    // no colon
-		{"no-port:", "unix"},       // empty port
-		{"file/with:port", "unix"}, // slashes in host
-		{"path/with:404", "unix"},  // slashes in host
-		{"mangled:@3", "unix"},     // non-alphanumerics in port
+	clock.Advance(3 * time.Second)
+	slow := srv.ServerInfo().SlowRequests
+	if len(slow) != 1 {
+		t.Fatalf("ServerInfo: got slow requests %+v, want 1", slow)
+	} else if s := slow[0]; s.Method != "Slow" || string(s.ID) != "2" || s.Elapsed != 3*time.Second {
+		t.Errorf("ServerInfo: got slow request %+v, want Slow id 2 elapsed 3s", s)
+	}
 
-		{":80", "tcp"},            // numeric port
-		{":dumb-crud", "tcp"},     // service name
-		{"localhost:80", "tcp"},   // host and numeric port
-		{"localhost:http", "tcp"}, // host and service name
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("Call Slow: unexpected error: %v", err)
 	}
-	for _, test := range tests {
-		got := jrpc2.Network(test.input)
-		if got != test.want {
-			t.Errorf("Network(%q): got %q, want %q", test.input, got, test.want)
+	info := srv.ServerInfo()
+	if slow := info.SlowRequests; len(slow) != 0 {
+		t.Errorf("ServerInfo: got slow requests %+v after completion, want none", slow)
+	}
+	for _, name := range []string{"rpc.slowRequests", "rpc.slowRequests.Slow"} {
+		if got := info.Counter[name]; got != 1 {
+			t.Errorf("Counter %q: got %d, want 1", name, got)
 		}
 	}
+	if got := info.Counter["rpc.slowRequests.Fast"]; got != 0 {
+		t.Errorf("Counter for Fast: got %d, want 0", got)
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	const want = `Slow request for "Slow" (id 2): 3s elapsed, 7 bytes of params`
+	if !strings.Contains(logBuf.String(), want) {
+		t.Errorf("Log does not contain %#q:\n%s", want, logBuf.String())
+	}
 }
 
-// Verify that the context passed to an assigner has the correct structure.
-func TestAssignContext(t *testing.T) {
-	loc := server.NewLocal(assignFunc(func(ctx context.Context, method string) jrpc2.Handler {
-		req := jrpc2.InboundRequest(ctx)
-		if req == nil {
-			t.Errorf("No inbound request for assignment of %q", method)
-		} else if req.Method() != method {
-			t.Errorf("Assign inbound: got %q, want %q", req.Method(), method)
-		} else {
-			t.Logf("Inbound request id=%v method=%q OK", req.ID(), req.Method())
-		}
-		return testOK
-	}), nil)
+func TestCorrelationID(t *testing.T) {
+	var logBuf bytes.Buffer
+	var logMu sync.Mutex
+	loc := server.NewLocal(handler.Map{
+		"ID": handler.New(func(ctx context.Context) string {
+			return jrpc2.CorrelationID(ctx)
+		}),
+		"Fail": handler.New(func(ctx context.Context) error {
+			return errors.New("failed")
+		}),
+		"Data": handler.New(func(ctx context.Context) error {
+			return jrpc2.DataErrorf(code.SystemError, "details", "failed")
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Logger:          log.New(lockedWriter{&logMu, &logBuf}, "", 0),
+			CorrelateErrors: true,
+		},
+	})
 	defer loc.Close()
-
 	ctx := context.Background()
-	var got string
-	if err := loc.Client.CallResult(ctx, "NerbleFleeger", nil, &got); err != nil {
-		t.Errorf("CallResult unexpectedly failed: %v", err)
-	} else if got != "OK" {
-		t.Errorf("CallResult: got %q, want %q", got, "OK")
-	}
-}
 
-type assignFunc func(context.Context, string) jrpc2.Handler
+	// Each request gets a distinct correlation ID.
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		var id string
+		if err := loc.Client.CallResult(ctx, "ID", nil, &id); err != nil {
+			t.Fatalf("Call ID: unexpected error: %v", err)
+		} else if id == "" || seen[id] {
+			t.Errorf("Call ID: got %q, want a new non-empty ID", id)
+		}
+		seen[id] = true
+	}
 
-func (a assignFunc) Assign(ctx context.Context, m string) jrpc2.Handler { return a(ctx, m) }
-func (assignFunc) Names() []string                                      { return nil }
+	// A failed request reports its correlation ID as error data, and the ID
+	// appears in the server log.
+	_, err := loc.Client.Call(ctx, "Fail", nil)
+	e, ok := err.(*jrpc2.Error)
+	if !ok {
+		t.Fatalf("Call Fail: got %v, want *jrpc2.Error", err)
+	}
+	var data struct {
+		ID string `json:"correlationId"`
+	}
+	if err := e.UnmarshalData(&data); err != nil {
+		t.Fatalf("Error data: %v", err)
+	} else if data.ID == "" || seen[data.ID] {
+		t.Errorf("Error correlation ID: got %q, want a new non-empty ID", data.ID)
+	}
+	logMu.Lock()
+	if log := logBuf.String(); !strings.Contains(log, "["+data.ID+"]") {
+		t.Errorf("Server log does not mention ID %q:\n%s", data.ID, log)
+	}
+	logMu.Unlock()
 
-func TestWaitStatus(t *testing.T) {
-	check := func(t *testing.T, stat jrpc2.ServerStatus, closed, stopped bool, wantErr error) {
-		t.Helper()
-		t.Logf("Server status: %+v", stat)
-		if got, want := stat.Success(), wantErr == nil; got != want {
-			t.Errorf("Status success: got %v, want %v", got, want)
-		}
-		if got := stat.Closed(); got != closed {
-			t.Errorf("Status closed: got %v, want %v", got, closed)
-		}
-		if got := stat.Stopped(); got != stopped {
-			t.Errorf("Status stopped: got %v, want %v", got, stopped)
-		}
-		if stat.Err != wantErr {
-			t.Errorf("Status error: got %v, want %v", stat.Err, wantErr)
+	// Error data reported by the handler are not replaced.
+	_, err = loc.Client.Call(ctx, "Data", nil)
+	if e, ok := err.(*jrpc2.Error); !ok {
+		t.Errorf("Call Data: got %v, want *jrpc2.Error", err)
+	} else {
+		var detail string
+		if err := e.UnmarshalData(&detail); err != nil || detail != "details" {
+			t.Errorf("Call Data: got error data %q, %v; want details", detail, err)
 		}
 	}
-	t.Run("ChannelClosed", func(t *testing.T) {
-		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
-		loc.Client.Close()
-		check(t, loc.Server.WaitStatus(), true, false, nil)
-	})
-
-	t.Run("ServerStopped", func(t *testing.T) {
-		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
-		loc.Server.Stop()
-		check(t, loc.Server.WaitStatus(), false, true, nil)
-	})
+}
 
-	t.Run("ChannelFailed", func(t *testing.T) {
-		wantErr := errors.New("failed")
-		ch := buggyChannel{data: "bogus", err: wantErr}
-		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(ch)
-		check(t, srv.WaitStatus(), false, false, wantErr)
-	})
+// lockedWriter is an io.Writer that serializes writes to w.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
 }
 
-type buggyChannel struct {
-	data string
-	err  error
+func (w lockedWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(data)
 }
 
-func (buggyChannel) Send([]byte) error       { panic("should not be called") }
-func (b buggyChannel) Recv() ([]byte, error) { return []byte(b.data), b.err }
-func (buggyChannel) Close() error            { return nil }
+func TestSampler(t *testing.T) {
+	var buf bytes.Buffer
+	logSample := jrpc2.SampleLog(&buf)
+	done := make(chan string, 10)
+	loc := server.NewLocal(handler.Map{
+		"Echo":  handler.New(func(_ context.Context, ss []string) string { return strings.Join(ss, "") }),
+		"Fail":  handler.New(func(context.Context) error { return errors.New("oops") }),
+		"Other": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Sampler: &jrpc2.Sampler{
+				Select: func(req *jrpc2.Request) bool { return req.Method() != "Other" },
+				Sink: func(req *jrpc2.Request, result json.RawMessage, err error, elapsed time.Duration) {
+					logSample(req, result, err, elapsed)
+					done <- req.Method()
+				},
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
 
-func TestStrictFields(t *testing.T) {
-	type other struct {
-		C bool `json:"charlie"`
+	loc.Client.Call(ctx, "Echo", []string{"a", "b"})
+	loc.Client.Call(ctx, "Other", nil)
+	loc.Client.Call(ctx, "Fail", nil)
+	loc.Client.Call(ctx, "Nonesuch", nil)
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, <-done)
 	}
-	type params struct {
-		A string `json:"alpha"`
-		B int    `json:"bravo"`
-		other
+	if diff := cmp.Diff([]string{"Echo", "Fail", "Nonesuch"}, got); diff != "" {
+		t.Errorf("Sampled methods (-want, +got):\n%s", diff)
 	}
-	type result struct {
-		X string `json:"xray"`
+
+	type record struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Result json.RawMessage `json:"result"`
+		Error  *jrpc2.Error    `json:"error"`
 	}
-	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-			var ps, qs params
+	var recs []record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Decoding sample: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("Got %d samples, want 3", len(recs))
+	}
+	if r := recs[0]; string(r.Params) != `["a","b"]` || string(r.Result) != `"ab"` || r.Error != nil {
+		t.Errorf("Echo sample: got %+v", r)
+	}
+	if r := recs[1]; r.Error == nil || r.Error.Message() != "oops" || r.Result != nil {
+		t.Errorf("Fail sample: got %+v", r)
+	}
+	if r := recs[2]; r.Error == nil || r.Error.Code() != code.MethodNotFound {
+		t.Errorf("Nonesuch sample: got %+v", r)
+	}
+	if n := loc.Server.ServerInfo().Counter["rpc.samples"]; n != 3 {
+		t.Errorf("Sample count: got %d, want 3", n)
+	}
+}
 
-			if err := req.UnmarshalParams(jrpc2.StrictFields(&ps)); err == nil {
-				t.Errorf("Unmarshal strict: got %+v, want error", ps)
-			}
+func TestSamplerDrops(t *testing.T) {
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{"X": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Sampler: &jrpc2.Sampler{
+				Select:     jrpc2.SampleRate(1),
+				Sink:       func(*jrpc2.Request, json.RawMessage, error, time.Duration) { <-release },
+				BufferSize: 1,
+			},
+		},
+	})
+	defer loc.Close()
 
-			if err := req.UnmarshalParams(&qs); err != nil {
-				t.Errorf("Unmarshal non-strict (default): unexpected error: %v", err)
-			} else {
-				t.Logf("Parameters OK: %+v", qs)
-			}
+	// The sink is stuck, so once its buffer is full, further samples are
+	// dropped rather than delaying the calls.
+	for i := 0; i < 4; i++ {
+		if _, err := loc.Client.Call(context.Background(), "X", nil); err != nil {
+			t.Errorf("Call %d: unexpected error: %v", i+1, err)
+		}
+	}
+	close(release)
 
-			return map[string]string{
-				"xray":  "ok",
-				"gamma": "not ok",
-			}, nil
+	info := loc.Server.ServerInfo()
+	kept, dropped := info.Counter["rpc.samples"], info.Counter["rpc.samplesDropped"]
+	if kept+dropped != 4 || dropped < 2 {
+		t.Errorf("Samples: got %d kept, %d dropped; want 4 total with at least 2 dropped", kept, dropped)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	var calls int32
+	mux := handler.Map{
+		"Work": handler.New(func(context.Context) string {
+			atomic.AddInt32(&calls, 1)
+			return "ok"
 		}),
-	}, nil)
+		"Other": handler.New(func(context.Context) string { return "ok" }),
+	}
+	overloaded := code.Register(-32001, "server overloaded")
+	policy := jrpc2.NewFaultPolicy()
+	loc := server.NewLocal(mux, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Faults: policy},
+	})
 	defer loc.Close()
-
 	ctx := context.Background()
-	rsp, err := loc.Client.Call(ctx, "Test", handler.Obj{
-		"alpha":   "foo",
-		"bravo":   25,
-		"charlie": true, // exercise embedding
-		"delta":   31.5, // unknown field
+
+	t.Run("Error", func(t *testing.T) {
+		policy.SetRules(jrpc2.FaultRule{
+			Method:      "W*",
+			Probability: 1,
+			Fault:       jrpc2.Fault{Kind: jrpc2.FaultError, Code: overloaded},
+		})
+		before := atomic.LoadInt32(&calls)
+		if _, err := loc.Client.Call(ctx, "Work", nil); code.FromError(err) != overloaded {
+			t.Errorf("Call Work: got %v, want code %v", err, overloaded)
+		}
+		if n := atomic.LoadInt32(&calls); n != before {
+			t.Errorf("Handler ran %d times, want 0", n-before)
+		}
+		if _, err := loc.Client.Call(ctx, "Other", nil); err != nil {
+			t.Errorf("Call Other: unexpected error: %v", err)
+		}
 	})
-	if err != nil {
-		t.Fatalf("Call failed: %v", err)
-	}
 
-	t.Run("NonStrictResult", func(t *testing.T) {
-		var res result
-		if err := rsp.UnmarshalResult(&res); err != nil {
-			t.Errorf("UnmarshalResult: %v", err)
+	t.Run("Delay", func(t *testing.T) {
+		const delay = 20 * time.Millisecond
+		policy.SetRules(jrpc2.FaultRule{
+			Probability: 1,
+			Fault:       jrpc2.Fault{Kind: jrpc2.FaultDelay, Delay: delay, Jitter: delay},
+		})
+		start := time.Now()
+		if _, err := loc.Client.Call(ctx, "Other", nil); err != nil {
+			t.Errorf("Call Other: unexpected error: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Errorf("Call Other: took %v, want at least %v", elapsed, delay)
 		}
-		t.Logf("Result: %+v", res)
 	})
 
-	t.Run("StrictResult", func(t *testing.T) {
-		var res result
-		if err := rsp.UnmarshalResult(jrpc2.StrictFields(&res)); err == nil {
-			t.Errorf("UnmarshalResult: got %+v, want error", res)
-		} else {
-			t.Logf("UnmarshalResult: got expected error: %v", err)
+	t.Run("Drop", func(t *testing.T) {
+		policy.SetRules(jrpc2.FaultRule{
+			Method:      "Work",
+			Probability: 1,
+			Fault:       jrpc2.Fault{Kind: jrpc2.FaultDrop},
+		})
+		before := atomic.LoadInt32(&calls)
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if rsp, err := loc.Client.Call(tctx, "Work", nil); err != context.DeadlineExceeded {
+			t.Errorf("Call Work: got (%v, %v), want %v", rsp, err, context.DeadlineExceeded)
 		}
+		if n := atomic.LoadInt32(&calls); n != before+1 {
+			t.Errorf("Handler ran %d times, want 1", n-before)
+		}
+	})
+
+	// With no rules, nothing is injected.
+	policy.SetRules()
+	if _, err := loc.Client.Call(ctx, "Work", nil); err != nil {
+		t.Errorf("Call Work: unexpected error: %v", err)
+	}
+
+	info := loc.Server.ServerInfo()
+	for _, kind := range []string{"error", "delay", "drop"} {
+		if n := info.Counter["rpc.faultsInjected."+kind]; n != 1 {
+			t.Errorf("Injected %s faults: got %d, want 1", kind, n)
+		}
+	}
+	if n := info.Counter["rpc.faultsInjected"]; n != 3 {
+		t.Errorf("Injected faults: got %d, want 3", n)
+	}
+}
+
+func TestFaultDisconnect(t *testing.T) {
+	loc := server.NewLocal(handler.Map{"X": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Faults: jrpc2.NewFaultPolicy(jrpc2.FaultRule{
+				Probability: 1,
+				Fault:       jrpc2.Fault{Kind: jrpc2.FaultDisconnect},
+			}),
+		},
 	})
+	if _, err := loc.Client.Call(context.Background(), "X", nil); err == nil {
+		t.Error("Call X: got nil error, want connection failure")
+	}
+	if err := loc.Server.Wait(); err == nil {
+		t.Error("Server Wait: got nil error, want injected fault")
+	} else {
+		t.Logf("Server Wait: got expected error: %v", err)
+	}
+	loc.Client.Close()
 }
@@ -0,0 +1,66 @@
+package jrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// A JSONCodec encodes and decodes the parameters and results of calls, in
+// place of the encoding/json package. The request and response messages that
+// carry them are always parsed and encoded by the jrpc2 package itself, so a
+// JSONCodec affects only the values exchanged with handlers and callers.
+// A JSONCodec must be safe for concurrent use by multiple goroutines.
+//
+// A JSONCodec must behave like encoding/json for the values it is given,
+// including values that implement json.Marshaler or json.Unmarshaler, and
+// values of type json.RawMessage, which are copied verbatim. The
+// conformance.CheckCodec function reports departures from this behaviour.
+type JSONCodec interface {
+	// Marshal returns the JSON encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the JSON value in data into v, which must be a
+	// non-nil pointer, according to opts.
+	Unmarshal(data []byte, v interface{}, opts DecodeOptions) error
+}
+
+// DecodeOptions are the settings for a call to the Unmarshal method of a
+// JSONCodec.
+type DecodeOptions struct {
+	// If true, numbers decoded into interface values must have type
+	// json.Number rather than float64.
+	UseNumber bool
+
+	// If true, object keys that do not match a field of the struct they are
+	// decoded into must be reported as an error.
+	DisallowUnknownFields bool
+}
+
+// StdJSON is the default JSONCodec, which uses the encoding/json package.
+var StdJSON JSONCodec = stdJSON{}
+
+type stdJSON struct{}
+
+func (stdJSON) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (stdJSON) Unmarshal(data []byte, v interface{}, opts DecodeOptions) error {
+	if !opts.UseNumber && !opts.DisallowUnknownFields {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// orStdJSON returns c if it is not nil, and otherwise StdJSON.
+func orStdJSON(c JSONCodec) JSONCodec {
+	if c == nil {
+		return StdJSON
+	}
+	return c
+}
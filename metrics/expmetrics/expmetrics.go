@@ -0,0 +1,82 @@
+// Package expmetrics publishes the metrics reported by a jrpc2 client as
+// expvar variables.
+//
+// Set the Metrics field of a jrpc2.ClientOptions to a *Client to use it:
+//
+//	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+//	   Metrics: expmetrics.NewClient("rpcclient"),
+//	})
+//
+// The metrics are then served with the other expvar variables, for example by
+// the "/debug/vars" HTTP handler.
+package expmetrics
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// A Client implements the jrpc2.ClientMetrics interface by publishing the
+// metrics it receives as an expvar.Map. The map has the following entries,
+// each of which is itself a map:
+//
+//	calls                  -- the number of calls completed, by method
+//	callErrors             -- the number of calls that failed, by method
+//	callMicros             -- the total latency of calls in µs, by method
+//	errorCodes             -- the number of calls that failed, by error code
+//	notificationsSent      -- the number of notifications sent, by method
+//	notificationsReceived  -- the number of notifications received, by method
+//
+// A Client may be shared by multiple clients, whose metrics are combined.
+type Client struct {
+	calls      *expvar.Map
+	callErrors *expvar.Map
+	callMicros *expvar.Map
+	errorCodes *expvar.Map
+	notesSent  *expvar.Map
+	notesRecv  *expvar.Map
+}
+
+// NewClient returns a new Client that publishes its metrics as an expvar.Map
+// with the given name. As with expvar.NewMap, it panics if name is already in
+// use by another variable.
+func NewClient(name string) *Client {
+	c := &Client{
+		calls:      new(expvar.Map).Init(),
+		callErrors: new(expvar.Map).Init(),
+		callMicros: new(expvar.Map).Init(),
+		errorCodes: new(expvar.Map).Init(),
+		notesSent:  new(expvar.Map).Init(),
+		notesRecv:  new(expvar.Map).Init(),
+	}
+	root := expvar.NewMap(name)
+	root.Set("calls", c.calls)
+	root.Set("callErrors", c.callErrors)
+	root.Set("callMicros", c.callMicros)
+	root.Set("errorCodes", c.errorCodes)
+	root.Set("notificationsSent", c.notesSent)
+	root.Set("notificationsReceived", c.notesRecv)
+	return c
+}
+
+// CallDone records a completed call. It implements part of the
+// jrpc2.ClientMetrics interface.
+func (c *Client) CallDone(method string, elapsed time.Duration, ec code.Code) {
+	c.calls.Add(method, 1)
+	c.callMicros.Add(method, int64(elapsed/time.Microsecond))
+	if ec != code.NoError {
+		c.callErrors.Add(method, 1)
+		c.errorCodes.Add(strconv.Itoa(int(ec)), 1)
+	}
+}
+
+// NotificationSent records a notification sent to the server. It implements
+// part of the jrpc2.ClientMetrics interface.
+func (c *Client) NotificationSent(method string) { c.notesSent.Add(method, 1) }
+
+// NotificationReceived records a notification received from the server. It
+// implements part of the jrpc2.ClientMetrics interface.
+func (c *Client) NotificationReceived(method string) { c.notesRecv.Add(method, 1) }
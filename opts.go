@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/creachadair/jrpc2/channel"
 	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/metrics"
+	"golang.org/x/sync/semaphore"
 )
 
 // ServerOptions control the behaviour of a server created by NewServer.
@@ -23,7 +26,9 @@ type ServerOptions struct {
 	RPCLog RPCLogger
 
 	// Instructs the server to tolerate requests that do not include the
-	// required "jsonrpc" version marker.
+	// required "jsonrpc" version marker. The server replies to such a request
+	// in the JSON-RPC 1.0 format: The response has no version marker, and has
+	// both a result and an error, one of which is null.
 	AllowV1 bool
 
 	// Instructs the server to allow server callbacks and notifications, a
@@ -47,7 +52,9 @@ type ServerOptions struct {
 	// parameters received from the client, before they are delivered to the
 	// handler. Its return value replaces the context and argument values. This
 	// allows the server to decode context metadata sent by the client.
-	// If unset, ctx and params are used as given.
+	// If unset, ctx and params are used as given. If it reports an error, the
+	// request fails without invoking the handler: An error of type *Error is
+	// reported as given, and any other error with code.InvalidParams.
 	DecodeContext func(context.Context, string, json.RawMessage) (context.Context, json.RawMessage, error)
 
 	// If set, this function is called with the context and the client request
@@ -55,6 +62,31 @@ type ServerOptions struct {
 	// the request fails with that error without invoking the handler.
 	CheckRequest func(ctx context.Context, req *Request) error
 
+	// If set, this function is called to authorize each request, after its
+	// context is decoded (see DecodeContext) and checked (see CheckRequest),
+	// and before its handler is assigned. It is given the decoded context,
+	// the method name, and the decoded parameters. The context carries any
+	// credentials the context decoder recovered from the request; for
+	// example, the Authorize method of a jctx.Verifier checks the token
+	// attached by jctx.EncodeAuth. If Authorize succeeds, it may return a
+	// context derived from ctx, for example one that records who made the
+	// request (see jctx.Principal), which is passed to the handler in place
+	// of ctx; if it returns a nil context, ctx is used unchanged. If
+	// Authorize reports an error, a call fails with code.Unauthorized (or
+	// code.Replayed, if the error has that code) without invoking the
+	// handler, and a notification is discarded. Like CheckRequest, it is
+	// called while the server is assigning handlers, so it must not call back
+	// into the server.
+	Authorize func(ctx context.Context, method string, params []byte) (context.Context, error)
+
+	// If set, these interceptors are applied around the handler for each
+	// request, after CheckRequest. The first interceptor is outermost, so it
+	// is called first, and its next function calls the second, and so on,
+	// until the last interceptor's next function calls the handler. A call to
+	// a method that does not exist is passed to the interceptors as usual,
+	// and its handler reports code.MethodNotFound.
+	Interceptors []Interceptor
+
 	// If set, use this value to record server metrics. All servers created
 	// from the same options will share the same metrics collector.  If none is
 	// set, an empty collector will be created for each new server.
@@ -63,6 +95,204 @@ type ServerOptions struct {
 	// If nonzero this value as the server start time; otherwise, use the
 	// current time when Start is called.
 	StartTime time.Time
+
+	// If set, the server uses this clock to read the current time and to
+	// measure elapsed time. If unset, the server uses the system clock. This
+	// is mainly useful in tests, to control the passage of time.
+	Clock Clock
+
+	// If true, the server reports the correlation ID of a failed request in
+	// its error response, as error data of the form {"correlationId": id},
+	// unless the error already has other data. The ID allows a user-reported
+	// error to be matched with the server logs. See CorrelationID.
+	CorrelateErrors bool
+
+	// If set, the server captures a sample of the requests it handles, as
+	// described by the Sampler. If nil, no requests are sampled.
+	Sampler *Sampler
+
+	// If set, the server injects faults into the handling of requests as
+	// described by the policy. This is meant for testing how clients handle
+	// a misbehaving server. If nil, no faults are injected.
+	Faults *FaultPolicy
+
+	// If true, the server rejects a request object that has members other
+	// than those defined by the JSON-RPC 2.0 specification ("jsonrpc", "id",
+	// "method", and "params") with an InvalidRequest error naming the extra
+	// members. By default, extra members are ignored, for compatibility with
+	// peers that attach vendor extensions. The elements of a batch are
+	// checked individually.
+	StrictSpec bool
+
+	// If true, the server sends the responses to requests in the order the
+	// requests arrived, even when their handlers run concurrently: A response
+	// that is ready is held until the responses to all the messages received
+	// before it have been sent. By default, each response is sent as soon as
+	// it is ready. Replies to messages that cannot be parsed are not ordered.
+	StrictOrder bool
+
+	// If true, the error reported for a handler that panics includes the stack
+	// trace of the panic as its data. By default, the error reports only that
+	// the handler panicked, and the stack trace is written to the log. This
+	// is meant for debugging, since the trace may expose server internals.
+	PanicStack bool
+
+	// If set, this function is called to create a new base context for each
+	// batch of requests received. If unset, the server uses the context passed
+	// to StartContext, or a background context if the server was started with
+	// Start. The contexts passed to handlers are derived from this value.
+	NewContext func() context.Context
+
+	// Instructs the server to retain the original encoding of each request
+	// message, so that handlers can retrieve it with jrpc2.RawRequest. This
+	// is useful for verifying signatures over the exact request bytes.  By
+	// default the original encoding is discarded after parsing.
+	RetainRawRequest bool
+
+	// If set, this function is called before the server invokes the handler
+	// for a deprecated method (see DeprecatedHandler), with the context and
+	// request that will be passed to the handler and the deprecation note.
+	// This allows the owner of a method to find its remaining callers.
+	OnDeprecatedCall func(ctx context.Context, req *Request, note string)
+
+	// Instructs the server to reject calls to deprecated methods with error
+	// code.Deprecated instead of invoking their handlers.
+	RejectDeprecated bool
+
+	// If positive, the maximum size in bytes of the encoded result of a call.
+	// If a handler returns a result whose JSON encoding is larger than this,
+	// the result is discarded and the call fails with code.ResultTooLarge.
+	// The error data is a ResultSizeError describing the result.
+	MaxResultSize int
+
+	// If positive, the maximum number of requests in a batch. A batch with
+	// more requests is rejected as a whole with code.LimitExceeded before any
+	// of its requests is handled. The error data is a LimitError.
+	MaxBatchSize int
+
+	// If positive, the maximum size in bytes of a message received from the
+	// client. A larger message is discarded without being parsed, and the
+	// server reports code.LimitExceeded with a null ID, since the ID of the
+	// request is not known. The error data is a LimitError. The server
+	// continues to serve the connection.
+	//
+	// The limit is checked once the channel has received the whole message,
+	// so it bounds the work the server does, but not the memory the channel
+	// uses to receive the message. An unframed channel such as channel.RawJSON
+	// must decode the message to find its end, so if an oversized message is
+	// also malformed, the channel fails and the server stops as usual.
+	MaxRequestSize int
+
+	// If positive, the maximum number of request batches the server holds at
+	// once, counting those waiting to be handled and those whose handlers are
+	// running. While the server holds this many, it sheds further load: Each
+	// call in a new batch fails at once with code.Overloaded, and each
+	// notification is discarded, without queueing the batch. A single request
+	// counts as a batch. If MaxQueuedBatches is zero, the reader instead waits
+	// for the server to catch up before it receives more messages.
+	MaxQueuedBatches int
+
+	// Instructs the server to trust that results of type RawResult returned by
+	// handlers are valid JSON without line breaks, and to copy them into
+	// responses without checking. By default such results are checked for
+	// validity, and compacted if they span multiple lines.
+	TrustRawResults bool
+
+	// Instructs the server to decode JSON numbers in request parameters as
+	// json.Number rather than float64, when a handler unmarshals them into
+	// interface values. By default, such numbers are decoded as float64, as
+	// with json.Unmarshal. Request IDs are not affected, and are always
+	// preserved exactly. Types with their own UnmarshalJSON method, such as
+	// handler.Args and handler.Obj, are not affected either.
+	UseNumber bool
+
+	// If set, the server uses this codec to decode request parameters and to
+	// encode results and the parameters of server pushes, in place of the
+	// encoding/json package. If nil, it uses StdJSON.
+	JSONCodec JSONCodec
+
+	// If set, this function is called with each notification that fails,
+	// either because it was rejected by the server (for example, if its
+	// method is not known), or because its handler reported an error. Since
+	// the server does not reply to notifications, this lets the application
+	// observe failures that would otherwise be silently discarded. This
+	// function may be called concurrently for notifications in a batch.
+	OnNotificationError func(*Request, error)
+
+	// If positive, the server stops if this many consecutive notifications
+	// fail. This acts as a circuit breaker against a misconfigured client
+	// whose notifications are all being discarded. The error reported by
+	// Wait describes the last failure.
+	MaxNotificationFailures int
+
+	// If positive, the server logs each request whose handler takes longer
+	// than this to complete, with its method, ID, correlation ID, elapsed
+	// time, and the size of its parameters. Slow requests are counted in the
+	// "rpc.slowRequests" metric, and requests still in flight that have
+	// exceeded the threshold are listed in the SlowRequests field of the
+	// ServerInfo. If zero, slow requests are not tracked.
+	SlowRequestThreshold time.Duration
+
+	// If true, the time compared to SlowRequestThreshold includes the time
+	// a request spent waiting to be handled after it was received, not only
+	// the time taken by its handler.
+	SlowRequestQueue bool
+
+	// If positive, the context passed to each handler ends this long after
+	// the server dispatches the request, including any time spent waiting for
+	// the concurrency limit, with error context.DeadlineExceeded. A call whose
+	// handler reports that error fails with code.DeadlineExceeded. Handlers
+	// that do not observe their context are not interrupted. The time is
+	// measured by the server's Clock.
+	RequestTimeout time.Duration
+
+	// If positive, the server stops if it receives no messages from the
+	// client for this long while it has no requests in flight. Requests in
+	// flight pause the timer, which restarts when the last of them is
+	// complete. A server stopped this way reports ErrIdleTimeout from Wait.
+	// The time is measured by the server's Clock.
+	IdleTimeout time.Duration
+
+	// If positive, the server limits the rate at which it accepts requests
+	// from the client to this many per second, with bursts of up to RateBurst
+	// requests. Each request in a batch counts separately. A call received
+	// in excess of the rate fails with code.RateLimited, and a notification is
+	// discarded. Time is measured by the server's Clock.
+	RateLimit float64
+
+	// The number of requests that may be accepted at once, when RateLimit is
+	// set. If RateBurst <= 0, it is 1.
+	RateBurst int
+
+	// If positive, a request received in excess of RateLimit is delayed until
+	// the rate permits it, if the delay needed is at most this long, rather
+	// than refused. While a request is delayed, the server does not receive
+	// further messages from the client.
+	RateWait time.Duration
+
+	// If positive, server pushes (see AllowPush) are queued for delivery to
+	// the client, up to this many at once, so that Notify and Callback do not
+	// wait for a client that is slow to read. When the queue is full, further
+	// pushes are handled according to PushOverflow. Responses to the client's
+	// requests are not queued, are never dropped, and are sent ahead of any
+	// queued pushes. If zero, pushes are sent before Notify or Callback
+	// returns, and the queue is not used.
+	PushQueueSize int
+
+	// The policy applied to a push when the push queue is full. The default
+	// is PushDropNewest. Dropped pushes are counted in "rpc.pushesDropped".
+	PushOverflow PushPolicy
+
+	// The codecs the server may use to compress results sent to a client.
+	// A client that shares one of them may select it by calling the built-in
+	// rpc.hello method (see RPCHello), after which results of at least
+	// CompressMin bytes are compressed. If empty, results are never
+	// compressed. Compressed results are counted in "rpc.compressedResults".
+	Codecs []Codec
+
+	// The size in bytes of the smallest result to compress, once the client
+	// has selected a codec. If zero, a default of 1024 is used.
+	CompressMin int
 }
 
 func (s *ServerOptions) logger() logger {
@@ -76,6 +306,124 @@ func (s *ServerOptions) logger() logger {
 func (s *ServerOptions) allowV1() bool      { return s != nil && s.AllowV1 }
 func (s *ServerOptions) allowPush() bool    { return s != nil && s.AllowPush }
 func (s *ServerOptions) allowBuiltin() bool { return s == nil || !s.DisableBuiltin }
+func (s *ServerOptions) retainRaw() bool    { return s != nil && s.RetainRawRequest }
+func (s *ServerOptions) rejectDep() bool    { return s != nil && s.RejectDeprecated }
+func (s *ServerOptions) trustRaw() bool     { return s != nil && s.TrustRawResults }
+func (s *ServerOptions) useNumber() bool    { return s != nil && s.UseNumber }
+func (s *ServerOptions) cidErrors() bool    { return s != nil && s.CorrelateErrors }
+func (s *ServerOptions) strictSpec() bool   { return s != nil && s.StrictSpec }
+func (s *ServerOptions) slowQueue() bool    { return s != nil && s.SlowRequestQueue }
+func (s *ServerOptions) panicStack() bool   { return s != nil && s.PanicStack }
+func (s *ServerOptions) strictOrder() bool  { return s != nil && s.StrictOrder }
+
+func (s *ServerOptions) jsonCodec() JSONCodec {
+	if s == nil {
+		return StdJSON
+	}
+	return orStdJSON(s.JSONCodec)
+}
+
+func (s *ServerOptions) pushQueue() (int, PushPolicy) {
+	if s == nil {
+		return 0, PushDropNewest
+	}
+	return s.PushQueueSize, s.PushOverflow
+}
+
+func (s *ServerOptions) compression() ([]Codec, int) {
+	if s == nil {
+		return nil, defaultCompressMin
+	} else if s.CompressMin <= 0 {
+		return s.Codecs, defaultCompressMin
+	}
+	return s.Codecs, s.CompressMin
+}
+
+func (s *ServerOptions) rateLimit() (float64, int, time.Duration) {
+	if s == nil {
+		return 0, 0, 0
+	}
+	return s.RateLimit, s.RateBurst, s.RateWait
+}
+
+func (s *ServerOptions) requestTimeout() time.Duration {
+	if s == nil || s.RequestTimeout < 0 {
+		return 0
+	}
+	return s.RequestTimeout
+}
+
+func (s *ServerOptions) idleTimeout() time.Duration {
+	if s == nil || s.IdleTimeout < 0 {
+		return 0
+	}
+	return s.IdleTimeout
+}
+
+func (s *ServerOptions) slowThreshold() time.Duration {
+	if s == nil || s.SlowRequestThreshold < 0 {
+		return 0
+	}
+	return s.SlowRequestThreshold
+}
+
+func (s *ServerOptions) sampler() *Sampler {
+	if s == nil {
+		return nil
+	}
+	return s.Sampler
+}
+
+func (s *ServerOptions) faultPolicy() *FaultPolicy {
+	if s == nil {
+		return nil
+	}
+	return s.Faults
+}
+
+type noteHook = func(*Request, error)
+
+func (s *ServerOptions) onNotificationError() noteHook {
+	if s == nil || s.OnNotificationError == nil {
+		return func(*Request, error) {}
+	}
+	return s.OnNotificationError
+}
+
+func (s *ServerOptions) maxNotificationFailures() int {
+	if s == nil || s.MaxNotificationFailures < 0 {
+		return 0
+	}
+	return s.MaxNotificationFailures
+}
+
+func (s *ServerOptions) maxRequestSize() int {
+	if s == nil || s.MaxRequestSize < 0 {
+		return 0
+	}
+	return s.MaxRequestSize
+}
+
+func (s *ServerOptions) maxQueuedBatches() int {
+	if s == nil || s.MaxQueuedBatches < 0 {
+		return 0
+	}
+	return s.MaxQueuedBatches
+}
+
+func (s *ServerOptions) maxBatchSize() int {
+	if s == nil || s.MaxBatchSize < 0 {
+		return 0
+	}
+	return s.MaxBatchSize
+}
+
+func (s *ServerOptions) maxResultSize() int {
+	if s == nil || s.MaxResultSize < 0 {
+		return 0
+	}
+	return s.MaxResultSize
+}
 
 func (s *ServerOptions) concurrency() int64 {
 	if s == nil || s.Concurrency < 1 {
@@ -91,6 +439,29 @@ func (s *ServerOptions) startTime() time.Time {
 	return s.StartTime
 }
 
+func (s *ServerOptions) clock() Clock {
+	if s == nil || s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+func (s *ServerOptions) newContext() func() context.Context {
+	if s == nil {
+		return nil
+	}
+	return s.NewContext
+}
+
+type depHook = func(context.Context, *Request, string)
+
+func (s *ServerOptions) onDeprecatedCall() depHook {
+	if s == nil || s.OnDeprecatedCall == nil {
+		return func(context.Context, *Request, string) {}
+	}
+	return s.OnDeprecatedCall
+}
+
 type decoder = func(context.Context, string, json.RawMessage) (context.Context, json.RawMessage, error)
 
 func (s *ServerOptions) decodeContext() (decoder, bool) {
@@ -104,6 +475,8 @@ func (s *ServerOptions) decodeContext() (decoder, bool) {
 
 type verifier = func(context.Context, *Request) error
 
+type authorizer = func(context.Context, string, []byte) (context.Context, error)
+
 func (s *ServerOptions) checkRequest() verifier {
 	if s == nil || s.CheckRequest == nil {
 		return func(context.Context, *Request) error { return nil }
@@ -111,6 +484,20 @@ func (s *ServerOptions) checkRequest() verifier {
 	return s.CheckRequest
 }
 
+func (s *ServerOptions) authorize() authorizer {
+	if s == nil {
+		return nil
+	}
+	return s.Authorize
+}
+
+func (s *ServerOptions) interceptors() []Interceptor {
+	if s == nil {
+		return nil
+	}
+	return s.Interceptors
+}
+
 func (s *ServerOptions) metrics() *metrics.M {
 	if s == nil || s.Metrics == nil {
 		return metrics.New()
@@ -139,6 +526,42 @@ type ClientOptions struct {
 	// when the context for an in-flight request terminates.
 	DisableCancel bool
 
+	// If positive, a call whose context has no deadline fails with
+	// context.DeadlineExceeded if its response does not arrive within this
+	// long after it is sent, as if its context had that deadline. This also
+	// applies to each call in a batch. A deadline set by the caller takes
+	// precedence. The time is measured by the client's Clock.
+	CallTimeout time.Duration
+
+	// If positive, at most this many calls may be pending at once, counting
+	// each call in a batch but not notifications. A call beyond the limit
+	// waits until a pending call completes, or until its context ends. If
+	// MaxPendingFailFast is true, such a call fails with ErrTooManyPending
+	// instead of waiting. A batch of more calls than the limit always fails
+	// with ErrTooManyPending.
+	MaxPending int
+
+	// If true, a call that would exceed MaxPending fails at once with
+	// ErrTooManyPending rather than waiting.
+	MaxPendingFailFast bool
+
+	// If positive, whenever the client has sent nothing to the server for
+	// this long, it calls KeepAliveMethod to check that the connection is
+	// alive. If the call fails, or does not complete within KeepAlive, the
+	// client closes the connection as if it had failed: Pending calls report
+	// ErrConnTerminated, and the client stops with an error reporting the
+	// failed check, unless it can redial (see Redial).
+	KeepAlive time.Duration
+
+	// The method the client calls to check its connection (see KeepAlive).
+	// If empty, it is "rpc.ping", which a server answers by default.
+	KeepAliveMethod string
+
+	// If set, the client uses this clock to measure CallTimeout, KeepAlive,
+	// and the delays between Redial attempts. If unset, the client uses the
+	// system clock.
+	Clock Clock
+
 	// If set, this function is called with the context, method name, and
 	// encoded request parameters before the request is sent to the server.
 	// Its return value replaces the request parameters. This allows the client
@@ -147,17 +570,44 @@ type ClientOptions struct {
 	EncodeContext func(context.Context, string, json.RawMessage) (json.RawMessage, error)
 
 	// If set, this function is called if a notification is received from the
-	// server. If unset, server notifications are logged and discarded.  At
-	// most one invocation of the callback will be active at a time.
+	// server, unless its method has a handler in NotifyHandlers. If unset,
+	// such notifications are logged and discarded.  At most one invocation of
+	// the callback will be active at a time.
 	// Server notifications are a non-standard extension of JSON-RPC.
 	OnNotify func(*Request)
 
-	// If set, this function is called if a request is received from the server.
-	// If unset, server requests are logged and discarded. At most one
-	// invocation of this callback will be active at a time.
+	// If set, server notifications are dispatched by method name to the
+	// functions in this map. A notification whose method is not in the map is
+	// passed to OnNotify, if it is set. Unlike OnNotify, these functions are
+	// called on other goroutines (see HandlerConcurrency), so that a slow
+	// handler does not delay the delivery of responses, and handlers for
+	// separate notifications may run concurrently and in any order. A handler may
+	// still be running after the client is closed.
+	NotifyHandlers map[string]func(*Request)
+
+	// If set, this function is called if a request is received from the
+	// server, unless its method has a handler in CallbackHandlers. If unset,
+	// the client replies to such requests with code.MethodNotFound. At most
+	// one invocation of this callback will be active at a time.
 	// Server callbacks are a non-standard extension of JSON-RPC.
 	OnCallback func(context.Context, *Request) (interface{}, error)
 
+	// If set, requests from the server are dispatched by method name to the
+	// functions in this map, and the client sends each result or error back
+	// to the server as the reply. A request whose method is not in the map is
+	// passed to OnCallback, if it is set. As for NotifyHandlers, these
+	// functions are called on other goroutines, so they may make calls of
+	// their own to the server through the client.
+	CallbackHandlers map[string]func(context.Context, *Request) (interface{}, error)
+
+	// The maximum number of NotifyHandlers and CallbackHandlers that may run
+	// concurrently. A value less than 1 uses runtime.NumCPU(). Requests that
+	// arrive while this many handlers are running are queued, and their
+	// handlers start in order of arrival as running handlers finish. The
+	// client does not start a goroutine for a request until its handler can
+	// run.
+	HandlerConcurrency int
+
 	// If set, this function is called when the context for a request terminates.
 	// The function receives the client and the response that was cancelled.
 	// The hook can obtain the ID and error value from rsp.
@@ -166,6 +616,100 @@ type ClientOptions struct {
 	// Note that the hook does not receive the client context, which has already
 	// ended by the time the hook is called.
 	OnCancel func(cli *Client, rsp *Response)
+
+	// If set, this function is called when the server announces that it is
+	// shutting down (see Server.AnnounceShutdown). The client can use the
+	// grace period to finish its work, and should expect the server to close
+	// the connection; the resulting error is not logged or reported by Close.
+	// The "rpc.shutdown" notification is handled by the client and is not
+	// passed to OnNotify. At most one invocation of the callback will be
+	// active at a time, and it must not block.
+	OnShutdown func(*ShutdownInfo)
+
+	// If set, the client calls this function to open a new channel to the
+	// server when its channel fails, rather than stopping. Calls in flight
+	// when the channel fails report ErrConnTerminated; calls made
+	// while the client is reconnecting wait until it has a new channel, or
+	// until their context ends. The context passed to Redial ends when the
+	// client is closed. If Redial reports an error, the client tries again
+	// after RedialDelay, doubling the delay after each failure up to
+	// RedialMaxDelay, and it stops with the error from the last attempt
+	// after RedialAttempts consecutive failures. If the server announced its
+	// shutdown before the channel failed (see OnShutdown), the client waits
+	// for the announced grace period, or RedialDelay if that is longer,
+	// before its first attempt.
+	Redial func(context.Context) (channel.Channel, error)
+
+	// The delay before the client retries a failed Redial. If RedialDelay
+	// <= 0, it is 100ms.
+	RedialDelay time.Duration
+
+	// The longest delay between Redial attempts. If RedialMaxDelay <= 0, it
+	// is 30s.
+	RedialMaxDelay time.Duration
+
+	// The number of consecutive failed Redial attempts after which the
+	// client stops. If RedialAttempts <= 0, the client retries until it is
+	// closed.
+	RedialAttempts int
+
+	// If set, this function is called with the error that caused the
+	// client's channel to fail, before the client begins to redial (see
+	// Redial). It must not block.
+	OnDisconnect func(error)
+
+	// If set, this function is called each time Redial opens a new channel
+	// to the server, after calls waiting for the channel have resumed. It
+	// may make calls through the client, for example to restore state the
+	// server lost with the old connection.
+	OnConnect func()
+
+	// Instructs the client to decode JSON numbers as json.Number rather than
+	// float64 when unmarshaling results, and the parameters of server
+	// notifications and callbacks, into interface values. This preserves the
+	// full precision of large integers, such as int64 values greater than
+	// 2^53. Decoding into values of concrete numeric type is not affected.
+	UseNumber bool
+
+	// If set, the client uses this codec to encode request parameters and
+	// callback results, and to decode results and the parameters of server
+	// notifications and callbacks, in place of the encoding/json package.
+	// If nil, it uses StdJSON.
+	JSONCodec JSONCodec
+
+	// If set, this prefix is added to the method name of each request and
+	// notification sent by the client, and removed from the method name of
+	// each notification and callback received from the server before it is
+	// passed to OnNotify or OnCallback. This allows a client to call methods
+	// of a service mounted under a common prefix, for example by a
+	// handler.ServiceMap, without naming the prefix at each call site.
+	// Reserved method names beginning with "rpc." are not affected.
+	MethodPrefix string
+
+	// The codecs the client can use to decompress results, in order of
+	// preference. The client offers them to the server when RPCHello is
+	// called, and the server may then compress large results with one of
+	// them. Compressed results are decompressed before they are returned.
+	Codecs []Codec
+
+	// If set, the client reports the outcome and latency of its calls, and
+	// the notifications it sends and receives, to this value. The
+	// metrics/expmetrics package provides an implementation that publishes
+	// them as expvar variables.
+	Metrics ClientMetrics
+
+	// If set, this function is called with each message the client sends to
+	// the server, including batches, notifications, and replies to callbacks,
+	// immediately before it is sent. It is called while the client holds its
+	// lock, so it must not block or call methods of the client. It must not
+	// retain or modify raw; it should copy raw if it needs it afterward.
+	OnSend func(raw []byte)
+
+	// If set, this function is called with each message the client receives
+	// from the server, immediately after it is received and before it is
+	// decoded, even if it is not valid. It must not retain or modify raw; it
+	// should copy raw if it needs it afterward.
+	OnReceive func(raw []byte)
 }
 
 func (c *ClientOptions) logger() logger {
@@ -178,6 +722,119 @@ func (c *ClientOptions) logger() logger {
 
 func (c *ClientOptions) allowV1() bool     { return c != nil && c.AllowV1 }
 func (c *ClientOptions) allowCancel() bool { return c == nil || !c.DisableCancel }
+func (c *ClientOptions) useNumber() bool   { return c != nil && c.UseNumber }
+
+func (c *ClientOptions) callTimeout() time.Duration {
+	if c == nil || c.CallTimeout < 0 {
+		return 0
+	}
+	return c.CallTimeout
+}
+
+func (c *ClientOptions) maxPending() (int, bool) {
+	if c == nil || c.MaxPending < 0 {
+		return 0, false
+	}
+	return c.MaxPending, c.MaxPendingFailFast
+}
+
+func (c *ClientOptions) keepAlive() (time.Duration, string) {
+	if c == nil || c.KeepAlive <= 0 {
+		return 0, ""
+	} else if c.KeepAliveMethod == "" {
+		return c.KeepAlive, rpcPing
+	}
+	return c.KeepAlive, c.KeepAliveMethod
+}
+
+func (c *ClientOptions) metrics() ClientMetrics {
+	if c == nil || c.Metrics == nil {
+		return nullClientMetrics{}
+	}
+	return c.Metrics
+}
+
+func (c *ClientOptions) onSend() func([]byte) {
+	if c == nil || c.OnSend == nil {
+		return func([]byte) {}
+	}
+	return c.OnSend
+}
+
+func (c *ClientOptions) onReceive() func([]byte) {
+	if c == nil || c.OnReceive == nil {
+		return func([]byte) {}
+	}
+	return c.OnReceive
+}
+
+func (c *ClientOptions) clock() Clock {
+	if c == nil || c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
+}
+
+type dialer = func(context.Context) (channel.Channel, error)
+
+func (c *ClientOptions) redial() (dialer, time.Duration, time.Duration, int) {
+	if c == nil || c.Redial == nil {
+		return nil, 0, 0, 0
+	}
+	delay, maxDelay := c.RedialDelay, c.RedialMaxDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	return c.Redial, delay, maxDelay, c.RedialAttempts
+}
+
+func (c *ClientOptions) onConnect() func() {
+	if c == nil {
+		return nil
+	}
+	return c.OnConnect
+}
+
+func (c *ClientOptions) onDisconnect() func(error) {
+	if c == nil {
+		return nil
+	}
+	return c.OnDisconnect
+}
+
+func (c *ClientOptions) jsonCodec() JSONCodec {
+	if c == nil {
+		return StdJSON
+	}
+	return orStdJSON(c.JSONCodec)
+}
+
+func (c *ClientOptions) codecs() []Codec {
+	if c == nil {
+		return nil
+	}
+	return c.Codecs
+}
+
+func (c *ClientOptions) methodPrefix() string {
+	if c == nil {
+		return ""
+	}
+	return c.MethodPrefix
+}
+
+// stripPrefix returns a function that removes the method prefix, if any, from
+// the name of an inbound request.
+func (c *ClientOptions) stripPrefix() func(string) string {
+	prefix := c.methodPrefix()
+	return func(method string) string { return strings.TrimPrefix(method, prefix) }
+}
 
 type encoder = func(context.Context, string, json.RawMessage) (json.RawMessage, error)
 
@@ -190,12 +847,34 @@ func (c *ClientOptions) encodeContext() encoder {
 	return c.EncodeContext
 }
 
-func (c *ClientOptions) handleNotification() func(*jmessage) {
-	if c == nil || c.OnNotify == nil {
+func (c *ClientOptions) handlerLimit() *semaphore.Weighted {
+	if c == nil || c.HandlerConcurrency < 1 {
+		return semaphore.NewWeighted(int64(runtime.NumCPU()))
+	}
+	return semaphore.NewWeighted(int64(c.HandlerConcurrency))
+}
+
+func (c *ClientOptions) handleNotification(pool *handlerPool) func(*jmessage) {
+	if c == nil || (c.OnNotify == nil && len(c.NotifyHandlers) == 0) {
 		return nil
 	}
-	h := c.OnNotify
-	return func(req *jmessage) { h(&Request{method: req.M, params: req.P}) }
+	h, log := c.OnNotify, c.logger()
+	hmap := make(map[string]func(*Request), len(c.NotifyHandlers))
+	for method, f := range c.NotifyHandlers {
+		hmap[method] = f
+	}
+	useNum, codec := c.UseNumber, c.jsonCodec()
+	strip := c.stripPrefix()
+	return func(msg *jmessage) {
+		req := &Request{method: strip(msg.M), params: msg.P, useNum: useNum, codec: codec}
+		if f, ok := hmap[req.method]; ok {
+			pool.start(func() { f(req) })
+		} else if h != nil {
+			h(req)
+		} else {
+			log("Discarding notification for %q: no handler", req.method)
+		}
+	}
 }
 
 func (c *ClientOptions) handleCancel() func(*Client, *Response) {
@@ -205,39 +884,96 @@ func (c *ClientOptions) handleCancel() func(*Client, *Response) {
 	return c.OnCancel
 }
 
-func (c *ClientOptions) handleCallback() func(*jmessage) ([]byte, error) {
-	if c == nil || c.OnCallback == nil {
+func (c *ClientOptions) handleShutdown() func(*ShutdownInfo) {
+	if c == nil {
 		return nil
 	}
-	cb := c.OnCallback
-	return func(req *jmessage) ([]byte, error) {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		rsp := &jmessage{V: Version, ID: req.ID}
-		v, err := cb(ctx, &Request{
-			id:     req.ID,
-			method: req.M,
-			params: req.P,
-		})
-		if err == nil {
-			rsp.R, err = json.Marshal(v)
+	return c.OnShutdown
+}
+
+type callbackFunc = func(context.Context, *Request) (interface{}, error)
+
+// handleCallback returns a function that handles a request from the server.
+// If the method of the request has a handler in CallbackHandlers, the function
+// returns a thunk to run that handler, which must be called outside the client
+// lock and reports the encoded reply. Otherwise, it reports nil, and the
+// request is handled by calling the function returned by replyCallback.
+func (c *ClientOptions) handleCallback() func(*jmessage) func() ([]byte, error) {
+	if c == nil || len(c.CallbackHandlers) == 0 {
+		return func(*jmessage) func() ([]byte, error) { return nil }
+	}
+	hmap := make(map[string]callbackFunc, len(c.CallbackHandlers))
+	for method, f := range c.CallbackHandlers {
+		hmap[method] = f
+	}
+	useNum, codec := c.UseNumber, c.jsonCodec()
+	strip := c.stripPrefix()
+	return func(msg *jmessage) func() ([]byte, error) {
+		f, ok := hmap[strip(msg.M)]
+		if !ok {
+			return nil
+		}
+		return func() ([]byte, error) {
+			return runCallback(f, msg, strip, useNum, codec)
+		}
+	}
+}
+
+// replyCallback returns a function that handles a request from the server
+// that has no handler in CallbackHandlers, and reports the encoded reply.
+func (c *ClientOptions) replyCallback() func(*jmessage) ([]byte, error) {
+	if c == nil || c.OnCallback == nil {
+		return func(msg *jmessage) ([]byte, error) {
+			return jmessages{{
+				V:  Version,
+				ID: msg.ID,
+				E:  &Error{code: code.MethodNotFound, message: fmt.Sprintf("no such method %q", msg.M)},
+			}}.toJSON()
 		}
-		if err != nil {
-			rsp.R = nil
-			if e, ok := err.(*Error); ok {
-				rsp.E = e
-			} else {
-				rsp.E = &Error{code: code.FromError(err), message: err.Error()}
-			}
+	}
+	cb := c.OnCallback
+	useNum, codec := c.UseNumber, c.jsonCodec()
+	strip := c.stripPrefix()
+	return func(msg *jmessage) ([]byte, error) {
+		return runCallback(cb, msg, strip, useNum, codec)
+	}
+}
+
+// runCallback calls f to handle the request msg from the server, and reports
+// the encoded reply.
+func runCallback(f callbackFunc, msg *jmessage, strip func(string) string, useNum bool, codec JSONCodec) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rsp := &jmessage{V: Version, ID: msg.ID}
+	v, err := f(ctx, &Request{
+		id:     msg.ID,
+		method: strip(msg.M),
+		params: msg.P,
+		useNum: useNum,
+		codec:  codec,
+	})
+	if err == nil {
+		rsp.R, err = codec.Marshal(v)
+	}
+	if err != nil {
+		rsp.R = nil
+		if e, ok := err.(*Error); ok {
+			rsp.E = e
+		} else {
+			rsp.E = &Error{code: code.FromError(err), message: err.Error()}
 		}
-		return json.Marshal(rsp)
 	}
+	return jmessages{rsp}.toJSON()
 }
 
 // An RPCLogger receives callbacks from a server to record the receipt of
 // requests and the delivery of responses. These callbacks are invoked
-// synchronously with the processing of the request.
+// synchronously with the processing of the request, but not while the server
+// holds its lock, so a slow logger delays only the request it is logging.
+//
+// If an RPCLogger also implements RPCTimingLogger, the server reports the time
+// taken to handle each request (see RPCTimingLogger).
 type RPCLogger interface {
 	// Called for each request received prior to invoking its handler.
 	LogRequest(ctx context.Context, req *Request)
@@ -248,7 +984,77 @@ type RPCLogger interface {
 	LogResponse(ctx context.Context, rsp *Response)
 }
 
+// An RPCTimingLogger is an RPCLogger that also records how long each request
+// took. If the RPCLog of a server implements RPCTimingLogger, the server calls
+// LogResponseTime in place of LogResponse.
+type RPCTimingLogger interface {
+	RPCLogger
+
+	// Called as LogResponse would be, with the time elapsed from when the
+	// request was dispatched until its handler returned, including any time
+	// spent waiting for the concurrency limit. If the request failed before
+	// its handler was invoked, for example because its method was not found,
+	// elapsed is 0.
+	//
+	// LogResponseTime is also called when the handler for each notification
+	// returns, with a response whose ID is empty, and which reports the error
+	// from the handler, if any. This response is not sent to the client.
+	LogResponseTime(ctx context.Context, rsp *Response, elapsed time.Duration)
+}
+
+// logResponse reports rsp to rpcLog, with the elapsed time if it accepts it.
+func logResponse(ctx context.Context, rpcLog RPCLogger, rsp *Response, elapsed time.Duration) {
+	if tl, ok := rpcLog.(RPCTimingLogger); ok {
+		tl.LogResponseTime(ctx, rsp, elapsed)
+	} else {
+		rpcLog.LogResponse(ctx, rsp)
+	}
+}
+
 type nullRPCLogger struct{}
 
 func (nullRPCLogger) LogRequest(context.Context, *Request)   {}
 func (nullRPCLogger) LogResponse(context.Context, *Response) {}
+
+// A ClientMetrics receives reports from a client about its calls and
+// notifications, for example to track the latency and error rate of each
+// method. These reports are made synchronously with the operations they
+// describe, but not while the client holds its lock. They may be made
+// concurrently from multiple goroutines.
+type ClientMetrics interface {
+	// Called when a call made by Call or Batch completes, with its method
+	// name, the time elapsed since the call began as measured by the
+	// client's Clock, and the code of the error it reported, or code.NoError
+	// if it succeeded. For a batch, the elapsed time is until all the calls
+	// in the batch are complete.
+	CallDone(method string, elapsed time.Duration, c code.Code)
+
+	// Called for each notification sent by Notify or Batch.
+	NotificationSent(method string)
+
+	// Called for each notification received from the server, before it is
+	// handled.
+	NotificationReceived(method string)
+}
+
+type nullClientMetrics struct{}
+
+func (nullClientMetrics) CallDone(string, time.Duration, code.Code) {}
+func (nullClientMetrics) NotificationSent(string)                   {}
+func (nullClientMetrics) NotificationReceived(string)               {}
+
+// ProxyOptions control the behaviour of a Proxy. A nil *ProxyOptions provides
+// sensible defaults.
+type ProxyOptions struct {
+	// If set, this function is called to rewrite the name of each method
+	// before it is forwarded, for example to remove a namespace prefix. If it
+	// returns "", the method is reported as not found.
+	RewriteMethod func(method string) string
+}
+
+func (p *ProxyOptions) rewriteMethod() func(string) string {
+	if p == nil || p.RewriteMethod == nil {
+		return func(method string) string { return method }
+	}
+	return p.RewriteMethod
+}
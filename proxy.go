@@ -0,0 +1,68 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// A Proxy is an Assigner that forwards each request it receives to an
+// upstream server via a client, and relays the result or error back to the
+// caller. Errors reported by the upstream server, including their codes and
+// data, are returned unchanged.
+//
+// Notifications are forwarded as notifications. If the context of a forwarded
+// call ends before the upstream server replies, the client cancels the call,
+// by default by sending rpc.cancel to the upstream server.
+//
+// The context passed to the upstream client is the handler context, so if the
+// proxy server decodes request contexts (for example with jctx.Decode) and the
+// upstream client encodes them (with jctx.Encode), deadlines and metadata are
+// passed through to the upstream server intact.
+//
+// A Proxy can be combined with other assigners, for example by using one
+// Proxy per backend in a handler.ServiceMap, to serve a merged set of methods
+// from several servers.
+type Proxy struct {
+	cli     *Client
+	rewrite func(string) string
+}
+
+// NewProxy constructs a new Proxy that forwards requests to upstream.  A nil
+// *ProxyOptions provides sensible defaults. The caller remains responsible
+// for closing upstream when the proxy is no longer needed.
+func NewProxy(upstream *Client, opts *ProxyOptions) *Proxy {
+	return &Proxy{cli: upstream, rewrite: opts.rewriteMethod()}
+}
+
+// Assign implements part of the Assigner interface. It returns a handler that
+// forwards requests for method to the upstream server, or nil if the method
+// rewrite hook rejects the name.
+func (p *Proxy) Assign(_ context.Context, method string) Handler {
+	target := p.rewrite(method)
+	if target == "" {
+		return nil
+	}
+	return methodFunc(func(ctx context.Context, req *Request) (interface{}, error) {
+		var params interface{}
+		if req.HasParams() {
+			params = req.params
+		}
+		if req.IsNotification() {
+			return nil, p.cli.Notify(ctx, target, params)
+		}
+
+		// Use Batch rather than Call so that errors are reported exactly as
+		// the upstream server sent them.
+		rsps, err := p.cli.Batch(ctx, []Spec{{Method: target, Params: params}})
+		if err != nil {
+			return nil, err
+		} else if err := rsps[0].Error(); err != nil {
+			return nil, err
+		}
+		return json.RawMessage(rsps[0].result), nil
+	})
+}
+
+// Names implements part of the Assigner interface. Since the methods exported
+// by the upstream server are not known in advance, it returns nil.
+func (p *Proxy) Names() []string { return nil }
@@ -0,0 +1,172 @@
+package jrpc2
+
+import (
+	"errors"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// A PushPolicy selects what a server does when it has a push to send to the
+// client, and its push queue is full (see ServerOptions.PushQueueSize).
+type PushPolicy int
+
+const (
+	// PushDropNewest discards the new push. Notify or Callback reports
+	// ErrPushDropped.
+	PushDropNewest PushPolicy = iota
+
+	// PushDropOldest discards the oldest push in the queue to make room for
+	// the new one. If the discarded push was a callback, its Callback reports
+	// ErrPushDropped.
+	PushDropOldest
+
+	// PushDisconnect stops the server, on the assumption that a client that
+	// cannot keep up is stuck. Notify or Callback reports ErrPushOverflow, as
+	// does the Wait method of the server. The channel is closed even if a push
+	// is being written to it.
+	PushDisconnect
+)
+
+// ErrPushDropped is reported by a server's push-to-client methods if the push
+// was discarded because the push queue was full.
+var ErrPushDropped = Errorf(code.SystemError, "push dropped: queue is full")
+
+// ErrPushOverflow is reported by a server's push-to-client methods, and by
+// the Wait method of the server, if the server stopped because its push queue
+// overflowed.
+var ErrPushOverflow = errors.New("push queue overflow")
+
+// PushQueueInfo describes the push queue of a server.
+type PushQueueInfo struct {
+	Length    int   `json:"length"`    // the number of pushes waiting
+	HighWater int   `json:"highWater"` // the most pushes ever waiting at once
+	Dropped   int64 `json:"dropped"`   // the number of pushes discarded
+}
+
+// A pushQueue holds pushes waiting to be sent to the client. Its fields are
+// protected by the server's lock. A goroutine to send pushes runs only while
+// the queue is not empty.
+type pushQueue struct {
+	max    int
+	policy PushPolicy
+
+	buf   []*pushItem
+	busy  bool // a sending goroutine is running
+	high  int
+	drops int64
+}
+
+// A pushItem is a push waiting to be sent. For a callback, rsp is the
+// response waiting for the client's reply.
+type pushItem struct {
+	kind string
+	msg  *jmessage
+	rsp  *Response
+}
+
+func newPushQueue(max int, policy PushPolicy) *pushQueue {
+	if max <= 0 {
+		return nil
+	}
+	return &pushQueue{max: max, policy: policy}
+}
+
+// queuePush adds a push to the queue, applying the overflow policy if the
+// queue is full. The caller must hold s.mu.
+func (s *Server) queuePush(item *pushItem) error {
+	q := s.push
+	if len(q.buf) >= q.max {
+		s.metrics.Count("rpc.pushesDropped", 1)
+		switch q.policy {
+		case PushDropOldest:
+			old := q.buf[0]
+			q.buf[0] = nil
+			q.buf = q.buf[1:]
+			q.drops++
+			s.log("Push queue full; dropping oldest %s %q", old.kind, old.msg.M)
+			s.failPush(old, ErrPushDropped.(*Error))
+		case PushDisconnect:
+			s.log("Push queue full; disconnecting client")
+			s.stop(ErrPushOverflow)
+			return ErrPushOverflow
+		default:
+			q.drops++
+			s.log("Push queue full; dropping %s %q", item.kind, item.msg.M)
+			return ErrPushDropped
+		}
+	}
+	q.buf = append(q.buf, item)
+	if n := len(q.buf); n > q.high {
+		q.high = n
+	}
+	s.metrics.SetMaxValue("rpc.pushQueueLength", int64(len(q.buf)))
+	if !q.busy {
+		q.busy = true
+		s.wg.Add(1)
+		go s.sendPushes()
+	}
+	return nil
+}
+
+// failPush reports err to the callback waiting for item, if any. The caller
+// must hold s.mu.
+func (s *Server) failPush(item *pushItem, err *Error) {
+	if item.rsp != nil {
+		delete(s.call, item.rsp.id)
+		item.rsp.ch <- &jmessage{ID: item.msg.ID, E: err}
+	}
+}
+
+// sendPushes sends queued pushes to the client until the queue is empty or
+// the server stops.
+//
+// The server lock is released while each push is sent, so a slow client does
+// not block the server, but the write lock is acquired first. Since deliver
+// holds the server lock while it waits for the write lock, a response that
+// is ready to send goes ahead of the remaining pushes.
+func (s *Server) sendPushes() {
+	defer s.wg.Done()
+	q := s.push
+	for {
+		s.mu.Lock()
+		if len(q.buf) == 0 || s.ch == nil {
+			q.busy = false
+			s.mu.Unlock()
+			return
+		}
+		next := q.buf[0]
+		q.buf[0] = nil
+		q.buf = q.buf[1:]
+		ch := s.ch
+		s.wmu.Lock()
+		s.mu.Unlock()
+
+		s.log("Posting server %s %q %s", next.kind, next.msg.M, string(next.msg.P))
+		nw, err := encode(ch, jmessages{next.msg})
+		s.wmu.Unlock()
+		s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+		s.metrics.Count("rpc."+next.kind+"s", 1)
+		if err != nil {
+			// As for other writes, a failure means the client can no longer be
+			// reached, so stop the server (see write).
+			s.log("Writing push: %v", err)
+			s.mu.Lock()
+			s.failPush(next, Errorf(code.SystemError, "writing push: %v", err).(*Error))
+			s.stop(err)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// clearPushes discards any pushes still queued when the server stops. The
+// caller must hold s.mu.
+func (s *Server) clearPushes() {
+	if s.push == nil {
+		return
+	}
+	closed := Errorf(code.SystemError, "%v", ErrConnClosed).(*Error)
+	for _, item := range s.push.buf {
+		s.failPush(item, closed)
+	}
+	s.push.buf = nil
+}
@@ -0,0 +1,54 @@
+package jrpc2
+
+import "time"
+
+// A rateLimiter is a token bucket that admits requests at a fixed rate, as
+// measured by the server's clock. Its fields are protected by the server's
+// lock.
+type rateLimiter struct {
+	rate  float64       // requests per second
+	burst float64       // maximum capacity of the bucket
+	wait  time.Duration // maximum delay for a request that exceeds the rate
+
+	tokens float64   // currently available; negative if in debt
+	last   time.Time // when tokens was last updated
+}
+
+func newRateLimiter(rate float64, burst int, wait time.Duration) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), wait: wait}
+}
+
+// reset fills the bucket, as of now.
+func (r *rateLimiter) reset(now time.Time) {
+	if r != nil {
+		r.tokens = r.burst
+		r.last = now
+	}
+}
+
+// reserve reports whether a request received at now is admitted, and if so,
+// how long it must be delayed for the rate to be respected. A request is
+// admitted if its delay would be at most r.wait.
+func (r *rateLimiter) reserve(now time.Time) (time.Duration, bool) {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0, true
+	}
+	delay := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+	if delay > r.wait {
+		return 0, false
+	}
+	r.tokens-- // repaid by the delay
+	return delay, true
+}
@@ -0,0 +1,162 @@
+package jrpc2
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// A Sampler describes how a server captures a sample of the requests it
+// handles, for example to record payloads for offline analysis.
+//
+// The server calls Select for each request before it is dispatched. If Select
+// reports true, then when the request is complete, the server hands it to
+// Sink along with its encoded result or error, and the time taken to invoke
+// its handler. A server calls Sink asynchronously, one sample at a time, so
+// that the sink does not delay the handling of requests. If the samples
+// awaiting the sink exceed the buffer size, further samples are discarded
+// until the sink catches up; these are counted in the "rpc.samplesDropped"
+// metric.
+//
+// Servers that share a Sampler (for example, via server.Loop) may call its
+// Sink concurrently.
+type Sampler struct {
+	// Reports whether the request should be sampled (required). Select is
+	// called while the server is checking the requests of a batch, so it
+	// must be cheap, and must not call back into the server.
+	Select func(req *Request) bool
+
+	// Receives each completed request that was selected (required). For a
+	// successful request, result is its encoded result and err == nil. For a
+	// request that failed, result is nil and err reports why.
+	Sink func(req *Request, result json.RawMessage, err error, elapsed time.Duration)
+
+	// The maximum number of samples to buffer for the sink. If BufferSize <=
+	// 0, a default of 64 is used.
+	BufferSize int
+}
+
+func (s *Sampler) bufferSize() int {
+	if s.BufferSize <= 0 {
+		return 64
+	}
+	return s.BufferSize
+}
+
+// SampleRate returns a Sampler selection function that selects each request
+// independently at random with probability p, for example 0.01 to select 1% of
+// requests.
+func SampleRate(p float64) func(*Request) bool {
+	return func(*Request) bool { return rand.Float64() < p }
+}
+
+// SampleLog returns a Sampler sink function that writes each sample to w as
+// a single line of JSON. Errors writing to w are ignored. Writes to w are not
+// synchronized, so a sink shared by multiple servers requires a w that is
+// safe for concurrent use, such as an *os.File.
+//
+// Each line is an object with the fields "method", "id", "correlationId",
+// "received", "params", "result", "error", and "elapsedMicros", of which the
+// empty fields are omitted.
+func SampleLog(w io.Writer) func(*Request, json.RawMessage, error, time.Duration) {
+	return func(req *Request, result json.RawMessage, err error, elapsed time.Duration) {
+		rec := sampleRecord{
+			Method:  req.method,
+			ID:      req.id,
+			CID:     req.cid,
+			Params:  req.params,
+			Result:  result,
+			Elapsed: elapsed.Microseconds(),
+		}
+		if t := req.recvd; !t.IsZero() {
+			rec.Received = &t
+		}
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				rec.Error = e
+			} else {
+				rec.Error = &Error{code: code.FromError(err), message: err.Error()}
+			}
+		}
+		bits, merr := json.Marshal(rec)
+		if merr == nil {
+			w.Write(append(bits, '\n'))
+		}
+	}
+}
+
+// sampleRecord is the format of a sample written by SampleLog.
+type sampleRecord struct {
+	Method   string          `json:"method"`
+	ID       json.RawMessage `json:"id,omitempty"`
+	CID      string          `json:"correlationId,omitempty"`
+	Received *time.Time      `json:"received,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *Error          `json:"error,omitempty"`
+	Elapsed  int64           `json:"elapsedMicros"`
+}
+
+// A sample is a completed request waiting to be delivered to a sink.
+type sample struct {
+	req     *Request
+	result  json.RawMessage
+	err     error
+	elapsed time.Duration
+}
+
+// A sampleQueue buffers samples for delivery to a sink. A goroutine to
+// deliver samples runs only while the queue is not empty.
+type sampleQueue struct {
+	sel  func(*Request) bool
+	sink func(*Request, json.RawMessage, error, time.Duration)
+	max  int
+
+	mu   sync.Mutex
+	buf  []sample
+	busy bool // a delivery goroutine is running
+}
+
+func newSampleQueue(s *Sampler) *sampleQueue {
+	if s == nil || s.Select == nil || s.Sink == nil {
+		return nil
+	}
+	return &sampleQueue{sel: s.Select, sink: s.Sink, max: s.bufferSize()}
+}
+
+// push adds a sample to the queue, and reports false if the queue is full.
+func (q *sampleQueue) push(s sample) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.buf) >= q.max {
+		return false
+	}
+	q.buf = append(q.buf, s)
+	if !q.busy {
+		q.busy = true
+		go q.deliver()
+	}
+	return true
+}
+
+// deliver passes queued samples to the sink until the queue is empty.
+func (q *sampleQueue) deliver() {
+	for {
+		q.mu.Lock()
+		if len(q.buf) == 0 {
+			q.busy = false
+			q.mu.Unlock()
+			return
+		}
+		next := q.buf[0]
+		q.buf[0] = sample{} // release the reference
+		q.buf = q.buf[1:]
+		q.mu.Unlock()
+
+		q.sink(next.req, next.result, next.err, next.elapsed)
+	}
+}
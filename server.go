@@ -1,13 +1,20 @@
 package jrpc2
 
 import (
-	"container/list"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/jrpc2/channel"
@@ -22,32 +29,92 @@ type logger = func(string, ...interface{})
 // responses on a channel.Channel provided by the caller, and dispatches
 // requests to user-defined Handlers.
 type Server struct {
-	wg      sync.WaitGroup      // ready when workers are done at shutdown time
-	mux     Assigner            // associates method names with handlers
-	sem     *semaphore.Weighted // bounds concurrent execution (default 1)
-	allow1  bool                // allow v1 requests with no version marker
-	allowP  bool                // allow server notifications to the client
-	log     logger              // write debug logs here
-	rpcLog  RPCLogger           // log RPC requests and responses here
-	dectx   decoder             // decode context from request
-	ckreq   verifier            // request checking hook
-	expctx  bool                // whether to expect request context
-	metrics *metrics.M          // metrics collected during execution
-	start   time.Time           // when Start was called
-	builtin bool                // whether built-in rpc.* methods are enabled
+	wg      sync.WaitGroup         // ready when workers are done at shutdown time
+	mux     Assigner               // associates method names with handlers
+	sem     *semaphore.Weighted    // bounds concurrent execution (default 1)
+	allow1  bool                   // allow v1 requests with no version marker
+	allowP  bool                   // allow server notifications to the client
+	log     logger                 // write debug logs here
+	rpcLog  RPCLogger              // log RPC requests and responses here
+	newctx  func() context.Context // create a new base request context (nil if unset)
+	dectx   decoder                // decode context from request
+	ckreq   verifier               // request checking hook
+	auth    authorizer             // request authorization hook (nil if none)
+	icept   []Interceptor          // interceptors applied around each handler
+	expctx  bool                   // whether to expect request context
+	metrics *metrics.M             // metrics collected during execution
+	start   time.Time              // when Start was called
+	builtin bool                   // whether built-in rpc.* methods are enabled
+	keepRaw bool                   // whether to retain raw request encodings
+	rejDep  bool                   // whether to reject deprecated methods
+	onDep   depHook                // deprecated call hook
+	maxRes  int                    // maximum encoded result size (0 = no limit)
+	maxBat  int                    // maximum requests in a batch (0 = no limit)
+	maxReq  int                    // maximum size of a message (0 = no limit)
+	maxQ    int                    // maximum batches held at once (0 = no limit)
+	rawOK   bool                   // whether to trust pre-encoded results
+	useNum  bool                   // decode numbers in params as json.Number
+	jcodec  JSONCodec              // encodes results and decodes params
+	onNErr  noteHook               // notification error hook
+	maxNErr int                    // max consecutive notification failures (0 = no limit)
+	clock   Clock                  // source of current time
+	cidBase string                 // prefix for request correlation IDs
+	cidData bool                   // whether to report correlation IDs in errors
+	sample  *sampleQueue           // request sampling (nil if disabled)
+	faults  *FaultPolicy           // fault injection (nil if disabled)
+	strict  bool                   // reject requests with extra fields
+	slowMin time.Duration          // slow request threshold (0 = disabled)
+	slowQ   bool                   // whether slow request time includes queueing
+	order   bool                   // whether to send responses in arrival order
+	timeout time.Duration          // limit on the time for each request (0 = none)
+	maxIdle time.Duration          // idle connection timeout (0 = none)
+	wmu     sync.Mutex             // serializes writes to the channel (see sendPushes)
+	codecs  []Codec                // codecs available to compress results
+	zmin    int                    // minimum size of a compressed result
+	pstack  bool                   // whether to report the stack of a handler panic
+	active  int32                  // handlers currently running (atomic)
+	lastRx  int64                  // when a message was last received, in ns (atomic)
 
 	mu *sync.Mutex // protects the fields below
 
 	nbar sync.WaitGroup  // notification barrier (see the dispatch method)
 	err  error           // error from a previous operation
-	work *sync.Cond      // for signaling message availability
-	inq  *list.List      // inbound requests awaiting processing
-	ch   channel.Channel // the channel to the client
+	ch   channel.Channel // the channel to the client; nil when stopped
+	nerr int             // consecutive notification failures
+	seq  int64           // sequence number for correlation IDs
+	push *pushQueue      // queued pushes to the client (nil if disabled)
+	shut *ShutdownInfo   // set while the server is draining
+	rate *rateLimiter    // limits the rate of requests (nil if disabled)
+	enc  Codec           // codec negotiated by rpc.hello (nil if none)
+	work int             // batches received whose responses are not sent
+	quit chan struct{}   // closed when the server stops
+	base context.Context // the context passed to StartContext
+	turn chan struct{}   // closed when the last batch dispatched is delivered
+
+	// Closed when work reaches zero after Shutdown is called; nil unless the
+	// server is draining.
+	drain chan struct{}
+
+	// Requests whose handlers are running, by correlation ID, when slow
+	// request tracking is enabled.
+	busy map[string]busyRequest
+
+	// Methods disabled by DisableMethods, mapped to the suggested retry delay
+	// (or 0), and the number of handlers in flight for each method. When the
+	// count for a method reaches zero, idle is closed and replaced.
+	off  map[string]time.Duration
+	live map[string]int
+	idle chan struct{}
 
 	// For each request ID currently in-flight, this map carries a cancel
-	// function attached to the context that was sent to the handler.
+	// function attached to the context that was sent to the handler. It is
+	// keyed by the canonical form of the ID (see idKey).
 	used map[string]context.CancelFunc
 
+	// Batches whose handlers are running. When the server stops, their
+	// contexts are cancelled, including those of notification handlers.
+	runs map[*batch]bool
+
 	// For each push-call ID currently in flight, this map carries the response
 	// waiting for its reply.
 	call   map[string]*Response
@@ -73,51 +140,129 @@ func NewServer(mux Assigner, opts *ServerOptions) *Server {
 		allowP:  opts.allowPush(),
 		log:     opts.logger(),
 		rpcLog:  opts.rpcLog(),
+		newctx:  opts.newContext(),
 		dectx:   dc,
 		ckreq:   opts.checkRequest(),
+		auth:    opts.authorize(),
+		icept:   opts.interceptors(),
 		expctx:  exp,
 		mu:      new(sync.Mutex),
 		metrics: opts.metrics(),
 		start:   opts.startTime(),
 		builtin: opts.allowBuiltin(),
-		inq:     list.New(),
+		keepRaw: opts.retainRaw(),
+		rejDep:  opts.rejectDep(),
+		onDep:   opts.onDeprecatedCall(),
+		maxRes:  opts.maxResultSize(),
+		maxBat:  opts.maxBatchSize(),
+		maxReq:  opts.maxRequestSize(),
+		maxQ:    opts.maxQueuedBatches(),
+		rawOK:   opts.trustRaw(),
+		useNum:  opts.useNumber(),
+		jcodec:  opts.jsonCodec(),
+		onNErr:  opts.onNotificationError(),
+		maxNErr: opts.maxNotificationFailures(),
+		clock:   opts.clock(),
+		cidBase: newCorrelationBase(),
+		cidData: opts.cidErrors(),
+		sample:  newSampleQueue(opts.sampler()),
+		faults:  opts.faultPolicy(),
+		strict:  opts.strictSpec(),
+		slowMin: opts.slowThreshold(),
+		slowQ:   opts.slowQueue(),
+		order:   opts.strictOrder(),
+		timeout: opts.requestTimeout(),
+		maxIdle: opts.idleTimeout(),
+		pstack:  opts.panicStack(),
+		push:    newPushQueue(opts.pushQueue()),
+		rate:    newRateLimiter(opts.rateLimit()),
+		busy:    make(map[string]busyRequest),
+		off:     make(map[string]time.Duration),
+		live:    make(map[string]int),
+		idle:    make(chan struct{}),
 		used:    make(map[string]context.CancelFunc),
+		runs:    make(map[*batch]bool),
 		call:    make(map[string]*Response),
 		callID:  1,
 	}
-	s.work = sync.NewCond(s.mu)
+	s.codecs, s.zmin = opts.compression()
 	return s
 }
 
+// inqSize is the number of decoded request batches that the reader may queue
+// for the dispatcher before it blocks waiting for the dispatcher to catch up.
+const inqSize = 64
+
 // Start enables processing of requests from c. This function will panic if the
-// server is already running.
+// server is already running. After Wait returns, Start may be called again to
+// serve a new channel; the state of the previous connection is discarded, but
+// metrics and the start time are retained.
+//
+// Start is equivalent to StartContext with a background context.
 func (s *Server) Start(c channel.Channel) *Server {
+	return s.StartContext(context.Background(), c)
+}
+
+// StartContext enables processing of requests from c, as Start does, for the
+// lifetime of ctx. Unless the server has a NewContext option, the contexts
+// passed to handlers are derived from ctx, so values that apply to the whole
+// connection, such as the identity of the client, can be attached to ctx.
+// When ctx ends, the server stops as if Stop were called, and Wait reports the
+// error from ctx.
+func (s *Server) StartContext(ctx context.Context, c channel.Channel) *Server {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.ch != nil {
 		panic("server is already running")
 	}
 
-	// Set up the queues and condition variable used by the workers.
 	s.ch = c
+	s.base = ctx
 	if s.start.IsZero() {
-		s.start = time.Now().In(time.UTC)
+		s.start = s.clock.Now().In(time.UTC)
 	}
 
 	// Reset all the I/O structures and start up the workers.
 	s.err = nil
+	s.nerr = 0
+	s.shut = nil
+	s.enc = nil
+	s.turn = nil
+	s.drain = nil
+	s.rate.reset(s.clock.Now())
 
 	// s.wg waits for the maintenance goroutines for receiving input and
 	// processing the request queue. In addition, each request in flight adds a
 	// goroutine to s.wg. At server shutdown, s.wg completes when the
 	// maintenance goroutines and all pending requests are finished.
+	//
+	// The reader sends decoded batches to the dispatcher via inq, and closes
+	// inq when the channel fails or is closed by stop. The dispatcher exits
+	// once it has drained inq.
 	s.wg.Add(2)
+	inq := make(chan jmessages, inqSize)
+	if s.maxQ > inqSize {
+		inq = make(chan jmessages, s.maxQ) // N.B. so the reader need not block
+	}
 
 	// Accept requests from the client and enqueue them for processing.
-	go func() { defer s.wg.Done(); s.read(c) }()
+	go func() { defer s.wg.Done(); s.read(c, inq) }()
 
 	// Remove requests from the queue and dispatch them to handlers.
-	go func() { defer s.wg.Done(); s.serve() }()
+	go func() { defer s.wg.Done(); s.serve(inq) }()
+
+	// Stop the server if the connection is idle for too long, or when its
+	// context ends.
+	s.quit = make(chan struct{})
+	if s.maxIdle > 0 {
+		s.touch()
+		s.wg.Add(1)
+		go func(quit <-chan struct{}) { defer s.wg.Done(); s.watchIdle(quit) }(s.quit)
+	}
+	if ctx.Done() != nil {
+		s.wg.Add(1)
+		go func(quit <-chan struct{}) { defer s.wg.Done(); s.watchContext(ctx, quit) }(s.quit)
+	}
 
 	return s
 }
@@ -138,43 +283,52 @@ func (s *Server) Start(c channel.Channel) *Server {
 //       |   ...
 //       * deliver     -- send responses to the client
 //
-func (s *Server) serve() {
-	for {
-		next, err := s.nextRequest()
-		if err != nil {
-			s.log("Reading next request: %v", err)
-			return
+func (s *Server) serve(inq <-chan jmessages) {
+	for in := range inq {
+		next := s.nextRequest(in)
+		if next == nil {
+			s.batchDone()
+			continue
 		}
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
+			defer s.batchDone()
 			next()
 		}()
 	}
+	s.log("Request queue closed; dispatcher exiting")
 }
 
-// nextRequest blocks until a request batch is available and returns a function
-// that dispatches it to the appropriate handlers. The result is only an error
-// if the connection failed; errors reported by the handler are reported to the
-// caller and not returned here.
+// nextRequest returns a function that dispatches the request batch next to
+// the appropriate handlers, or nil if there is nothing to dispatch.
+//
+// If the server has stopped, requests still in the queue are discarded, but
+// notifications are retained: The server handles pending notifications before
+// it exits.
 //
 // The caller must invoke the returned function to complete the request.
-func (s *Server) nextRequest() (func() error, error) {
+func (s *Server) nextRequest(next jmessages) func() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for s.ch != nil && s.inq.Len() == 0 {
-		s.work.Wait()
-	}
-	if s.ch == nil && s.inq.Len() == 0 {
-		return nil, s.err
-	}
 	ch := s.ch // capture
-
-	next := s.inq.Remove(s.inq.Front()).(jmessages)
+	if ch == nil {
+		var keep jmessages
+		for _, req := range next {
+			if req.isNotification() {
+				s.log("Retaining notification %p", req)
+				keep = append(keep, req)
+			}
+		}
+		if len(keep) == 0 {
+			return nil
+		}
+		next = keep
+	}
 	s.log("Processing %d requests", len(next))
 
 	// Construct a dispatcher to run the handlers outside the lock.
-	return s.dispatch(next, ch), nil
+	return s.dispatch(next, ch)
 }
 
 // waitForBarrier blocks until all notification handlers that have been issued
@@ -201,17 +355,45 @@ func (s *Server) waitForBarrier(n int) {
 // concurrently.
 func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
 	// Resolve all the task handlers or record errors.
-	start := time.Now()
-	tasks := s.checkAndAssign(next)
+	start := s.clock.Now()
+	b := newBatch(s.baseContext())
+	if ch != nil {
+		s.runs[b] = true // N.B. not notifications retained after a stop
+	}
+	tasks := s.checkAndAssign(b, next)
 	last := len(tasks) - 1
 
+	// Record notifications that failed validation. Their failures are reported
+	// to the hook once the lock is released.
+	var rejected []*task
+	for _, t := range tasks {
+		if t.err != nil && t.hreq.IsNotification() && s.noteResult(t, nil) {
+			rejected = append(rejected, t)
+		}
+	}
+
+	// If responses are sent in order of arrival, this batch delivers after
+	// the batch dispatched before it, and the next batch after this one.
+	var prev, turn chan struct{}
+	if s.order {
+		prev, turn = s.turn, make(chan struct{})
+		s.turn = turn
+	}
+
 	// Ensure all notifications already issued have completed; see #24.
 	s.waitForBarrier(tasks.numValidNotifications())
 
 	return func() error {
+		for _, t := range rejected {
+			s.onNErr(t.hreq, t.err)
+		}
 		var wg sync.WaitGroup
 		for i, t := range tasks {
 			if t.err != nil {
+				b.fail()
+				if t.pick {
+					s.capture(t, nil, t.err, 0)
+				}
 				continue // nothing to do here; this task has already failed
 			}
 			t := t
@@ -222,7 +404,30 @@ func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
 				if t.hreq.IsNotification() {
 					defer s.nbar.Done()
 				}
-				t.val, t.err = s.invoke(t.ctx, t.m, t.hreq)
+				start := s.clock.Now()
+				val, err := s.runTask(t, s.faults.choose(t.hreq.method))
+				t.elapsed = s.clock.Now().Sub(start)
+				s.finished(t.hreq.method)
+				if t.pick {
+					s.capture(t, val, err, t.elapsed)
+				}
+				if err != nil {
+					b.fail()
+				}
+				if !t.hreq.IsNotification() {
+					t.val, t.err = val, err
+					return
+				}
+				if tl, ok := s.rpcLog.(RPCTimingLogger); ok {
+					rsp := new(Response)
+					if err != nil {
+						rsp.err = asError(err)
+					}
+					tl.LogResponseTime(t.ctx, rsp, t.elapsed)
+				}
+				if s.notifyDone(t, err) {
+					s.onNErr(t.hreq, err) // not reported to the client
+				}
 			}
 			if i < last {
 				go run()
@@ -231,46 +436,129 @@ func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
 			}
 		}
 
-		// Wait for all the handlers to return, then deliver any responses.
+		// Wait for all the handlers to return and the batch to settle, then
+		// deliver any responses.
 		wg.Wait()
-		return s.deliver(tasks.responses(s.rpcLog), ch, time.Since(start))
+		b.finish()
+		s.mu.Lock()
+		delete(s.runs, b)
+		s.mu.Unlock()
+		if turn != nil {
+			defer close(turn)
+			if prev != nil {
+				<-prev
+			}
+		}
+		return s.deliver(tasks, ch, s.clock.Now().Sub(start))
 	}
 }
 
-// deliver cleans up completed responses and arranges their replies (if any) to
-// be sent back to the client.
-func (s *Server) deliver(rsps jmessages, ch channel.Sender, elapsed time.Duration) error {
+// deliver cleans up completed tasks and arranges their replies (if any) to be
+// sent back to the client.
+func (s *Server) deliver(ts tasks, ch channel.Sender, elapsed time.Duration) error {
+	for _, t := range ts {
+		if t.stop != nil {
+			t.stop()
+		}
+	}
+	rsps := ts.responses(s.rpcLog, s.cidData)
 	if len(rsps) == 0 {
 		return nil
+	} else if ch == nil {
+		return ErrConnClosed // the server stopped before the batch was dispatched
 	}
 	s.log("Completed %d requests [%v elapsed]", len(rsps), elapsed)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Ensure all the inflight requests get their contexts cancelled.
-	for _, rsp := range rsps {
-		s.cancel(string(rsp.ID))
+	// Ensure all the inflight requests get their contexts cancelled, and
+	// release their IDs for reuse. Only the task that reserved an ID releases
+	// it, since a response may also be an error for a duplicate of an ID that
+	// is still in flight.
+	for _, t := range ts {
+		if t.held {
+			s.cancel(idKey(t.hreq.id))
+		}
+	}
+	s.compress(rsps)
+
+	bits, err := rsps.toJSON()
+	if err != nil {
+		return err
 	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	err = s.write(ch, bits)
+	s.countResponses(rsps)
+	return err
+}
 
-	nw, err := encode(ch, rsps)
-	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+// write sends bits to the client via ch, and records the number of bytes
+// written. If the write fails, the client can no longer be reached, so write
+// stops the server with the error. This cancels the requests still in flight,
+// so that their handlers need not finish work whose results cannot be
+// delivered. The caller must hold s.mu and s.wmu.
+func (s *Server) write(ch channel.Sender, bits []byte) error {
+	err := ch.Send(bits)
+	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(len(bits)))
+	if err != nil {
+		s.log("Writing to client: %v", err)
+		s.stop(err)
+	}
 	return err
 }
 
+// countResponses records the number of responses sent to the client, and the
+// number of error responses for each error code.
+func (s *Server) countResponses(rsps jmessages) {
+	s.metrics.Count("rpc.responses", int64(len(rsps)))
+	for _, rsp := range rsps {
+		if rsp.E != nil {
+			s.metrics.Count("rpc.errorCodes."+strconv.Itoa(int(rsp.E.code)), 1)
+		}
+	}
+}
+
 // checkAndAssign resolves all the task handlers for the given batch, or
 // records errors for them as appropriate. The caller must hold s.mu.
-func (s *Server) checkAndAssign(next jmessages) tasks {
+func (s *Server) checkAndAssign(b *batch, next jmessages) tasks {
 	var ts tasks
+	dups := batchDups(next)
 	for _, req := range next {
-		s.log("Checking request for %q: %s", req.M, string(req.P))
 		fid := fixID(req.ID)
+		s.seq++
 		t := &task{
-			hreq:  &Request{id: fid, method: req.M, params: req.P},
+			hreq: &Request{
+				id:     fid,
+				method: req.M,
+				params: req.P,
+				useNum: s.useNum,
+				codec:  s.jcodec,
+				cid:    s.cidBase + "-" + strconv.FormatInt(s.seq, 10),
+			},
 			batch: req.batch,
+			v1:    s.isV1(req),
+		}
+		s.log("[%s] Checking request for %q: %s", t.hreq.cid, req.M, string(req.P))
+		if s.keepRaw {
+			t.hreq.raw = req.raw
 		}
+		t.hreq.meta = req.meta
+		t.hreq.recvd = req.recv
 		if req.err != nil {
 			t.err = req.err // deferred validation error
-		} else if id := string(fid); id != "" && s.used[id] != nil {
+		} else if seen, ok := dups[idKey(fid)]; ok && req.isRequestOrNotification() {
+			// Reject all the requests that share this ID, but report the
+			// error only once, so the client gets one response for the ID.
+			if seen {
+				continue
+			}
+			dups[idKey(fid)] = true
+			t.err = Errorf(code.InvalidRequest, "duplicate request id %q in batch", string(fid))
+		} else if s.strict && len(req.extra) != 0 {
+			t.err = DataErrorf(code.InvalidRequest, req.extra, "extra fields in request: %s",
+				strings.Join(req.extra, ", "))
+		} else if id := string(fid); id != "" && req.isRequestOrNotification() && s.used[idKey(fid)] != nil {
 			t.err = Errorf(code.InvalidRequest, "duplicate request id %q", id)
 		} else if !s.versionOK(req.V) {
 			t.err = ErrInvalidVersion
@@ -282,29 +570,109 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 			continue // don't send a reply for this
 		} else if req.M == "" {
 			t.err = Errorf(code.InvalidRequest, "empty method name")
-		} else if s.setContext(t, id) {
+		} else if s.interceptCancel(req) {
+			continue // handled already; no reply is needed
+		} else if retry, ok := s.off[req.M]; ok {
+			s.metrics.Count("rpc.unavailableCalls", 1)
+			s.metrics.Count("rpc.unavailableCalls."+req.M, 1)
+			if req.isNotification() {
+				s.log("[%s] Dropping notification to disabled method %q", t.hreq.cid, req.M)
+				continue // there is no one to tell
+			}
+			t.err = DataErrorf(code.Unavailable, &UnavailableError{
+				Method:     req.M,
+				RetryAfter: retry.Seconds(),
+			}, "method %q is unavailable", req.M)
+		} else if !s.setContext(b, t, idKey(fid)) {
+			// t.err reports why
+		} else if err := s.authorize(t); err != nil && req.isNotification() {
+			s.log("[%s] Dropping unauthorized notification to %q: %v", t.hreq.cid, req.M, err)
+			continue // there is no one to tell
+		} else if err != nil {
+			t.err = err
+		} else {
 			t.m = s.assign(t.ctx, req.M)
-			if t.m == nil {
+			if t.m == nil && len(s.icept) != 0 {
+				t.m = notFound // so the interceptors observe the call
+			} else if t.m == nil {
 				t.err = Errorf(code.MethodNotFound, "no such method %q", req.M)
+			} else if d, ok := t.m.(DeprecatedHandler); ok && s.rejDep {
+				t.err = Errorf(code.Deprecated, "method %q is deprecated: %s", req.M, d.Deprecated())
 			}
 		}
 
+		if s.sample != nil && s.sample.sel(t.hreq) {
+			t.pick = true
+		}
 		if t.err != nil {
-			s.log("Task error: %v", t.err)
+			s.log("[%s] Task error: %v", t.hreq.cid, t.err)
 			s.metrics.Count("rpc.errors", 1)
+		} else {
+			s.live[t.hreq.method]++
 		}
 		ts = append(ts, t)
 	}
 	return ts
 }
 
-// setContext constructs and attaches a request context to t, and reports
-// whether this succeeded.
-func (s *Server) setContext(t *task, id string) bool {
-	base, params, err := s.dectx(context.Background(), t.hreq.method, t.hreq.params)
+// batchDups returns a map whose keys are the IDs (see idKey) shared by more
+// than one valid request in the batch, each mapped to false.
+func batchDups(next jmessages) map[string]bool {
+	if len(next) < 2 {
+		return nil
+	}
+	var dups map[string]bool
+	count := make(map[string]int)
+	for _, req := range next {
+		if req.err != nil || !req.isRequestOrNotification() {
+			continue
+		} else if key := idKey(req.ID); key != "" {
+			count[key]++
+			if count[key] == 2 {
+				if dups == nil {
+					dups = make(map[string]bool)
+				}
+				dups[key] = false
+			}
+		}
+	}
+	return dups
+}
+
+// authorize checks the authorization of t, if the server has an authorization
+// hook, and reports the error with which t fails if it is not authorized. If
+// the hook returns a context, it replaces the context of t. The caller must
+// hold s.mu.
+func (s *Server) authorize(t *task) error {
+	if s.auth == nil {
+		return nil
+	}
+	ctx, err := s.auth(t.ctx, t.hreq.method, t.hreq.params)
+	if err == nil {
+		if ctx != nil {
+			t.ctx = ctx
+		}
+		return nil
+	}
+	s.metrics.Count("rpc.unauthorized", 1)
+	c := code.FromError(err)
+	if c != code.Replayed {
+		c = code.Unauthorized
+	}
+	return Errorf(c, "request not authorized: %v", err)
+}
+
+// setContext constructs and attaches a request context to t, derived from
+// the context of batch b, and reports whether this succeeded. If key != "",
+// the request ID is reserved under that key (see idKey).
+func (s *Server) setContext(b *batch, t *task, key string) bool {
+	base, params, err := s.dectx(b.ctx, t.hreq.method, t.hreq.params)
 	t.hreq.params = params
-	if err != nil {
-		t.err = Errorf(code.InternalError, "invalid request context: %v", err)
+	if e, ok := err.(*Error); ok {
+		t.err = e
+		return false
+	} else if err != nil {
+		t.err = Errorf(code.InvalidParams, "invalid request context: %v", err)
 		return false
 	}
 
@@ -314,18 +682,98 @@ func (s *Server) setContext(t *task, id string) bool {
 		return false
 	}
 
+	// The context decoder may not have preserved the batch; if so, restore it.
+	if batchFromContext(base) != b {
+		base = context.WithValue(base, batchKey{}, b)
+	}
 	t.ctx = context.WithValue(base, inboundRequestKey{}, t.hreq)
 
+	// Apply the request timeout, if any. Its resources are released when the
+	// task is delivered, since the context decoder may have detached the
+	// request from the batch context.
+	if s.timeout > 0 {
+		t.ctx, t.stop = withTimeout(t.ctx, s.clock, s.timeout)
+	}
+
 	// Store the cancellation for a request that needs a reply, so that we can
 	// respond to rpc.cancel requests.
-	if id != "" {
+	if key != "" {
 		ctx, cancel := context.WithCancel(t.ctx)
-		s.used[id] = cancel
+		s.used[key] = cancel
 		t.ctx = ctx
+		t.held = true
 	}
 	return true
 }
 
+// runTask invokes the handler for t, subject to the injected fault f. If f ==
+// nil, runTask is equivalent to invoke.
+func (s *Server) runTask(t *task, f *Fault) (json.RawMessage, error) {
+	if f == nil {
+		return s.invoke(t.ctx, t.m, t.hreq)
+	}
+	s.log("[%s] Injecting %s fault for %q", t.hreq.cid, f.Kind, t.hreq.method)
+	s.metrics.Count("rpc.faultsInjected", 1)
+	s.metrics.Count("rpc.faultsInjected."+f.Kind.String(), 1)
+	switch f.Kind {
+	case FaultDelay:
+		select {
+		case <-s.clock.After(f.delay()):
+		case <-t.ctx.Done():
+			return nil, t.ctx.Err()
+		}
+	case FaultError:
+		return nil, f.err()
+	case FaultDrop:
+		// Since no response is delivered, release the request ID here.
+		val, err := s.invoke(t.ctx, t.m, t.hreq)
+		s.mu.Lock()
+		s.cancel(idKey(t.hreq.id))
+		s.mu.Unlock()
+		t.drop, t.held = true, false
+		return val, err
+	case FaultDisconnect:
+		s.mu.Lock()
+		s.stop(errFaultDisconnect)
+		s.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	return s.invoke(t.ctx, t.m, t.hreq)
+}
+
+// handle calls h with the specified request, through the interceptors of the
+// server if it has any. If h or an interceptor panics, the panic is logged and
+// reported as an InternalError. The message of the error does not include the
+// panic value, which may expose server internals.
+func (s *Server) handle(ctx context.Context, h Handler, req *Request) (v interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := debug.Stack()
+			s.metrics.Count("rpc.panics", 1)
+			s.log("[%s] Handler for %q panicked: %v\n%s", req.cid, req.Method(), p, stack)
+			var data interface{}
+			if s.pstack {
+				data = string(stack)
+			}
+			v, err = nil, DataErrorf(code.InternalError, data, "handler for %q panicked", req.Method())
+		}
+	}()
+	next := h.Handle
+	for i := len(s.icept) - 1; i >= 0; i-- {
+		ic, inner := s.icept[i], next
+		next = func(ctx context.Context, req *Request) (interface{}, error) {
+			return ic(ctx, req, inner)
+		}
+	}
+	return next(ctx, req)
+}
+
+// notFound is the handler assigned to a method that does not exist, when the
+// server has interceptors.
+var notFound = methodFunc(func(_ context.Context, req *Request) (interface{}, error) {
+	return nil, Errorf(code.MethodNotFound, "no such method %q", req.Method())
+})
+
 // invoke invokes the handler m for the specified request type, and marshals
 // the return value into JSON if there is one.
 func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.RawMessage, error) {
@@ -334,17 +782,174 @@ func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.Raw
 		return nil, err
 	}
 	defer s.sem.Release(1)
+	if err := ctx.Err(); err != nil && !req.IsNotification() {
+		// A slot may be granted after ctx ends, for example when the server
+		// stops and a running handler releases its slot to a waiting call.
+		// Do not start a handler for a call that is already cancelled.
+		// Notifications are handled even after a stop (see nextRequest).
+		return nil, err
+	}
+	s.metrics.SetMaxValue("rpc.activeHandlers", int64(atomic.AddInt32(&s.active, 1)))
+	defer atomic.AddInt32(&s.active, -1)
 
+	if d, ok := h.(DeprecatedHandler); ok {
+		s.metrics.Count("rpc.deprecatedCalls", 1)
+		s.metrics.Count("rpc.deprecatedCalls."+req.Method(), 1)
+		s.onDep(ctx, req, d.Deprecated())
+	}
 	s.rpcLog.LogRequest(ctx, req)
-	v, err := h.Handle(ctx, req)
+	start := s.clock.Now()
+	if !req.recvd.IsZero() {
+		s.metrics.CountAndSetMax("rpc.queueMicros", start.Sub(req.recvd).Microseconds())
+	}
+	if s.slowMin > 0 {
+		defer s.checkSlow(req, start)()
+	}
+	v, err := s.handle(ctx, h, req)
+	s.metrics.CountAndSetMax("rpc.handlerMicros", s.clock.Now().Sub(start).Microseconds())
 	if err != nil {
 		if req.IsNotification() {
-			s.log("Discarding error from notification to %q: %v", req.Method(), err)
-			return nil, nil // a notification
+			s.log("[%s] Discarding error from notification to %q: %v", req.cid, req.Method(), err)
+		}
+		return nil, err
+	}
+	bits, err := s.encodeResult(v)
+	if _, ok := err.(*Error); err != nil && !ok {
+		s.metrics.Count("rpc.marshalErrors", 1)
+		s.log("[%s] Marshaling %T result of %q: %v", req.cid, v, req.Method(), err)
+		return nil, Errorf(code.InternalError, "marshaling result of %q: %v", req.Method(), err)
+	}
+	if err == nil && s.maxRes > 0 && len(bits) > s.maxRes && !req.IsNotification() {
+		s.metrics.Count("rpc.resultTooLarge", 1)
+		s.metrics.Count("rpc.resultTooLarge."+req.Method(), 1)
+		s.log("[%s] Discarding %d-byte result for %q (limit %d)", req.cid, len(bits), req.Method(), s.maxRes)
+		return nil, DataErrorf(code.ResultTooLarge, &ResultSizeError{
+			Method: req.Method(),
+			Size:   len(bits),
+			Limit:  s.maxRes,
+		}, "result size %d exceeds limit %d", len(bits), s.maxRes)
+	}
+	return bits, err
+}
+
+// checkSlow records that the handler for req started at the given time, and
+// returns a function to be called when the handler returns, which logs and
+// counts the request if it was slow.
+func (s *Server) checkSlow(req *Request, start time.Time) func() {
+	since := start
+	if s.slowQ && !req.recvd.IsZero() {
+		since = req.recvd
+	}
+	s.mu.Lock()
+	s.busy[req.cid] = busyRequest{req: req, since: since}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.busy, req.cid)
+		s.mu.Unlock()
+
+		elapsed := s.clock.Now().Sub(since)
+		if elapsed <= s.slowMin {
+			return
+		}
+		s.metrics.Count("rpc.slowRequests", 1)
+		s.metrics.Count("rpc.slowRequests."+req.method, 1)
+		id := string(req.id)
+		if id == "" {
+			id = "none"
+		}
+		s.log("[%s] WARNING: Slow request for %q (id %s): %v elapsed, %d bytes of params",
+			req.cid, req.method, id, elapsed, len(req.params))
+	}
+}
+
+// A busyRequest is a request whose handler is running, and the time from
+// which it is timed for slow request tracking.
+type busyRequest struct {
+	req   *Request
+	since time.Time
+}
+
+// capture hands a completed request to the sampler.
+func (s *Server) capture(t *task, result json.RawMessage, err error, elapsed time.Duration) {
+	if s.sample.push(sample{req: t.hreq, result: result, err: err, elapsed: elapsed}) {
+		s.metrics.Count("rpc.samples", 1)
+	} else {
+		s.metrics.Count("rpc.samplesDropped", 1)
+	}
+}
+
+// finished records that a handler for the named method has returned.
+func (s *Server) finished(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live[name]--
+	if s.live[name] == 0 {
+		delete(s.live, name)
+		close(s.idle)
+		s.idle = make(chan struct{})
+	}
+}
+
+// DisableMethods causes s to refuse requests for the named methods until they
+// are re-enabled by EnableMethods. A call to a disabled method fails with
+// code.Unavailable, and a notification to a disabled method is discarded.
+// Requests already dispatched to handlers are not affected; use DrainMethods
+// to wait for them to finish. Disabling a method that is already disabled has
+// no further effect.
+func (s *Server) DisableMethods(names ...string) { s.DisableMethodsRetry(0, names...) }
+
+// DisableMethodsRetry is as DisableMethods, but the errors reported for calls
+// to the named methods suggest that the client wait for retryAfter before
+// trying again. If the methods are already disabled, their retry delay is
+// updated.
+func (s *Server) DisableMethodsRetry(retryAfter time.Duration, names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.off[name] = retryAfter
+	}
+}
+
+// EnableMethods re-enables the named methods, if they were disabled by a
+// previous call to DisableMethods.
+func (s *Server) EnableMethods(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		delete(s.off, name)
+	}
+}
+
+// DrainMethods blocks until no handlers for any of the named methods are in
+// flight, or until ctx ends. It reports nil if the methods drained, or else
+// the error from ctx. DrainMethods does not prevent new requests from being
+// dispatched to the methods, so it should usually follow a call to
+// DisableMethods. A handler must not drain its own method, as that will
+// never complete.
+func (s *Server) DrainMethods(ctx context.Context, names ...string) error {
+	for {
+		s.mu.Lock()
+		busy := false
+		for _, name := range names {
+			if s.live[name] != 0 {
+				busy = true
+				break
+			}
+		}
+		idle := s.idle
+		s.mu.Unlock()
+
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
 		}
-		return nil, err // a call reporting an error
 	}
-	return json.Marshal(v)
 }
 
 // ServerInfo returns an atomic snapshot of the current server info for s.
@@ -352,7 +957,7 @@ func (s *Server) ServerInfo() *ServerInfo {
 	info := &ServerInfo{
 		Methods:     s.mux.Names(),
 		UsesContext: s.expctx,
-		StartTime:   s.start,
+		AllowV1:     s.allow1,
 		Counter:     make(map[string]int64),
 		MaxValue:    make(map[string]int64),
 		Label:       make(map[string]interface{}),
@@ -362,9 +967,66 @@ func (s *Server) ServerInfo() *ServerInfo {
 		MaxValue: info.MaxValue,
 		Label:    info.Label,
 	})
+	if d, ok := s.mux.(DeprecationNamer); ok {
+		if deps := d.Deprecations(); len(deps) != 0 {
+			info.Deprecated = deps
+		}
+	}
+	s.mu.Lock()
+	info.StartTime = s.start
+	info.Running = s.ch != nil
+	for name := range s.off {
+		info.Disabled = append(info.Disabled, name)
+	}
+	if q := s.push; q != nil {
+		info.PushQueue = &PushQueueInfo{Length: len(q.buf), HighWater: q.high, Dropped: q.drops}
+	}
+	now := s.clock.Now()
+	for cid, b := range s.busy {
+		if elapsed := now.Sub(b.since); elapsed > s.slowMin {
+			info.SlowRequests = append(info.SlowRequests, &SlowRequest{
+				Method:        b.req.method,
+				ID:            b.req.id,
+				CorrelationID: cid,
+				Elapsed:       elapsed,
+			})
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(info.Disabled)
+	sort.Slice(info.SlowRequests, func(i, j int) bool {
+		return info.SlowRequests[i].Elapsed > info.SlowRequests[j].Elapsed
+	})
 	return info
 }
 
+// Metrics returns a snapshot of the metrics of s. Unlike ServerInfo, it does
+// not describe the methods of the server, so it is cheap enough to call
+// frequently, for example to export the metrics to a monitoring system. It
+// does not depend on the built-in rpc.serverInfo method being enabled.
+//
+// The metrics, Held, and Active are each read separately while the server
+// continues to run, so they need not agree exactly with one another. For
+// example, a request counted in Held may not yet be reflected in the
+// counters.
+func (s *Server) Metrics() *MetricsSnapshot {
+	snap := &MetricsSnapshot{
+		Counter:  make(map[string]int64),
+		MaxValue: make(map[string]int64),
+		Label:    make(map[string]interface{}),
+		Active:   int(atomic.LoadInt32(&s.active)),
+	}
+	s.metrics.Snapshot(metrics.Snapshot{
+		Counter:  snap.Counter,
+		MaxValue: snap.MaxValue,
+		Label:    snap.Label,
+	})
+	s.mu.Lock()
+	snap.Held = s.work
+	s.mu.Unlock()
+	return snap
+}
+
 // Notify posts a single server-side notification to the client.
 //
 // This is a non-standard extension of JSON-RPC, and may not be supported by
@@ -376,14 +1038,15 @@ func (s *Server) Notify(ctx context.Context, method string, params interface{})
 	if !s.allowP {
 		return ErrPushUnsupported
 	}
-	_, err := s.pushReq(ctx, false /* no ID */, method, params)
+	_, err := s.pushReq(ctx, nil, false /* no ID */, method, params)
 	return err
 }
 
 // Callback posts a single server-side call to the client. It blocks until a
-// reply is received or the client connection terminates.  A successful
-// callback reports a nil error and a non-nil response. Errors returned by the
-// client have concrete type *jrpc2.Error.
+// reply is received, ctx ends, or the client connection terminates.  A
+// successful callback reports a nil error and a non-nil response. Errors
+// returned by the client have concrete type *jrpc2.Error. If ctx ends before
+// the reply arrives, Callback reports the error from ctx.
 //
 // This is a non-standard extension of JSON-RPC, and may not be supported by
 // all clients. Unless s was constructed with the AllowPush option set true,
@@ -394,7 +1057,7 @@ func (s *Server) Callback(ctx context.Context, method string, params interface{}
 	if !s.allowP {
 		return nil, ErrPushUnsupported
 	}
-	rsp, err := s.pushReq(ctx, true /* set ID */, method, params)
+	rsp, err := s.pushReq(ctx, nil, true /* set ID */, method, params)
 	if err != nil {
 		return nil, err
 	}
@@ -405,10 +1068,15 @@ func (s *Server) Callback(ctx context.Context, method string, params interface{}
 	return rsp, nil
 }
 
-func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params interface{}) (rsp *Response, _ error) {
+// pushReq posts a request to the client on behalf of Notify and Callback. If
+// during != nil, the request is posted only if during has not ended, and
+// otherwise pushReq reports ErrRequestDone. The check is made under the same
+// lock as the write, so that unless pushes are queued, the push is not sent
+// after the response to the request whose context is during.
+func (s *Server) pushReq(ctx, during context.Context, wantID bool, method string, params interface{}) (rsp *Response, _ error) {
 	var bits []byte
 	if params != nil {
-		v, err := json.Marshal(params)
+		v, err := s.jcodec.Marshal(params)
 		if err != nil {
 			return nil, err
 		}
@@ -418,6 +1086,8 @@ func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params
 	defer s.mu.Unlock()
 	if s.ch == nil {
 		return nil, ErrConnClosed
+	} else if during != nil && during.Err() != nil {
+		return nil, ErrRequestDone
 	}
 
 	kind := "notification"
@@ -427,24 +1097,64 @@ func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params
 		id := strconv.FormatInt(s.callID, 10)
 		s.callID++
 		jid = json.RawMessage(id)
+		pctx, cancel := context.WithCancel(ctx)
 		rsp = &Response{
 			ch:     make(chan *jmessage, 1),
 			id:     id,
-			cancel: func() {},
+			codec:  s.jcodec,
+			cancel: cancel,
 		}
 		s.call[id] = rsp
+		go s.waitCallback(pctx, rsp)
 	}
 
-	s.log("Posting server %s %q %s", kind, method, string(bits))
-	nw, err := encode(s.ch, jmessages{{
-		V:  Version,
-		ID: jid,
-		M:  method,
-		P:  bits,
-	}})
-	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+	msg := &jmessage{V: Version, ID: jid, M: method, P: bits}
+	var err error
+	if s.push != nil {
+		err = s.queuePush(&pushItem{kind: kind, msg: msg, rsp: rsp})
+	} else {
+		err = s.post(kind, msg)
+	}
+	if err != nil {
+		if rsp != nil {
+			delete(s.call, rsp.id)
+			rsp.cancel()
+		}
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// waitCallback waits for the context of a pending callback to end. If the
+// callback is still waiting for its reply, it fails with the error from the
+// context.
+func (s *Server) waitCallback(ctx context.Context, rsp *Response) {
+	<-ctx.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.call[rsp.id] != rsp {
+		return // the reply was delivered, or the callback already failed
+	}
+	delete(s.call, rsp.id)
+	err := ctx.Err()
+	rsp.ch <- &jmessage{
+		ID: json.RawMessage(rsp.id),
+		E:  &Error{code: code.FromError(err), message: err.Error()},
+	}
+}
+
+// post writes a push message directly to the client, bypassing the push
+// queue. The caller must hold s.mu, and the server must be running.
+func (s *Server) post(kind string, msg *jmessage) error {
+	s.log("Posting server %s %q %s", kind, msg.M, string(msg.P))
+	bits, err := jmessages{msg}.toJSON()
+	if err != nil {
+		return err
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
 	s.metrics.Count("rpc."+kind+"s", 1)
-	return rsp, err
+	return s.write(s.ch, bits)
 }
 
 // Stop shuts down the server. It is safe to call this method multiple times or
@@ -455,6 +1165,280 @@ func (s *Server) Stop() {
 	s.stop(errServerStopped)
 }
 
+// Shutdown gracefully stops the server. Requests already received, whether
+// queued or in flight, are handled and their responses are sent before the
+// channel is closed. Calls received after Shutdown begins fail with
+// code.ShuttingDown, whose error data is a ShutdownInfo giving the time left
+// until ctx's deadline, if any. Notifications received after that are
+// discarded. If ctx ends before the requests are finished, the remaining
+// handlers are cancelled, the server stops, and Shutdown reports the error
+// from ctx. Otherwise, or if the server is not running, it reports nil. As
+// with Stop, Wait returns once everything has settled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var info ShutdownInfo
+	if dl, ok := ctx.Deadline(); ok {
+		if d := time.Until(dl); d > 0 {
+			info.Grace = d.Seconds()
+		}
+	}
+	drain := s.beginDrain(info, false)
+	if drain == nil {
+		return nil // nothing is running
+	}
+
+	var err error
+	select {
+	case <-drain:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.log("Server drain ended: %v", err)
+	}
+	s.Stop()
+	return err
+}
+
+// beginDrain starts draining the server, if it is not already, and returns a
+// channel that is closed once its work is done. If announce is true, the
+// client is notified of the shutdown (see AnnounceShutdown). If the server is
+// not running, beginDrain returns nil.
+func (s *Server) beginDrain(info ShutdownInfo, announce bool) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		return nil
+	} else if s.drain != nil {
+		return s.drain // already draining
+	}
+	s.log("Server draining %d request batches", s.work)
+	s.shut = &info
+	s.drain = make(chan struct{})
+	if announce {
+		s.log("Shutdown announced [%gs grace]: %s", info.Grace, info.Reason)
+	}
+	if announce && s.allowP {
+		// Send the notification directly, since a queued push may be
+		// discarded when the server stops.
+		bits, _ := json.Marshal(info)
+		msg := &jmessage{V: Version, M: rpcShutdown, P: bits}
+		if err := s.post("notification", msg); err != nil {
+			s.log("Sending shutdown notification: %v", err)
+		}
+	}
+	s.checkDrain()
+	return s.drain
+}
+
+// admit records the receipt of a batch of requests, and returns the messages
+// to be enqueued for the dispatcher, and how long to delay them for the rate
+// limit. While the server is draining, or if the rate limit is exceeded, calls
+// are marked to fail and notifications are discarded. If the server already
+// holds as many batches as it may, the batch is shed (see shed) and admit
+// returns no messages.
+func (s *Server) admit(in jmessages) (jmessages, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxQ > 0 && s.work >= s.maxQ {
+		s.shed(in)
+		return nil, 0
+	}
+	var delay time.Duration
+	if s.rate != nil {
+		now := s.clock.Now()
+		keep := in[:0]
+		for _, req := range in {
+			if req.isRequestOrNotification() && req.err == nil {
+				if d, ok := s.rate.reserve(now); ok {
+					delay = d // N.B. each delay is at least the one before
+				} else if req.isNotification() {
+					s.metrics.Count("rpc.rateLimited", 1)
+					s.log("Discarding notification %q over the rate limit", req.M)
+					continue
+				} else {
+					s.metrics.Count("rpc.rateLimited", 1)
+					req.err = Errorf(code.RateLimited, "request rate limit exceeded")
+				}
+			}
+			keep = append(keep, req)
+		}
+		in = keep
+	}
+	if s.drain != nil {
+		keep := in[:0]
+		for _, req := range in {
+			if req.isNotification() {
+				s.log("Discarding notification %q received while draining", req.M)
+				continue
+			} else if req.isRequestOrNotification() && req.err == nil {
+				s.metrics.Count("rpc.shutdownCalls", 1)
+				req.err = DataErrorf(code.ShuttingDown, *s.shut, "server is shutting down")
+			}
+			keep = append(keep, req)
+		}
+		in = keep
+	}
+	if len(in) != 0 {
+		s.work++
+		s.metrics.SetMaxValue("rpc.heldBatches", int64(s.work))
+	}
+	return in, delay
+}
+
+// shed replies to each call in a batch that the server is too busy to queue
+// with code.Overloaded, and discards its notifications. Requests that failed
+// validation are reported as usual. The caller must hold s.mu.
+func (s *Server) shed(in jmessages) {
+	s.metrics.Count("rpc.overloaded", 1)
+	var rsps jmessages
+	for _, req := range in {
+		if req.isNotification() {
+			s.log("Discarding notification %q; server overloaded", req.M)
+			continue
+		}
+		rsp := &jmessage{V: Version, ID: fixID(req.ID), batch: req.batch}
+		if s.isV1(req) {
+			rsp.V = "" // reply in kind; see appendV1
+		}
+		if rsp.ID == nil {
+			rsp.ID = json.RawMessage("null")
+		}
+		if e, ok := req.err.(*Error); ok {
+			rsp.E = e
+		} else if req.err != nil {
+			rsp.E = &Error{code: code.FromError(req.err), message: req.err.Error()}
+		} else {
+			rsp.E = &Error{code: code.Overloaded, message: "server overloaded"}
+		}
+		rsps = append(rsps, rsp)
+	}
+	s.log("Shedding %d requests; %d batches held", len(in), s.work)
+	if len(rsps) == 0 || s.ch == nil {
+		return
+	}
+
+	bits, err := rsps.toJSON()
+	if err != nil {
+		s.log("Encoding overload response: %v", err)
+		return
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.write(s.ch, bits)
+	s.countResponses(rsps)
+}
+
+// batchDone records that a batch of requests is finished, and its responses
+// (if any) have been sent.
+func (s *Server) batchDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.work--
+	if s.work == 0 && s.maxIdle > 0 {
+		s.touch() // restart the idle timer
+	}
+	s.checkDrain()
+}
+
+// touch records the current time as the time of the last activity on the
+// connection, for the idle timeout.
+func (s *Server) touch() { atomic.StoreInt64(&s.lastRx, s.clock.Now().UnixNano()) }
+
+// watchIdle stops the server with ErrIdleTimeout if no message is received
+// for s.maxIdle while no batches are held, until quit is closed.
+func (s *Server) watchIdle(quit <-chan struct{}) {
+	wait := s.maxIdle
+	for {
+		select {
+		case <-quit:
+			return
+		case <-s.clock.After(wait):
+		}
+		s.mu.Lock()
+		if s.quit != quit {
+			s.mu.Unlock()
+			return // the server has already stopped
+		}
+		wait = s.maxIdle
+		if s.work == 0 {
+			idle := s.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&s.lastRx)))
+			if idle >= s.maxIdle {
+				s.log("Connection idle for %v; stopping", idle)
+				s.metrics.Count("rpc.idleTimeouts", 1)
+				s.stop(ErrIdleTimeout)
+				s.mu.Unlock()
+				return
+			}
+			wait = s.maxIdle - idle
+		}
+		s.mu.Unlock()
+	}
+}
+
+// watchContext stops the server when ctx ends, unless quit is closed first to
+// signal that the server has already stopped.
+func (s *Server) watchContext(ctx context.Context, quit <-chan struct{}) {
+	select {
+	case <-quit:
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.quit == quit {
+			s.log("Server context ended: %v", ctx.Err())
+			s.stop(ctx.Err())
+		}
+	}
+}
+
+// baseContext returns a new base context for a batch of requests. The caller
+// must hold s.mu.
+func (s *Server) baseContext() context.Context {
+	if s.newctx != nil {
+		return s.newctx()
+	} else if s.base != nil {
+		return s.base
+	}
+	return context.Background()
+}
+
+// checkDrain signals a draining server if all its work is done, or it has
+// stopped. The caller must hold s.mu.
+func (s *Server) checkDrain() {
+	if s.drain != nil && (s.work == 0 || s.ch == nil) {
+		select {
+		case <-s.drain:
+		default:
+			close(s.drain)
+		}
+	}
+}
+
+// AnnounceShutdown gracefully stops the server, as Shutdown does with a
+// deadline of grace. In addition, it first sends an "rpc.shutdown"
+// notification to the client, whose parameters (see ShutdownInfo) report grace
+// and reason. The same ShutdownInfo is the error data of the calls refused
+// while the server drains. AnnounceShutdown blocks until the server is
+// stopped, and reports nil, even if grace expires first or the server is not
+// running.
+//
+// The notification is a non-standard extension of JSON-RPC, and is sent only
+// if s was constructed with the AllowPush option set true. Otherwise the
+// shutdown proceeds without it. The notification is not subject to the push
+// queue, if there is one. If the server is already draining, no notification
+// is sent.
+func (s *Server) AnnounceShutdown(grace time.Duration, reason string) error {
+	drain := s.beginDrain(ShutdownInfo{Grace: grace.Seconds(), Reason: reason}, true)
+	if drain == nil {
+		return nil // nothing is running
+	}
+
+	select {
+	case <-drain:
+	case <-s.clock.After(grace):
+		s.log("Shutdown grace period expired")
+	}
+	s.Stop()
+	return nil
+}
+
 // ServerStatus describes the status of a stopped server.
 type ServerStatus struct {
 	Err error // the error that caused the server to stop (nil on success)
@@ -476,20 +1460,25 @@ func (s ServerStatus) Closed() bool { return s.Err == nil && !s.stopped }
 // safe to call s.Start again to restart the server with a fresh channel.
 func (s *Server) WaitStatus() ServerStatus {
 	s.wg.Wait()
-	// Postcondition check.
-	if s.inq.Len() != 0 {
-		panic("s.inq is not empty at shutdown")
-	}
-	exitErr := s.err
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+
 	// Don't remark on a closed channel or EOF as a noteworthy failure.
-	if s.err == io.EOF || channel.IsErrClosing(s.err) || s.err == errServerStopped {
+	exitErr := err
+	if errors.Is(err, io.EOF) || channel.IsErrClosing(err) || err == errServerStopped {
 		exitErr = nil
 	}
-	return ServerStatus{Err: exitErr, stopped: s.err == errServerStopped}
+	return ServerStatus{Err: exitErr, stopped: err == errServerStopped}
 }
 
 // Wait blocks until the server terminates and returns the resulting error.
 // It is equivalent to s.WaitStatus().Err.
+//
+// A clean disconnect by the client (io.EOF or a closed channel) and a call to
+// Stop both report nil; use WaitStatus to tell them apart. Any other failure
+// of the channel is returned as-is. If the server stops for more than one
+// reason, the first one is reported.
 func (s *Server) Wait() error { return s.WaitStatus().Err }
 
 // stop shuts down the connection and records err as its final state.  The
@@ -500,79 +1489,199 @@ func (s *Server) stop(err error) {
 		return // nothing is running
 	}
 	s.log("Server signaled to stop with err=%v", err)
-	s.ch.Close()
 
-	// Remove any pending requests from the queue, but retain notifications.
-	// The server will process pending notifications before giving up.
-	//
-	// TODO(@creachadair): We need better tests for this behaviour.
-	var keep jmessages
-	for cur := s.inq.Front(); cur != nil; cur = s.inq.Front() {
-		for _, req := range cur.Value.(jmessages) {
-			if req.isNotification() {
-				keep = append(keep, req)
-				s.log("Retaining notification %p", req)
-			} else {
-				s.cancel(string(req.ID))
-			}
-		}
-		s.inq.Remove(cur)
-	}
-	for _, elt := range keep {
-		s.inq.PushBack(jmessages{elt})
-	}
-	s.work.Broadcast()
+	// Closing the channel causes the reader to exit and close the request
+	// queue. Requests still in the queue are discarded by the dispatcher, but
+	// notifications are retained (see nextRequest).
+	s.ch.Close()
 
-	// Cancel any in-flight requests that made it out of the queue.
+	// Cancel any in-flight requests that made it out of the queue, and the
+	// contexts of the batches they belong to, so that notification handlers
+	// also see the server stop.
 	for id, cancel := range s.used {
 		cancel()
 		delete(s.used, id)
 	}
+	for b := range s.runs {
+		b.cancel()
+		delete(s.runs, b)
+	}
 
 	// Postcondition check.
 	if len(s.used) != 0 {
 		panic("s.used is not empty at shutdown")
 	}
+	s.clearPushes()
+
+	// Fail any callbacks still waiting for a reply from the client.
+	for id, rsp := range s.call {
+		delete(s.call, id)
+		rsp.ch <- &jmessage{
+			ID: json.RawMessage(id),
+			E:  &Error{code: code.SystemError, message: ErrConnClosed.Error()},
+		}
+	}
 
+	if s.quit != nil {
+		close(s.quit)
+		s.quit = nil
+	}
 	s.err = err
 	s.ch = nil
+	s.checkDrain() // wake a pending Shutdown
 }
 
 // read is the main receiver loop, decoding requests from the client and adding
 // them to the queue. Decoding errors and message-format problems are handled
 // and reported back to the client directly, so that any message that survives
 // into the request queue is structurally valid.
-func (s *Server) read(ch channel.Receiver) {
+func (s *Server) read(ch channel.Receiver, inq chan<- jmessages) {
+	defer close(inq)
+	md, _ := ch.(channel.Metadata)
 	for {
 		// If the message is not sensible, report an error; otherwise enqueue it
 		// for processing. Errors in individual requests are handled later.
 		var in jmessages
 		var derr error
 		bits, err := ch.Recv()
+		recv := s.clock.Now()
+		if s.maxIdle > 0 {
+			atomic.StoreInt64(&s.lastRx, recv.UnixNano())
+		}
 		s.metrics.CountAndSetMax("rpc.bytesRead", int64(len(bits)))
-		if err == nil || (err == io.EOF && len(bits) != 0) {
+		if (err == nil || err == io.EOF) && s.maxReq > 0 && len(bits) > s.maxReq {
+			err = nil
+			s.metrics.Count("rpc.requestTooLarge", 1)
+			derr = DataErrorf(code.LimitExceeded, &LimitError{
+				Limit: "requestSize",
+				Size:  len(bits),
+				Max:   s.maxReq,
+			}, "message size %d exceeds limit %d", len(bits), s.maxReq)
+		} else if err == nil || (err == io.EOF && len(bits) != 0) {
 			err = nil
 			derr = in.parseJSON(bits)
 			s.metrics.Count("rpc.requests", int64(len(in)))
+			if derr != nil && len(in) != 0 {
+				// Part of a batch was decoded before a syntax error. Report
+				// errors for the elements that were decoded, followed by the
+				// error for the remainder.
+				in = append(in, &jmessage{batch: true, err: derr})
+				derr = nil
+			}
+			var meta interface{}
+			if md != nil {
+				meta = md.Metadata()
+			}
+			for _, req := range in {
+				req.meta = meta
+				req.recv = recv
+			}
 		}
-		s.mu.Lock()
 		if err != nil { // receive failure; shut down
+			s.mu.Lock()
 			s.stop(err)
 			s.mu.Unlock()
 			return
-		} else if derr != nil { // parse failure; report and continue
+		} else if derr == nil && len(in) == 0 {
+			derr = Errorf(code.InvalidRequest, "empty request batch")
+		} else if s.maxBat > 0 && len(in) > s.maxBat {
+			s.metrics.Count("rpc.batchTooLarge", 1)
+			derr = DataErrorf(code.LimitExceeded, &LimitError{
+				Limit: "batchSize",
+				Size:  len(in),
+				Max:   s.maxBat,
+			}, "batch of %d requests exceeds limit %d", len(in), s.maxBat)
+		}
+		if derr != nil { // parse failure; report and continue
+			s.mu.Lock()
 			s.pushError(derr)
-		} else if len(in) == 0 {
-			s.pushError(Errorf(code.InvalidRequest, "empty request batch"))
-		} else {
-			s.log("Received %d new requests", len(in))
-			s.inq.PushBack(in)
-			s.work.Broadcast()
+			s.mu.Unlock()
+			continue
 		}
-		s.mu.Unlock()
+		s.log("Received %d new requests", len(in))
+		in, delay := s.admit(in)
+		if len(in) == 0 {
+			continue
+		} else if delay > 0 {
+			s.log("Delaying %d requests %v for the rate limit", len(in), delay)
+			<-s.clock.After(delay)
+		}
+		inq <- in // N.B. blocks if the dispatcher is behind
 	}
 }
 
+// encodeResult returns the JSON encoding of a result value returned by a
+// handler. A nil result, including a typed nil pointer, is encoded as null.
+// Results of type RawResult are already encoded, and are used without
+// re-encoding. Unless the server trusts raw results, they are checked for
+// validity, and compacted if they contain line breaks, which would break the
+// framing of line-oriented channels.
+func (s *Server) encodeResult(v interface{}) ([]byte, error) {
+	var raw []byte
+	switch t := v.(type) {
+	case nil:
+		return []byte("null"), nil
+	case RawResult:
+		raw = t
+	default:
+		return s.jcodec.Marshal(v)
+	}
+	if len(raw) == 0 {
+		return []byte("null"), nil
+	} else if s.rawOK {
+		return raw, nil
+	} else if !json.Valid(raw) {
+		return nil, Errorf(code.InternalError, "invalid raw result")
+	} else if bytes.IndexAny(raw, "\r\n") < 0 {
+		return raw, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(raw))
+	json.Compact(&buf, raw) // cannot fail, raw is valid
+	return buf.Bytes(), nil
+}
+
+// correlationData is the error data reported for a failed request when the
+// server is configured with the CorrelateErrors option.
+type correlationData struct {
+	ID string `json:"correlationId"`
+}
+
+// newCorrelationBase returns a random prefix for the correlation IDs of a new
+// server, so that the IDs of different servers are unlikely to collide.
+func newCorrelationBase() string {
+	var buf [6]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// ResultSizeError is the error data reported for a call whose result exceeds
+// the MaxResultSize limit of the server.
+type ResultSizeError struct {
+	Method string `json:"method"` // the method that was called
+	Size   int    `json:"size"`   // the size of the encoded result in bytes
+	Limit  int    `json:"limit"`  // the server's limit in bytes
+}
+
+// LimitError is the error data reported for a message that exceeds a limit
+// set by the server, such as ServerOptions.MaxBatchSize or MaxRequestSize.
+type LimitError struct {
+	Limit string `json:"limit"` // the limit exceeded, "batchSize" or "requestSize"
+	Size  int    `json:"size"`  // the size of the message
+	Max   int    `json:"max"`   // the server's limit
+}
+
+// UnavailableError is the error data reported for a call to a method that has
+// been disabled by the server.
+type UnavailableError struct {
+	Method string `json:"method"` // the method that was called
+
+	// The suggested delay in seconds before retrying, or 0 if unknown.
+	RetryAfter float64 `json:"retryAfter,omitempty"`
+}
+
 // ServerInfo is the concrete type of responses from the rpc.serverInfo method.
 type ServerInfo struct {
 	// The list of method names exported by this server.
@@ -581,13 +1690,69 @@ type ServerInfo struct {
 	// Whether this server understands context wrappers.
 	UsesContext bool `json:"usesContext"`
 
-	// Metric values defined by the evaluation of methods.
+	// Metric values defined by the evaluation of methods. Among others, the
+	// server counts the requests it receives ("rpc.requests"), the responses
+	// it sends ("rpc.responses"), and the error responses it sends for each
+	// error code (for example, "rpc.errorCodes.-32601").
 	Counter  map[string]int64       `json:"counters,omitempty"`
 	MaxValue map[string]int64       `json:"maxValue,omitempty"`
 	Label    map[string]interface{} `json:"labels,omitempty"`
 
-	// When the server started.
+	// When the server started, or the zero time if it has not been started.
 	StartTime time.Time `json:"startTime,omitempty"`
+
+	// Whether the server is running: It has been started, and has not yet
+	// stopped.
+	Running bool `json:"running"`
+
+	// Whether the server accepts requests that lack the version marker (see
+	// ServerOptions.AllowV1).
+	AllowV1 bool `json:"allowV1,omitempty"`
+
+	// Deprecated methods exported by this server, mapped to their
+	// deprecation notes. These are reported only if the assigner of the
+	// server is a DeprecationNamer.
+	Deprecated map[string]string `json:"deprecated,omitempty"`
+
+	// Methods currently disabled by the server (see Server.DisableMethods).
+	Disabled []string `json:"disabled,omitempty"`
+
+	// Requests in flight that have exceeded the slow request threshold (see
+	// ServerOptions.SlowRequestThreshold), oldest first.
+	SlowRequests []*SlowRequest `json:"slowRequests,omitempty"`
+
+	// The state of the push queue, if enabled (see ServerOptions.PushQueueSize).
+	PushQueue *PushQueueInfo `json:"pushQueue,omitempty"`
+}
+
+// MetricsSnapshot is a snapshot of the metrics of a server, returned by its
+// Metrics method. The counters, maximum values, and labels are
+// the same as those reported by ServerInfo; these include the metrics recorded
+// by handlers (see ServerMetrics).
+type MetricsSnapshot struct {
+	Counter  map[string]int64       `json:"counters,omitempty"`
+	MaxValue map[string]int64       `json:"maxValue,omitempty"`
+	Label    map[string]interface{} `json:"labels,omitempty"`
+
+	// The number of request batches received from the client whose responses
+	// have not yet been sent, whether they are waiting to be handled or their
+	// handlers are running (see also ServerOptions.MaxQueuedBatches). Its
+	// maximum is tracked as "rpc.heldBatches".
+	Held int `json:"held"`
+
+	// The number of handlers currently running. Handlers waiting for the
+	// concurrency limit are not counted. Its maximum is tracked as
+	// "rpc.activeHandlers".
+	Active int `json:"active"`
+}
+
+// A SlowRequest describes a request in flight that has exceeded the slow
+// request threshold of the server.
+type SlowRequest struct {
+	Method        string          `json:"method"`
+	ID            json.RawMessage `json:"id,omitempty"`
+	CorrelationID string          `json:"correlationId"`
+	Elapsed       time.Duration   `json:"elapsed"`
 }
 
 // assign returns a Handler to handle the specified name, or nil.
@@ -599,6 +1764,10 @@ func (s *Server) assign(ctx context.Context, name string) Handler {
 			return methodFunc(s.handleRPCServerInfo)
 		case rpcCancel:
 			return methodFunc(s.handleRPCCancel)
+		case rpcHello:
+			return methodFunc(s.handleRPCHello)
+		case rpcPing:
+			return methodFunc(s.handleRPCPing)
 		default:
 			return nil // reserved
 		}
@@ -607,10 +1776,15 @@ func (s *Server) assign(ctx context.Context, name string) Handler {
 }
 
 // pushError reports an error for the given request ID directly back to the
-// client, bypassing the normal request handling mechanism.  The caller must
-// hold s.mu when calling this method.
+// client, bypassing the normal request handling mechanism.  The error is
+// always sent as a single object, since it applies to a whole message (for
+// example, one that could not be parsed or an empty batch) rather than to an
+// element of a batch.  The caller must hold s.mu when calling this method.
 func (s *Server) pushError(err error) {
 	s.log("Invalid request: %v", err)
+	if s.ch == nil {
+		return // the server has stopped; there is no one to tell
+	}
 	var jerr *Error
 	if e, ok := err.(*Error); ok {
 		jerr = e
@@ -618,26 +1792,32 @@ func (s *Server) pushError(err error) {
 		jerr = &Error{code: code.FromError(err), message: err.Error()}
 	}
 
-	nw, err := encode(s.ch, jmessages{{
+	rsps := jmessages{{
 		V:  Version,
 		ID: json.RawMessage("null"),
 		E:  jerr,
-	}})
+	}}
 	s.metrics.Count("rpc.errors", 1)
-	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+	bits, err := rsps.toJSON()
 	if err != nil {
-		s.log("Writing error response: %v", err)
+		s.log("Encoding error response: %v", err)
+		return
 	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.write(s.ch, bits)
+	s.countResponses(rsps)
 }
 
-// cancel reports whether id is an active call.  If so, it also calls the
-// cancellation function associated with id and removes it from the
-// reservations. The caller must hold s.mu.
-func (s *Server) cancel(id string) bool {
-	cancel, ok := s.used[id]
+// cancel reports whether the ID with the given key (see idKey) is an active
+// call.  If so, it also calls the cancellation function associated with the
+// ID and removes it from the reservations, so that the ID may be reused. The
+// caller must hold s.mu.
+func (s *Server) cancel(key string) bool {
+	cancel, ok := s.used[key]
 	if ok {
 		cancel()
-		delete(s.used, id)
+		delete(s.used, key)
 	}
 	return ok
 }
@@ -649,13 +1829,24 @@ func (s *Server) versionOK(v string) bool {
 	return v == Version // ... otherwise it must match the spec
 }
 
+// isV1 reports whether req is a JSON-RPC 1.0 request that the server accepts,
+// to which it replies in the 1.0 format.
+func (s *Server) isV1(req *jmessage) bool { return s.allow1 && req.V == "" }
+
 // A task represents a pending method invocation received by the server.
 type task struct {
 	m Handler // the assigned handler (after assignment)
 
-	ctx   context.Context // the context passed to the handler
-	hreq  *Request        // the request passed to the handler
-	batch bool            // whether the request was part of a batch
+	ctx   context.Context    // the context passed to the handler
+	stop  context.CancelFunc // releases the request timeout (if any)
+	hreq  *Request           // the request passed to the handler
+	batch bool               // whether the request was part of a batch
+	pick  bool               // whether the request was selected for sampling
+	drop  bool               // whether to discard the response (fault injection)
+	held  bool               // whether the task has reserved its ID in s.used
+	v1    bool               // whether the request is JSON-RPC 1.0 (see AllowV1)
+
+	elapsed time.Duration // from dispatch until the handler returned
 
 	val json.RawMessage // the result value (when complete)
 	err error           // the error value (when complete)
@@ -663,10 +1854,15 @@ type task struct {
 
 type tasks []*task
 
-func (ts tasks) responses(rpcLog RPCLogger) jmessages {
+// responses constructs the response messages for ts, if any. If withCID is
+// true, error responses that have no other data report the correlation ID of
+// their request (see ServerOptions.CorrelateErrors).
+func (ts tasks) responses(rpcLog RPCLogger, withCID bool) jmessages {
 	var rsps jmessages
 	for _, task := range ts {
-		if task.hreq.id == nil {
+		if task.drop {
+			continue
+		} else if task.hreq.id == nil {
 			// Spec: "The Server MUST NOT reply to a Notification, including
 			// those that are within a batch request.  Notifications are not
 			// confirmable by definition, since they do not have a Response
@@ -680,28 +1876,92 @@ func (ts tasks) responses(rpcLog RPCLogger) jmessages {
 			}
 		}
 		rsp := &jmessage{V: Version, ID: task.hreq.id, batch: task.batch}
+		if task.v1 {
+			rsp.V = "" // reply in kind; see appendV1
+		}
 		if rsp.ID == nil {
 			rsp.ID = json.RawMessage("null")
 		}
 		if task.err == nil {
+			// A successful response must include a result, so report a
+			// missing result as null rather than omitting it.
 			rsp.R = task.val
-		} else if e, ok := task.err.(*Error); ok {
-			rsp.E = e
-		} else if c := code.FromError(task.err); c != code.NoError {
-			rsp.E = &Error{code: c, message: task.err.Error()}
+			if len(rsp.R) == 0 {
+				rsp.R = json.RawMessage("null")
+			}
 		} else {
-			rsp.E = &Error{code: code.InternalError, message: task.err.Error()}
+			rsp.E = asError(task.err)
 		}
-		rpcLog.LogResponse(task.ctx, &Response{
+		if withCID && rsp.E != nil && len(rsp.E.data) == 0 {
+			e := *rsp.E // copy, since the original may be shared
+			e.data, _ = json.Marshal(correlationData{ID: task.hreq.cid})
+			rsp.E = &e
+		}
+		logResponse(task.ctx, rpcLog, &Response{
 			id:     string(rsp.ID),
 			err:    rsp.E,
 			result: rsp.R,
-		})
+		}, task.elapsed)
 		rsps = append(rsps, rsp)
 	}
 	return rsps
 }
 
+// notifyDone records the outcome of notification t, given the error reported
+// by its handler, and reports whether it failed.
+func (s *Server) notifyDone(t *task, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.noteResult(t, err)
+}
+
+// noteResult records the outcome of notification t in the server metrics,
+// given the error from its handler, if any. A notification that failed
+// validation is not recorded, since an error is reported to the client for
+// it. If the server has a limit on consecutive notification failures and t
+// exceeds it, the server is stopped. It reports whether t failed.
+// The caller must hold s.mu.
+func (s *Server) noteResult(t *task, herr error) bool {
+	if c := code.FromError(t.err); c == code.ParseError || c == code.InvalidRequest {
+		return false
+	}
+	s.metrics.Count("rpc.notifications", 1)
+	err := t.err
+	if err == nil {
+		s.metrics.Count("rpc.notificationsDispatched", 1)
+		err = herr
+	}
+	if err == nil {
+		s.nerr = 0
+		return false
+	}
+	s.metrics.Count("rpc.notificationErrors", 1)
+	s.metrics.Count("rpc.notificationErrors."+notificationFailure(t.err, herr), 1)
+	s.nerr++
+	if s.maxNErr > 0 && s.nerr >= s.maxNErr {
+		s.stop(fmt.Errorf("%d consecutive notification failures; last: %v", s.nerr, err))
+	}
+	return true
+}
+
+// notificationFailure returns a label for the reason a notification failed,
+// for use in metrics, given its validation error or handler error.
+func notificationFailure(verr, herr error) string {
+	if verr == nil {
+		if code.FromError(herr) == code.InvalidParams {
+			return "invalidParams"
+		}
+		return "handlerError"
+	}
+	switch code.FromError(verr) {
+	case code.MethodNotFound:
+		return "methodNotFound"
+	case code.Deprecated:
+		return "deprecated"
+	}
+	return "rejected"
+}
+
 // numValidNotifications reports the number of elements in ts that are
 // syntactically valid notifications.
 func (ts tasks) numValidNotifications() (n int) {
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// ErrConnLimit is the error logged by Loop when it refuses a connection
+// because its peer already has the maximum number of connections permitted by
+// a ConnLimit.
+var ErrConnLimit = errors.New("too many connections for peer identity")
+
+// A LimitPolicy selects what a ConnLimit does with a new connection from a
+// peer that already has the maximum number of connections.
+type LimitPolicy int
+
+const (
+	// RefuseNew closes the new connection without serving it.
+	RefuseNew LimitPolicy = iota
+
+	// EvictOldest stops the server for the oldest connection from the peer,
+	// and serves the new connection.
+	EvictOldest
+)
+
+// A ConnLimit limits the number of connections that Loop and MultiLoop will
+// serve concurrently for each peer identity. Set the limit in the ConnLimit
+// field of the LoopOptions. A ConnLimit may be shared by several loops, in
+// which case the limit applies to their connections in total. A ConnLimit is
+// safe for concurrent use by multiple goroutines.
+type ConnLimit struct {
+	identify func(*PeerInfo) string
+	max      int
+	policy   LimitPolicy
+
+	mu    sync.Mutex
+	conns map[string][]*connSlot // for each identity, oldest first
+}
+
+// NewConnLimit constructs a ConnLimit that permits up to max concurrent
+// connections for each peer identity, and applies the given policy to
+// connections in excess of that. The identify function reports the identity
+// of a peer, for example the subject of its verified TLS certificate.
+// Connections whose identity is "" are not limited. If max <= 0, connections
+// are counted but not limited.
+func NewConnLimit(identify func(*PeerInfo) string, max int, policy LimitPolicy) *ConnLimit {
+	return &ConnLimit{
+		identify: identify,
+		max:      max,
+		policy:   policy,
+		conns:    make(map[string][]*connSlot),
+	}
+}
+
+// Counts returns the number of connections currently served for each peer
+// identity. Identities with no connections are omitted.
+func (c *ConnLimit) Counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.conns))
+	for id, slots := range c.conns {
+		counts[id] = len(slots)
+	}
+	return counts
+}
+
+// A connSlot records a connection counted against the limit for an identity.
+type connSlot struct {
+	id      string
+	srv     *jrpc2.Server // nil until the server starts
+	evicted bool          // the slot was evicted before its server started
+}
+
+// acquire reserves a slot for a new connection from peer, or reports
+// ErrConnLimit if the connection must be refused. It returns a nil slot if
+// the connection is not limited. It is safe to call acquire on a nil
+// *ConnLimit.
+func (c *ConnLimit) acquire(peer *PeerInfo) (*connSlot, error) {
+	if c == nil {
+		return nil, nil
+	}
+	id := c.identify(peer)
+	if id == "" {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	slots := c.conns[id]
+	var victim *connSlot
+	if c.max > 0 && len(slots) >= c.max {
+		if c.policy != EvictOldest {
+			c.mu.Unlock()
+			return nil, ErrConnLimit
+		}
+		victim = slots[0]
+		victim.evicted = true
+		slots = append([]*connSlot(nil), slots[1:]...)
+	}
+	slot := &connSlot{id: id}
+	c.conns[id] = append(slots, slot)
+	c.mu.Unlock()
+
+	if victim != nil && victim.srv != nil {
+		victim.srv.Stop()
+	}
+	return slot, nil
+}
+
+// start records that srv is serving the connection for slot. If the slot was
+// evicted before its server started, the server is stopped.
+func (c *ConnLimit) start(slot *connSlot, srv *jrpc2.Server) {
+	if slot == nil {
+		return
+	}
+	c.mu.Lock()
+	slot.srv = srv
+	evicted := slot.evicted
+	c.mu.Unlock()
+	if evicted {
+		srv.Stop()
+	}
+}
+
+// release removes slot from the count for its identity, if it has not
+// already been evicted.
+func (c *ConnLimit) release(slot *connSlot) {
+	if slot == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slots := c.conns[slot.id]
+	for i, s := range slots {
+		if s == slot {
+			slots = append(slots[:i:i], slots[i+1:]...)
+			break
+		}
+	}
+	if len(slots) == 0 {
+		delete(c.conns, slot.id)
+	} else {
+		c.conns[slot.id] = slots
+	}
+}
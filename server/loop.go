@@ -2,8 +2,10 @@
 package server
 
 import (
+	"context"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/creachadair/jrpc2"
 	"github.com/creachadair/jrpc2/channel"
@@ -36,15 +38,105 @@ func NewStatic(assigner jrpc2.Assigner) func() Service {
 // once all the servers currently active have returned.
 //
 // TODO: Add options to support sensible rate-limitation.
+//
+// The context passed to each handler includes a PeerInfo for the connection,
+// which may be retrieved using the Peer function. If lst is a TLS listener,
+// the handshake is completed before the server starts.
 func Loop(lst net.Listener, newService func() Service, opts *LoopOptions) error {
-	newChannel := opts.framing()
-	serverOpts := opts.serverOpts()
+	_, err := acceptLoop(context.Background(), lst, newService, opts.framing(), opts.serverOpts(), opts)
+	return err
+}
+
+// A ListenerSpec describes a listener to be served by MultiLoop.
+type ListenerSpec struct {
+	// The listener from which to accept connections (required).
+	Listener net.Listener
+
+	// If non-nil, this framing is used for connections accepted from this
+	// listener instead of the framing given in the LoopOptions.
+	Framing channel.Framing
+
+	// If non-nil, these options are used for servers handling connections from
+	// this listener instead of the server options given in the LoopOptions.
+	ServerOptions *jrpc2.ServerOptions
+
+	// If true, an error accepting connections from this listener terminates
+	// the loops for all the other listeners too. Otherwise, the remaining
+	// listeners continue to serve.
+	Critical bool
+}
+
+// LoopStats report the outcome of an accept loop for a single listener.
+type LoopStats struct {
+	Addr     net.Addr // the address of the listener
+	Accepted int      // the number of connections accepted
+	Err      error    // the error that terminated the loop, or nil
+}
+
+// MultiLoop runs a Loop concurrently for each of the listeners described by
+// specs, using the given service constructor and options, and blocks until all
+// of them have terminated. The LoopStats for each listener are returned in the
+// same order as the specs, along with the first non-nil error among them.
+//
+// When ctx ends, MultiLoop closes all the listeners and stops the servers for
+// any connections that are still active.
+func MultiLoop(ctx context.Context, specs []ListenerSpec, newService func() Service, opts *LoopOptions) ([]LoopStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Close all the listeners when the context ends, either because the caller
+	// cancelled it or because a critical listener failed.
+	go func() {
+		<-ctx.Done()
+		for _, spec := range specs {
+			spec.Listener.Close()
+		}
+	}()
+
+	stats := make([]LoopStats, len(specs))
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		i, spec := i, spec
+		framing, serverOpts := spec.Framing, spec.ServerOptions
+		if framing == nil {
+			framing = opts.framing()
+		}
+		if serverOpts == nil {
+			serverOpts = opts.serverOpts()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := acceptLoop(ctx, spec.Listener, newService, framing, serverOpts, opts)
+			stats[i] = LoopStats{Addr: spec.Listener.Addr(), Accepted: n, Err: err}
+			if err != nil && spec.Critical {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, stat := range stats {
+		if stat.Err != nil {
+			return stats, stat.Err
+		}
+	}
+	return stats, nil
+}
+
+// acceptLoop implements the accept loop for a single listener, and reports
+// the number of connections accepted and the error that terminated the loop.
+// When ctx ends, any servers still active are stopped.
+func acceptLoop(ctx context.Context, lst net.Listener, newService func() Service, newChannel channel.Framing, serverOpts *jrpc2.ServerOptions, opts *LoopOptions) (int, error) {
+	htimeout, limit := opts.handshakeTimeout(), opts.connLimit()
 	log := func(string, ...interface{}) {}
 	if serverOpts != nil && serverOpts.Logger != nil {
 		log = serverOpts.Logger.Printf
 	}
 
 	var wg sync.WaitGroup
+	var naccept int
 	for {
 		conn, err := lst.Accept()
 		if err != nil {
@@ -54,19 +146,43 @@ func Loop(lst net.Listener, newService func() Service, opts *LoopOptions) error
 				log("Error accepting new connection: %v", err)
 			}
 			wg.Wait()
-			return err
+			return naccept, err
 		}
-		ch := newChannel(conn, conn)
+		naccept++
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			peer, err := newPeer(conn, htimeout)
+			if err != nil {
+				log("Handshake with %v failed: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			slot, err := limit.acquire(peer)
+			if err != nil {
+				log("Refusing connection from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			defer limit.release(slot)
+			ch := newChannel(conn, conn)
 			svc := newService()
 			assigner, err := svc.Assigner()
 			if err != nil {
 				log("Service initialization failed: %v", err)
 				return
 			}
-			srv := jrpc2.NewServer(assigner, serverOpts).Start(ch)
+			srv := jrpc2.NewServer(assigner, withPeer(serverOpts, peer)).Start(ch)
+			limit.start(slot, srv)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					srv.Stop()
+				case <-done:
+				}
+			}()
 			stat := srv.WaitStatus()
 			svc.Finish(stat)
 			if stat.Err != nil {
@@ -86,6 +202,29 @@ type LoopOptions struct {
 	// If non-nil, these options are used when constructing the server to
 	// handle requests on an inbound connection.
 	ServerOptions *jrpc2.ServerOptions
+
+	// The maximum time allowed for a TLS handshake to complete on a new
+	// connection. If zero, a default of 10 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// If non-nil, this limits the number of connections served concurrently
+	// for each peer identity. A connection's slot is released when its server
+	// exits, for whatever reason.
+	ConnLimit *ConnLimit
+}
+
+func (o *LoopOptions) connLimit() *ConnLimit {
+	if o == nil {
+		return nil
+	}
+	return o.ConnLimit
+}
+
+func (o *LoopOptions) handshakeTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.HandshakeTimeout
 }
 
 func (o *LoopOptions) serverOpts() *jrpc2.ServerOptions {
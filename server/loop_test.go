@@ -2,15 +2,19 @@ package server
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"net"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/creachadair/jrpc2"
 	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/jrpc2/metrics"
 )
 
 var newChan = channel.Varint
@@ -167,3 +171,241 @@ func TestLoop(t *testing.T) {
 		})
 	}
 }
+
+// Test that Loop passes its server options to the server for each connection.
+func TestLoopServerOptions(t *testing.T) {
+	lst := mustListen(t)
+	addr := lst.Addr().String()
+	m := metrics.New()
+	sc := make(chan struct{})
+	go func() {
+		defer close(sc)
+		if err := Loop(lst, testService, &LoopOptions{
+			Framing: newChan,
+			ServerOptions: &jrpc2.ServerOptions{
+				Metrics: m,
+				CheckRequest: func(_ context.Context, req *jrpc2.Request) error {
+					if req.HasParams() {
+						return jrpc2.Errorf(code.InvalidParams, "no parameters allowed")
+					}
+					return nil
+				},
+			},
+		}); err != nil {
+			t.Errorf("Loop: unexpected failure: %v", err)
+		}
+	}()
+
+	const numClients = 3
+	for i := 0; i < numClients; i++ {
+		cli := mustDial(t, addr)
+		if _, err := cli.Call(context.Background(), "Test", nil); err != nil {
+			t.Errorf("[client %d] Test call: unexpected error: %v", i, err)
+		}
+		_, err := cli.Call(context.Background(), "Test", []int{1})
+		if got := code.FromError(err); got != code.InvalidParams {
+			t.Errorf("[client %d] Test call with params: got %v, want %v", i, err, code.InvalidParams)
+		}
+		cli.Close()
+	}
+	lst.Close()
+	<-sc
+
+	// The servers for all the connections share the metrics collector.
+	snap := metrics.Snapshot{Counter: make(map[string]int64)}
+	m.Snapshot(snap)
+	if got, want := snap.Counter["rpc.requests"], int64(2*numClients); got != want {
+		t.Errorf("Requests counted: got %d, want %d", got, want)
+	}
+}
+
+// A listener whose Accept method fails immediately with a fixed error.
+type failListener struct {
+	net.Listener
+	err error
+}
+
+func (f failListener) Accept() (net.Conn, error) { return nil, f.err }
+
+// Test that MultiLoop serves several listeners with different framings, and
+// reports statistics for each.
+func TestMultiLoop(t *testing.T) {
+	dir := t.TempDir()
+	ulst, err := net.Listen("unix", filepath.Join(dir, "test.sock"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	tlst := mustListen(t)
+	bad := failListener{Listener: mustListen(t), err: errors.New("bogus accept failure")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		stats []LoopStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := MultiLoop(ctx, []ListenerSpec{
+			{Listener: tlst},
+			{Listener: ulst, Framing: channel.Line},
+			{Listener: bad},
+		}, testService, &LoopOptions{Framing: newChan})
+		done <- result{stats, err}
+	}()
+
+	call := func(ntype, addr string, framing channel.Framing) {
+		t.Helper()
+		conn, err := net.Dial(ntype, addr)
+		if err != nil {
+			t.Fatalf("Dial %q: %v", addr, err)
+		}
+		cli := jrpc2.NewClient(framing(conn, conn), nil)
+		defer cli.Close()
+
+		var rsp string
+		if err := cli.CallResult(context.Background(), "Test", nil, &rsp); err != nil {
+			t.Errorf("Call %s %q: unexpected error: %v", ntype, addr, err)
+		} else if rsp != "OK" {
+			t.Errorf("Call %s %q: got %q, want OK", ntype, addr, rsp)
+		}
+	}
+
+	// The failing listener should not prevent the others from serving.
+	call("tcp", tlst.Addr().String(), newChan)
+	call("tcp", tlst.Addr().String(), newChan)
+	call("unix", ulst.Addr().String(), channel.Line)
+
+	// Cancelling the context should stop the remaining loops.
+	cancel()
+	res := <-done
+	if res.err == nil || res.err.Error() != bad.err.Error() {
+		t.Errorf("MultiLoop: got error %v, want %v", res.err, bad.err)
+	}
+	want := []int{2, 1, 0}
+	for i, stat := range res.stats {
+		if stat.Accepted != want[i] {
+			t.Errorf("Listener %d (%v): accepted %d, want %d", i, stat.Addr, stat.Accepted, want[i])
+		}
+		if i < 2 && stat.Err != nil {
+			t.Errorf("Listener %d (%v): unexpected error: %v", i, stat.Addr, stat.Err)
+		}
+	}
+}
+
+// Test that an error from a critical listener stops the others.
+func TestMultiLoopCritical(t *testing.T) {
+	lst := mustListen(t)
+	bad := failListener{Listener: mustListen(t), err: errors.New("bogus accept failure")}
+
+	stats, err := MultiLoop(context.Background(), []ListenerSpec{
+		{Listener: lst},
+		{Listener: bad, Critical: true},
+	}, testService, nil)
+	if err == nil || err.Error() != bad.err.Error() {
+		t.Errorf("MultiLoop: got error %v, want %v", err, bad.err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("MultiLoop: got %d stats, want 2", len(stats))
+	}
+	if stats[0].Err != nil {
+		t.Errorf("Listener 0: unexpected error: %v", stats[0].Err)
+	}
+}
+
+// Test that a ConnLimit limits the connections for a single identity.
+func TestConnLimit(t *testing.T) {
+	call := func(cli *jrpc2.Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := cli.Call(ctx, "Test", nil)
+		return err
+	}
+	waitCount := func(t *testing.T, limit *ConnLimit, want int) {
+		t.Helper()
+		for i := 0; i < 500; i++ {
+			if limit.Counts()["alice"] == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Counts: got %v, want alice=%d", limit.Counts(), want)
+	}
+
+	// Serve with a limit of two connections, and connect three clients with
+	// the same identity, one at a time so that the order in which they are
+	// counted is fixed.
+	run := func(t *testing.T, policy LimitPolicy, test func(*ConnLimit, string, []*jrpc2.Client)) {
+		lst := mustListen(t)
+		addr := lst.Addr().String()
+		limit := NewConnLimit(func(*PeerInfo) string { return "alice" }, 2, policy)
+		sc := make(chan struct{})
+		go func() {
+			defer close(sc)
+			if err := Loop(lst, testService, &LoopOptions{
+				Framing:   newChan,
+				ConnLimit: limit,
+			}); err != nil {
+				t.Errorf("Loop: unexpected failure: %v", err)
+			}
+		}()
+
+		var clients []*jrpc2.Client
+		for i := 0; i < 3; i++ {
+			cli := mustDial(t, addr)
+			defer cli.Close()
+			clients = append(clients, cli)
+			if i < 2 {
+				if err := call(cli); err != nil {
+					t.Fatalf("[client %d] Test call: unexpected error: %v", i, err)
+				}
+			}
+		}
+		test(limit, addr, clients)
+
+		for _, cli := range clients {
+			cli.Close()
+		}
+		lst.Close()
+		<-sc
+		if n := len(limit.Counts()); n != 0 {
+			t.Errorf("Counts after exit: got %v, want empty", limit.Counts())
+		}
+	}
+
+	t.Run("RefuseNew", func(t *testing.T) {
+		run(t, RefuseNew, func(limit *ConnLimit, addr string, clients []*jrpc2.Client) {
+			if err := call(clients[2]); err == nil {
+				t.Error("[client 2] Test call: got nil error, want refusal")
+			}
+			if err := call(clients[0]); err != nil {
+				t.Errorf("[client 0] Test call: unexpected error: %v", err)
+			}
+			waitCount(t, limit, 2)
+
+			// Closing a connection releases its slot for a new one.
+			clients[0].Close()
+			waitCount(t, limit, 1)
+			cli := mustDial(t, addr)
+			defer cli.Close()
+			if err := call(cli); err != nil {
+				t.Errorf("[new client] Test call: unexpected error: %v", err)
+			}
+			waitCount(t, limit, 2)
+		})
+	})
+
+	t.Run("EvictOldest", func(t *testing.T) {
+		run(t, EvictOldest, func(limit *ConnLimit, _ string, clients []*jrpc2.Client) {
+			if err := call(clients[2]); err != nil {
+				t.Errorf("[client 2] Test call: unexpected error: %v", err)
+			}
+			if err := call(clients[0]); err == nil {
+				t.Error("[client 0] Test call: got nil error, want eviction")
+			}
+			if err := call(clients[1]); err != nil {
+				t.Errorf("[client 1] Test call: unexpected error: %v", err)
+			}
+			waitCount(t, limit, 2)
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// PeerInfo describes the remote peer of a connection accepted by Loop.
+type PeerInfo struct {
+	// The remote network address of the connection.
+	Addr net.Addr
+
+	// If the connection uses TLS, the state of the connection after the
+	// handshake completed, including the verified peer certificates and the
+	// negotiated protocol. Otherwise nil.
+	TLS *tls.ConnectionState
+}
+
+// Peer returns the peer information associated with ctx, or nil if ctx does
+// not have any. The context passed to a handler by a server started by Loop
+// or MultiLoop will include this value.
+func Peer(ctx context.Context) *PeerInfo {
+	if v, ok := ctx.Value(peerKey{}).(*PeerInfo); ok {
+		return v
+	}
+	return nil
+}
+
+type peerKey struct{}
+
+// defaultHandshakeTimeout is the timeout for TLS handshakes used by Loop if
+// the caller does not specify one.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// newPeer constructs a PeerInfo for conn. If conn is a TLS connection, the
+// handshake is performed eagerly, with the given timeout, so that its state
+// is available before any requests are served.
+func newPeer(conn net.Conn, timeout time.Duration) (*PeerInfo, error) {
+	peer := &PeerInfo{Addr: conn.RemoteAddr()}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return peer, nil
+	}
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	if err := tc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	} else if err := tc.Handshake(); err != nil {
+		return nil, err
+	} else if err := tc.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	peer.TLS = &state
+	return peer, nil
+}
+
+// withPeer returns a copy of opts whose base contexts include peer.
+func withPeer(opts *jrpc2.ServerOptions, peer *PeerInfo) *jrpc2.ServerOptions {
+	var cp jrpc2.ServerOptions
+	if opts != nil {
+		cp = *opts
+	}
+	base := cp.NewContext
+	if base == nil {
+		base = context.Background
+	}
+	cp.NewContext = func() context.Context {
+		return context.WithValue(base(), peerKey{}, peer)
+	}
+	return &cp
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/handler"
+)
+
+// testCA is a minimal certificate authority for testing.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	next int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Parsing CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, next: 2}
+}
+
+// issue generates a certificate for the given common name signed by ca.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating key for %q: %v", cn, err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.next),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	ca.next++
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Creating certificate for %q: %v", cn, err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Test that a handler can see the verified TLS client identity.
+func TestPeerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	lst := tls.NewListener(mustListen(t), &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		NextProtos:   []string{"jrpc2"},
+	})
+	svc := NewStatic(handler.Map{
+		"Whoami": handler.New(func(ctx context.Context) (string, error) {
+			peer := Peer(ctx)
+			if peer == nil {
+				return "", errors.New("no peer info")
+			} else if peer.Addr == nil {
+				return "", errors.New("no peer address")
+			} else if peer.TLS == nil {
+				return "", errors.New("no TLS state")
+			} else if len(peer.TLS.PeerCertificates) == 0 {
+				return "", errors.New("no peer certificates")
+			} else if p := peer.TLS.NegotiatedProtocol; p != "jrpc2" {
+				return "", errors.New("wrong protocol: " + p)
+			}
+			return peer.TLS.PeerCertificates[0].Subject.CommonName, nil
+		}),
+	})
+	sc := make(chan error, 1)
+	go func() { sc <- Loop(lst, svc, &LoopOptions{Framing: newChan}) }()
+
+	conn, err := tls.Dial("tcp", lst.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      ca.pool,
+		ServerName:   "server",
+		NextProtos:   []string{"jrpc2"},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	cli := jrpc2.NewClient(newChan(conn, conn), nil)
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Whoami", nil, &got); err != nil {
+		t.Errorf("Call failed: %v", err)
+	} else if got != "alice" {
+		t.Errorf("Whoami: got %q, want alice", got)
+	}
+	cli.Close()
+	lst.Close()
+	if err := <-sc; err != nil {
+		t.Errorf("Loop: unexpected error: %v", err)
+	}
+}
+
+// Test that a client that never completes a TLS handshake is disconnected.
+func TestPeerHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	lst := tls.NewListener(mustListen(t), &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+	})
+	sc := make(chan error, 1)
+	go func() {
+		sc <- Loop(lst, testService, &LoopOptions{
+			Framing:          newChan,
+			HandshakeTimeout: 50 * time.Millisecond,
+		})
+	}()
+
+	// Connect without TLS and send nothing; the server should hang up.
+	conn, err := net.Dial("tcp", lst.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err == nil {
+		t.Error("Read: unexpectedly succeeded")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Server did not close the connection before the read deadline")
+	}
+	lst.Close()
+	if err := <-sc; err != nil {
+		t.Errorf("Loop: unexpected error: %v", err)
+	}
+}
+
+// Test that a plain connection reports a peer address but no TLS state.
+func TestPeerPlain(t *testing.T) {
+	lst := mustListen(t)
+	svc := NewStatic(handler.Map{
+		"Peer": handler.New(func(ctx context.Context) (bool, error) {
+			peer := Peer(ctx)
+			return peer != nil && peer.Addr != nil && peer.TLS == nil, nil
+		}),
+	})
+	sc := mustServe(t, lst, svc)
+	cli := mustDial(t, lst.Addr().String())
+
+	var ok bool
+	if err := cli.CallResult(context.Background(), "Peer", nil, &ok); err != nil {
+		t.Errorf("Call failed: %v", err)
+	} else if !ok {
+		t.Error("Peer: wrong peer info for a plain connection")
+	}
+	cli.Close()
+	lst.Close()
+	<-sc
+}
@@ -0,0 +1,422 @@
+// Package subprocess runs a JSON-RPC server as a child process, and connects
+// a client to it over the standard input and output of the process.
+//
+// This supports plugin architectures, in which each plugin is a program that
+// serves JSON-RPC on its stdin and stdout:
+//
+//    h, err := subprocess.Start(exec.Command("my-plugin"), &subprocess.Options{
+//       Framing: channel.Line,
+//       Stderr:  os.Stderr,
+//    })
+//    if err != nil {
+//       log.Fatalf("Starting plugin: %v", err)
+//    }
+//    defer h.Close()
+//    rsp, err := h.Client().Call(ctx, "Method", params)
+//
+// The Host supervises the process. If the process exits unexpectedly, the
+// host may restart it (see Options.MaxRestarts), or stop and report an
+// *ExitError from its Wait method. When the host is closed, it closes the
+// standard input of the process, waits for a grace period for the process to
+// exit, and kills it if it has not.
+package subprocess
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// Options control the behaviour of a Host. A nil *Options provides sensible
+// defaults.
+type Options struct {
+	// The framing used for the standard input and output of the process. If
+	// nil, channel.Line is used.
+	Framing channel.Framing
+
+	// Options for the client connected to the process.
+	Client *jrpc2.ClientOptions
+
+	// If not nil, the standard error of the process is copied here.
+	// Otherwise it is discarded.
+	Stderr io.Writer
+
+	// If not nil, send debug logs here.
+	Logger *log.Logger
+
+	// If set, Close sends a notification with this method name to the
+	// process before closing its standard input, so that it can shut down in
+	// an orderly way.
+	ShutdownMethod string
+
+	// How long Close waits for the process to exit once its standard input
+	// is closed, before it kills the process. If zero, a default of 1 second
+	// is used.
+	Grace time.Duration
+
+	// The number of times the process is restarted after it exits
+	// unexpectedly. If zero, the process is not restarted, and the host
+	// stops when the process exits. If negative, there is no limit.
+	MaxRestarts int
+
+	// The delay before the process is restarted. The delay doubles for each
+	// restart, up to MaxBackoff. If zero, a default of 100ms is used.
+	Backoff time.Duration
+
+	// The longest delay before a restart. If zero, a default of 10s is used.
+	MaxBackoff time.Duration
+
+	// If set, this function is called with the new client each time the
+	// process is restarted, before the client is returned by the Client
+	// method. It can be used to replay session setup, for example. If it
+	// reports an error, the host stops and Wait reports that error.
+	OnReconnect func(*jrpc2.Client) error
+}
+
+func (o *Options) framing() channel.Framing {
+	if o == nil || o.Framing == nil {
+		return channel.Line
+	}
+	return o.Framing
+}
+
+func (o *Options) clientOptions() *jrpc2.ClientOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Client
+}
+
+func (o *Options) stderr() io.Writer {
+	if o == nil || o.Stderr == nil {
+		return ioutil.Discard
+	}
+	return o.Stderr
+}
+
+func (o *Options) logger() func(string, ...interface{}) {
+	if o == nil || o.Logger == nil {
+		return func(string, ...interface{}) {}
+	}
+	logger := o.Logger
+	return func(msg string, args ...interface{}) { logger.Output(2, fmt.Sprintf(msg, args...)) }
+}
+
+func (o *Options) shutdownMethod() string {
+	if o == nil {
+		return ""
+	}
+	return o.ShutdownMethod
+}
+
+func (o *Options) grace() time.Duration {
+	if o == nil || o.Grace <= 0 {
+		return time.Second
+	}
+	return o.Grace
+}
+
+func (o *Options) maxRestarts() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxRestarts
+}
+
+func (o *Options) backoff() (time.Duration, time.Duration) {
+	min, max := 100*time.Millisecond, 10*time.Second
+	if o != nil && o.Backoff > 0 {
+		min = o.Backoff
+	}
+	if o != nil && o.MaxBackoff > 0 {
+		max = o.MaxBackoff
+	}
+	return min, max
+}
+
+func (o *Options) onReconnect() func(*jrpc2.Client) error {
+	if o == nil {
+		return nil
+	}
+	return o.OnReconnect
+}
+
+// An ExitError reports that the process run by a Host exited.
+type ExitError struct {
+	Err    error // the error from waiting for the process, or nil
+	Killed bool  // whether the process was killed after the grace period
+}
+
+func (e *ExitError) Error() string {
+	if e.Killed {
+		return "subprocess killed after grace period"
+	} else if e.Err == nil {
+		return "subprocess exited"
+	}
+	return "subprocess exited: " + e.Err.Error()
+}
+
+// Unwrap supports error wrapping.
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// A Host runs a JSON-RPC server as a child process, and supervises it.
+type Host struct {
+	tmpl  *exec.Cmd
+	opts  *Options
+	log   func(string, ...interface{})
+	stop  chan struct{} // closed by Close
+	done  chan struct{} // closed when the supervisor exits
+	close sync.Once
+
+	mu       sync.Mutex
+	cur      *process // the current process
+	restarts int      // the number of restarts so far
+	err      error    // the reason the host stopped, if it failed
+	closeErr error    // the result of shutting down the last process
+}
+
+// A process is a running child process and the client connected to it.
+type process struct {
+	cmd    *exec.Cmd
+	cli    *jrpc2.Client
+	in     io.WriteCloser // the standard input of the process
+	out    *os.File       // the standard output of the process
+	exited chan struct{}  // closed when the process has exited
+	err    error          // the result of cmd.Wait, once exited is closed
+}
+
+// Start starts the process described by cmd, connects a client to its
+// standard input and output, and returns a Host that supervises it. Only the
+// Path, Args, Env, Dir, and SysProcAttr fields of cmd are used; the host
+// starts a new command with these fields each time the process is started.
+func Start(cmd *exec.Cmd, opts *Options) (*Host, error) {
+	h := &Host{
+		tmpl: cmd,
+		opts: opts,
+		log:  opts.logger(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	p, err := h.launch()
+	if err != nil {
+		return nil, err
+	}
+	h.cur = p
+	go h.supervise()
+	return h, nil
+}
+
+// Client returns the client connected to the current process. After a
+// restart, it returns the client for the new process.
+func (h *Host) Client() *jrpc2.Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cur.cli
+}
+
+// Restarts reports the number of times the process has been restarted.
+func (h *Host) Restarts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.restarts
+}
+
+// Wait blocks until the host stops, and reports why. It returns nil if the
+// host was closed by Close. If the process exited unexpectedly and was not
+// restarted, Wait reports an *ExitError.
+func (h *Host) Wait() error {
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Close shuts down the host and the process. If a shutdown method is set in
+// the options, Close first sends that notification to the process. Then it
+// closes the standard input of the process, and waits for the grace period
+// for it to exit. If it does not, Close kills the process and reports an
+// *ExitError whose Killed field is true. Close also reports an *ExitError if
+// the process exits with an error. It is safe to call Close more than once.
+func (h *Host) Close() error {
+	h.close.Do(func() {
+		h.mu.Lock()
+		close(h.stop)
+		p := h.cur
+		h.mu.Unlock()
+
+		err := h.shutdown(p)
+		<-h.done
+		h.mu.Lock()
+		h.closeErr = err
+		h.mu.Unlock()
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closeErr
+}
+
+// launch starts a new process and connects a client to it.
+func (h *Host) launch() (*process, error) {
+	cmd := &exec.Cmd{
+		Path:        h.tmpl.Path,
+		Args:        h.tmpl.Args,
+		Env:         h.tmpl.Env,
+		Dir:         h.tmpl.Dir,
+		SysProcAttr: h.tmpl.SysProcAttr,
+		Stderr:      h.opts.stderr(),
+	}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Use our own pipe for output rather than cmd.StdoutPipe, since Wait
+	// closes the latter even if the client has not finished reading it.
+	out, w, err := os.Pipe()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		in.Close()
+		out.Close()
+		return nil, err
+	}
+	h.log("Started subprocess %q (pid %d)", cmd.Path, cmd.Process.Pid)
+
+	p := &process{
+		cmd:    cmd,
+		cli:    jrpc2.NewClient(h.opts.framing()(out, in), h.opts.clientOptions()),
+		in:     in,
+		out:    out,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// finish cleans up after p has exited.
+func (p *process) finish() {
+	p.cli.Close()
+	p.out.Close()
+}
+
+// shutdown stops p, killing it if it does not exit within the grace period.
+func (h *Host) shutdown(p *process) error {
+	select {
+	case <-p.exited:
+		return nil // already gone; the supervisor reports why
+	default:
+	}
+	if m := h.opts.shutdownMethod(); m != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), h.opts.grace())
+		if err := p.cli.Notify(ctx, m, nil); err != nil {
+			h.log("Sending %q to subprocess: %v", m, err)
+		}
+		cancel()
+	}
+	p.in.Close()
+
+	select {
+	case <-p.exited:
+		if p.err != nil {
+			return &ExitError{Err: p.err}
+		}
+		return nil
+	case <-time.After(h.opts.grace()):
+		h.log("Subprocess did not exit after %v; killing it", h.opts.grace())
+		p.cmd.Process.Kill()
+		<-p.exited
+		return &ExitError{Err: p.err, Killed: true}
+	}
+}
+
+// supervise waits for each process to exit, and restarts it if it exited
+// unexpectedly and the options permit.
+func (h *Host) supervise() {
+	defer close(h.done)
+	delay, maxDelay := h.opts.backoff()
+	for {
+		h.mu.Lock()
+		p := h.cur
+		h.mu.Unlock()
+
+		<-p.exited
+		p.finish()
+		select {
+		case <-h.stop:
+			return // the host was closed
+		default:
+		}
+		xerr := &ExitError{Err: p.err}
+		h.log("Subprocess exited unexpectedly: %v", xerr)
+
+		h.mu.Lock()
+		if max := h.opts.maxRestarts(); max == 0 || (max > 0 && h.restarts >= max) {
+			h.err = xerr
+			h.mu.Unlock()
+			return
+		}
+		h.restarts++
+		h.mu.Unlock()
+
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+
+		np, err := h.launch()
+		if err == nil {
+			if f := h.opts.onReconnect(); f != nil {
+				err = f(np.cli)
+			}
+			if err != nil {
+				h.shutdown(np)
+				np.finish()
+			}
+		}
+		if err != nil {
+			h.log("Restarting subprocess: %v", err)
+			h.mu.Lock()
+			h.err = err
+			h.mu.Unlock()
+			return
+		}
+
+		// If the host was closed while the process was restarting, Close did
+		// not see the new process, so shut it down here.
+		h.mu.Lock()
+		closed := false
+		select {
+		case <-h.stop:
+			closed = true
+		default:
+			h.cur = np
+		}
+		h.mu.Unlock()
+		if closed {
+			h.shutdown(np)
+			np.finish()
+			return
+		}
+	}
+}
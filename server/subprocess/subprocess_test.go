@@ -0,0 +1,202 @@
+package subprocess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/handler"
+)
+
+// When the test binary is run with this variable set, it acts as a server on
+// its stdin and stdout instead of running tests (see serve).
+const serverEnv = "SUBPROCESS_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(serverEnv); mode != "" {
+		serve(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// serve runs a server on stdin and stdout. If mode is "hang", the process
+// does not exit when its input is closed.
+func serve(mode string) {
+	fmt.Fprintln(os.Stderr, "server ready")
+	srv := jrpc2.NewServer(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) int {
+			var sum int
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+		"Exit": handler.New(func(context.Context) error {
+			os.Exit(3)
+			return nil
+		}),
+	}, nil).Start(channel.Line(os.Stdin, os.Stdout))
+	srv.Wait()
+	fmt.Fprintln(os.Stderr, "server done")
+	if mode == "hang" {
+		time.Sleep(time.Hour)
+	}
+}
+
+// serverCmd returns a command to run the test binary as a server. When the
+// race detector is enabled, it delays the exit of a process by default, so
+// the delay is disabled to keep the process within the grace period.
+func serverCmd(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), serverEnv+"="+mode, "GORACE=atexit_sleep_ms=0")
+	return cmd
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func add(t *testing.T, h *Host) {
+	t.Helper()
+	var sum int
+	if err := h.Client().CallResult(context.Background(), "Add", []int{1, 2, 3}, &sum); err != nil {
+		t.Errorf("Call Add: unexpected error: %v", err)
+	} else if sum != 6 {
+		t.Errorf("Call Add: got %d, want 6", sum)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var stderr lockedBuffer
+	h, err := Start(serverCmd("normal"), &Options{Stderr: &stderr})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	add(t, h)
+	if err := h.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if err := h.Wait(); err != nil {
+		t.Errorf("Wait: unexpected error: %v", err)
+	}
+	if got, want := stderr.String(), "server ready\nserver done\n"; got != want {
+		t.Errorf("Stderr: got %q, want %q", got, want)
+	}
+}
+
+func TestKillAfterGrace(t *testing.T) {
+	h, err := Start(serverCmd("hang"), &Options{Grace: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	add(t, h)
+
+	start := time.Now()
+	err = h.Close()
+	var xerr *ExitError
+	if !errors.As(err, &xerr) || !xerr.Killed {
+		t.Errorf("Close: got %v, want a killed *ExitError", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Close returned after %v, before the grace period", elapsed)
+	}
+	if err := h.Close(); err != xerr {
+		t.Errorf("Close again: got %v, want %v", err, xerr)
+	}
+}
+
+func TestUnexpectedExit(t *testing.T) {
+	h, err := Start(serverCmd("normal"), nil)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer h.Close()
+	if _, err := h.Client().Call(context.Background(), "Exit", nil); err == nil {
+		t.Error("Call Exit: got nil error, want failure")
+	}
+
+	var xerr *ExitError
+	if err := h.Wait(); !errors.As(err, &xerr) {
+		t.Fatalf("Wait: got %v, want *ExitError", err)
+	}
+	var eerr *exec.ExitError
+	if !errors.As(xerr, &eerr) || eerr.ExitCode() != 3 {
+		t.Errorf("Wait: got %v, want exit status 3", xerr)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	var reconnects []*jrpc2.Client
+	h, err := Start(serverCmd("normal"), &Options{
+		MaxRestarts: 1,
+		Backoff:     time.Millisecond,
+		OnReconnect: func(cli *jrpc2.Client) error {
+			reconnects = append(reconnects, cli)
+			var sum int
+			return cli.CallResult(context.Background(), "Add", []int{1}, &sum)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer h.Close()
+
+	// exit makes the current process exit, and waits for the host to notice.
+	exit := func() {
+		cli := h.Client()
+		cli.Call(context.Background(), "Exit", nil)
+		for h.Client() == cli && waitErr(h) == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	add(t, h)
+	exit()
+	if n := h.Restarts(); n != 1 {
+		t.Errorf("Restarts: got %d, want 1", n)
+	}
+	if len(reconnects) != 1 || reconnects[0] != h.Client() {
+		t.Errorf("OnReconnect: got %d calls, want 1 with the new client", len(reconnects))
+	}
+	add(t, h)
+
+	// The restart limit is reached, so the host stops.
+	exit()
+	if err := h.Wait(); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Wait: got %v, want exit status 3", err)
+	}
+}
+
+// waitErr reports the error from h.Wait if h has stopped, or nil.
+func waitErr(h *Host) error {
+	select {
+	case <-h.done:
+		return h.Wait()
+	default:
+		return nil
+	}
+}
@@ -10,8 +10,59 @@ import (
 const (
 	rpcServerInfo = "rpc.serverInfo"
 	rpcCancel     = "rpc.cancel"
+	rpcShutdown   = "rpc.shutdown"
+	rpcHello      = "rpc.hello"
+	rpcProgress   = "rpc.progress"
+	rpcPing       = "rpc.ping"
 )
 
+// helloParams are the parameters of the rpc.hello method.
+type helloParams struct {
+	Encodings []string `json:"encodings"` // in order of preference
+}
+
+// helloResult is the result of the rpc.hello method.
+type helloResult struct {
+	Encoding string `json:"encoding,omitempty"` // "" if none was selected
+}
+
+// helloKey marks the context of a call to rpc.hello made by RPCHello.
+type helloKey struct{}
+
+// checkHello reports an error if method is rpc.hello and ctx is not that of a
+// call made by RPCHello.
+func checkHello(ctx context.Context, method string) error {
+	if method == rpcHello && ctx.Value(helloKey{}) == nil {
+		return errHelloReserved
+	}
+	return nil
+}
+
+// ShutdownInfo is the parameter of the "rpc.shutdown" notification a server
+// sends to its client when it announces that it is shutting down (see
+// Server.AnnounceShutdown). It is also the data of the errors reported for
+// calls the server refuses while it is shutting down (see Server.Shutdown).
+type ShutdownInfo struct {
+	// The time in seconds the server will wait for the requests it has
+	// received to complete before it closes the connection, or 0 if it has
+	// not set a limit.
+	Grace float64 `json:"grace"`
+
+	// A human-readable explanation of the shutdown, if provided.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ProgressInfo is the parameter of the "rpc.progress" notification a server
+// sends to its client when a handler reports the progress of a call with
+// PushProgress.
+type ProgressInfo struct {
+	// The ID of the call whose progress is reported.
+	ID json.RawMessage `json:"id"`
+
+	// The progress value reported by the handler.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
 // Handle the special rpc.cancel notification, that requests cancellation of a
 // set of pending methods. This only works if issued as a notification.
 func (s *Server) handleRPCCancel(ctx context.Context, req *Request) (interface{}, error) {
@@ -29,14 +80,36 @@ func (s *Server) handleRPCCancel(ctx context.Context, req *Request) (interface{}
 func (s *Server) cancelRequests(ctx context.Context, ids []json.RawMessage) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cancelIDs(ids)
+}
+
+// cancelIDs cancels the pending requests with the given IDs. Their IDs remain
+// reserved until their responses are delivered. The caller must hold s.mu.
+func (s *Server) cancelIDs(ids []json.RawMessage) {
 	for _, raw := range ids {
-		id := string(raw)
-		if s.cancel(id) {
-			s.log("Cancelled request %s by client order", id)
+		if cancel, ok := s.used[idKey(raw)]; ok {
+			cancel()
+			s.log("Cancelled request %s by client order", string(raw))
 		}
 	}
 }
 
+// interceptCancel handles req directly if it is a well-formed rpc.cancel
+// notification, and reports whether it did so. This averts waiting for the
+// concurrency limit, which the requests to be cancelled may be holding. The
+// caller must hold s.mu.
+func (s *Server) interceptCancel(req *jmessage) bool {
+	if !s.builtin || req.M != rpcCancel || !req.isNotification() {
+		return false
+	}
+	var ids []json.RawMessage
+	if err := json.Unmarshal(req.P, &ids); err != nil {
+		return false // let the handler report the error
+	}
+	s.cancelIDs(ids)
+	return true
+}
+
 // methodFunc is a replication of handler.Func redeclared to avert a cycle.
 type methodFunc func(context.Context, *Request) (interface{}, error)
 
@@ -49,6 +122,69 @@ func (s *Server) handleRPCServerInfo(context.Context, *Request) (interface{}, er
 	return s.ServerInfo(), nil
 }
 
+// Handle the special rpc.ping method, that does nothing. A client calls it to
+// check that the server is responsive (see ClientOptions.KeepAlive).
+func (s *Server) handleRPCPing(context.Context, *Request) (interface{}, error) {
+	return nil, nil
+}
+
+// Handle the special rpc.hello method, that negotiates the encoding of the
+// results sent to the client. The server selects the first of the encodings
+// offered by the client that it supports, if any, for the remainder of the
+// connection.
+func (s *Server) handleRPCHello(ctx context.Context, req *Request) (interface{}, error) {
+	if InboundRequest(ctx).IsNotification() {
+		return nil, code.MethodNotFound.Err()
+	}
+	var params helloParams
+	if err := req.UnmarshalParams(&params); err != nil {
+		return nil, err
+	}
+	var result helloResult
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc = nil
+	for _, name := range params.Encodings {
+		if c := findCodec(s.codecs, name); c != nil {
+			s.enc = c
+			result.Encoding = name
+			break
+		}
+	}
+	s.log("Negotiated result encoding %q", result.Encoding)
+	return result, nil
+}
+
+// RPCHello calls the built-in rpc.hello method exported by servers, to
+// negotiate the compression of results. It offers the codecs of the client
+// (see ClientOptions.Codecs) and reports the name of the one the server
+// selected, or "" if the server will not compress results. A server that
+// does not support rpc.hello is treated as having selected none, so the
+// client and server then communicate without compression.
+//
+// The encoding applies to every call made through cli, which may be shared,
+// for example by a jhttp.Bridge. For that reason, the client refuses to call
+// rpc.hello other than through RPCHello, so that a request forwarded on
+// behalf of another caller cannot select an encoding the client does not
+// support.
+func RPCHello(ctx context.Context, cli *Client) (string, error) {
+	var params helloParams
+	for _, c := range cli.codecs {
+		params.Encodings = append(params.Encodings, c.Name())
+	}
+	if len(params.Encodings) == 0 {
+		return "", nil // nothing to offer
+	}
+	var result helloResult
+	err := cli.CallResult(context.WithValue(ctx, helloKey{}, true), rpcHello, params, &result)
+	if code.FromError(err) == code.MethodNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return result.Encoding, nil
+}
+
 // RPCServerInfo calls the built-in rpc.serverInfo method exported by servers.
 // It is a convenience wrapper for an invocation of cli.CallResult.
 func RPCServerInfo(ctx context.Context, cli *Client) (result *ServerInfo, err error) {